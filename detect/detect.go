@@ -0,0 +1,278 @@
+package detect
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	ClassCar        = "car"
+	ClassVan        = "van"
+	ClassTruck      = "truck"
+	ClassMotorcycle = "motorcycle"
+
+	TypeHarshBraking      = "harshBraking"
+	TypeHarshAcceleration = "harshAcceleration"
+	TypeSharpCornering    = "sharpCornering"
+	TypeSpeeding          = "speeding"
+	TypePhoneDistraction  = "phoneDistraction"
+
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+
+	// Consecutive samples further apart than this aren't compared; the
+	// derivatives would be meaningless.
+	maxSampleGap = time.Second * 5
+
+	// Exceedances this close together are one event.
+	mergeGap = time.Second * 3
+
+	// Cornering needs some speed for the heading to be reliable.
+	minCorneringSpeedMps = 5
+
+	// Below this the phone is probably being picked up before or after driving.
+	minDistractionSpeedMps = 3
+
+	// Phone motion counts once it lasts this long.
+	minDistraction = time.Second * 2
+)
+
+var Classes = []string{ClassCar, ClassVan, ClassTruck, ClassMotorcycle}
+
+// Thresholds are per vehicle class; zero fields use the class defaults.
+// Accelerations are in m/s².
+type Thresholds struct {
+	BrakingMps2      float64 `yaml:"braking-mps2"`      // deceleration
+	AccelerationMps2 float64 `yaml:"acceleration-mps2"` // forward
+	CorneringMps2    float64 `yaml:"cornering-mps2"`    // lateral
+	SpeedLimitKmh    float64 `yaml:"speed-limit-kmh"`   // fixed limit, we have no road data
+	SpeedingSeconds  int     `yaml:"speeding-seconds"`  // how long above the limit counts
+	PhoneMotionMps2  float64 `yaml:"phone-motion-mps2"` // change in device acceleration between samples
+}
+
+// Heavier vehicles brake, accelerate and corner less hard before it's harsh, and
+// have lower limits.
+var defaults = map[string]Thresholds{
+	ClassCar:        {BrakingMps2: 3.5, AccelerationMps2: 3, CorneringMps2: 4, SpeedLimitKmh: 130, SpeedingSeconds: 10, PhoneMotionMps2: 6},
+	ClassVan:        {BrakingMps2: 3, AccelerationMps2: 2.5, CorneringMps2: 3.5, SpeedLimitKmh: 110, SpeedingSeconds: 10, PhoneMotionMps2: 6},
+	ClassTruck:      {BrakingMps2: 2.5, AccelerationMps2: 1.5, CorneringMps2: 2.5, SpeedLimitKmh: 90, SpeedingSeconds: 10, PhoneMotionMps2: 6},
+	ClassMotorcycle: {BrakingMps2: 4.5, AccelerationMps2: 4, CorneringMps2: 5, SpeedLimitKmh: 130, SpeedingSeconds: 10, PhoneMotionMps2: 8},
+}
+
+// ValidClass reports whether class is one we have thresholds for.
+func ValidClass(class string) bool {
+	_, ok := defaults[class]
+	return ok
+}
+
+// For returns the thresholds for class, with configured values from overrides
+// taking precedence over the defaults. Unknown classes get the car defaults.
+func For(class string, overrides map[string]Thresholds) Thresholds {
+	t, ok := defaults[class]
+	if !ok {
+		t = defaults[ClassCar]
+	}
+
+	o := overrides[class]
+	for _, f := range []struct{ dst, src *float64 }{
+		{&t.BrakingMps2, &o.BrakingMps2},
+		{&t.AccelerationMps2, &o.AccelerationMps2},
+		{&t.CorneringMps2, &o.CorneringMps2},
+		{&t.SpeedLimitKmh, &o.SpeedLimitKmh},
+		{&t.PhoneMotionMps2, &o.PhoneMotionMps2},
+	} {
+		if *f.src > 0 {
+			*f.dst = *f.src
+		}
+	}
+
+	if o.SpeedingSeconds > 0 {
+		t.SpeedingSeconds = o.SpeedingSeconds
+	}
+
+	return t
+}
+
+// Sample is a telemetry sample. Acceleration is in the device frame; all zero
+// means the device sent no IMU data.
+type Sample struct {
+	Seq        int64
+	At         time.Time
+	Lat, Lon   float64
+	SpeedMps   float64
+	HeadingDeg float64
+	AccelX     float64
+	AccelY     float64
+	AccelZ     float64
+}
+
+// Event is one detected event. Peak is the worst value seen (m/s², or km/h for
+// speeding) and Threshold what it was compared against; Lat and Lon are where
+// the peak was.
+type Event struct {
+	Type      string
+	Severity  string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Lat, Lon  float64
+	Peak      float64
+	Threshold float64
+}
+
+// Detect finds events in a trip's samples, ordered by time. Braking, acceleration
+// and cornering are derived from GPS speed and heading, which, unlike the
+// accelerometer, don't depend on how the phone is mounted. Phone distraction is
+// the accelerometer changing sharply while the vehicle itself drives smoothly.
+// The result only depends on the input, ordered by start time then type.
+func Detect(samples []*Sample, t Thresholds) []*Event {
+	var out []*Event
+	runs := map[string]*run{}
+	emit := func(r *run) {
+		if r != nil && r.done(t) {
+			out = append(out, r.event(t))
+		}
+	}
+
+	flag := func(typ string, sm *Sample, value float64) {
+		r := runs[typ]
+		if r != nil && sm.At.Sub(r.ev.EndedAt) > mergeGap {
+			emit(r)
+			r = nil
+		}
+
+		if r == nil {
+			r = &run{ev: &Event{Type: typ, StartedAt: sm.At}}
+			runs[typ] = r
+		}
+
+		r.ev.EndedAt = sm.At
+		if value >= r.ev.Peak {
+			r.ev.Peak, r.ev.Lat, r.ev.Lon = value, sm.Lat, sm.Lon
+		}
+	}
+
+	limitMps := t.SpeedLimitKmh / 3.6
+	for i, sm := range samples {
+		if t.SpeedLimitKmh > 0 && sm.SpeedMps > limitMps {
+			flag(TypeSpeeding, sm, sm.SpeedMps*3.6)
+		} else if r := runs[TypeSpeeding]; r != nil {
+			emit(r) // speeding must be continuous
+			delete(runs, TypeSpeeding)
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		prev := samples[i-1]
+		dt := sm.At.Sub(prev.At)
+		if dt <= 0 || dt > maxSampleGap {
+			continue
+		}
+
+		secs := dt.Seconds()
+		accel := (sm.SpeedMps - prev.SpeedMps) / secs
+		switch {
+		case -accel >= t.BrakingMps2:
+			flag(TypeHarshBraking, sm, -accel)
+		case accel >= t.AccelerationMps2:
+			flag(TypeHarshAcceleration, sm, accel)
+		}
+
+		speed := (sm.SpeedMps + prev.SpeedMps) / 2
+		if speed >= minCorneringSpeedMps {
+			turn := math.Remainder(sm.HeadingDeg-prev.HeadingDeg, 360) * math.Pi / 180
+			if lateral := math.Abs(speed * turn / secs); lateral >= t.CorneringMps2 {
+				flag(TypeSharpCornering, sm, lateral)
+			}
+		}
+
+		if speed >= minDistractionSpeedMps && hasImu(sm) && hasImu(prev) &&
+			math.Abs(accel) < t.BrakingMps2/2 {
+			jolt := math.Sqrt(sq(sm.AccelX-prev.AccelX) + sq(sm.AccelY-prev.AccelY) + sq(sm.AccelZ-prev.AccelZ))
+			if jolt >= t.PhoneMotionMps2 {
+				flag(TypePhoneDistraction, sm, jolt)
+			}
+		}
+	}
+
+	for _, r := range runs {
+		emit(r)
+	}
+
+	sortEvents(out)
+	return out
+}
+
+// run is an event still being extended.
+type run struct {
+	ev *Event
+}
+
+func (r *run) done(t Thresholds) bool {
+	switch r.ev.Type {
+	case TypeSpeeding:
+		return r.ev.EndedAt.Sub(r.ev.StartedAt) >= time.Second*time.Duration(t.SpeedingSeconds)
+	case TypePhoneDistraction:
+		return r.ev.EndedAt.Sub(r.ev.StartedAt) >= minDistraction
+	}
+
+	return true
+}
+
+func (r *run) event(t Thresholds) *Event {
+	ev := r.ev
+	switch ev.Type {
+	case TypeHarshBraking:
+		ev.Threshold = t.BrakingMps2
+	case TypeHarshAcceleration:
+		ev.Threshold = t.AccelerationMps2
+	case TypeSharpCornering:
+		ev.Threshold = t.CorneringMps2
+	case TypeSpeeding:
+		ev.Threshold = t.SpeedLimitKmh
+	case TypePhoneDistraction:
+		ev.Threshold = t.PhoneMotionMps2
+	}
+
+	ev.Severity = severity(ev)
+	return ev
+}
+
+// severity grades how far past the threshold the peak went. Speeding is graded
+// more strictly: 20% over the limit is already high.
+func severity(ev *Event) string {
+	medium, high := 1.25, 1.5
+	if ev.Type == TypeSpeeding {
+		medium, high = 1.1, 1.2
+	}
+
+	switch ratio := ev.Peak / ev.Threshold; {
+	case ratio >= high:
+		return SeverityHigh
+	case ratio >= medium:
+		return SeverityMedium
+	}
+
+	return SeverityLow
+}
+
+var typeOrder = map[string]int{TypeHarshBraking: 0, TypeHarshAcceleration: 1,
+	TypeSharpCornering: 2, TypeSpeeding: 3, TypePhoneDistraction: 4}
+
+func sortEvents(events []*Event) {
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if !a.StartedAt.Equal(b.StartedAt) {
+			return a.StartedAt.Before(b.StartedAt)
+		}
+
+		return typeOrder[a.Type] < typeOrder[b.Type]
+	})
+}
+
+func hasImu(sm *Sample) bool { return sm.AccelX != 0 || sm.AccelY != 0 || sm.AccelZ != 0 }
+
+func sq(f float64) float64 { return f * f }
@@ -0,0 +1,183 @@
+package detect
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// load reads a trip's samples from a CSV fixture in testdata, simulated by
+// testdata/simulate.go.
+func load(t *testing.T, name string) []*Sample {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []*Sample
+	for _, r := range records[1:] { // header
+		var fs [9]float64
+		for i, v := range r {
+			if i == 1 {
+				continue // at
+			}
+
+			if fs[i], err = strconv.ParseFloat(v, 64); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		}
+
+		at, err := time.Parse(time.RFC3339, r[1])
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		out = append(out, &Sample{
+			Seq:        int64(fs[0]),
+			At:         at,
+			Lat:        fs[2],
+			Lon:        fs[3],
+			SpeedMps:   fs[4],
+			HeadingDeg: fs[5],
+			AccelX:     fs[6],
+			AccelY:     fs[7],
+			AccelZ:     fs[8],
+		})
+	}
+
+	return out
+}
+
+func TestDetect(t *testing.T) {
+	type want struct {
+		typ, severity string
+		startedAt     string // time of day, the fixtures are all on 2026-03-14
+		lat, lon      float64
+	}
+
+	for _, tc := range []struct {
+		name      string
+		fixture   string
+		class     string
+		overrides map[string]Thresholds
+		want      []want
+	}{
+		{
+			name:    "braking car",
+			fixture: "braking.csv",
+			class:   ClassCar,
+			want:    []want{{TypeHarshBraking, SeverityMedium, "08:03:21", 52.526323, 13.424933}},
+		},
+		{
+			name:    "braking truck",
+			fixture: "braking.csv",
+			class:   ClassTruck,
+			want:    []want{{TypeHarshBraking, SeverityHigh, "08:03:21", 52.526323, 13.424933}},
+		},
+		{
+			name:    "braking motorcycle",
+			fixture: "braking.csv",
+			class:   ClassMotorcycle,
+			want:    []want{{TypeHarshBraking, SeverityLow, "08:03:21", 52.526323, 13.424933}},
+		},
+		{
+			name:    "acceleration car",
+			fixture: "acceleration.csv",
+			class:   ClassCar,
+			want:    []want{{TypeHarshAcceleration, SeverityLow, "08:02:37", 52.526395, 13.41704}},
+		},
+		{
+			name:    "acceleration truck",
+			fixture: "acceleration.csv",
+			class:   ClassTruck,
+			want:    []want{{TypeHarshAcceleration, SeverityHigh, "08:02:37", 52.526395, 13.41704}},
+		},
+		{
+			name:    "cornering car",
+			fixture: "cornering.csv",
+			class:   ClassCar,
+			want:    []want{{TypeSharpCornering, SeverityMedium, "08:03:09", 52.526466, 13.421964}},
+		},
+		{
+			name:    "cornering truck",
+			fixture: "cornering.csv",
+			class:   ClassTruck,
+			want:    []want{{TypeSharpCornering, SeverityHigh, "08:03:09", 52.526466, 13.421964}},
+		},
+		{
+			name:    "speeding car default limit",
+			fixture: "speeding.csv",
+			class:   ClassCar,
+		},
+		{
+			name:      "speeding car",
+			fixture:   "speeding.csv",
+			class:     ClassCar,
+			overrides: map[string]Thresholds{ClassCar: {SpeedLimitKmh: 100}},
+			want:      []want{{TypeSpeeding, SeverityMedium, "08:03:04", 52.526386, 13.46469}},
+		},
+		{
+			name:    "speeding truck default limit",
+			fixture: "speeding.csv",
+			class:   ClassTruck,
+			want:    []want{{TypeSpeeding, SeverityHigh, "08:03:01", 52.526386, 13.46469}},
+		},
+		{
+			name:      "speeding truck",
+			fixture:   "speeding.csv",
+			class:     ClassTruck,
+			overrides: map[string]Thresholds{ClassTruck: {SpeedLimitKmh: 80}},
+			want:      []want{{TypeSpeeding, SeverityHigh, "08:02:59", 52.526386, 13.46469}},
+		},
+		{
+			name:    "distraction car",
+			fixture: "distraction.csv",
+			class:   ClassCar,
+			want:    []want{{TypePhoneDistraction, SeverityHigh, "08:03:09", 52.526375, 13.422088}},
+		},
+		{
+			name:    "distraction van",
+			fixture: "distraction.csv",
+			class:   ClassVan,
+			want:    []want{{TypePhoneDistraction, SeverityHigh, "08:03:09", 52.526375, 13.422088}},
+		},
+		{
+			name:    "distraction motorcycle", // too short above the higher threshold
+			fixture: "distraction.csv",
+			class:   ClassMotorcycle,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Detect(load(t, tc.fixture), For(tc.class, tc.overrides))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v events, want %v", len(got), len(tc.want))
+			}
+
+			for i, w := range tc.want {
+				ev := got[i]
+				at, _ := time.Parse(time.RFC3339, "2026-03-14T"+w.startedAt+"Z")
+				switch {
+				case ev.Type != w.typ:
+					t.Errorf("type = %v, want %v", ev.Type, w.typ)
+				case ev.Severity != w.severity:
+					t.Errorf("severity = %v, want %v (peak %v, threshold %v)", ev.Severity, w.severity,
+						ev.Peak, ev.Threshold)
+				case !ev.StartedAt.Equal(at):
+					t.Errorf("started at %v, want %v", ev.StartedAt, at)
+				case ev.Lat != w.lat || ev.Lon != w.lon:
+					t.Errorf("at %v,%v, want %v,%v", ev.Lat, ev.Lon, w.lat, w.lon)
+				}
+			}
+		})
+	}
+}
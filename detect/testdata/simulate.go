@@ -0,0 +1,189 @@
+//go:build ignore
+
+// Simulate writes the trip fixtures in this directory: whole trips sampled at
+// 1 Hz, with GPS and accelerometer noise, each with one driving event in it.
+// The noise is seeded, so running it again gives the same files:
+//
+//	go run simulate.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+const metersPerDeg = 111195
+
+type sim struct {
+	rng      *rand.Rand
+	at       time.Time
+	v, h     float64 // true speed and heading
+	lat, lon float64
+	speedErr float64 // GPS speed error, correlated between fixes
+	rows     [][]string
+}
+
+func newSim(seed uint64) *sim {
+	return &sim{
+		rng: rand.New(rand.NewPCG(seed, 43)),
+		at:  time.Date(2026, 3, 14, 8, 0, 0, 0, time.UTC),
+		lat: 52.52,
+		lon: 13.405,
+	}
+}
+
+// step advances one second, changing speed by a (m/s²) and heading by turn
+// (degrees), with phone adding to the device acceleration.
+func (s *sim) step(a, turn float64, phone [3]float64) {
+	a = max(a, -s.v)
+	s.v += a
+	if s.v > 0.5 {
+		s.h = math.Mod(s.h+turn+360, 360)
+	} else {
+		turn = 0
+	}
+
+	rad := s.h * math.Pi / 180
+	s.lat += s.v * math.Cos(rad) / metersPerDeg
+	s.lon += s.v * math.Sin(rad) / (metersPerDeg * math.Cos(s.lat*math.Pi/180))
+
+	s.speedErr = 0.7*s.speedErr + s.rng.NormFloat64()*0.05
+	speed := math.Abs(s.rng.NormFloat64() * 0.05) // standing still
+	if s.v > 0 {
+		speed = max(s.v+s.speedErr, 0)
+	}
+
+	gpsErr := func(deg float64) float64 { return deg + s.rng.NormFloat64()*1.5/metersPerDeg }
+	lateral := s.v * turn * math.Pi / 180
+	s.rows = append(s.rows, []string{
+		fmt.Sprint(len(s.rows) + 1),
+		s.at.Format(time.RFC3339),
+		fmt.Sprintf("%.6f", gpsErr(s.lat)),
+		fmt.Sprintf("%.6f", gpsErr(s.lon)),
+		fmt.Sprintf("%.2f", speed),
+		fmt.Sprintf("%.1f", math.Mod(s.h+s.rng.NormFloat64()*0.4+360, 360)),
+		fmt.Sprintf("%.2f", lateral+s.rng.NormFloat64()*0.15+phone[0]),
+		fmt.Sprintf("%.2f", a+s.rng.NormFloat64()*0.15+phone[1]),
+		fmt.Sprintf("%.2f", 9.81+s.rng.NormFloat64()*0.2+phone[2]),
+	})
+
+	s.at = s.at.Add(time.Second)
+}
+
+func (s *sim) stand(secs int) {
+	for i := 0; i < secs; i++ {
+		s.step(0, 0, [3]float64{})
+	}
+}
+
+// speedTo accelerates or brakes at a until the speed is v.
+func (s *sim) speedTo(v, a float64) {
+	for math.Abs(s.v-v) > 1e-9 {
+		s.step(math.Copysign(min(a, math.Abs(v-s.v)), v-s.v), 0, [3]float64{})
+	}
+}
+
+// cruise drives around speed v for secs, drifting a little.
+func (s *sim) cruise(v float64, secs int) {
+	for i := 0; i < secs; i++ {
+		s.step(0.1*(v-s.v)+s.rng.NormFloat64()*0.08, 0, [3]float64{})
+	}
+}
+
+// turn changes heading by deg at rate degrees per second, keeping speed.
+func (s *sim) turn(deg, rate float64) {
+	for left := deg; math.Abs(left) > 1e-9; {
+		d := math.Copysign(min(rate, math.Abs(left)), left)
+		s.step(0, d, [3]float64{})
+		left -= d
+	}
+}
+
+// phone is the driver picking up the phone while cruising: the device swings
+// around for a few seconds, one swing harder than the rest.
+func (s *sim) phone() {
+	for _, o := range [][3]float64{{6.8, 0, 0}, {6.8, -9.5, 0}, {-0.2, -9.5, 0}, {-0.2, -2.6, 0}} {
+		s.step(0, 0, o)
+	}
+}
+
+func (s *sim) write(name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"seq", "at", "lat", "lon", "speed_mps", "heading_deg", "accel_x", "accel_y", "accel_z"})
+	w.WriteAll(s.rows)
+	if err = w.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// city is a stretch of town driving: pulling away, a corner, a stop.
+func (s *sim) city() {
+	s.speedTo(13, 1)
+	s.cruise(13, 40)
+	s.speedTo(8, 1.2)
+	s.turn(90, 9)
+	s.speedTo(13, 1)
+	s.cruise(13, 50)
+	s.speedTo(0, 1.5)
+	s.stand(15)
+}
+
+func main() {
+	s := newSim(1)
+	s.stand(10)
+	s.city()
+	s.speedTo(14, 1)
+	s.cruise(14, 30)
+	s.speedTo(0, 4.8) // harsh
+	s.stand(20)
+	s.city()
+	s.write("braking.csv")
+
+	s = newSim(2)
+	s.stand(10)
+	s.city()
+	s.speedTo(10, 3.4) // harsh
+	s.speedTo(13, 1)
+	s.cruise(13, 40)
+	s.city()
+	s.write("acceleration.csv")
+
+	s = newSim(3)
+	s.stand(10)
+	s.city()
+	s.speedTo(12, 1)
+	s.cruise(12, 20)
+	s.turn(-90, 26) // sharp
+	s.cruise(12, 30)
+	s.city()
+	s.write("cornering.csv")
+
+	s = newSim(4)
+	s.stand(10)
+	s.city()
+	s.speedTo(31.5, 1) // on the motorway
+	s.cruise(31.5, 90)
+	s.speedTo(14, 1.2)
+	s.city()
+	s.write("speeding.csv")
+
+	s = newSim(5)
+	s.stand(10)
+	s.city()
+	s.speedTo(12, 1)
+	s.cruise(12, 20)
+	s.phone()
+	s.cruise(12, 30)
+	s.city()
+	s.write("distraction.csv")
+}
@@ -0,0 +1,283 @@
+package geo
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+const (
+	// Mean Earth radius (IUGG), in meters.
+	earthRadiusM = 6371008.8
+
+	// Web Mercator uses the WGS84 equatorial radius.
+	mercatorRadiusM = 6378137
+)
+
+type Point struct {
+	Lat float64 `json:"lat,omitempty"`
+	Lon float64 `json:"lon,omitempty"`
+}
+
+// Distance returns the great-circle distance between a and b in meters
+// (haversine). Good to well under 1% for the distances between GPS samples.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLon := radians(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+// Simplify reduces a path with the Douglas–Peucker algorithm, dropping points
+// closer than tolerance meters to the line through the points kept around them.
+// The first and last points are always kept. Returns the indexes of the kept
+// points, in order.
+func Simplify(path []Point, tolerance float64) []int {
+	if len(path) < 3 {
+		out := make([]int, len(path))
+		for i := range path {
+			out[i] = i
+		}
+
+		return out
+	}
+
+	xy := make([][2]float64, len(path))
+	for i, p := range path {
+		xy[i] = project(path[0], p)
+	}
+
+	keep := make([]bool, len(path))
+	keep[0], keep[len(path)-1] = true, true
+	stack := [][2]int{{0, len(path) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		var farthest int
+		var dmax float64
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(xy[i], xy[first], xy[last]); d > dmax {
+				farthest, dmax = i, d
+			}
+		}
+
+		if dmax > tolerance {
+			keep[farthest] = true
+			stack = append(stack, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	var out []int
+	for i, k := range keep {
+		if k {
+			out = append(out, i)
+		}
+	}
+
+	return out
+}
+
+// PolygonDistance returns the distance in meters from p to the boundary of a
+// polygon, negative if p is inside. The ring needn't repeat its first point.
+func PolygonDistance(p Point, ring []Point) float64 {
+	d := math.Inf(1)
+	var inside bool
+	for i := range ring {
+		a, b := project(p, ring[i]), project(p, ring[(i+1)%len(ring)])
+		d = math.Min(d, segmentDistance([2]float64{}, a, b))
+
+		// Crossings of the ray from p (the origin) along +x.
+		if (a[1] > 0) != (b[1] > 0) && a[0]+(b[0]-a[0])*-a[1]/(b[1]-a[1]) > 0 {
+			inside = !inside
+		}
+	}
+
+	if inside {
+		return -d
+	}
+
+	return d
+}
+
+// Circle is an area around Center.
+type Circle struct {
+	Center  Point
+	RadiusM float64
+}
+
+func (c Circle) Contains(p Point) bool { return Distance(c.Center, p) < c.RadiusM }
+
+// SnapOutside moves p to the edge of the circles containing it, straight away
+// from their centers, and returns whether it moved. Where circles overlap and
+// that lands inside another one, p goes to the nearest edge point of the union.
+func SnapOutside(p Point, circles []Circle) (Point, bool) {
+	if !inAny(p, circles) {
+		return p, false
+	}
+
+	q := p
+	for range circles {
+		in := slices.IndexFunc(circles, func(c Circle) bool { return c.Contains(q) })
+		if in < 0 {
+			return q, true
+		}
+
+		q = edge(circles[in], q)
+	}
+
+	if !inAny(q, circles) {
+		return q, true
+	}
+
+	best, bestD := q, math.Inf(1)
+	for _, c := range circles {
+		for bearing := 0.0; bearing < 360; bearing += 5 {
+			e := Offset(c.Center, bearing, c.RadiusM+0.5)
+			if d := Distance(p, e); d < bestD && !inAny(e, circles) {
+				best, bestD = e, d
+			}
+		}
+	}
+
+	return best, true
+}
+
+// edge is the point on the edge of c straight away from its center through p,
+// a hair outside so that Contains no longer holds. From the center, it's due
+// north.
+func edge(c Circle, p Point) Point {
+	xy := project(c.Center, p)
+	d := math.Hypot(xy[0], xy[1])
+	if d == 0 {
+		xy, d = [2]float64{0, 1}, 1
+	}
+
+	k := (c.RadiusM + 0.5) / d
+	return unproject(c.Center, [2]float64{xy[0] * k, xy[1] * k})
+}
+
+func inAny(p Point, circles []Circle) bool {
+	return slices.ContainsFunc(circles, func(c Circle) bool { return c.Contains(p) })
+}
+
+// Offset returns the point distM from p in the direction of bearing, in degrees
+// clockwise from north. Good for short distances only.
+func Offset(p Point, bearing, distM float64) Point {
+	b := radians(bearing)
+	return unproject(p, [2]float64{distM * math.Sin(b), distM * math.Cos(b)})
+}
+
+// Round rounds p to the given number of decimal places, e.g. 3 for about 100 m.
+func Round(p Point, digits int) Point {
+	f := math.Pow(10, float64(digits))
+	return Point{Lat: math.Round(p.Lat*f) / f, Lon: math.Round(p.Lon*f) / f}
+}
+
+// RoundOutside is Round for a point outside circles that has to stay outside:
+// if rounding lands in one, p goes to the nearest grid point that isn't in any.
+// The search goes out as far as the circles reach, so there always is one.
+func RoundOutside(p Point, digits int, circles []Circle) Point {
+	r := Round(p, digits)
+	if !inAny(r, circles) {
+		return r
+	}
+
+	f := math.Pow(10, float64(digits))
+	lat, lon := math.Floor(p.Lat*f), math.Floor(p.Lon*f)
+
+	// Ring k holds the grid points at least k-1 steps from p along one axis.
+	// Past maxRing every point is beyond all circles' bounding boxes.
+	stepM := radians(1/f) * earthRadiusM * math.Max(math.Cos(radians(p.Lat)), 0.01)
+	maxRing := 1.0
+	for _, c := range circles {
+		dLat := c.RadiusM / earthRadiusM * 180 / math.Pi
+		dLon := dLat / math.Max(math.Cos(radians(c.Center.Lat)), 0.01)
+		maxRing = math.Max(maxRing, (math.Abs(c.Center.Lat-p.Lat)+dLat)*f+2)
+		maxRing = math.Max(maxRing, (math.Abs(c.Center.Lon-p.Lon)+dLon)*f+2)
+	}
+
+	best, bestD := r, math.Inf(1)
+	for ring := 1; float64(ring) <= maxRing && float64(ring-1)*stepM*0.99 < bestD; ring++ {
+		for i := 1 - ring; i <= ring; i++ {
+			step := 1
+			if i != 1-ring && i != ring {
+				step = 2*ring - 1 // only the first and last column
+			}
+
+			for j := 1 - ring; j <= ring; j += step {
+				q := Point{Lat: (lat + float64(i)) / f, Lon: (lon + float64(j)) / f}
+				if d := Distance(p, q); d < bestD && !inAny(q, circles) {
+					best, bestD = q, d
+				}
+			}
+		}
+	}
+
+	return best
+}
+
+// project maps p to a plane in meters centered on origin; fine within a few
+// tens of kilometers.
+func project(origin, p Point) [2]float64 {
+	return [2]float64{
+		radians(p.Lon-origin.Lon) * math.Cos(radians(origin.Lat)) * earthRadiusM,
+		radians(p.Lat-origin.Lat) * earthRadiusM,
+	}
+}
+
+// unproject is the inverse of project.
+func unproject(origin Point, xy [2]float64) Point {
+	return Point{
+		Lat: origin.Lat + xy[1]/earthRadiusM*180/math.Pi,
+		Lon: origin.Lon + xy[0]/(math.Cos(radians(origin.Lat))*earthRadiusM)*180/math.Pi,
+	}
+}
+
+// segmentDistance is the distance from p to the segment ab, in the plane.
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
+
+// MetersPerPixel is the ground resolution of a web map (256px Web Mercator
+// tiles) at the given zoom level and latitude.
+func MetersPerPixel(zoom int, lat float64) float64 {
+	return 2 * math.Pi * mercatorRadiusM * math.Cos(radians(lat)) / (256 * math.Pow(2, float64(zoom)))
+}
+
+// EncodePolyline encodes a path in Google's encoded polyline format, precision 5.
+func EncodePolyline(path []Point) string {
+	var b strings.Builder
+	var prevLat, prevLon int64
+	for _, p := range path {
+		lat, lon := int64(math.Round(p.Lat*1e5)), int64(math.Round(p.Lon*1e5))
+		encodeValue(&b, lat-prevLat)
+		encodeValue(&b, lon-prevLon)
+		prevLat, prevLon = lat, lon
+	}
+
+	return b.String()
+}
+
+func encodeValue(b *strings.Builder, v int64) {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+
+	for u >= 0x20 {
+		b.WriteByte(byte((0x20 | (u & 0x1f)) + 63))
+		u >>= 5
+	}
+
+	b.WriteByte(byte(u + 63))
+}
@@ -0,0 +1,176 @@
+package geo
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRoundOutside(t *testing.T) {
+	berlin := Point{Lat: 52.52, Lon: 13.405}
+	for _, tc := range []struct {
+		name    string
+		p       Point
+		digits  int
+		circles []Circle
+	}{
+		{
+			name:   "no circles",
+			p:      Point{Lat: 52.52049, Lon: 13.40551},
+			digits: 3,
+		},
+		{
+			name:    "rounds away from the zone",
+			p:       Offset(berlin, 0, 205),
+			digits:  3,
+			circles: []Circle{{Center: berlin, RadiusM: 200}},
+		},
+		{
+			name:    "deep inside a large zone",
+			p:       Offset(berlin, 45, 100),
+			digits:  3,
+			circles: []Circle{{Center: berlin, RadiusM: 7500}},
+		},
+		{
+			name:    "between overlapping zones",
+			p:       Offset(berlin, 90, 2000),
+			digits:  4,
+			circles: []Circle{{Center: berlin, RadiusM: 2000}, {Center: Offset(berlin, 90, 4000), RadiusM: 2000}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := RoundOutside(tc.p, tc.digits, tc.circles)
+			if inAny(got, tc.circles) {
+				t.Fatalf("%v is inside a circle", got)
+			}
+
+			if Round(got, tc.digits) != got {
+				t.Errorf("%v is not on the grid", got)
+			}
+
+			if tc.circles == nil && got != Round(tc.p, tc.digits) {
+				t.Errorf("got %v, want %v", got, Round(tc.p, tc.digits))
+			}
+		})
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	origin := Point{Lat: 52.52, Lon: 13.405}
+	// path walks from origin, turning by the given bearings, 100 m per step.
+	path := func(bearings ...float64) []Point {
+		out := []Point{origin}
+		for _, b := range bearings {
+			out = append(out, Offset(out[len(out)-1], b, 100))
+		}
+
+		return out
+	}
+
+	// zigzag is a path heading east with points alternately off by ±offM.
+	zigzag := func(n int, offM float64) []Point {
+		var out []Point
+		for i := 0; i < n; i++ {
+			p := Offset(origin, 90, float64(i)*100)
+			if i%2 == 1 {
+				p = Offset(p, 0, offM)
+			}
+
+			out = append(out, p)
+		}
+
+		return out
+	}
+
+	for _, tc := range []struct {
+		name      string
+		path      []Point
+		tolerance float64
+		want      []int
+	}{
+		{
+			name:      "empty",
+			tolerance: 10,
+			want:      []int{},
+		},
+		{
+			name:      "two points",
+			path:      path(90),
+			tolerance: 10,
+			want:      []int{0, 1},
+		},
+		{
+			name:      "straight",
+			path:      path(90, 90, 90, 90),
+			tolerance: 1,
+			want:      []int{0, 4},
+		},
+		{
+			name:      "corner",
+			path:      path(90, 90, 90, 0, 0, 0),
+			tolerance: 10,
+			want:      []int{0, 3, 6},
+		},
+		{
+			name:      "zigzag above tolerance",
+			path:      zigzag(5, 20),
+			tolerance: 10,
+			want:      []int{0, 1, 2, 3, 4},
+		},
+		{
+			name:      "zigzag below tolerance",
+			path:      zigzag(5, 20),
+			tolerance: 30,
+			want:      []int{0, 4},
+		},
+		{
+			name:      "u-turn",
+			path:      path(90, 90, 270, 270),
+			tolerance: 10,
+			want:      []int{0, 2, 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Simplify(tc.path, tc.tolerance); !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodePolyline(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path []Point
+		want string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "origin",
+			path: []Point{{}},
+			want: "??",
+		},
+		{
+			name: "reference example", // from the format's documentation
+			path: []Point{{Lat: 38.5, Lon: -120.2}, {Lat: 40.7, Lon: -120.95}, {Lat: 43.252, Lon: -126.453}},
+			want: "_p~iF~ps|U_ulLnnqC_mqNvxq`@",
+		},
+		{
+			name: "rounded to 5 digits",
+			path: []Point{{Lat: 38.500004, Lon: -120.199996}, {Lat: 40.699996, Lon: -120.950004}},
+			want: "_p~iF~ps|U_ulLnnqC",
+		},
+		{
+			name: "repeated point",
+			path: []Point{{Lat: 52.52, Lon: 13.405}, {Lat: 52.52, Lon: 13.405}},
+			want: "_yp_IgdypA??",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := EncodePolyline(tc.path); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
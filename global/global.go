@@ -5,6 +5,10 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 
+	"github.com/drival-ai/v10-api/blob"
+	"github.com/drival-ai/v10-api/detect"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/drival-ai/v10-api/notify"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -21,12 +25,53 @@ oQIDAQAB
 )
 
 var (
-	PgxPool *pgxpool.Pool
+	PgxPool   *pgxpool.Pool
+	BlobStore blob.Store
+	Notifier  notify.Notifier = notify.Log{}
 )
 
 type Config struct {
-	AndroidClientId string `yaml:"android-client-id"` // used for audience
-	PgDsn           string `yaml:"pg-dsn"`
+	AndroidClientId  string         `yaml:"android-client-id"` // used for audience
+	PgDsn            string         `yaml:"pg-dsn"`
+	Admins           []string       `yaml:"admins"`             // user ids allowed to call admin endpoints
+	TransferTtlHours int            `yaml:"transfer-ttl-hours"` // validity of ownership transfer codes
+	BlobDir          string         `yaml:"blob-dir"`           // root of the local blob store
+	MaxUploadMb      int            `yaml:"max-upload-mb"`      // per-file upload cap
+	ExpiryReminders  []int          `yaml:"expiry-reminders"`   // days before a document expires, e.g. [30, 7, 1]
+	RecallsFile      string         `yaml:"recalls-file"`       // recall dataset, reloaded on change
+	RetentionDays    int            `yaml:"retention-days"`     // how long deleted vehicles can be restored
+	ValuationFile    string         `yaml:"valuation-file"`     // depreciation curves, reloaded on change
+	ExchangeRates    money.Rates    `yaml:"exchange-rates"`     // for reports that mix currencies
+	Trips            TripConfig     `yaml:"trips"`              // trip segmentation thresholds
+	Geofences        GeofenceConfig `yaml:"geofences"`          // enter and exit detection
+	Privacy          PrivacyConfig  `yaml:"privacy"`            // privacy zones and shared coordinates
+}
+
+// TripConfig tunes how telemetry is split into trips. Zero values use defaults.
+type TripConfig struct {
+	IdleMinutes     int     `yaml:"idle-minutes"`       // stopped this long ends a trip, default 5
+	MinDistanceM    float64 `yaml:"min-distance-m"`     // shorter trips are dropped, default 500
+	MaxGapMinutes   int     `yaml:"max-gap-minutes"`    // longest gap in the data bridged within a trip, default 30
+	MaxAccuracyM    float64 `yaml:"max-accuracy-m"`     // less accurate fixes are ignored, default 100
+	MaxJumpSpeedMps float64 `yaml:"max-jump-speed-mps"` // fixes implying a faster move are GPS jumps, default 90
+
+	// Driving event thresholds by vehicle class (car, van, truck, motorcycle).
+	Events map[string]detect.Thresholds `yaml:"events"`
+}
+
+// GeofenceConfig tunes geofence enter and exit detection. Zero values use
+// defaults.
+type GeofenceConfig struct {
+	ExitBufferM  float64 `yaml:"exit-buffer-m"`  // how far outside a fence counts as having left, default 30
+	DwellSeconds int     `yaml:"dwell-seconds"`  // how long a change must hold before it's an event, default 30
+	MaxAccuracyM float64 `yaml:"max-accuracy-m"` // less accurate fixes are ignored, default 100
+}
+
+// PrivacyConfig tunes privacy zones and the coordinates shared outside the app.
+// Zero values use defaults.
+type PrivacyConfig struct {
+	HomeRadiusM  float64 `yaml:"home-radius-m"` // radius of detected home zones, default 300
+	SharedDigits int     `yaml:"shared-digits"` // decimal places of exported coordinates, default 3 (about 100 m)
 }
 
 func LoadPublicKey() (*rsa.PublicKey, error) {
@@ -3,8 +3,10 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	jwtv5 "github.com/golang-jwt/jwt/v5"
 	"github.com/golang/glog"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"google.golang.org/api/idtoken"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -30,6 +33,7 @@ const (
 var (
 	UnauthorizedCallerErr = status.Errorf(codes.Unauthenticated, "Unauthorized caller.")
 	InternalErr           = status.Errorf(codes.Internal, "Internal error.")
+	EtagMismatchErr       = status.Errorf(codes.Aborted, "etag mismatch, reload and retry")
 
 	allowed = []string{
 		"@labs-169405.iam.gserviceaccount.com",  // dev
@@ -48,6 +52,14 @@ type UserInfo struct {
 	Name  string
 }
 
+// ExportResponse is a file made for sharing outside the app, such as a CSV
+// export.
+type ExportResponse struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
 type Auth struct {
 	AndroidClientId string // audience for token validation (Android)
 }
@@ -248,6 +260,96 @@ func GetInternalConn(ctx context.Context, host string) (*grpc.ClientConn, error)
 	return con, nil
 }
 
+// IsAdmin returns true if the user is listed as an admin in config.
+func IsAdmin(config *global.Config, u UserInfo) bool {
+	if config == nil || u.Id == "" {
+		return false
+	}
+
+	for _, v := range config.Admins {
+		if v == u.Id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckVehicleOwner returns a NotFound error if the vehicle doesn't exist or isn't
+// owned by userId. We don't distinguish the two to avoid leaking vehicle ids.
+func CheckVehicleOwner(ctx context.Context, vehicleId, userId string) error {
+	if vehicleId == "" {
+		return status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	var owned bool
+	var q strings.Builder
+	fmt.Fprintf(&q, "select exists(select 1 from vehicles ")
+	fmt.Fprintf(&q, "where id = $1 and user_id = $2 and deleted_at is null)")
+	err := global.PgxPool.QueryRow(ctx, q.String(), vehicleId, userId).Scan(&owned)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return InternalErr
+	}
+
+	if !owned {
+		return status.Errorf(codes.NotFound, "vehicle not found")
+	}
+
+	return nil
+}
+
+// CheckVehicleAccess is CheckVehicleOwner that also lets members of the vehicle's
+// org through, e.g. fleet drivers.
+func CheckVehicleAccess(ctx context.Context, vehicleId, userId string) error {
+	if vehicleId == "" {
+		return status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	var ok bool
+	var q strings.Builder
+	fmt.Fprintf(&q, "select exists(select 1 from vehicles v where v.id = $1 and v.deleted_at is null ")
+	fmt.Fprintf(&q, "and (v.user_id = $2 or v.org_id in ")
+	fmt.Fprintf(&q, "(select m.org_id from org_members m where m.user_id = $2)))")
+	err := global.PgxPool.QueryRow(ctx, q.String(), vehicleId, userId).Scan(&ok)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return InternalErr
+	}
+
+	if !ok {
+		return status.Errorf(codes.NotFound, "vehicle not found")
+	}
+
+	return nil
+}
+
+// Etag formats a row version for clients. Mutable tables carry a `version` column
+// that every update bumps in SQL (`version = version + 1`), so a conditional
+// update on the expected version fails on all API instances alike.
+func Etag(version int64) string { return strconv.Quote(strconv.FormatInt(version, 10)) }
+
+// ParseEtag returns the row version in etag. Unquoted etags are accepted too.
+func ParseEtag(etag string) (int64, error) {
+	raw := strings.TrimPrefix(etag, "W/")
+	if s, err := strconv.Unquote(raw); err == nil {
+		raw = s
+	}
+
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid etag %q", etag)
+	}
+
+	return v, nil
+}
+
+// IsUniqueViolation returns true if err is a Postgres unique constraint violation.
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 func shouldBypassMethod(method string) bool {
 	var skip bool
 	for _, v := range reBypassMethods {
@@ -7,10 +7,23 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/drival-ai/v10-api/blob"
 	"github.com/drival-ai/v10-api/global"
 	"github.com/drival-ai/v10-api/internal"
 	"github.com/drival-ai/v10-api/params"
+	basesvc "github.com/drival-ai/v10-api/services/base"
+	"github.com/drival-ai/v10-api/services/compliance"
+	"github.com/drival-ai/v10-api/services/geofence"
+	"github.com/drival-ai/v10-api/services/location"
+	"github.com/drival-ai/v10-api/services/maintenance"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/drival-ai/v10-api/services/recall"
+	"github.com/drival-ai/v10-api/services/score"
+	"github.com/drival-ai/v10-api/services/transfer"
+	"github.com/drival-ai/v10-api/services/trip"
+	"github.com/drival-ai/v10-api/services/valuation"
 	"github.com/drival-ai/v10-go/base/v1"
 	"github.com/drival-ai/v10-go/iam/v1"
 	jwtv5 "github.com/golang-jwt/jwt/v5"
@@ -54,6 +67,21 @@ func run(ctx context.Context, network, port string, done chan error) error {
 		}
 	}
 
+	// Setup blob storage for uploads:
+	blobDir := config.BlobDir
+	if blobDir == "" {
+		blobDir = "/var/lib/v10-api/blobs"
+	}
+
+	// Assigned on success only: a nil *blob.Local in the interface would get past
+	// the nil checks and panic on use.
+	store, err := blob.NewLocal(blobDir)
+	if err != nil {
+		glog.Errorf("blob.NewLocal failed: %v", err)
+	} else {
+		global.BlobStore = store
+	}
+
 	// Setup private key:
 	pkb, err := os.ReadFile(*params.PrivateKey)
 	if err != nil {
@@ -89,7 +117,25 @@ func run(ctx context.Context, network, port string, done chan error) error {
 	}
 
 	iam.RegisterIamServer(gs, svc)
-	base.RegisterV10Server(gs, svc)
+	gs.RegisterService(v10Service(&base.V10_ServiceDesc), svc) // with the methods in rpc.go
+
+	// Background jobs:
+	go maintenance.RunReminders(ctx, time.Hour)
+	go compliance.RunExpiryReminders(ctx, time.Hour, config.ExpiryReminders)
+	go basesvc.RunPurge(ctx, time.Hour)
+	go transfer.RunExpiry(ctx, time.Hour)
+	go trip.RunSegmenter(ctx, time.Minute, config.Trips)
+	go score.RunScorer(ctx, time.Minute)
+	go geofence.RunGeofences(ctx, time.Second*15, config.Geofences)
+	go location.RunHub(ctx)
+	go privacy.RunHomeDetection(ctx, time.Hour*6, config.Privacy)
+	if config.RecallsFile != "" {
+		go recall.Watch(ctx, config.RecallsFile, time.Minute)
+	}
+
+	if config.ValuationFile != "" {
+		go valuation.Watch(ctx, config.ValuationFile, time.Minute)
+	}
 
 	go func() {
 		<-ctx.Done()
@@ -0,0 +1,41 @@
+-- Ownership periods per vehicle. History (trips, costs, etc.) recorded while a
+-- user owned a vehicle stays scoped to that user after a transfer.
+create table if not exists vehicle_ownerships (
+    id         bigserial primary key,
+    vehicle_id text not null references vehicles (id) on delete cascade,
+    user_id    text not null references users (id),
+    started_at timestamptz not null default now(),
+    ended_at   timestamptz,
+    start_kms  integer not null default 0,
+    end_kms    integer
+);
+
+create unique index if not exists vehicle_ownerships_open_idx
+    on vehicle_ownerships (vehicle_id) where ended_at is null;
+
+-- Backfill an open ownership period for every existing vehicle.
+insert into vehicle_ownerships (vehicle_id, user_id, start_kms)
+select v.id, v.user_id, coalesce(v.kms, 0) from vehicles v
+where not exists (select 1 from vehicle_ownerships o where o.vehicle_id = v.id);
+
+-- Ownership transfers. Codes are stored hashed; only the current owner sees
+-- the plain code when starting a transfer.
+create table if not exists vehicle_transfers (
+    id           text primary key,
+    vehicle_id   text not null references vehicles (id) on delete cascade,
+    from_user_id text not null references users (id),
+    to_user_id   text references users (id),
+    code_hash    text,
+    status       text not null default 'pending', -- pending, completed, cancelled, overridden, expired
+    created_at   timestamptz not null default now(),
+    expires_at   timestamptz,
+    completed_at timestamptz,
+    admin_id     text,
+    reason       text
+);
+
+create unique index if not exists vehicle_transfers_pending_idx
+    on vehicle_transfers (vehicle_id) where status = 'pending';
+
+create unique index if not exists vehicle_transfers_code_idx
+    on vehicle_transfers (code_hash) where status = 'pending';
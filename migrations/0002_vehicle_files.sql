@@ -0,0 +1,16 @@
+-- Photos and documents attached to vehicles. Contents live in the blob store
+-- under blob_key; this table only holds metadata.
+create table if not exists vehicle_files (
+    id           text primary key,
+    vehicle_id   text not null references vehicles (id) on delete cascade,
+    user_id      text not null references users (id),
+    kind         text not null, -- photo, registration, insurance, other
+    filename     text not null default '',
+    content_type text not null,
+    size_bytes   bigint not null,
+    sha256       text not null,
+    blob_key     text not null,
+    created_at   timestamptz not null default now()
+);
+
+create index if not exists vehicle_files_vehicle_idx on vehicle_files (vehicle_id, created_at);
@@ -0,0 +1,41 @@
+-- Service history per vehicle. Rows belong to the user who recorded them so
+-- they stay with that owner across transfers.
+create table if not exists service_records (
+    id           text primary key,
+    vehicle_id   text not null references vehicles (id) on delete cascade,
+    user_id      text not null references users (id),
+    service_type text not null,
+    serviced_on  date not null,
+    odometer_kms integer not null default 0,
+    cost_minor   bigint not null default 0,
+    currency     text not null default '',
+    notes        text not null default '',
+    created_at   timestamptz not null default now(),
+    updated_at   timestamptz not null default now()
+);
+
+create index if not exists service_records_vehicle_idx
+    on service_records (vehicle_id, user_id, service_type, serviced_on);
+
+-- Recurring maintenance, due every interval_days and/or interval_kms since the
+-- last matching service record (or since the schedule was created).
+create table if not exists maintenance_schedules (
+    id            text primary key,
+    vehicle_id    text not null references vehicles (id) on delete cascade,
+    user_id       text not null references users (id),
+    service_type  text not null,
+    interval_days integer,
+    interval_kms  integer,
+    baseline_kms  integer not null default 0,
+    created_at    timestamptz not null default now(),
+    unique (vehicle_id, user_id, service_type),
+    check (interval_days > 0 or interval_kms > 0)
+);
+
+-- Reminders already sent, so each due date is only notified once.
+create table if not exists maintenance_notifications (
+    schedule_id text not null references maintenance_schedules (id) on delete cascade,
+    due_key     text not null,
+    sent_at     timestamptz not null default now(),
+    primary key (schedule_id, due_key)
+);
@@ -0,0 +1,17 @@
+-- Fill-ups (litres) and charging sessions (kWh) per vehicle.
+create table if not exists fuel_entries (
+    id           text primary key,
+    vehicle_id   text not null references vehicles (id) on delete cascade,
+    user_id      text not null references users (id),
+    kind         text not null, -- fuel, charge
+    filled_at    timestamptz not null,
+    volume       double precision not null, -- litres or kWh, depending on kind
+    cost_minor   bigint not null default 0,
+    currency     text not null default '',
+    odometer_kms integer not null,
+    full         boolean not null default false, -- full tank or charged to 100%
+    created_at   timestamptz not null default now()
+);
+
+create index if not exists fuel_entries_vehicle_idx
+    on fuel_entries (vehicle_id, user_id, kind, odometer_kms);
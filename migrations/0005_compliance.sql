@@ -0,0 +1,26 @@
+-- Expiring vehicle documents: registration, insurance, roadworthiness inspection.
+create table if not exists compliance_records (
+    id         text primary key,
+    vehicle_id text not null references vehicles (id) on delete cascade,
+    user_id    text not null references users (id),
+    kind       text not null, -- registration, insurance, inspection
+    reference  text not null default '', -- policy/certificate number
+    issuer     text not null default '',
+    issued_on  date,
+    expires_on date not null,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create index if not exists compliance_records_expiry_idx on compliance_records (expires_on);
+create index if not exists compliance_records_vehicle_idx on compliance_records (vehicle_id, user_id);
+
+-- Reminders already sent. Keyed by expiry date so renewing a document re-arms
+-- its reminders, and persisted so restarts never send the same one twice.
+create table if not exists compliance_reminders (
+    record_id   text not null references compliance_records (id) on delete cascade,
+    expires_on  date not null,
+    offset_days integer not null,
+    sent_at     timestamptz not null default now(),
+    primary key (record_id, expires_on, offset_days)
+);
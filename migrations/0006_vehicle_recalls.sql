@@ -0,0 +1,21 @@
+-- Recall campaigns matched against vehicles. Campaign details are copied from
+-- the dataset at match time; withdrawn_at is set when a reload drops the campaign.
+create table if not exists vehicle_recalls (
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    campaign_id     text not null,
+    description     text not null default '',
+    remedy          text not null default '',
+    dataset_version text not null,
+    matched_at      timestamptz not null default now(),
+    withdrawn_at    timestamptz,
+    primary key (vehicle_id, campaign_id)
+);
+
+-- Acknowledgements are per owner, so a new owner still sees open recalls.
+create table if not exists recall_acknowledgements (
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    campaign_id     text not null,
+    user_id         text not null references users (id),
+    acknowledged_at timestamptz not null default now(),
+    primary key (vehicle_id, campaign_id, user_id)
+);
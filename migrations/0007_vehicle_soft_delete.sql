@@ -0,0 +1,8 @@
+-- Archived vehicles are hidden from default listings. Deleted vehicles are kept
+-- (and still count toward VIN/chassis uniqueness) until purge_after, when the
+-- purge job removes them along with all dependent rows.
+alter table vehicles add column if not exists archived_at timestamptz;
+alter table vehicles add column if not exists deleted_at timestamptz;
+alter table vehicles add column if not exists purge_after timestamptz;
+
+create index if not exists vehicles_purge_idx on vehicles (purge_after) where purge_after is not null;
@@ -0,0 +1,3 @@
+-- Row version for optimistic concurrency; exposed to clients as an etag.
+-- Every update of a vehicle bumps it with `version = version + 1`.
+alter table vehicles add column if not exists version bigint not null default 1;
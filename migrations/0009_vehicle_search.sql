@@ -0,0 +1,29 @@
+-- Organizations (fleets) share visibility of their vehicles with all members.
+create table if not exists orgs (
+    id         text primary key,
+    name       text not null,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists org_members (
+    org_id     text not null references orgs (id) on delete cascade,
+    user_id    text not null references users (id),
+    role       text not null default 'member', -- member, admin
+    created_at timestamptz not null default now(),
+    primary key (org_id, user_id)
+);
+
+create index if not exists org_members_user_idx on org_members (user_id);
+
+alter table vehicles add column if not exists org_id text references orgs (id) on delete set null;
+create index if not exists vehicles_org_idx on vehicles (org_id) where org_id is not null;
+
+-- Typo-tolerant search over identifying fields (see base.SearchVehicles).
+create extension if not exists pg_trgm;
+
+alter table vehicles add column if not exists search_text text generated always as (
+    lower(coalesce(vin, '') || ' ' || coalesce(chassis_number, '') || ' ' ||
+          coalesce(make, '') || ' ' || coalesce(model, ''))
+) stored;
+
+create index if not exists vehicles_search_idx on vehicles using gin (search_text gin_trgm_ops);
@@ -0,0 +1,32 @@
+-- License plates. plate_number is normalized (see plate.Normalize) and unique per
+-- country among vehicles that aren't deleted.
+alter table vehicles add column if not exists plate_number text;
+alter table vehicles add column if not exists plate_country text;
+alter table vehicles add column if not exists plate_region text not null default '';
+
+create unique index if not exists vehicles_plate_idx on vehicles (plate_country, plate_number)
+    where plate_number is not null and deleted_at is null;
+
+-- Every plate a vehicle has had; the current one has ended_at null.
+create table if not exists vehicle_plates (
+    id            text primary key,
+    vehicle_id    text not null references vehicles (id) on delete cascade,
+    user_id       text not null references users (id),
+    plate_number  text not null,
+    plate_country text not null,
+    plate_region  text not null default '',
+    started_at    timestamptz not null default now(),
+    ended_at      timestamptz
+);
+
+create index if not exists vehicle_plates_vehicle_idx on vehicle_plates (vehicle_id, started_at);
+
+-- Include the plate in search (see 0009).
+drop index if exists vehicles_search_idx;
+alter table vehicles drop column if exists search_text;
+alter table vehicles add column search_text text generated always as (
+    lower(coalesce(vin, '') || ' ' || coalesce(chassis_number, '') || ' ' ||
+          coalesce(make, '') || ' ' || coalesce(model, '') || ' ' || coalesce(plate_number, ''))
+) stored;
+
+create index if not exists vehicles_search_idx on vehicles using gin (search_text gin_trgm_ops);
@@ -0,0 +1,37 @@
+-- Claims on a vehicle registered by someone else. owner_id is the owner when the
+-- claim was filed; owner actions always check the vehicle's current owner.
+create table if not exists vehicle_claims (
+    id             text primary key,
+    vehicle_id     text not null references vehicles (id) on delete cascade,
+    claimant_id    text not null references users (id),
+    owner_id       text not null references users (id),
+    vin            text not null default '',
+    chassis_number text not null default '',
+    reason         text not null default '',
+    status         text not null default 'open', -- open, disputed, released, approved, rejected, withdrawn
+    created_at     timestamptz not null default now(),
+    updated_at     timestamptz not null default now(),
+    resolved_at    timestamptz,
+    resolved_by    text references users (id)
+);
+
+create unique index if not exists vehicle_claims_active_idx on vehicle_claims (vehicle_id, claimant_id)
+    where status in ('open', 'disputed');
+
+create index if not exists vehicle_claims_claimant_idx on vehicle_claims (claimant_id, created_at);
+
+-- Every state transition of a claim, including the initial filing.
+create table if not exists vehicle_claim_events (
+    id         bigserial primary key,
+    claim_id   text not null references vehicle_claims (id) on delete cascade,
+    status     text not null,
+    actor_id   text not null references users (id),
+    actor_role text not null, -- claimant, owner, admin
+    note       text not null default '',
+    created_at timestamptz not null default now()
+);
+
+create index if not exists vehicle_claim_events_claim_idx on vehicle_claim_events (claim_id, id);
+
+-- Supporting documents uploaded by the claimant (see media.UploadVehicleFile).
+alter table vehicle_files add column if not exists claim_id text references vehicle_claims (id) on delete cascade;
@@ -0,0 +1,15 @@
+-- Value estimates per vehicle and owner, at most one per day (the latest wins).
+create table if not exists vehicle_valuations (
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    user_id         text not null references users (id),
+    valued_on       date not null,
+    low_minor       bigint not null,
+    mid_minor       bigint not null,
+    high_minor      bigint not null,
+    currency        text not null,
+    kms             integer not null,
+    curves_version  text not null,
+    factors         jsonb not null default '[]',
+    created_at      timestamptz not null default now(),
+    primary key (vehicle_id, user_id, valued_on)
+);
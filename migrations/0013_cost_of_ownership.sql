@@ -0,0 +1,8 @@
+-- Purchase price per ownership period, for cost of ownership reports.
+alter table vehicle_ownerships add column if not exists purchased_on date;
+alter table vehicle_ownerships add column if not exists purchase_price_minor bigint not null default 0;
+alter table vehicle_ownerships add column if not exists purchase_currency text not null default '';
+
+-- What a registration, insurance policy or inspection cost.
+alter table compliance_records add column if not exists cost_minor bigint not null default 0;
+alter table compliance_records add column if not exists currency text not null default '';
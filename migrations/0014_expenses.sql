@@ -0,0 +1,20 @@
+-- Other vehicle expenses: tolls, parking, fines and the like, optionally tied to
+-- a trip and a receipt uploaded as a vehicle file.
+create table if not exists expenses (
+    id              text primary key,
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    user_id         text not null references users (id),
+    trip_id         text, -- client-provided trip reference
+    category        text not null, -- toll, parking, fine, wash, other
+    spent_at        timestamptz not null,
+    amount_minor    bigint not null,
+    currency        text not null,
+    receipt_file_id text references vehicle_files (id) on delete set null,
+    reimbursable    boolean not null default false,
+    note            text not null default '',
+    created_at      timestamptz not null default now()
+);
+
+create index if not exists expenses_vehicle_idx on expenses (vehicle_id, spent_at);
+create index if not exists expenses_user_idx on expenses (user_id, spent_at);
+create index if not exists expenses_trip_idx on expenses (trip_id) where trip_id is not null;
@@ -0,0 +1,21 @@
+-- GPS/IMU samples streamed by the app while driving. seq is assigned by the app
+-- per vehicle and increases monotonically, so resent samples are dropped.
+create table if not exists telemetry_samples (
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    user_id     text not null references users (id),
+    seq         bigint not null,
+    recorded_at timestamptz not null,
+    lat         double precision not null,
+    lon         double precision not null,
+    speed_mps   real not null default 0,
+    heading_deg real not null default 0,
+    accuracy_m  real not null default 0,
+    accel_x     real not null default 0, -- m/s², device frame
+    accel_y     real not null default 0,
+    accel_z     real not null default 0,
+    received_at timestamptz not null default now(),
+    primary key (vehicle_id, user_id, seq)
+);
+
+create index if not exists telemetry_samples_time_idx
+    on telemetry_samples (vehicle_id, user_id, recorded_at);
@@ -0,0 +1,32 @@
+-- Trips segmented from telemetry_samples by the server. They're recomputed when
+-- samples arrive late, keeping the ids of the trips they replace where they overlap.
+create table if not exists trips (
+    id            text primary key,
+    vehicle_id    text not null references vehicles (id) on delete cascade,
+    user_id       text not null references users (id),
+    started_at    timestamptz not null,
+    ended_at      timestamptz not null,
+    distance_m    double precision not null,
+    start_lat     double precision not null,
+    start_lon     double precision not null,
+    end_lat       double precision not null,
+    end_lon       double precision not null,
+    max_speed_mps real not null default 0,
+    samples       integer not null,
+    start_seq     bigint not null,
+    end_seq       bigint not null,
+    updated_at    timestamptz not null default now()
+);
+
+create index if not exists trips_vehicle_idx on trips (vehicle_id, user_id, started_at);
+
+-- Time ranges with new samples that the segmenter hasn't looked at yet, one per
+-- vehicle and user, widened as more samples arrive.
+create table if not exists trip_dirty_windows (
+    vehicle_id text not null references vehicles (id) on delete cascade,
+    user_id    text not null references users (id),
+    from_at    timestamptz not null,
+    to_at      timestamptz not null,
+    marked_at  timestamptz not null default now(),
+    primary key (vehicle_id, user_id)
+);
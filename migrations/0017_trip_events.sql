@@ -0,0 +1,20 @@
+-- Event thresholds depend on the kind of vehicle: car, van, truck, motorcycle.
+alter table vehicles add column if not exists vehicle_class text not null default 'car';
+
+-- Driving events detected in a trip's telemetry, redone with the trip.
+create table if not exists trip_events (
+    id         text primary key,
+    trip_id    text not null references trips (id) on delete cascade,
+    vehicle_id text not null references vehicles (id) on delete cascade,
+    user_id    text not null references users (id),
+    type       text not null, -- harshBraking, harshAcceleration, sharpCornering, speeding, phoneDistraction
+    severity   text not null, -- low, medium, high
+    started_at timestamptz not null,
+    ended_at   timestamptz not null,
+    lat        double precision not null,
+    lon        double precision not null,
+    peak       double precision not null, -- m/s², km/h for speeding
+    threshold  double precision not null
+);
+
+create index if not exists trip_events_trip_idx on trip_events (trip_id, started_at);
@@ -0,0 +1,21 @@
+-- Trip profile used for scoring, computed by the segmenter.
+alter table trips add column if not exists night_share real not null default 0;
+alter table trips add column if not exists speed_cv real not null default 0;
+
+-- Trip scores per scoring model version. Trips are re-scored when they're
+-- re-segmented or a new model is released; older versions are kept.
+create table if not exists trip_scores (
+    trip_id       text not null references trips (id) on delete cascade,
+    model_version text not null,
+    vehicle_id    text not null references vehicles (id) on delete cascade,
+    user_id       text not null references users (id),
+    started_at    timestamptz not null, -- copied from the trip, for rolling windows
+    distance_m    double precision not null,
+    score         real not null,
+    sub_scores    jsonb not null,
+    scored_at     timestamptz not null default now(),
+    primary key (trip_id, model_version)
+);
+
+create index if not exists trip_scores_user_idx on trip_scores (user_id, model_version, started_at);
+create index if not exists trip_scores_vehicle_idx on trip_scores (vehicle_id, model_version, started_at);
@@ -0,0 +1,11 @@
+-- Simplified trip geometry per tolerance, as served to the app. Dropped by the
+-- segmenter when the trip changes.
+create table if not exists trip_routes (
+    trip_id       text not null references trips (id) on delete cascade,
+    tolerance_m   real not null,
+    polyline      text not null,
+    points        integer not null,
+    speed_buckets smallint[] not null, -- one per segment
+    created_at    timestamptz not null default now(),
+    primary key (trip_id, tolerance_m)
+);
@@ -0,0 +1,34 @@
+-- Complete trips recorded offline and uploaded in one go, possibly over several
+-- interrupted streams. Samples are staged per upload until all have arrived.
+create table if not exists trip_uploads (
+    id              text primary key,
+    user_id         text not null references users (id),
+    idempotency_key text not null,
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    client_trip_id  text not null,
+    total_samples   integer not null,
+    first_seq       bigint not null, -- the trip's samples are first_seq to first_seq + total_samples - 1
+    status          text not null default 'receiving', -- receiving, complete, rejected
+    result          jsonb, -- returned for re-sends once complete or rejected
+    created_at      timestamptz not null default now(),
+    completed_at    timestamptz,
+    unique (user_id, idempotency_key)
+);
+
+create index if not exists trip_uploads_trip_idx on trip_uploads (vehicle_id, user_id, client_trip_id);
+
+create table if not exists trip_upload_samples (
+    upload_id   text not null references trip_uploads (id) on delete cascade,
+    seq         bigint not null,
+    valid       boolean not null,
+    recorded_at timestamptz not null,
+    lat         double precision not null,
+    lon         double precision not null,
+    speed_mps   real not null default 0,
+    heading_deg real not null default 0,
+    accuracy_m  real not null default 0,
+    accel_x     real not null default 0,
+    accel_y     real not null default 0,
+    accel_z     real not null default 0,
+    primary key (upload_id, seq)
+);
@@ -0,0 +1,39 @@
+-- Readings from OBD-II dongles, one row per poll. Columns are null when the
+-- vehicle doesn't support the pid.
+create table if not exists obd_readings (
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    user_id     text not null references users (id),
+    recorded_at timestamptz not null,
+    rpm         real,
+    coolant_c   real,
+    fuel_pct    real,
+    speed_kmh   real,
+    odometer_km double precision,
+    received_at timestamptz not null default now(),
+    primary key (vehicle_id, user_id, recorded_at)
+);
+
+-- Diagnostic trouble codes per vehicle. A fault is open (active or pending)
+-- until a report no longer contains its code; a code that comes back later
+-- opens a new fault.
+create table if not exists vehicle_faults (
+    id            text primary key,
+    vehicle_id    text not null references vehicles (id) on delete cascade,
+    user_id       text not null references users (id), -- who reported it first
+    code          text not null,
+    state         text not null, -- active, pending, cleared
+    first_seen_at timestamptz not null,
+    last_seen_at  timestamptz not null,
+    cleared_at    timestamptz
+);
+
+create unique index if not exists vehicle_faults_open_idx on vehicle_faults (vehicle_id, code)
+    where state <> 'cleared';
+create index if not exists vehicle_faults_vehicle_idx on vehicle_faults (vehicle_id, first_seen_at);
+
+-- Time of the latest trouble code report per vehicle; older reports arriving
+-- late, e.g. from another phone, don't reopen or clear anything.
+create table if not exists vehicle_fault_reads (
+    vehicle_id text primary key references vehicles (id) on delete cascade,
+    read_at    timestamptz not null
+);
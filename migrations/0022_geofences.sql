@@ -0,0 +1,69 @@
+-- Geofences: circles or polygons, personal or shared within an org (managed by
+-- its admins). They apply to the vehicles they're assigned to.
+create table if not exists geofences (
+    id         text primary key,
+    user_id    text not null references users (id), -- creator
+    org_id     text references orgs (id) on delete cascade,
+    name       text not null,
+    shape      text not null, -- circle, polygon
+    center_lat double precision,
+    center_lon double precision,
+    radius_m   double precision,
+    polygon    jsonb, -- [{"lat": .., "lon": ..}, ..]
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create index if not exists geofences_user_idx on geofences (user_id);
+create index if not exists geofences_org_idx on geofences (org_id) where org_id is not null;
+
+-- Telemetry received before a vehicle was assigned is never evaluated.
+create table if not exists geofence_vehicles (
+    geofence_id text not null references geofences (id) on delete cascade,
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    created_at  timestamptz not null default now(),
+    primary key (geofence_id, vehicle_id)
+);
+
+create index if not exists geofence_vehicles_vehicle_idx on geofence_vehicles (vehicle_id);
+
+-- Where each driver of a vehicle is relative to a fence. A change of state
+-- becomes an event once it has held for the dwell time (see RunGeofences).
+create table if not exists geofence_states (
+    geofence_id     text not null references geofences (id) on delete cascade,
+    vehicle_id      text not null references vehicles (id) on delete cascade,
+    user_id         text not null references users (id),
+    state           text not null default 'unknown', -- unknown, inside, outside
+    candidate_since timestamptz, -- first sample of a possible change
+    candidate_lat   double precision,
+    candidate_lon   double precision,
+    last_at         timestamptz not null, -- latest sample evaluated
+    primary key (geofence_id, vehicle_id, user_id)
+);
+
+create table if not exists geofence_events (
+    id          text primary key,
+    geofence_id text not null references geofences (id) on delete cascade,
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    user_id     text not null references users (id), -- driver
+    type        text not null, -- enter, exit
+    at          timestamptz not null,
+    lat         double precision not null,
+    lon         double precision not null,
+    created_at  timestamptz not null default now()
+);
+
+create index if not exists geofence_events_geofence_idx on geofence_events (geofence_id, at);
+create index if not exists geofence_events_vehicle_idx on geofence_events (vehicle_id, at);
+
+-- Telemetry evaluated so far per vehicle and driver, by arrival.
+create table if not exists geofence_cursors (
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    user_id     text not null references users (id),
+    received_at timestamptz not null,
+    seq         bigint not null,
+    primary key (vehicle_id, user_id)
+);
+
+create index if not exists telemetry_samples_received_idx
+    on telemetry_samples (vehicle_id, user_id, received_at, seq);
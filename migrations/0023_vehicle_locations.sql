@@ -0,0 +1,19 @@
+-- Latest position per vehicle and driver, for live maps. Telemetry ingestion
+-- keeps it current and announces changes on the vehicle_locations channel
+-- (see location.RunHub).
+create table if not exists vehicle_locations (
+    vehicle_id  text not null references vehicles (id) on delete cascade,
+    user_id     text not null references users (id),
+    seq         bigint not null,
+    recorded_at timestamptz not null,
+    lat         double precision not null,
+    lon         double precision not null,
+    speed_mps   real not null default 0,
+    heading_deg real not null default 0,
+    primary key (vehicle_id, user_id)
+);
+
+insert into vehicle_locations (vehicle_id, user_id, seq, recorded_at, lat, lon, speed_mps, heading_deg)
+select distinct on (vehicle_id, user_id) vehicle_id, user_id, seq, recorded_at, lat, lon, speed_mps, heading_deg
+from telemetry_samples order by vehicle_id, user_id, recorded_at desc, seq desc
+on conflict do nothing;
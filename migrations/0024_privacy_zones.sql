@@ -0,0 +1,18 @@
+-- Privacy zones: circles around places a driver doesn't want to give away, like
+-- home. Trip endpoints inside one are moved to its edge and route points inside
+-- are left out. Centers are stored offset from what the user picked (and the
+-- radius grown to still cover it), so that the edge doesn't point at the place.
+create table if not exists privacy_zones (
+    id           text primary key,
+    user_id      text not null references users (id),
+    name         text not null,
+    center_lat   double precision not null,
+    center_lon   double precision not null,
+    radius_m     double precision not null,
+    source       text not null, -- user, home (detected from frequent stops)
+    dismissed_at timestamptz, -- a detected home zone the user removed; not detected again there
+    created_at   timestamptz not null default now()
+);
+
+create index if not exists privacy_zones_user_idx on privacy_zones (user_id);
+create index if not exists trips_user_ended_idx on trips (user_id, ended_at);
@@ -0,0 +1,15 @@
+-- VINs and chassis numbers are stored trimmed and upper-cased (see
+-- base.validateVehicle); rows from before that are normalized here. The unique
+-- indexes back up the vehicleExists check, which runs outside the insert's
+-- transaction. Like vehicleExists, the chassis number only has to be unique
+-- among vehicles without a VIN, and deleted vehicles still count until purged.
+-- Creating the indexes fails if normalizing turned up duplicates; resolve those
+-- (e.g. with a claim) and re-run.
+update vehicles set vin = upper(trim(vin)) where vin <> upper(trim(vin));
+update vehicles set chassis_number = upper(trim(chassis_number))
+    where chassis_number <> upper(trim(chassis_number));
+
+create unique index if not exists vehicles_vin_idx on vehicles (vin) where vin <> '';
+
+create unique index if not exists vehicles_chassis_number_idx on vehicles (chassis_number)
+    where coalesce(vin, '') = '' and chassis_number <> '';
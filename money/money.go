@@ -0,0 +1,99 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var ErrNoRate = errors.New("no exchange rate")
+
+// Currencies whose minor unit isn't 1/100 of the major unit (ISO 4217).
+var minorDigits = map[string]int{
+	"BHD": 3, "BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "IQD": 3, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KMF": 0, "KRW": 0, "KWD": 3, "LYD": 3, "OMR": 3,
+	"PYG": 0, "RWF": 0, "TND": 3, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// NormalizeCurrency uppercases an ISO 4217 code and reports whether it looks valid.
+func NormalizeCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 3 {
+		return code, false
+	}
+
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return code, false
+		}
+	}
+
+	return code, true
+}
+
+// MinorDigits returns the number of decimals of the currency's minor unit.
+func MinorDigits(code string) int {
+	if d, ok := minorDigits[code]; ok {
+		return d
+	}
+
+	return 2
+}
+
+// Format renders a minor-unit amount in major units, e.g. 12345 USD as "123.45".
+func Format(amountMinor int64, code string) string {
+	d := MinorDigits(code)
+	if d == 0 {
+		return fmt.Sprintf("%d", amountMinor)
+	}
+
+	return fmt.Sprintf("%.*f", d, float64(amountMinor)/math.Pow10(d))
+}
+
+// Rates is an exchange-rate table, e.g. from config:
+//
+//	exchange-rates:
+//	  base: USD
+//	  rates:        # value of one major unit in the base currency
+//	    EUR: 1.08
+//	    JPY: 0.0067
+type Rates struct {
+	Base  string             `yaml:"base"`
+	Rates map[string]float64 `yaml:"rates"`
+}
+
+// Convert converts a minor-unit amount between currencies through the base
+// currency, rounding to the nearest minor unit of to.
+func (r *Rates) Convert(amountMinor int64, from, to string) (int64, error) {
+	if from == to {
+		return amountMinor, nil
+	}
+
+	rf, ok := r.rate(from)
+	if !ok {
+		return 0, fmt.Errorf("%w for %v", ErrNoRate, from)
+	}
+
+	rt, ok := r.rate(to)
+	if !ok {
+		return 0, fmt.Errorf("%w for %v", ErrNoRate, to)
+	}
+
+	major := float64(amountMinor) / math.Pow10(MinorDigits(from)) * rf / rt
+	return int64(math.Round(major * math.Pow10(MinorDigits(to)))), nil
+}
+
+func (r *Rates) rate(code string) (float64, bool) {
+	if r == nil {
+		return 0, false
+	}
+
+	if code == r.Base {
+		return 1, true
+	}
+
+	v, ok := r.Rates[code]
+	return v, ok && v > 0
+}
@@ -0,0 +1,47 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	rates := &Rates{
+		Base:  "USD",
+		Rates: map[string]float64{"EUR": 1.08, "JPY": 0.0067, "KWD": 3.25, "XAF": 0},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		rates    *Rates
+		amount   int64
+		from, to string
+		want     int64
+		err      error
+	}{
+		{name: "same currency", rates: rates, amount: 12345, from: "CHF", to: "CHF", want: 12345},
+		{name: "same currency without rates", amount: 12345, from: "EUR", to: "EUR", want: 12345},
+		{name: "to base", rates: rates, amount: 10000, from: "EUR", to: "USD", want: 10800},
+		{name: "from base", rates: rates, amount: 10800, from: "USD", to: "EUR", want: 10000},
+		{name: "through base", rates: rates, amount: 10000, from: "EUR", to: "JPY", want: 16119},
+		{name: "no minor unit", rates: rates, amount: 1000, from: "JPY", to: "USD", want: 670},
+		{name: "three digit minor unit", rates: rates, amount: 1000, from: "KWD", to: "USD", want: 325},
+		{name: "to three digit minor unit", rates: rates, amount: 100, from: "USD", to: "KWD", want: 308},
+		{name: "rounds to nearest", rates: rates, amount: 1, from: "EUR", to: "USD", want: 1},
+		{name: "refund", rates: rates, amount: -10000, from: "EUR", to: "USD", want: -10800},
+		{name: "no rate from", rates: rates, amount: 100, from: "CHF", to: "USD", err: ErrNoRate},
+		{name: "no rate to", rates: rates, amount: 100, from: "USD", to: "CHF", err: ErrNoRate},
+		{name: "zero rate", rates: rates, amount: 100, from: "XAF", to: "USD", err: ErrNoRate},
+		{name: "no rates", amount: 100, from: "EUR", to: "USD", err: ErrNoRate},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.rates.Convert(tc.amount, tc.from, tc.to)
+			switch {
+			case !errors.Is(err, tc.err):
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			case got != tc.want:
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
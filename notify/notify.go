@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/golang/glog"
+)
+
+// Notification is a user-facing message, e.g. a push notification.
+type Notification struct {
+	UserId string            `json:"userId,omitempty"`
+	Kind   string            `json:"kind,omitempty"` // e.g. "maintenance.due_soon"
+	Title  string            `json:"title,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// Notifier delivers notifications to users. Implementations should be safe for
+// concurrent use.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// Log is a Notifier that only writes notifications to the log. Used until a
+// delivery backend is configured.
+type Log struct{}
+
+func (Log) Notify(ctx context.Context, n *Notification) error {
+	b, _ := json.Marshal(n)
+	glog.Infof("notify: %v", string(b))
+	return nil
+}
@@ -0,0 +1,127 @@
+package obd
+
+import (
+	_ "embed"
+	"errors"
+	"strings"
+)
+
+const (
+	SystemPowertrain = "powertrain"
+	SystemChassis    = "chassis"
+	SystemBody       = "body"
+	SystemNetwork    = "network"
+
+	CategoryGeneric      = "generic"      // same meaning on every make (SAE J2012)
+	CategoryManufacturer = "manufacturer" // meaning depends on the make
+)
+
+var ErrCode = errors.New("invalid trouble code")
+
+//go:embed dtc.tsv
+var dtcTable string
+
+var (
+	systems = map[byte]string{
+		'P': SystemPowertrain,
+		'C': SystemChassis,
+		'B': SystemBody,
+		'U': SystemNetwork,
+	}
+
+	// Third character of P0, P1 and P2 codes.
+	powertrainAreas = map[byte]string{
+		'0': "fuel and air metering and auxiliary emission controls",
+		'1': "fuel and air metering",
+		'2': "fuel and air metering (injector circuit)",
+		'3': "ignition system or misfire",
+		'4': "auxiliary emission controls",
+		'5': "vehicle speed, idle control and auxiliary inputs",
+		'6': "computer and auxiliary outputs",
+		'7': "transmission",
+		'8': "transmission",
+		'9': "transmission",
+		'A': "hybrid propulsion",
+		'B': "hybrid propulsion",
+		'C': "hybrid propulsion",
+	}
+
+	descriptions = parseTable(dtcTable)
+)
+
+// DTC is a decoded diagnostic trouble code. Description is empty for codes not
+// in the generic table, e.g. manufacturer codes.
+type DTC struct {
+	Code        string `json:"code,omitempty"`
+	System      string `json:"system,omitempty"`   // powertrain, chassis, body, network
+	Category    string `json:"category,omitempty"` // generic, manufacturer
+	Area        string `json:"area,omitempty"`     // P0, P1 and P2 codes only
+	Description string `json:"description,omitempty"`
+}
+
+// Normalize returns code in its canonical form, e.g. "P0301" for " p0301".
+func Normalize(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 5 || systems[code[0]] == "" || code[1] > '3' {
+		return code, ErrCode
+	}
+
+	for i := 1; i < len(code); i++ {
+		c := code[i]
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return code, ErrCode
+		}
+	}
+
+	return code, nil
+}
+
+// Decode splits a trouble code into its system and category, and looks up its
+// description in the generic code table.
+func Decode(code string) (*DTC, error) {
+	code, err := Normalize(code)
+	if err != nil {
+		return nil, err
+	}
+
+	d := DTC{Code: code, System: systems[code[0]], Category: CategoryGeneric}
+	switch code[1] {
+	case '1':
+		d.Category = CategoryManufacturer
+	case '2':
+		if code[0] == 'B' || code[0] == 'U' {
+			d.Category = CategoryManufacturer
+		}
+	case '3':
+		// P30-P33 are the manufacturer's, P34-P39 generic; B3, C3 and U3 are reserved.
+		if code[0] == 'P' && code[2] <= '3' {
+			d.Category = CategoryManufacturer
+		}
+	}
+
+	if d.System == SystemPowertrain && code[1] <= '2' {
+		d.Area = powertrainAreas[code[2]]
+	}
+
+	d.Description = descriptions[code]
+	return &d, nil
+}
+
+// parseTable reads tab-separated code and description lines; # starts a comment.
+func parseTable(s string) map[string]string {
+	m := map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		code, desc, ok := strings.Cut(line, "\t")
+		if !ok {
+			panic("obd: bad line in dtc.tsv: " + line)
+		}
+
+		m[code] = desc
+	}
+
+	return m
+}
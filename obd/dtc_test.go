@@ -0,0 +1,79 @@
+package obd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		want *DTC
+		err  error
+	}{
+		{
+			code: "P0300",
+			want: &DTC{Code: "P0300", System: SystemPowertrain, Category: CategoryGeneric,
+				Area: "ignition system or misfire", Description: "Random/Multiple Cylinder Misfire Detected"},
+		},
+		{
+			code: " p0420 ",
+			want: &DTC{Code: "P0420", System: SystemPowertrain, Category: CategoryGeneric,
+				Area: "auxiliary emission controls", Description: "Catalyst System Efficiency Below Threshold (Bank 1)"},
+		},
+		{
+			code: "P2096",
+			want: &DTC{Code: "P2096", System: SystemPowertrain, Category: CategoryGeneric,
+				Area:        "fuel and air metering and auxiliary emission controls",
+				Description: "Post Catalyst Fuel Trim System Too Lean (Bank 1)"},
+		},
+		{
+			code: "P1234",
+			want: &DTC{Code: "P1234", System: SystemPowertrain, Category: CategoryManufacturer,
+				Area: "fuel and air metering (injector circuit)"},
+		},
+		{
+			code: "P0A80",
+			want: &DTC{Code: "P0A80", System: SystemPowertrain, Category: CategoryGeneric, Area: "hybrid propulsion"},
+		},
+		{
+			code: "P3000",
+			want: &DTC{Code: "P3000", System: SystemPowertrain, Category: CategoryManufacturer},
+		},
+		{
+			code: "P3400",
+			want: &DTC{Code: "P3400", System: SystemPowertrain, Category: CategoryGeneric},
+		},
+		{
+			code: "B2000",
+			want: &DTC{Code: "B2000", System: SystemBody, Category: CategoryManufacturer},
+		},
+		{
+			code: "C0035",
+			want: &DTC{Code: "C0035", System: SystemChassis, Category: CategoryGeneric,
+				Description: "Left Front Wheel Speed Sensor Circuit"},
+		},
+		{
+			code: "U1000",
+			want: &DTC{Code: "U1000", System: SystemNetwork, Category: CategoryManufacturer},
+		},
+		{code: "", err: ErrCode},
+		{code: "P030", err: ErrCode},
+		{code: "P03001", err: ErrCode},
+		{code: "X0300", err: ErrCode},
+		{code: "P4300", err: ErrCode},
+		{code: "P03G0", err: ErrCode},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			got, err := Decode(tc.code)
+			switch {
+			case !errors.Is(err, tc.err):
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			case tc.want == nil:
+				return
+			case *got != *tc.want:
+				t.Errorf("got %+v, want %+v", *got, *tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package obd
+
+import "errors"
+
+// Mode 01 PIDs we store.
+const (
+	PidCoolantTemp = 0x05 // °C
+	PidRpm         = 0x0C // revolutions per minute
+	PidSpeed       = 0x0D // km/h
+	PidFuelLevel   = 0x2F // percent
+	PidOdometer    = 0xA6 // km, newer vehicles only
+)
+
+var (
+	ErrPid  = errors.New("unsupported pid")
+	ErrData = errors.New("wrong data length for pid")
+)
+
+type pid struct {
+	n      int // data bytes
+	decode func(b []byte) float64
+}
+
+// Formulas from SAE J1979; b holds the data bytes A, B, ... of the response.
+var pids = map[int]pid{
+	PidCoolantTemp: {1, func(b []byte) float64 { return float64(b[0]) - 40 }},
+	PidRpm:         {2, func(b []byte) float64 { return float64(int(b[0])<<8|int(b[1])) / 4 }},
+	PidSpeed:       {1, func(b []byte) float64 { return float64(b[0]) }},
+	PidFuelLevel:   {1, func(b []byte) float64 { return float64(b[0]) * 100 / 255 }},
+	PidOdometer: {4, func(b []byte) float64 {
+		return float64(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3])) / 10
+	}},
+}
+
+// DecodePid returns the value in a mode 01 response, in the unit noted on the
+// pid's constant.
+func DecodePid(n int, data []byte) (float64, error) {
+	p, ok := pids[n]
+	if !ok {
+		return 0, ErrPid
+	}
+
+	if len(data) != p.n {
+		return 0, ErrData
+	}
+
+	return p.decode(data), nil
+}
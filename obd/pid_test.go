@@ -0,0 +1,38 @@
+package obd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodePid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pid  int
+		data []byte
+		want float64
+		err  error
+	}{
+		{name: "coolant", pid: PidCoolantTemp, data: []byte{0x7B}, want: 83},
+		{name: "coolant below zero", pid: PidCoolantTemp, data: []byte{0x00}, want: -40},
+		{name: "rpm", pid: PidRpm, data: []byte{0x1A, 0xF8}, want: 1726},
+		{name: "rpm max", pid: PidRpm, data: []byte{0xFF, 0xFF}, want: 16383.75},
+		{name: "speed", pid: PidSpeed, data: []byte{0x64}, want: 100},
+		{name: "fuel full", pid: PidFuelLevel, data: []byte{0xFF}, want: 100},
+		{name: "fuel half", pid: PidFuelLevel, data: []byte{0x80}, want: 128 * 100.0 / 255},
+		{name: "odometer", pid: PidOdometer, data: []byte{0x00, 0x1E, 0x84, 0x80}, want: 200000},
+		{name: "short data", pid: PidRpm, data: []byte{0x1A}, err: ErrData},
+		{name: "long data", pid: PidSpeed, data: []byte{0x64, 0x00}, err: ErrData},
+		{name: "unsupported", pid: 0x10, data: []byte{0x01, 0x02}, err: ErrPid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DecodePid(tc.pid, tc.data)
+			switch {
+			case !errors.Is(err, tc.err):
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			case got != tc.want:
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
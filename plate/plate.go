@@ -0,0 +1,75 @@
+package plate
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrCountry = errors.New("invalid country code")
+	ErrFormat  = errors.New("invalid plate number")
+
+	// Per-country formats after normalization. Countries not listed here only get
+	// the generic check; formats vary too much (vanity, diplomatic, legacy series)
+	// to validate everywhere, so the patterns are deliberately permissive.
+	formats = map[string]*regexp.Regexp{
+		"US": regexp.MustCompile(`^[A-Z0-9]{1,8}$`),
+		"CA": regexp.MustCompile(`^[A-Z0-9]{2,8}$`),
+		"GB": regexp.MustCompile(`^[A-Z0-9]{2,7}$`),
+		"DE": regexp.MustCompile(`^[A-ZÄÖÜ]{1,3}[A-Z]{1,2}[0-9]{1,4}[EH]?$`),
+		"FR": regexp.MustCompile(`^([A-Z]{2}[0-9]{3}[A-Z]{2}|[0-9]{1,4}[A-Z]{1,3}[0-9]{2,3})$`),
+		"PH": regexp.MustCompile(`^([A-Z]{3}[0-9]{3,4}|[A-Z]{2}[0-9]{4,5}|[0-9]{3,4}[A-Z]{2,3})$`),
+		"JP": regexp.MustCompile(`^[\p{Han}\p{Hiragana}\p{Katakana}A-Z0-9]{4,12}$`),
+	}
+)
+
+// NormalizeCountry uppercases an ISO 3166-1 alpha-2 code.
+func NormalizeCountry(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return code, ErrCountry
+	}
+
+	return code, nil
+}
+
+// Normalize returns the canonical form of a plate number registered in country:
+// uppercase with spaces, dashes, dots and other separators removed, so that
+// "ab-12 cde" and "AB12CDE" are the same plate.
+func Normalize(country, number string) (string, error) {
+	country, err := NormalizeCountry(country)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, r := range strings.ToUpper(number) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r), unicode.IsPunct(r), unicode.IsSymbol(r):
+			// separator
+		default:
+			return "", ErrFormat
+		}
+	}
+
+	n := b.String()
+	if n == "" || len([]rune(n)) > 12 {
+		return "", ErrFormat
+	}
+
+	if re, ok := formats[country]; ok && !re.MatchString(n) {
+		return "", ErrFormat
+	}
+
+	return n, nil
+}
+
+// NormalizeRegion uppercases a state, province or prefecture code; it isn't
+// validated since not every country has a standard list.
+func NormalizeRegion(region string) string {
+	return strings.ToUpper(strings.TrimSpace(region))
+}
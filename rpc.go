@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	base "github.com/drival-ai/v10-api/services/base"
+	"github.com/drival-ai/v10-api/services/location"
+	"github.com/drival-ai/v10-api/services/media"
+	"github.com/drival-ai/v10-api/services/telemetry"
+	basepb "github.com/drival-ai/v10-go/base/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The V10 service also serves the methods below, which have no definitions in
+// v10-go yet. Their messages are the service packages' own types, sent as JSON:
+// clients call /v10proto.base.v1.V10/<method> with the "json" content subtype,
+// e.g. grpc.CallContentSubtype("json") in Go. Generated clients use the proto
+// codec as before.
+
+func init() { encoding.RegisterCodec(jsonCodec{}) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+var v10Methods = []grpc.MethodDesc{
+	// Transfers
+	unary("StartTransfer", (*service).StartTransfer),
+	unary("CancelTransfer", (*service).CancelTransfer),
+	unary("RedeemTransfer", (*service).RedeemTransfer),
+	unary("OverrideTransfer", (*service).OverrideTransfer),
+
+	// Vehicle files
+	unary("ListVehicleFiles", (*service).ListVehicleFiles),
+	unary("DeleteVehicleFile", (*service).DeleteVehicleFile),
+
+	// Maintenance
+	unary("CreateServiceRecord", (*service).CreateServiceRecord),
+	unary("ListServiceRecords", (*service).ListServiceRecords),
+	unary("UpdateServiceRecord", (*service).UpdateServiceRecord),
+	unary("DeleteServiceRecord", (*service).DeleteServiceRecord),
+	unary("CreateSchedule", (*service).CreateSchedule),
+	unary("ListSchedules", (*service).ListSchedules),
+	unary("DeleteSchedule", (*service).DeleteSchedule),
+	unary("ListUpcomingMaintenance", (*service).ListUpcomingMaintenance),
+
+	// Fuel and charging
+	unary("CreateFuelEntry", (*service).CreateFuelEntry),
+	unary("ListFuelEntries", (*service).ListFuelEntries),
+	unary("DeleteFuelEntry", (*service).DeleteFuelEntry),
+	unary("GetFuelAnalytics", (*service).GetFuelAnalytics),
+
+	// Compliance documents
+	unary("CreateRecord", (*service).CreateRecord),
+	unary("ListRecords", (*service).ListRecords),
+	unary("UpdateRecord", (*service).UpdateRecord),
+	unary("DeleteRecord", (*service).DeleteRecord),
+	unary("ListExpiring", (*service).ListExpiring),
+
+	// Recalls
+	unary("ListRecalls", (*service).ListRecalls),
+	unary("AcknowledgeRecall", (*service).AcknowledgeRecall),
+
+	// Vehicles
+	unary("ListVehiclesWithOptions", (*service).ListVehiclesWithOptions),
+	unary("ArchiveVehicle", (*service).ArchiveVehicle),
+	unary("UnarchiveVehicle", (*service).UnarchiveVehicle),
+	unary("DeleteVehicle", (*service).DeleteVehicle),
+	unary("RestoreVehicle", (*service).RestoreVehicle),
+	unary("GetVehicle", (*service).GetVehicle),
+	unary("UpdateVehicle", (*service).UpdateVehicle),
+	unary("SearchVehicles", (*service).SearchVehicles),
+	unary("SetVehiclePlate", (*service).SetVehiclePlate),
+	unary("LookupVehicleByPlate", (*service).LookupVehicleByPlate),
+	unary("ListPlateHistory", (*service).ListPlateHistory),
+
+	// Orgs
+	unary("CreateOrg", (*service).CreateOrg),
+	unary("DeleteOrg", (*service).DeleteOrg),
+	unary("ListOrgs", (*service).ListOrgs),
+	unary("AddOrgMember", (*service).AddOrgMember),
+	unary("RemoveOrgMember", (*service).RemoveOrgMember),
+	unary("ListOrgMembers", (*service).ListOrgMembers),
+	unary("SetVehicleOrg", (*service).SetVehicleOrg),
+
+	// Claims
+	unary("CreateClaim", (*service).CreateClaim),
+	unary("WithdrawClaim", (*service).WithdrawClaim),
+	unary("ReleaseVehicle", (*service).ReleaseVehicle),
+	unary("DisputeClaim", (*service).DisputeClaim),
+	unary("ResolveClaim", (*service).ResolveClaim),
+	unary("GetClaim", (*service).GetClaim),
+	unary("ListClaims", (*service).ListClaims),
+
+	// Valuation
+	unary("EstimateValue", (*service).EstimateValue),
+	unary("ListValuations", (*service).ListValuations),
+
+	// Cost of ownership
+	unary("SetPurchase", (*service).SetPurchase),
+	unary("GetReport", (*service).GetReport),
+	unary("ExportReport", (*service).ExportReport),
+
+	// Expenses
+	unary("CreateExpense", (*service).CreateExpense),
+	unary("UpdateExpense", (*service).UpdateExpense),
+	unary("DeleteExpense", (*service).DeleteExpense),
+	unary("ListExpenses", (*service).ListExpenses),
+	unary("AggregateExpenses", (*service).AggregateExpenses),
+	unary("ExportExpenses", (*service).ExportExpenses),
+
+	// Telemetry
+	unary("LastSequence", (*service).LastSequence),
+	unary("GetTripUpload", (*service).GetTripUpload),
+
+	// Trips
+	unary("ListTrips", (*service).ListTrips),
+	unary("GetTrip", (*service).GetTrip),
+	unary("ListTripEvents", (*service).ListTripEvents),
+	unary("GetTripRoute", (*service).GetTripRoute),
+	unary("ExportTrips", (*service).ExportTrips),
+
+	// Scores
+	unary("GetScore", (*service).GetScore),
+	unary("ScoreHistory", (*service).ScoreHistory),
+
+	// Diagnostics
+	unary("UploadObd", (*service).UploadObd),
+	unary("ListFaults", (*service).ListFaults),
+	unary("GetObdStatus", (*service).GetObdStatus),
+
+	// Geofences
+	unary("CreateGeofence", (*service).CreateGeofence),
+	unary("UpdateGeofence", (*service).UpdateGeofence),
+	unary("DeleteGeofence", (*service).DeleteGeofence),
+	unary("ListGeofences", (*service).ListGeofences),
+	unary("SetGeofenceVehicles", (*service).SetGeofenceVehicles),
+	unary("ListGeofenceEvents", (*service).ListGeofenceEvents),
+
+	// Privacy zones
+	unary("CreatePrivacyZone", (*service).CreatePrivacyZone),
+	unary("DeletePrivacyZone", (*service).DeletePrivacyZone),
+	unary("ListPrivacyZones", (*service).ListPrivacyZones),
+}
+
+var v10Streams = []grpc.StreamDesc{
+	// Vehicles
+	clientStream[base.ImportVehiclesRequest, base.ImportVehiclesResponse]("ImportVehicles", (*service).ImportVehicles),
+
+	// Vehicle files
+	clientStream[media.UploadVehicleFileRequest, media.VehicleFile]("UploadVehicleFile", (*service).UploadVehicleFile),
+	serverStream[media.DownloadVehicleFileResponse]("DownloadVehicleFile", (*service).DownloadVehicleFile),
+
+	// Telemetry
+	clientStream[telemetry.UploadTelemetryRequest, telemetry.UploadTelemetryResponse]("UploadTelemetry", (*service).UploadTelemetry),
+	clientStream[telemetry.UploadTripRequest, telemetry.UploadTripResponse]("UploadTrip", (*service).UploadTrip),
+
+	// Live locations
+	serverStream[location.LocationUpdate]("WatchVehicleLocations", (*service).WatchVehicleLocations),
+}
+
+// v10Service returns sd, the generated V10 service, with the methods above.
+func v10Service(sd *grpc.ServiceDesc) *grpc.ServiceDesc {
+	out := *sd
+	out.Methods = append(slices.Clip(sd.Methods), v10Methods...)
+	out.Streams = append(slices.Clip(sd.Streams), v10Streams...)
+	return &out
+}
+
+// unary serves a unary method.
+func unary[Req, Res any](method string, f func(*service, context.Context, *Req) (*Res, error)) grpc.MethodDesc {
+	fullMethod := "/" + basepb.V10_ServiceDesc.ServiceName + "/" + method
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := new(Req)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+
+			if interceptor == nil {
+				return f(srv.(*service), ctx, in)
+			}
+
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+			return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+				return f(srv.(*service), ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+// clientStream serves a client-streaming method. S is the stream interface the
+// service package declares, with Recv and SendAndClose.
+func clientStream[Req, Res, S any](method string, f func(*service, S) error) grpc.StreamDesc {
+	mustImplement[S](&recvStream[Req, Res]{}, method)
+	return grpc.StreamDesc{
+		StreamName: method,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return f(srv.(*service), any(&recvStream[Req, Res]{stream}).(S))
+		},
+		ClientStreams: true,
+	}
+}
+
+// serverStream serves a server-streaming method. S is the stream interface the
+// service package declares, with Send.
+func serverStream[Res, Req, S any](method string, f func(*service, *Req, S) error) grpc.StreamDesc {
+	mustImplement[S](&sendStream[Res]{}, method)
+	return grpc.StreamDesc{
+		StreamName: method,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			in := new(Req)
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+
+			return f(srv.(*service), in, any(&sendStream[Res]{stream}).(S))
+		},
+		ServerStreams: true,
+	}
+}
+
+func mustImplement[S any](stream any, method string) {
+	if _, ok := stream.(S); !ok {
+		panic(fmt.Sprintf("%v: %T doesn't implement the stream interface", method, stream))
+	}
+}
+
+type recvStream[Req, Res any] struct {
+	grpc.ServerStream
+}
+
+func (x *recvStream[Req, Res]) Recv() (*Req, error) {
+	m := new(Req)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (x *recvStream[Req, Res]) SendAndClose(m *Res) error { return x.ServerStream.SendMsg(m) }
+
+type sendStream[Res any] struct {
+	grpc.ServerStream
+}
+
+func (x *sendStream[Res]) Send(m *Res) error { return x.ServerStream.SendMsg(m) }
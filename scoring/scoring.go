@@ -0,0 +1,160 @@
+package scoring
+
+import (
+	"math"
+	"time"
+
+	"github.com/drival-ai/v10-api/detect"
+)
+
+const (
+	SubBraking      = "braking"
+	SubAcceleration = "acceleration"
+	SubCornering    = "cornering"
+	SubSpeeding     = "speeding"
+	SubDistraction  = "distraction"
+	SubNight        = "night"
+	SubSmoothness   = "smoothness"
+
+	// Current is the model new scores are computed with. Bumping it has the
+	// scorer re-score every trip; scores from older models are kept.
+	Current = "v1"
+)
+
+// Inputs is what a trip score is based on.
+type Inputs struct {
+	DistanceM  float64
+	NightShare float64 // of driving time, 0 to 1
+	SpeedCV    float64 // coefficient of variation of moving speed
+	Events     []*Event
+}
+
+type Event struct {
+	Type     string
+	Severity string
+}
+
+type Result struct {
+	Score     float64            // 0 to 100, higher is better
+	SubScores map[string]float64 // same scale
+}
+
+// Model turns a trip's inputs into a score. Models are never changed once
+// released: a new formula is a new version.
+type Model func(in *Inputs) *Result
+
+var models = map[string]Model{
+	"v1": v1,
+}
+
+// Get returns the model with the given version.
+func Get(version string) (Model, bool) {
+	m, ok := models[version]
+	return m, ok
+}
+
+// v1 rates each event type by its severity-weighted count per 100 km, and
+// weighs in night driving and how much the speed varied.
+func v1(in *Inputs) *Result {
+	// Short trips would swing wildly on a single event.
+	per100km := 100000 / math.Max(in.DistanceM, 5000)
+	weighted := map[string]float64{}
+	for _, ev := range in.Events {
+		switch ev.Severity {
+		case detect.SeverityHigh:
+			weighted[ev.Type] += 3
+		case detect.SeverityMedium:
+			weighted[ev.Type] += 2
+		default:
+			weighted[ev.Type]++
+		}
+	}
+
+	rate := func(typ string, k float64) float64 {
+		return 100 * math.Exp(-k*weighted[typ]*per100km)
+	}
+
+	subs := map[string]float64{
+		SubBraking:      rate(detect.TypeHarshBraking, 0.15),
+		SubAcceleration: rate(detect.TypeHarshAcceleration, 0.1),
+		SubCornering:    rate(detect.TypeSharpCornering, 0.1),
+		SubSpeeding:     rate(detect.TypeSpeeding, 0.2),
+		SubDistraction:  rate(detect.TypePhoneDistraction, 0.25),
+		SubNight:        100 - 40*clamp(in.NightShare),
+		SubSmoothness:   100 - 60*clamp((in.SpeedCV-0.25)/0.75),
+	}
+
+	weights := []struct {
+		sub    string
+		weight float64
+	}{
+		{SubBraking, 0.2},
+		{SubAcceleration, 0.15},
+		{SubCornering, 0.15},
+		{SubSpeeding, 0.25},
+		{SubDistraction, 0.15},
+		{SubNight, 0.05},
+		{SubSmoothness, 0.05},
+	}
+
+	out := Result{SubScores: map[string]float64{}}
+	for _, w := range weights {
+		out.SubScores[w.sub] = round(subs[w.sub])
+		out.Score += subs[w.sub] * w.weight
+	}
+
+	out.Score = round(out.Score)
+	return &out
+}
+
+const (
+	nightStart = 22 // local solar time
+	nightEnd   = 5
+
+	// A sample stands for at most this much driving time.
+	maxSampleSpan = time.Second * 30
+
+	minMovingSpeedMps = 2
+)
+
+// Profile computes the share of driving time at night and the variation of
+// moving speed from a trip's samples, ordered by time. Night is judged by solar
+// time at the sample's longitude, which needs no time zone data and is within
+// an hour or so of local time nearly everywhere.
+func Profile(samples []*detect.Sample) (nightShare, speedCV float64) {
+	var total, night time.Duration
+	var n, sum, sumSq float64
+	for i, sm := range samples {
+		if sm.SpeedMps >= minMovingSpeedMps {
+			n++
+			sum += sm.SpeedMps
+			sumSq += sm.SpeedMps * sm.SpeedMps
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		span := min(sm.At.Sub(samples[i-1].At), maxSampleSpan)
+		total += span
+		solar := sm.At.UTC().Add(time.Duration(sm.Lon / 15 * float64(time.Hour)))
+		if h := solar.Hour(); h >= nightStart || h < nightEnd {
+			night += span
+		}
+	}
+
+	if total > 0 {
+		nightShare = float64(night) / float64(total)
+	}
+
+	if n > 1 && sum > 0 {
+		mean := sum / n
+		speedCV = math.Sqrt(math.Max(sumSq/n-mean*mean, 0)) / mean
+	}
+
+	return math.Round(nightShare*1000) / 1000, math.Round(speedCV*1000) / 1000
+}
+
+func clamp(f float64) float64 { return math.Min(math.Max(f, 0), 1) }
+
+func round(f float64) float64 { return math.Round(f*10) / 10 }
@@ -0,0 +1,165 @@
+package scoring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/drival-ai/v10-api/detect"
+)
+
+func TestV1(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    Inputs
+		score float64
+		subs  map[string]float64 // the ones below 100
+	}{
+		{
+			name:  "clean",
+			in:    Inputs{DistanceM: 20000, SpeedCV: 0.2},
+			score: 100,
+		},
+		{
+			name:  "one high braking in 10 km",
+			in:    Inputs{DistanceM: 10000, Events: []*Event{{detect.TypeHarshBraking, detect.SeverityHigh}}},
+			score: 80.2,
+			subs:  map[string]float64{SubBraking: 1.1},
+		},
+		{
+			name:  "same in 100 km",
+			in:    Inputs{DistanceM: 100000, Events: []*Event{{detect.TypeHarshBraking, detect.SeverityHigh}}},
+			score: 92.8,
+			subs:  map[string]float64{SubBraking: 63.8},
+		},
+		{
+			name:  "short trip counts as 5 km",
+			in:    Inputs{DistanceM: 1000, Events: []*Event{{detect.TypeSpeeding, detect.SeverityLow}}},
+			score: 75.5,
+			subs:  map[string]float64{SubSpeeding: 1.8},
+		},
+		{
+			name: "mixed events",
+			in: Inputs{DistanceM: 50000, Events: []*Event{
+				{detect.TypeHarshAcceleration, detect.SeverityMedium},
+				{detect.TypeSharpCornering, detect.SeverityLow},
+				{detect.TypeSharpCornering, detect.SeverityLow},
+				{detect.TypePhoneDistraction, detect.SeverityHigh},
+			}},
+			score: 78.5,
+			subs:  map[string]float64{SubAcceleration: 67, SubCornering: 67, SubDistraction: 22.3},
+		},
+		{
+			name:  "night and uneven speed",
+			in:    Inputs{DistanceM: 20000, NightShare: 0.5, SpeedCV: 0.625},
+			score: 97.5,
+			subs:  map[string]float64{SubNight: 80, SubSmoothness: 70},
+		},
+		{
+			name:  "all night, very uneven",
+			in:    Inputs{DistanceM: 20000, NightShare: 1, SpeedCV: 2},
+			score: 95,
+			subs:  map[string]float64{SubNight: 60, SubSmoothness: 40},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, ok := Get(Current)
+			if !ok {
+				t.Fatalf("no model %v", Current)
+			}
+
+			got := m(&tc.in)
+			if got.Score != tc.score {
+				t.Errorf("score = %v, want %v", got.Score, tc.score)
+			}
+
+			for _, sub := range []string{SubBraking, SubAcceleration, SubCornering, SubSpeeding,
+				SubDistraction, SubNight, SubSmoothness} {
+				want, ok := tc.subs[sub]
+				if !ok {
+					want = 100
+				}
+
+				if got.SubScores[sub] != want {
+					t.Errorf("%v = %v, want %v", sub, got.SubScores[sub], want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	// samples returns one sample every 10 seconds from start (UTC) at lon.
+	samples := func(start string, lon float64, speeds ...float64) []*detect.Sample {
+		at, _ := time.Parse(time.DateTime, "2026-03-14 "+start)
+		var out []*detect.Sample
+		for i, v := range speeds {
+			out = append(out, &detect.Sample{At: at.Add(time.Second * 10 * time.Duration(i)), Lon: lon, SpeedMps: v})
+		}
+
+		return out
+	}
+
+	for _, tc := range []struct {
+		name       string
+		samples    []*detect.Sample
+		nightShare float64
+		speedCV    float64
+	}{
+		{
+			name: "no samples",
+		},
+		{
+			name:    "day, steady",
+			samples: samples("12:00:00", 13.4, 15, 15, 15, 15),
+		},
+		{
+			name:       "night",
+			samples:    samples("23:00:00", 0, 15, 15, 15),
+			nightShare: 1,
+		},
+		{
+			name:       "night by solar time east",
+			samples:    samples("21:30:00", 30, 15, 15, 15),
+			nightShare: 1,
+		},
+		{
+			name:    "day by solar time west",
+			samples: samples("23:30:00", -30, 15, 15, 15),
+		},
+		{
+			name:       "night starts halfway",
+			samples:    samples("21:59:30", 0, 15, 15, 15, 15, 15),
+			nightShare: 0.5,
+		},
+		{
+			name: "gaps count as 30 seconds",
+			samples: []*detect.Sample{
+				{At: time.Date(2026, 3, 14, 21, 0, 0, 0, time.UTC), SpeedMps: 15},
+				{At: time.Date(2026, 3, 14, 21, 59, 50, 0, time.UTC), SpeedMps: 15},
+				{At: time.Date(2026, 3, 14, 22, 0, 20, 0, time.UTC), SpeedMps: 15},
+			},
+			nightShare: 0.5,
+		},
+		{
+			name:    "uneven speed",
+			samples: samples("12:00:00", 0, 10, 20, 10, 20),
+			speedCV: 0.333,
+		},
+		{
+			name:    "standing still left out",
+			samples: samples("12:00:00", 0, 10, 0, 1, 20, 10, 20),
+			speedCV: 0.333,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nightShare, speedCV := Profile(tc.samples)
+			if nightShare != tc.nightShare {
+				t.Errorf("night share = %v, want %v", nightShare, tc.nightShare)
+			}
+
+			if speedCV != tc.speedCV {
+				t.Errorf("speed cv = %v, want %v", speedCV, tc.speedCV)
+			}
+		})
+	}
+}
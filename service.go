@@ -9,7 +9,25 @@ import (
 	iampb "github.com/drival-ai/v10-go/iam/v1"
 
 	base "github.com/drival-ai/v10-api/services/base"
+	"github.com/drival-ai/v10-api/services/claim"
+	"github.com/drival-ai/v10-api/services/compliance"
+	"github.com/drival-ai/v10-api/services/diagnostic"
+	"github.com/drival-ai/v10-api/services/expense"
+	"github.com/drival-ai/v10-api/services/fuel"
+	"github.com/drival-ai/v10-api/services/geofence"
 	iam "github.com/drival-ai/v10-api/services/iam"
+	"github.com/drival-ai/v10-api/services/location"
+	"github.com/drival-ai/v10-api/services/maintenance"
+	"github.com/drival-ai/v10-api/services/media"
+	"github.com/drival-ai/v10-api/services/org"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/drival-ai/v10-api/services/recall"
+	"github.com/drival-ai/v10-api/services/score"
+	"github.com/drival-ai/v10-api/services/tco"
+	"github.com/drival-ai/v10-api/services/telemetry"
+	"github.com/drival-ai/v10-api/services/transfer"
+	"github.com/drival-ai/v10-api/services/trip"
+	"github.com/drival-ai/v10-api/services/valuation"
 	basepb "github.com/drival-ai/v10-go/base/v1"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
@@ -20,6 +38,14 @@ var (
 	}
 )
 
+// userInfo is the caller, as set by the auth interceptors.
+func userInfo(ctx context.Context) internal.UserInfo {
+	id, _ := ctx.Value(internal.CtxKeyId).(string)
+	email, _ := ctx.Value(internal.CtxKeyEmail).(string)
+	name, _ := ctx.Value(internal.CtxKeyName).(string)
+	return internal.UserInfo{Id: id, Email: email, Name: name}
+}
+
 type service struct {
 	ctx        context.Context
 	Config     *global.Config
@@ -72,3 +98,460 @@ func (s *service) RegisterVehicle(ctx context.Context, req *basepb.RegisterVehic
 
 	return base.New((*base.Config)(&config)).RegisterVehicle(ctx, req)
 }
+
+func (s *service) ListVehicles(ctx context.Context, req *basepb.ListVehiclesRequest) (*basepb.ListVehiclesResponse, error) {
+	id := ctx.Value(internal.CtxKeyId)
+	email := ctx.Value(internal.CtxKeyEmail)
+	name := ctx.Value(internal.CtxKeyName)
+	config := base.Config{
+		UserInfo: internal.UserInfo{
+			Id:    id.(string),
+			Email: email.(string),
+			Name:  name.(string),
+		},
+		Config:     s.Config,
+		PrivateKey: s.PrivateKey,
+	}
+
+	return base.New(&config).ListVehicles(ctx, req)
+}
+
+func (s *service) StartTransfer(ctx context.Context, req *transfer.StartTransferRequest) (*transfer.StartTransferResponse, error) {
+	config := transfer.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return transfer.New(&config).StartTransfer(ctx, req)
+}
+
+func (s *service) CancelTransfer(ctx context.Context, req *transfer.CancelTransferRequest) (*emptypb.Empty, error) {
+	config := transfer.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return transfer.New(&config).CancelTransfer(ctx, req)
+}
+
+func (s *service) RedeemTransfer(ctx context.Context, req *transfer.RedeemTransferRequest) (*transfer.RedeemTransferResponse, error) {
+	config := transfer.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return transfer.New(&config).RedeemTransfer(ctx, req)
+}
+
+func (s *service) OverrideTransfer(ctx context.Context, req *transfer.OverrideTransferRequest) (*emptypb.Empty, error) {
+	config := transfer.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return transfer.New(&config).OverrideTransfer(ctx, req)
+}
+
+func (s *service) ImportVehicles(stream base.ImportVehiclesServer) error {
+	config := base.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).ImportVehicles(stream)
+}
+
+func (s *service) UploadVehicleFile(stream media.UploadVehicleFileServer) error {
+	config := media.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return media.New(&config).UploadVehicleFile(stream)
+}
+
+func (s *service) DownloadVehicleFile(req *media.DownloadVehicleFileRequest, stream media.DownloadVehicleFileServer) error {
+	config := media.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return media.New(&config).DownloadVehicleFile(req, stream)
+}
+
+func (s *service) ListVehicleFiles(ctx context.Context, req *media.ListVehicleFilesRequest) (*media.ListVehicleFilesResponse, error) {
+	config := media.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return media.New(&config).ListVehicleFiles(ctx, req)
+}
+
+func (s *service) DeleteVehicleFile(ctx context.Context, req *media.DeleteVehicleFileRequest) (*emptypb.Empty, error) {
+	config := media.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return media.New(&config).DeleteVehicleFile(ctx, req)
+}
+
+func (s *service) CreateServiceRecord(ctx context.Context, req *maintenance.ServiceRecord) (*maintenance.ServiceRecord, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).CreateServiceRecord(ctx, req)
+}
+
+func (s *service) ListServiceRecords(ctx context.Context, req *maintenance.ListServiceRecordsRequest) (*maintenance.ListServiceRecordsResponse, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).ListServiceRecords(ctx, req)
+}
+
+func (s *service) UpdateServiceRecord(ctx context.Context, req *maintenance.ServiceRecord) (*maintenance.ServiceRecord, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).UpdateServiceRecord(ctx, req)
+}
+
+func (s *service) DeleteServiceRecord(ctx context.Context, req *maintenance.DeleteServiceRecordRequest) (*emptypb.Empty, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).DeleteServiceRecord(ctx, req)
+}
+
+func (s *service) CreateSchedule(ctx context.Context, req *maintenance.Schedule) (*maintenance.Schedule, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).CreateSchedule(ctx, req)
+}
+
+func (s *service) ListSchedules(ctx context.Context, req *maintenance.ListSchedulesRequest) (*maintenance.ListSchedulesResponse, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).ListSchedules(ctx, req)
+}
+
+func (s *service) DeleteSchedule(ctx context.Context, req *maintenance.DeleteScheduleRequest) (*emptypb.Empty, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).DeleteSchedule(ctx, req)
+}
+
+func (s *service) ListUpcomingMaintenance(ctx context.Context, req *maintenance.ListUpcomingMaintenanceRequest) (*maintenance.ListUpcomingMaintenanceResponse, error) {
+	config := maintenance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return maintenance.New(&config).ListUpcomingMaintenance(ctx, req)
+}
+
+func (s *service) CreateFuelEntry(ctx context.Context, req *fuel.FuelEntry) (*fuel.FuelEntry, error) {
+	config := fuel.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return fuel.New(&config).CreateFuelEntry(ctx, req)
+}
+
+func (s *service) ListFuelEntries(ctx context.Context, req *fuel.ListFuelEntriesRequest) (*fuel.ListFuelEntriesResponse, error) {
+	config := fuel.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return fuel.New(&config).ListFuelEntries(ctx, req)
+}
+
+func (s *service) DeleteFuelEntry(ctx context.Context, req *fuel.DeleteFuelEntryRequest) (*emptypb.Empty, error) {
+	config := fuel.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return fuel.New(&config).DeleteFuelEntry(ctx, req)
+}
+
+func (s *service) GetFuelAnalytics(ctx context.Context, req *fuel.GetFuelAnalyticsRequest) (*fuel.FuelAnalytics, error) {
+	config := fuel.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return fuel.New(&config).GetFuelAnalytics(ctx, req)
+}
+
+func (s *service) CreateRecord(ctx context.Context, req *compliance.Record) (*compliance.Record, error) {
+	config := compliance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return compliance.New(&config).CreateRecord(ctx, req)
+}
+
+func (s *service) ListRecords(ctx context.Context, req *compliance.ListRecordsRequest) (*compliance.ListRecordsResponse, error) {
+	config := compliance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return compliance.New(&config).ListRecords(ctx, req)
+}
+
+func (s *service) UpdateRecord(ctx context.Context, req *compliance.Record) (*compliance.Record, error) {
+	config := compliance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return compliance.New(&config).UpdateRecord(ctx, req)
+}
+
+func (s *service) DeleteRecord(ctx context.Context, req *compliance.DeleteRecordRequest) (*emptypb.Empty, error) {
+	config := compliance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return compliance.New(&config).DeleteRecord(ctx, req)
+}
+
+func (s *service) ListExpiring(ctx context.Context, req *compliance.ListExpiringRequest) (*compliance.ListExpiringResponse, error) {
+	config := compliance.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return compliance.New(&config).ListExpiring(ctx, req)
+}
+
+func (s *service) ListRecalls(ctx context.Context, req *recall.ListRecallsRequest) (*recall.ListRecallsResponse, error) {
+	config := recall.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return recall.New(&config).ListRecalls(ctx, req)
+}
+
+func (s *service) AcknowledgeRecall(ctx context.Context, req *recall.AcknowledgeRecallRequest) (*emptypb.Empty, error) {
+	config := recall.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return recall.New(&config).AcknowledgeRecall(ctx, req)
+}
+
+func (s *service) ListVehiclesWithOptions(ctx context.Context, req *base.ListVehiclesOptions) (*basepb.ListVehiclesResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).ListVehiclesWithOptions(ctx, req)
+}
+
+func (s *service) ArchiveVehicle(ctx context.Context, req *base.VehicleRequest) (*emptypb.Empty, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).ArchiveVehicle(ctx, req)
+}
+
+func (s *service) UnarchiveVehicle(ctx context.Context, req *base.VehicleRequest) (*emptypb.Empty, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).UnarchiveVehicle(ctx, req)
+}
+
+func (s *service) DeleteVehicle(ctx context.Context, req *base.VehicleRequest) (*base.DeleteVehicleResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).DeleteVehicle(ctx, req)
+}
+
+func (s *service) RestoreVehicle(ctx context.Context, req *base.VehicleRequest) (*emptypb.Empty, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).RestoreVehicle(ctx, req)
+}
+
+func (s *service) GetVehicle(ctx context.Context, req *base.VehicleRequest) (*base.VehicleResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).GetVehicle(ctx, req)
+}
+
+func (s *service) UpdateVehicle(ctx context.Context, req *base.UpdateVehicleRequest) (*base.VehicleResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).UpdateVehicle(ctx, req)
+}
+
+func (s *service) SearchVehicles(ctx context.Context, req *base.SearchVehiclesRequest) (*base.SearchVehiclesResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).SearchVehicles(ctx, req)
+}
+
+func (s *service) SetVehiclePlate(ctx context.Context, req *base.SetVehiclePlateRequest) (*base.VehicleResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).SetVehiclePlate(ctx, req)
+}
+
+func (s *service) LookupVehicleByPlate(ctx context.Context, req *base.LookupVehicleByPlateRequest) (*base.VehicleResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).LookupVehicleByPlate(ctx, req)
+}
+
+func (s *service) ListPlateHistory(ctx context.Context, req *base.VehicleRequest) (*base.ListPlateHistoryResponse, error) {
+	config := base.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return base.New(&config).ListPlateHistory(ctx, req)
+}
+
+func (s *service) CreateOrg(ctx context.Context, req *org.Org) (*org.Org, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).CreateOrg(ctx, req)
+}
+
+func (s *service) DeleteOrg(ctx context.Context, req *org.DeleteOrgRequest) (*emptypb.Empty, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).DeleteOrg(ctx, req)
+}
+
+func (s *service) ListOrgs(ctx context.Context, req *org.ListOrgsRequest) (*org.ListOrgsResponse, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).ListOrgs(ctx, req)
+}
+
+func (s *service) AddOrgMember(ctx context.Context, req *org.OrgMember) (*org.OrgMember, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).AddOrgMember(ctx, req)
+}
+
+func (s *service) RemoveOrgMember(ctx context.Context, req *org.RemoveOrgMemberRequest) (*emptypb.Empty, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).RemoveOrgMember(ctx, req)
+}
+
+func (s *service) ListOrgMembers(ctx context.Context, req *org.ListOrgMembersRequest) (*org.ListOrgMembersResponse, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).ListOrgMembers(ctx, req)
+}
+
+func (s *service) SetVehicleOrg(ctx context.Context, req *org.SetVehicleOrgRequest) (*emptypb.Empty, error) {
+	config := org.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return org.New(&config).SetVehicleOrg(ctx, req)
+}
+
+func (s *service) CreateClaim(ctx context.Context, req *claim.CreateClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).CreateClaim(ctx, req)
+}
+
+func (s *service) WithdrawClaim(ctx context.Context, req *claim.ClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).WithdrawClaim(ctx, req)
+}
+
+func (s *service) ReleaseVehicle(ctx context.Context, req *claim.ClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).ReleaseVehicle(ctx, req)
+}
+
+func (s *service) DisputeClaim(ctx context.Context, req *claim.ClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).DisputeClaim(ctx, req)
+}
+
+func (s *service) ResolveClaim(ctx context.Context, req *claim.ResolveClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).ResolveClaim(ctx, req)
+}
+
+func (s *service) GetClaim(ctx context.Context, req *claim.ClaimRequest) (*claim.Claim, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).GetClaim(ctx, req)
+}
+
+func (s *service) ListClaims(ctx context.Context, req *claim.ListClaimsRequest) (*claim.ListClaimsResponse, error) {
+	config := claim.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return claim.New(&config).ListClaims(ctx, req)
+}
+
+func (s *service) EstimateValue(ctx context.Context, req *valuation.EstimateValueRequest) (*valuation.Valuation, error) {
+	config := valuation.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return valuation.New(&config).EstimateValue(ctx, req)
+}
+
+func (s *service) ListValuations(ctx context.Context, req *valuation.ListValuationsRequest) (*valuation.ListValuationsResponse, error) {
+	config := valuation.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return valuation.New(&config).ListValuations(ctx, req)
+}
+
+func (s *service) SetPurchase(ctx context.Context, req *tco.SetPurchaseRequest) (*emptypb.Empty, error) {
+	config := tco.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return tco.New(&config).SetPurchase(ctx, req)
+}
+
+func (s *service) GetReport(ctx context.Context, req *tco.ReportRequest) (*tco.Report, error) {
+	config := tco.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return tco.New(&config).GetReport(ctx, req)
+}
+
+func (s *service) ExportReport(ctx context.Context, req *tco.ReportRequest) (*internal.ExportResponse, error) {
+	config := tco.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return tco.New(&config).ExportReport(ctx, req)
+}
+
+func (s *service) CreateExpense(ctx context.Context, req *expense.Expense) (*expense.Expense, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).CreateExpense(ctx, req)
+}
+
+func (s *service) UpdateExpense(ctx context.Context, req *expense.Expense) (*expense.Expense, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).UpdateExpense(ctx, req)
+}
+
+func (s *service) DeleteExpense(ctx context.Context, req *expense.DeleteExpenseRequest) (*emptypb.Empty, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).DeleteExpense(ctx, req)
+}
+
+func (s *service) ListExpenses(ctx context.Context, req *expense.ListExpensesRequest) (*expense.ListExpensesResponse, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).ListExpenses(ctx, req)
+}
+
+func (s *service) AggregateExpenses(ctx context.Context, req *expense.AggregateExpensesRequest) (*expense.AggregateExpensesResponse, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).AggregateExpenses(ctx, req)
+}
+
+func (s *service) ExportExpenses(ctx context.Context, req *expense.ListExpensesRequest) (*internal.ExportResponse, error) {
+	config := expense.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return expense.New(&config).ExportExpenses(ctx, req)
+}
+
+func (s *service) UploadTelemetry(stream telemetry.UploadTelemetryServer) error {
+	config := telemetry.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return telemetry.New(&config).UploadTelemetry(stream)
+}
+
+func (s *service) LastSequence(ctx context.Context, req *telemetry.LastSequenceRequest) (*telemetry.LastSequenceResponse, error) {
+	config := telemetry.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return telemetry.New(&config).LastSequence(ctx, req)
+}
+
+func (s *service) ListTrips(ctx context.Context, req *trip.ListTripsRequest) (*trip.ListTripsResponse, error) {
+	config := trip.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return trip.New(&config).ListTrips(ctx, req)
+}
+
+func (s *service) GetTrip(ctx context.Context, req *trip.GetTripRequest) (*trip.Trip, error) {
+	config := trip.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return trip.New(&config).GetTrip(ctx, req)
+}
+
+func (s *service) ListTripEvents(ctx context.Context, req *trip.ListTripEventsRequest) (*trip.ListTripEventsResponse, error) {
+	config := trip.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return trip.New(&config).ListTripEvents(ctx, req)
+}
+
+func (s *service) GetScore(ctx context.Context, req *score.GetScoreRequest) (*score.GetScoreResponse, error) {
+	config := score.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return score.New(&config).GetScore(ctx, req)
+}
+
+func (s *service) ScoreHistory(ctx context.Context, req *score.ScoreHistoryRequest) (*score.ScoreHistoryResponse, error) {
+	config := score.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return score.New(&config).ScoreHistory(ctx, req)
+}
+
+func (s *service) GetTripRoute(ctx context.Context, req *trip.GetTripRouteRequest) (*trip.TripRoute, error) {
+	config := trip.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return trip.New(&config).GetTripRoute(ctx, req)
+}
+
+func (s *service) UploadTrip(stream telemetry.UploadTripServer) error {
+	config := telemetry.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return telemetry.New(&config).UploadTrip(stream)
+}
+
+func (s *service) GetTripUpload(ctx context.Context, req *telemetry.GetTripUploadRequest) (*telemetry.UploadTripResponse, error) {
+	config := telemetry.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return telemetry.New(&config).GetTripUpload(ctx, req)
+}
+
+func (s *service) UploadObd(ctx context.Context, req *diagnostic.UploadObdRequest) (*diagnostic.UploadObdResponse, error) {
+	config := diagnostic.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return diagnostic.New(&config).UploadObd(ctx, req)
+}
+
+func (s *service) ListFaults(ctx context.Context, req *diagnostic.ListFaultsRequest) (*diagnostic.ListFaultsResponse, error) {
+	config := diagnostic.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return diagnostic.New(&config).ListFaults(ctx, req)
+}
+
+func (s *service) GetObdStatus(ctx context.Context, req *diagnostic.GetObdStatusRequest) (*diagnostic.ObdStatus, error) {
+	config := diagnostic.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return diagnostic.New(&config).GetObdStatus(ctx, req)
+}
+
+func (s *service) CreateGeofence(ctx context.Context, req *geofence.Geofence) (*geofence.Geofence, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).CreateGeofence(ctx, req)
+}
+
+func (s *service) UpdateGeofence(ctx context.Context, req *geofence.Geofence) (*geofence.Geofence, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).UpdateGeofence(ctx, req)
+}
+
+func (s *service) DeleteGeofence(ctx context.Context, req *geofence.DeleteGeofenceRequest) (*emptypb.Empty, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).DeleteGeofence(ctx, req)
+}
+
+func (s *service) ListGeofences(ctx context.Context, req *geofence.ListGeofencesRequest) (*geofence.ListGeofencesResponse, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).ListGeofences(ctx, req)
+}
+
+func (s *service) SetGeofenceVehicles(ctx context.Context, req *geofence.SetGeofenceVehiclesRequest) (*geofence.Geofence, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).SetGeofenceVehicles(ctx, req)
+}
+
+func (s *service) ListGeofenceEvents(ctx context.Context, req *geofence.ListGeofenceEventsRequest) (*geofence.ListGeofenceEventsResponse, error) {
+	config := geofence.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return geofence.New(&config).ListGeofenceEvents(ctx, req)
+}
+
+func (s *service) WatchVehicleLocations(req *location.WatchVehicleLocationsRequest, stream location.WatchVehicleLocationsServer) error {
+	config := location.Config{UserInfo: userInfo(stream.Context()), Config: s.Config, PrivateKey: s.PrivateKey}
+	return location.New(&config).WatchVehicleLocations(req, stream)
+}
+
+func (s *service) CreatePrivacyZone(ctx context.Context, req *privacy.PrivacyZone) (*privacy.PrivacyZone, error) {
+	config := privacy.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return privacy.New(&config).CreatePrivacyZone(ctx, req)
+}
+
+func (s *service) DeletePrivacyZone(ctx context.Context, req *privacy.DeletePrivacyZoneRequest) (*emptypb.Empty, error) {
+	config := privacy.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return privacy.New(&config).DeletePrivacyZone(ctx, req)
+}
+
+func (s *service) ListPrivacyZones(ctx context.Context, req *privacy.ListPrivacyZonesRequest) (*privacy.ListPrivacyZonesResponse, error) {
+	config := privacy.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return privacy.New(&config).ListPrivacyZones(ctx, req)
+}
+
+func (s *service) ExportTrips(ctx context.Context, req *trip.ListTripsRequest) (*internal.ExportResponse, error) {
+	config := trip.Config{UserInfo: userInfo(ctx), Config: s.Config, PrivateKey: s.PrivateKey}
+	return trip.New(&config).ExportTrips(ctx, req)
+}
@@ -0,0 +1,300 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	defaultRetentionDays = 30
+	purgeBatchSize       = 50
+)
+
+type VehicleRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+	Etag      string `json:"etag,omitempty"` // optional; the call fails with Aborted if stale
+}
+
+type DeleteVehicleResponse struct {
+	PurgeAfter time.Time `json:"purgeAfter,omitempty"` // restorable until then
+}
+
+// ArchiveVehicle hides a vehicle from default listings. Its data stays available.
+func (s *svc) ArchiveVehicle(ctx context.Context, in *VehicleRequest) (*emptypb.Empty, error) {
+	return s.updateState(ctx, "ArchiveVehicle", in,
+		"archived_at = coalesce(archived_at, now())",
+		"deleted_at is null")
+}
+
+func (s *svc) UnarchiveVehicle(ctx context.Context, in *VehicleRequest) (*emptypb.Empty, error) {
+	return s.updateState(ctx, "UnarchiveVehicle", in,
+		"archived_at = null",
+		"deleted_at is null")
+}
+
+// DeleteVehicle soft-deletes a vehicle. It disappears from all endpoints but can
+// be restored until the retention window ends, after which RunPurge removes it
+// along with its history. Pending transfers are cancelled.
+func (s *svc) DeleteVehicle(ctx context.Context, in *VehicleRequest) (*DeleteVehicleResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("DeleteVehicle input=%v", string(b))
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	args, err := s.stateArgs(in)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var out DeleteVehicleResponse
+	var q strings.Builder
+	args["days"] = s.retentionDays()
+	fmt.Fprintf(&q, "update vehicles set deleted_at = now(), ")
+	fmt.Fprintf(&q, "purge_after = now() + make_interval(days => @days), ")
+	fmt.Fprintf(&q, "version = version + 1 ")
+	fmt.Fprintf(&q, "where id = @id and user_id = @user_id and deleted_at is null ")
+	if in.Etag != "" {
+		fmt.Fprintf(&q, "and version = @version ")
+	}
+
+	fmt.Fprintf(&q, "returning purge_after")
+	err = tx.QueryRow(ctx, q.String(), args).Scan(&out.PurgeAfter)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, s.updateMissed(ctx, in.VehicleId, args)
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "update vehicle_transfers set status = 'cancelled' ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and status = 'pending'")
+	if _, err = tx.Exec(ctx, q.String(), in.VehicleId); err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	glog.Infof("DeleteVehicle success! vehicle=%v, purgeAfter=%v", in.VehicleId, out.PurgeAfter)
+	return &out, nil
+}
+
+// RestoreVehicle undoes DeleteVehicle if the vehicle hasn't been purged yet.
+func (s *svc) RestoreVehicle(ctx context.Context, in *VehicleRequest) (*emptypb.Empty, error) {
+	return s.updateState(ctx, "RestoreVehicle", in,
+		"deleted_at = null, purge_after = null",
+		"deleted_at is not null and purge_after > now()")
+}
+
+// updateState applies set to a vehicle owned by the caller when cond holds, and
+// when the request carries an etag, only if it still matches.
+func (s *svc) updateState(ctx context.Context, method string, in *VehicleRequest, set, cond string) (*emptypb.Empty, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("%v input=%v", method, string(b))
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	args, err := s.stateArgs(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicles set %v, version = version + 1 ", set)
+	fmt.Fprintf(&q, "where id = @id and user_id = @user_id and %v", cond)
+	if in.Etag != "" {
+		fmt.Fprintf(&q, " and version = @version")
+	}
+
+	tag, err := global.PgxPool.Exec(ctx, q.String(), args)
+	switch {
+	case internal.IsUniqueViolation(err):
+		// Restoring a vehicle whose plate was registered again in the meantime.
+		return nil, status.Errorf(codes.FailedPrecondition, "plate is registered to another vehicle")
+	case err != nil:
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, s.updateMissed(ctx, in.VehicleId, args)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *svc) stateArgs(in *VehicleRequest) (pgx.NamedArgs, error) {
+	args := pgx.NamedArgs{"id": in.VehicleId, "user_id": s.Config.UserInfo.Id}
+	if in.Etag != "" {
+		version, err := internal.ParseEtag(in.Etag)
+		if err != nil {
+			return nil, err
+		}
+
+		args["version"] = version
+	}
+
+	return args, nil
+}
+
+// updateMissed explains a conditional update that matched no rows: the etag is
+// stale if the vehicle is still there at another version, else it's not found.
+func (s *svc) updateMissed(ctx context.Context, vehicleId string, args pgx.NamedArgs) error {
+	expected, ok := args["version"].(int64)
+	if !ok {
+		return status.Errorf(codes.NotFound, "vehicle not found")
+	}
+
+	var version int64
+	err := global.PgxPool.QueryRow(ctx, "select version from vehicles where id = $1 and user_id = $2",
+		vehicleId, s.Config.UserInfo.Id).Scan(&version)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	case version != expected:
+		return internal.EtagMismatchErr
+	}
+
+	return status.Errorf(codes.NotFound, "vehicle not found")
+}
+
+func (s *svc) retentionDays() int {
+	if s.Config.Config != nil && s.Config.Config.RetentionDays > 0 {
+		return s.Config.Config.RetentionDays
+	}
+
+	return defaultRetentionDays
+}
+
+// RunPurge permanently removes soft-deleted vehicles past their retention window,
+// checking every interval until ctx is done. Dependent rows go with the vehicle
+// (on delete cascade); uploaded files are removed from the blob store. Rows are
+// claimed with skip locked so several instances can run this concurrently.
+func RunPurge(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := purge(ctx)
+			if err != nil {
+				glog.Errorf("purge failed: %v", err)
+			}
+
+			if err != nil || n < purgeBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purge(ctx context.Context) (int, error) {
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id from vehicles ")
+	fmt.Fprintf(&q, "where purge_after < now() ")
+	fmt.Fprintf(&q, "order by purge_after limit $1 for update skip locked")
+	rows, err := tx.Query(ctx, q.String(), purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	var keys []string
+	rows, err = tx.Query(ctx, "select blob_key from vehicle_files where vehicle_id = any($1)", ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, "delete from vehicles where id = any($1)", ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	// Only after commit; a failure here leaves an orphaned blob, not a dangling row.
+	for _, key := range keys {
+		if global.BlobStore == nil {
+			break
+		}
+
+		if err = global.BlobStore.Delete(ctx, key); err != nil {
+			glog.Errorf("Delete (%v) failed: %v", key, err)
+		}
+	}
+
+	glog.Infof("purged %v vehicles: %v", len(ids), ids)
+	return len(ids), nil
+}
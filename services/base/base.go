@@ -4,11 +4,14 @@ import (
 	"context"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/drival-ai/v10-api/detect"
 	"github.com/drival-ai/v10-api/global"
 	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/recall"
 	"github.com/drival-ai/v10-go/base/v1"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
@@ -31,65 +34,72 @@ type svc struct {
 func (s *svc) RegisterVehicle(ctx context.Context, in *base.RegisterVehicleRequest) (*emptypb.Empty, error) {
 	b, _ := json.Marshal(in)
 	glog.Infof("RegisterVehicle input=%v", string(b))
-	if in.Vehicle == nil {
-		return nil, status.Errorf(codes.InvalidArgument, "vehicle is nil")
+	if err := validateVehicle(in.Vehicle); err != nil {
+		return nil, err
 	}
+
 	// Check if vehicle already exists
-	var exist bool
-	if in.Vehicle.Vin != "" {
-		err := global.PgxPool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM vehicles WHERE vin = $1)", in.Vehicle.Vin).Scan(&exist)
-		if err != nil {
-			glog.Errorf("QueryRow failed: %v", err)
-			return nil, internal.InternalErr
-		}
-		if exist {
-			return nil, status.Errorf(codes.AlreadyExists, "vehicle already exists")
-		}
-	} else if in.Vehicle.ChassisNumber != "" {
-		err := global.PgxPool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM vehicles WHERE chassis_number = $1)", in.Vehicle.ChassisNumber).Scan(&exist)
-		if err != nil {
-			glog.Errorf("QueryRow failed: %v", err)
-			return nil, internal.InternalErr
-		}
-		if exist {
-			return nil, status.Errorf(codes.AlreadyExists, "vehicle already exists")
-		}
-	} else {
-		return nil, status.Errorf(codes.InvalidArgument, "vin and chassis number are empty")
+	exist, err := vehicleExists(ctx, global.PgxPool, in.Vehicle)
+	if err != nil {
+		glog.Errorf("vehicleExists failed: %v", err)
+		return nil, internal.InternalErr
 	}
 
-	vehicleId := uuid.New().String()
-	var q strings.Builder
-	fmt.Fprintf(&q, "insert into vehicles (id, chassis_numer, vin, ")
-	fmt.Fprintf(&q, "make, model, year, kms, user_id) ")
-	fmt.Fprintf(&q, "values (@id, @chassis_number, @vin, ")
-	fmt.Fprintf(&q, "@make, @model, @year, @kms, @user_id)")
-	args := pgx.NamedArgs{
-		"id":            vehicleId,
-		"chassis_numer": in.Vehicle.ChassisNumber,
-		"make":          in.Vehicle.Make,
-		"model":         in.Vehicle.Model,
-		"year":          in.Vehicle.Year,
-		"kms":           in.Vehicle.Kilometers,
-		"user_id":       s.Config.UserInfo.Id,
+	if exist {
+		// The caller can dispute the existing registration with claim.CreateClaim.
+		return nil, status.Errorf(codes.AlreadyExists, "vehicle already exists, file a claim if it is yours")
 	}
 
-	_, err := global.PgxPool.Exec(ctx, q.String(), args)
+	tx, err := global.PgxPool.Begin(ctx)
 	if err != nil {
-		glog.Errorf("Exec failed: %v", err)
+		glog.Errorf("Begin failed: %v", err)
 		return nil, internal.InternalErr
 	}
 
+	defer tx.Rollback(ctx)
+	vehicleId, err := insertVehicle(ctx, tx, in.Vehicle, s.Config.UserInfo.Id)
+	switch {
+	case internal.IsUniqueViolation(err):
+		// Registered concurrently since the check above.
+		return nil, status.Errorf(codes.AlreadyExists, "vehicle already exists, file a claim if it is yours")
+	case err != nil:
+		glog.Errorf("insertVehicle failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	matchRecalls(ctx, vehicleId, in.Vehicle)
+
 	glog.Info("RegisterVehicle success!")
 	return &emptypb.Empty{}, nil
 }
 
+// ListVehiclesOptions carries listing flags that base.ListVehiclesRequest doesn't have yet.
+type ListVehiclesOptions struct {
+	IncludeArchived bool `json:"includeArchived,omitempty"`
+}
+
+// ListVehicles lists the caller's vehicles, leaving out archived and deleted ones.
 func (s *svc) ListVehicles(ctx context.Context, in *base.ListVehiclesRequest) (*base.ListVehiclesResponse, error) {
+	return s.ListVehiclesWithOptions(ctx, &ListVehiclesOptions{})
+}
+
+// ListVehiclesWithOptions is ListVehicles with opt-in archived vehicles. Deleted
+// vehicles are never listed; see RestoreVehicle.
+func (s *svc) ListVehiclesWithOptions(ctx context.Context, in *ListVehiclesOptions) (*base.ListVehiclesResponse, error) {
 	var q strings.Builder
 	fmt.Fprintf(&q, "select id, chassis_number, vin, ")
 	fmt.Fprintf(&q, "make, model, year, kms ")
 	fmt.Fprintf(&q, "from vehicles ")
-	fmt.Fprintf(&q, "where user_id = $1")
+	fmt.Fprintf(&q, "where user_id = $1 and deleted_at is null")
+	if !in.IncludeArchived {
+		fmt.Fprintf(&q, " and archived_at is null")
+	}
+
 	rows, err := global.PgxPool.Query(ctx, q.String(), s.Config.UserInfo.Id)
 	if err != nil {
 		glog.Errorf("Query failed: %v", err)
@@ -118,4 +128,212 @@ func (s *svc) ListVehicles(ctx context.Context, in *base.ListVehiclesRequest) (*
 	return &base.ListVehiclesResponse{Vehicles: vehicles}, nil
 }
 
+type VehicleResponse struct {
+	Vehicle *base.Vehicle `json:"vehicle,omitempty"`
+	Plate   *Plate        `json:"plate,omitempty"` // nil if not set
+	Class   string        `json:"class,omitempty"` // car, van, truck, motorcycle
+	Etag    string        `json:"etag,omitempty"`
+}
+
+type UpdateVehicleRequest struct {
+	Vehicle *base.Vehicle `json:"vehicle,omitempty"`
+	Class   string        `json:"class,omitempty"` // optional, empty keeps the current class
+	Etag    string        `json:"etag,omitempty"`  // from GetVehicle or a previous update
+}
+
+// GetVehicle returns one of the caller's vehicles, archived ones included, with
+// the etag to pass to UpdateVehicle and DeleteVehicle.
+func (s *svc) GetVehicle(ctx context.Context, in *VehicleRequest) (*VehicleResponse, error) {
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicles ", vehicleColumns)
+	fmt.Fprintf(&q, "where id = $1 and user_id = $2 and deleted_at is null")
+	out, err := scanVehicle(global.PgxPool.QueryRow(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// UpdateVehicle replaces the vehicle's make, model, year and odometer. The VIN and
+// chassis number identify the vehicle and can't be changed. The etag is required
+// so that concurrent edits (say, two family members) don't silently overwrite
+// each other; a stale one fails with Aborted.
+func (s *svc) UpdateVehicle(ctx context.Context, in *UpdateVehicleRequest) (*VehicleResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("UpdateVehicle input=%v", string(b))
+	switch {
+	case in.Vehicle == nil:
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle is nil")
+	case in.Vehicle.Id == "":
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	case in.Etag == "":
+		return nil, status.Errorf(codes.InvalidArgument, "etag is empty")
+	case in.Vehicle.Kilometers < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "kilometers must not be negative")
+	case in.Class != "" && !detect.ValidClass(in.Class):
+		return nil, status.Errorf(codes.InvalidArgument, "class must be one of %v", strings.Join(detect.Classes, ", "))
+	}
+
+	version, err := internal.ParseEtag(in.Etag)
+	if err != nil {
+		return nil, err
+	}
+
+	args := pgx.NamedArgs{
+		"id":      in.Vehicle.Id,
+		"user_id": s.Config.UserInfo.Id,
+		"version": version,
+		"make":    in.Vehicle.Make,
+		"model":   in.Vehicle.Model,
+		"year":    in.Vehicle.Year,
+		"kms":     in.Vehicle.Kilometers,
+		"class":   nil,
+	}
+
+	if in.Class != "" {
+		args["class"] = in.Class
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicles set make = @make, model = @model, year = @year, ")
+	fmt.Fprintf(&q, "kms = @kms, vehicle_class = coalesce(@class, vehicle_class), version = version + 1 ")
+	fmt.Fprintf(&q, "where id = @id and user_id = @user_id and deleted_at is null ")
+	fmt.Fprintf(&q, "and version = @version ")
+	fmt.Fprintf(&q, "returning %v", vehicleColumns)
+	out, err := scanVehicle(global.PgxPool.QueryRow(ctx, q.String(), args))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, s.updateMissed(ctx, in.Vehicle.Id, args)
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	glog.Infof("UpdateVehicle success! vehicle=%v, etag=%v", out.Vehicle.Id, out.Etag)
+	return out, nil
+}
+
+const vehicleColumns = "id, chassis_number, vin, make, model, year, kms, version, " +
+	"plate_number, plate_country, plate_region, vehicle_class"
+
+func scanVehicle(row pgx.Row) (*VehicleResponse, error) {
+	var v base.Vehicle
+	var version int64
+	var number, country *string
+	var region, class string
+	err := row.Scan(&v.Id, &v.ChassisNumber, &v.Vin, &v.Make, &v.Model, &v.Year,
+		&v.Kilometers, &version, &number, &country, &region, &class)
+	if err != nil {
+		return nil, err
+	}
+
+	out := VehicleResponse{Vehicle: &v, Class: class, Etag: internal.Etag(version)}
+	if number != nil && country != nil {
+		out.Plate = &Plate{Number: *number, Country: *country, Region: region}
+	}
+
+	return &out, nil
+}
+
+// querier is satisfied by both the pool and transactions.
+type querier interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+// validateVehicle holds the input rules shared by all vehicle registration paths.
+// VINs and chassis numbers are stored uppercase, so that duplicates are found
+// whatever case they're entered in.
+func validateVehicle(v *base.Vehicle) error {
+	if v != nil {
+		v.Vin = strings.ToUpper(strings.TrimSpace(v.Vin))
+		v.ChassisNumber = strings.ToUpper(strings.TrimSpace(v.ChassisNumber))
+	}
+
+	switch {
+	case v == nil:
+		return status.Errorf(codes.InvalidArgument, "vehicle is nil")
+	case v.Vin == "" && v.ChassisNumber == "":
+		return status.Errorf(codes.InvalidArgument, "vin and chassis number are empty")
+	}
+
+	return nil
+}
+
+// vehicleExists checks the VIN, or the chassis number when there's no VIN,
+// against all known vehicles. Soft-deleted vehicles still count until purged.
+func vehicleExists(ctx context.Context, db querier, v *base.Vehicle) (bool, error) {
+	var exist bool
+	var err error
+	if v.Vin != "" {
+		err = db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM vehicles WHERE vin = $1)", v.Vin).Scan(&exist)
+	} else {
+		err = db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM vehicles WHERE chassis_number = $1)", v.ChassisNumber).Scan(&exist)
+	}
+
+	return exist, err
+}
+
+// insertVehicle adds the vehicle under userId and opens its first ownership
+// period (see transfer.MoveOwnership). Returns the new vehicle id.
+func insertVehicle(ctx context.Context, tx pgx.Tx, v *base.Vehicle, userId string) (string, error) {
+	vehicleId := uuid.New().String()
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicles (id, chassis_number, vin, ")
+	fmt.Fprintf(&q, "make, model, year, kms, user_id) ")
+	fmt.Fprintf(&q, "values (@id, @chassis_number, @vin, ")
+	fmt.Fprintf(&q, "@make, @model, @year, @kms, @user_id)")
+	args := pgx.NamedArgs{
+		"id":             vehicleId,
+		"chassis_number": v.ChassisNumber,
+		"vin":            v.Vin,
+		"make":           v.Make,
+		"model":          v.Model,
+		"year":           v.Year,
+		"kms":            v.Kilometers,
+		"user_id":        userId,
+	}
+
+	_, err := tx.Exec(ctx, q.String(), args)
+	if err != nil {
+		return "", err
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into vehicle_ownerships (vehicle_id, user_id, start_kms) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3)")
+	_, err = tx.Exec(ctx, q.String(), vehicleId, userId, v.Kilometers)
+	if err != nil {
+		return "", err
+	}
+
+	return vehicleId, nil
+}
+
+// matchRecalls checks a newly registered vehicle against the recall dataset.
+// Failures are only logged; the next dataset reload matches it again.
+func matchRecalls(ctx context.Context, vehicleId string, v *base.Vehicle) {
+	m := base.Vehicle{
+		Id:            vehicleId,
+		ChassisNumber: v.ChassisNumber,
+		Vin:           v.Vin,
+		Make:          v.Make,
+		Model:         v.Model,
+		Year:          v.Year,
+		Kilometers:    v.Kilometers,
+	}
+
+	if err := recall.MatchVehicle(ctx, &m); err != nil {
+		glog.Errorf("MatchVehicle failed: %v", err)
+	}
+}
+
 func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,380 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-go/base/v1"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 5000
+)
+
+type ImportMode int32
+
+const (
+	// Nothing is written unless every row is valid and inserted.
+	ImportAllOrNothing ImportMode = iota
+	// Valid rows are written, invalid ones are reported and skipped.
+	ImportBestEffort
+)
+
+// ImportVehiclesRequest is one message of the import stream. The CSV payload
+// may be split across any number of messages; options are read from the first.
+type ImportVehiclesRequest struct {
+	Data   []byte     `json:"data,omitempty"`
+	DryRun bool       `json:"dryRun,omitempty"`
+	Mode   ImportMode `json:"mode,omitempty"`
+}
+
+type ImportRowResult struct {
+	Line          int32  `json:"line,omitempty"`
+	Vin           string `json:"vin,omitempty"`
+	ChassisNumber string `json:"chassisNumber,omitempty"`
+	VehicleId     string `json:"vehicleId,omitempty"` // empty on dry runs
+	Ok            bool   `json:"ok,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type ImportVehiclesResponse struct {
+	DryRun    bool               `json:"dryRun,omitempty"`
+	Committed bool               `json:"committed,omitempty"`
+	Total     int32              `json:"total,omitempty"`
+	Succeeded int32              `json:"succeeded,omitempty"`
+	Failed    int32              `json:"failed,omitempty"`
+	Rows      []*ImportRowResult `json:"rows,omitempty"`
+}
+
+// ImportVehiclesServer is the server side of the client-streaming import RPC.
+type ImportVehiclesServer interface {
+	Context() context.Context
+	Recv() (*ImportVehiclesRequest, error)
+	SendAndClose(*ImportVehiclesResponse) error
+}
+
+type importRow struct {
+	result  *ImportRowResult
+	vehicle *base.Vehicle
+}
+
+// ImportVehicles registers vehicles in bulk from CSV with columns vin,
+// chassis_number, make, model, year, km. A header row is optional; when present,
+// columns are matched by name instead of position. Every row goes through the
+// same checks as RegisterVehicle.
+func (s *svc) ImportVehicles(stream ImportVehiclesServer) error {
+	ctx := stream.Context()
+	var opts *ImportVehiclesRequest
+	var data bytes.Buffer
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			glog.Errorf("Recv failed: %v", err)
+			return err
+		}
+
+		if opts == nil {
+			opts = in
+		}
+
+		if data.Len()+len(in.Data) > maxImportBytes {
+			return status.Errorf(codes.ResourceExhausted, "import exceeds %v bytes", maxImportBytes)
+		}
+
+		data.Write(in.Data)
+	}
+
+	if opts == nil || data.Len() == 0 {
+		return status.Errorf(codes.InvalidArgument, "no data")
+	}
+
+	glog.Infof("ImportVehicles: user=%v, bytes=%v, dryRun=%v, mode=%v",
+		s.Config.UserInfo.Id, data.Len(), opts.DryRun, opts.Mode)
+
+	rows, err := parseImport(&data)
+	if err != nil {
+		return err
+	}
+
+	out := ImportVehiclesResponse{DryRun: opts.DryRun, Total: int32(len(rows))}
+	for _, r := range rows {
+		out.Rows = append(out.Rows, r.result)
+	}
+
+	err = s.checkImportRows(ctx, rows)
+	if err != nil {
+		return err
+	}
+
+	invalid := countFailed(rows)
+	switch {
+	case opts.DryRun:
+	case opts.Mode == ImportAllOrNothing && invalid > 0:
+	default:
+		out.Committed, err = s.commitImport(ctx, rows, opts.Mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	out.Failed = int32(countFailed(rows))
+	out.Succeeded = out.Total - out.Failed
+	if !opts.DryRun && !out.Committed {
+		// Rows inserted before a failure were rolled back with the rest.
+		out.Succeeded = 0
+		for _, r := range rows {
+			r.result.VehicleId = ""
+		}
+	}
+
+	glog.Infof("ImportVehicles done: total=%v, ok=%v, failed=%v, committed=%v",
+		out.Total, out.Succeeded, out.Failed, out.Committed)
+
+	return stream.SendAndClose(&out)
+}
+
+// checkImportRows validates rows against the registration rules, against each
+// other, and against existing vehicles. Failures are recorded on the row results.
+func (s *svc) checkImportRows(ctx context.Context, rows []*importRow) error {
+	seen := map[string]int32{}
+	for _, r := range rows {
+		if !r.result.Ok {
+			continue
+		}
+
+		err := validateVehicle(r.vehicle)
+		r.result.Vin, r.result.ChassisNumber = r.vehicle.Vin, r.vehicle.ChassisNumber
+		if err != nil {
+			failRow(r, err)
+			continue
+		}
+
+		key := "vin:" + r.vehicle.Vin
+		if r.vehicle.Vin == "" {
+			key = "chassis:" + r.vehicle.ChassisNumber
+		}
+
+		if line, ok := seen[key]; ok {
+			failRow(r, fmt.Errorf("duplicate of line %v", line))
+			continue
+		}
+
+		seen[key] = r.result.Line
+		exist, err := vehicleExists(ctx, global.PgxPool, r.vehicle)
+		if err != nil {
+			glog.Errorf("vehicleExists failed: %v", err)
+			return internal.InternalErr
+		}
+
+		if exist {
+			failRow(r, status.Errorf(codes.AlreadyExists, "vehicle already exists"))
+		}
+	}
+
+	return nil
+}
+
+// commitImport inserts the valid rows. In best-effort mode each row gets its own
+// savepoint so one failure doesn't abort the others; in all-or-nothing mode any
+// failure rolls back everything. Returns whether the transaction was committed.
+func (s *svc) commitImport(ctx context.Context, rows []*importRow, mode ImportMode) (bool, error) {
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return false, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	for _, r := range rows {
+		if !r.result.Ok {
+			continue
+		}
+
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			glog.Errorf("Begin (savepoint) failed: %v", err)
+			return false, internal.InternalErr
+		}
+
+		id, err := insertVehicle(ctx, sp, r.vehicle, s.Config.UserInfo.Id)
+		if err == nil {
+			err = sp.Commit(ctx)
+		}
+
+		if err != nil {
+			sp.Rollback(ctx)
+			if internal.IsUniqueViolation(err) {
+				failRow(r, status.Errorf(codes.AlreadyExists, "vehicle already exists"))
+			} else {
+				glog.Errorf("insertVehicle failed (line %v): %v", r.result.Line, err)
+				failRow(r, errors.New("insert failed"))
+			}
+
+			if mode == ImportAllOrNothing {
+				return false, nil
+			}
+
+			continue
+		}
+
+		r.result.VehicleId = id
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return false, internal.InternalErr
+	}
+
+	for _, r := range rows {
+		if r.result.VehicleId != "" {
+			matchRecalls(ctx, r.result.VehicleId, r.vehicle)
+		}
+	}
+
+	return true, nil
+}
+
+// parseImport reads the CSV payload into rows. Field-level errors (e.g. a
+// non-numeric year) are recorded per row; only unreadable input fails the call.
+func parseImport(r io.Reader) ([]*importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid csv: %v", err)
+	}
+
+	cols := map[string]int{"vin": 0, "chassis_number": 1, "make": 2, "model": 3, "year": 4, "km": 5}
+	first := 0
+	if len(records) > 0 && isImportHeader(records[0]) {
+		cols = map[string]int{}
+		for i, v := range records[0] {
+			if name, ok := importColumn(v); ok {
+				cols[name] = i
+			}
+		}
+
+		first = 1
+	}
+
+	if len(records)-first > maxImportRows {
+		return nil, status.Errorf(codes.InvalidArgument, "import exceeds %v rows", maxImportRows)
+	}
+
+	field := func(rec []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+
+		return strings.TrimSpace(rec[i])
+	}
+
+	var rows []*importRow
+	for i, rec := range records[first:] {
+		r := importRow{
+			result: &ImportRowResult{Line: int32(i + first + 1), Ok: true},
+			vehicle: &base.Vehicle{
+				Vin:           field(rec, "vin"),
+				ChassisNumber: field(rec, "chassis_number"),
+				Make:          field(rec, "make"),
+				Model:         field(rec, "model"),
+			},
+		}
+
+		r.result.Vin = r.vehicle.Vin
+		r.result.ChassisNumber = r.vehicle.ChassisNumber
+		rows = append(rows, &r)
+		if v := field(rec, "year"); v != "" {
+			year, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				failRow(&r, fmt.Errorf("invalid year %q", v))
+				continue
+			}
+
+			r.vehicle.Year = int32(year)
+		}
+
+		if v := field(rec, "km"); v != "" {
+			km, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || km < 0 {
+				failRow(&r, fmt.Errorf("invalid km %q", v))
+				continue
+			}
+
+			r.vehicle.Kilometers = int32(km)
+		}
+	}
+
+	return rows, nil
+}
+
+func isImportHeader(rec []string) bool {
+	for _, v := range rec {
+		if _, ok := importColumn(v); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// importColumn maps accepted header spellings to canonical column names.
+func importColumn(v string) (string, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	v = strings.NewReplacer(" ", "_", "-", "_").Replace(v)
+	switch v {
+	case "vin":
+		return "vin", true
+	case "chassis_number", "chassis_no", "chassis":
+		return "chassis_number", true
+	case "make":
+		return "make", true
+	case "model":
+		return "model", true
+	case "year":
+		return "year", true
+	case "km", "kms", "kilometers", "odometer":
+		return "km", true
+	}
+
+	return "", false
+}
+
+func failRow(r *importRow, err error) {
+	r.result.Ok = false
+	if st, ok := status.FromError(err); ok {
+		r.result.Error = st.Message()
+		return
+	}
+
+	r.result.Error = err.Error()
+}
+
+func countFailed(rows []*importRow) int {
+	var n int
+	for _, r := range rows {
+		if !r.result.Ok {
+			n++
+		}
+	}
+
+	return n
+}
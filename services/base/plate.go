@@ -0,0 +1,225 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/plate"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Plate struct {
+	Number    string    `json:"number,omitempty"`  // normalized, e.g. AB12CDE
+	Country   string    `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	Region    string    `json:"region,omitempty"`  // state, province, prefecture; optional
+	StartedAt time.Time `json:"startedAt,omitempty"`
+	EndedAt   time.Time `json:"endedAt,omitempty"` // zero for the current plate
+}
+
+type SetVehiclePlateRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+	Number    string `json:"number,omitempty"` // empty to remove the plate
+	Country   string `json:"country,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Etag      string `json:"etag,omitempty"` // optional; the call fails with Aborted if stale
+}
+
+type LookupVehicleByPlateRequest struct {
+	Number  string `json:"number,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+type ListPlateHistoryResponse struct {
+	Plates []*Plate `json:"plates,omitempty"` // oldest first
+}
+
+// SetVehiclePlate sets, changes or removes a vehicle's license plate. The old
+// plate is kept in the vehicle's plate history.
+func (s *svc) SetVehiclePlate(ctx context.Context, in *SetVehiclePlateRequest) (*VehicleResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("SetVehiclePlate input=%v", string(b))
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	var number, country *string
+	region := plate.NormalizeRegion(in.Region)
+	if strings.TrimSpace(in.Number) != "" {
+		c, err := plate.NormalizeCountry(in.Country)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid country %q", in.Country)
+		}
+
+		n, err := plate.Normalize(c, in.Number)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid plate number %q for %v", in.Number, c)
+		}
+
+		number, country = &n, &c
+	} else {
+		region = ""
+	}
+
+	args, err := s.stateArgs(&VehicleRequest{VehicleId: in.VehicleId, Etag: in.Etag})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicles ", vehicleColumns)
+	fmt.Fprintf(&q, "where id = @id and user_id = @user_id and deleted_at is null for update")
+	cur, err := scanVehicle(tx.QueryRow(ctx, q.String(), args))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	case in.Etag != "" && internal.Etag(args["version"].(int64)) != cur.Etag:
+		return nil, internal.EtagMismatchErr
+	case samePlate(cur.Plate, number, country, region):
+		return cur, nil
+	}
+
+	args["number"], args["country"], args["region"] = number, country, region
+	q.Reset()
+	fmt.Fprintf(&q, "update vehicles set plate_number = @number, plate_country = @country, ")
+	fmt.Fprintf(&q, "plate_region = @region, version = version + 1 ")
+	fmt.Fprintf(&q, "where id = @id returning %v", vehicleColumns)
+	out, err := scanVehicle(tx.QueryRow(ctx, q.String(), args))
+	switch {
+	case internal.IsUniqueViolation(err):
+		return nil, status.Errorf(codes.AlreadyExists, "plate is registered to another vehicle")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	_, err = tx.Exec(ctx, "update vehicle_plates set ended_at = now() "+
+		"where vehicle_id = $1 and ended_at is null", in.VehicleId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if number != nil {
+		q.Reset()
+		fmt.Fprintf(&q, "insert into vehicle_plates (id, vehicle_id, user_id, ")
+		fmt.Fprintf(&q, "plate_number, plate_country, plate_region) ")
+		fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6)")
+		_, err = tx.Exec(ctx, q.String(), uuid.NewString(), in.VehicleId,
+			s.Config.UserInfo.Id, *number, *country, region)
+		if err != nil {
+			glog.Errorf("Exec failed: %v", err)
+			return nil, internal.InternalErr
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// LookupVehicleByPlate finds a vehicle the caller can see, directly or through an
+// org, by its plate. The number is normalized first, so separators don't matter.
+func (s *svc) LookupVehicleByPlate(ctx context.Context, in *LookupVehicleByPlateRequest) (*VehicleResponse, error) {
+	country, err := plate.NormalizeCountry(in.Country)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid country %q", in.Country)
+	}
+
+	number, err := plate.Normalize(country, in.Number)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid plate number %q for %v", in.Number, country)
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicles v ", vehicleColumns)
+	fmt.Fprintf(&q, "where v.plate_country = @country and v.plate_number = @number ")
+	fmt.Fprintf(&q, "and v.deleted_at is null and %v", visibleVehicles)
+	args := pgx.NamedArgs{
+		"user_id": s.Config.UserInfo.Id,
+		"country": country,
+		"number":  number,
+	}
+
+	out, err := scanVehicle(global.PgxPool.QueryRow(ctx, q.String(), args))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// ListPlateHistory returns the plates recorded for a vehicle the caller can see,
+// including those from before it was transferred to them.
+func (s *svc) ListPlateHistory(ctx context.Context, in *VehicleRequest) (*ListPlateHistoryResponse, error) {
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select plate_number, plate_country, plate_region, started_at, ended_at ")
+	fmt.Fprintf(&q, "from vehicle_plates where vehicle_id = $1 order by started_at")
+	rows, err := global.PgxPool.Query(ctx, q.String(), in.VehicleId)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListPlateHistoryResponse
+	for rows.Next() {
+		var p Plate
+		var ended *time.Time
+		if err = rows.Scan(&p.Number, &p.Country, &p.Region, &p.StartedAt, &ended); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if ended != nil {
+			p.EndedAt = *ended
+		}
+
+		out.Plates = append(out.Plates, &p)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+func samePlate(cur *Plate, number, country *string, region string) bool {
+	if cur == nil || number == nil {
+		return cur == nil && number == nil
+	}
+
+	return cur.Number == *number && cur.Country == *country && cur.Region == region
+}
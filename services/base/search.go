@@ -0,0 +1,214 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-go/base/v1"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	minQueryLen        = 2
+	maxQueryLen        = 64
+
+	// Same as pg_trgm's default word_similarity_threshold, used by <% below.
+	fuzzyThreshold = 0.6
+
+	hlStart = "<em>"
+	hlEnd   = "</em>"
+)
+
+type SearchVehiclesRequest struct {
+	Query string `json:"query,omitempty"`
+	OrgId string `json:"orgId,omitempty"` // optional, only this org's vehicles
+	Limit int32  `json:"limit,omitempty"` // default 20
+}
+
+type Highlight struct {
+	Field    string `json:"field,omitempty"`    // vin, chassisNumber, make, model, plateNumber
+	Fragment string `json:"fragment,omitempty"` // field value with matches in <em></em>
+}
+
+type SearchHit struct {
+	Vehicle    *base.Vehicle `json:"vehicle,omitempty"`
+	Plate      *Plate        `json:"plate,omitempty"`
+	OrgId      string        `json:"orgId,omitempty"`
+	Archived   bool          `json:"archived,omitempty"`
+	Score      float64       `json:"score,omitempty"`
+	Highlights []*Highlight  `json:"highlights,omitempty"`
+}
+
+type SearchVehiclesResponse struct {
+	Hits []*SearchHit `json:"hits,omitempty"`
+}
+
+// visibleVehicles limits a query on vehicles v to the ones the caller (@user_id)
+// may see: their own, and those of any org they're a member of.
+const visibleVehicles = "(v.user_id = @user_id or v.org_id in " +
+	"(select m.org_id from org_members m where m.user_id = @user_id))"
+
+// SearchVehicles finds vehicles by partial or misspelled VIN, chassis number,
+// make, model or plate, best matches first. Substring matches rank above fuzzy ones.
+// Archived vehicles are included and flagged; deleted ones are not.
+func (s *svc) SearchVehicles(ctx context.Context, in *SearchVehiclesRequest) (*SearchVehiclesResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("SearchVehicles input=%v", string(b))
+	query := strings.ToLower(strings.Join(strings.Fields(in.Query), " "))
+	switch n := utf8.RuneCountInString(query); {
+	case n < minQueryLen:
+		return nil, status.Errorf(codes.InvalidArgument, "query must have at least %v characters", minQueryLen)
+	case n > maxQueryLen:
+		return nil, status.Errorf(codes.InvalidArgument, "query must have at most %v characters", maxQueryLen)
+	}
+
+	limit := in.Limit
+	switch {
+	case limit == 0:
+		limit = defaultSearchLimit
+	case limit < 0 || limit > maxSearchLimit:
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %v", maxSearchLimit)
+	}
+
+	// Plates are stored without separators, so match them against the query
+	// normalized the same way: "ab-12" finds AB12CDE.
+	platePart := plateQuery(query)
+	args := pgx.NamedArgs{
+		"user_id": s.Config.UserInfo.Id,
+		"q":       query,
+		"qp":      platePart,
+		"pattern": "%" + escapeLike(query) + "%",
+		"plate":   "%" + escapeLike(platePart) + "%",
+		"limit":   limit,
+	}
+
+	if platePart == "" {
+		args["plate"] = nil // like null never matches
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, chassis_number, vin, make, model, year, kms, ")
+	fmt.Fprintf(&q, "plate_number, plate_country, plate_region, org_id, archived, ")
+	fmt.Fprintf(&q, "greatest(s_vin, s_chassis, s_make, s_model, s_plate) + ")
+	fmt.Fprintf(&q, "case when search_text like @pattern or lower(plate_number) like @plate ")
+	fmt.Fprintf(&q, "then 1 else 0 end as score, ")
+	fmt.Fprintf(&q, "s_vin, s_chassis, s_make, s_model, s_plate ")
+	fmt.Fprintf(&q, "from (select v.*, v.archived_at is not null as archived, ")
+	fmt.Fprintf(&q, "word_similarity(@q, lower(coalesce(v.vin, ''))) as s_vin, ")
+	fmt.Fprintf(&q, "word_similarity(@q, lower(coalesce(v.chassis_number, ''))) as s_chassis, ")
+	fmt.Fprintf(&q, "word_similarity(@q, lower(coalesce(v.make, ''))) as s_make, ")
+	fmt.Fprintf(&q, "word_similarity(@q, lower(coalesce(v.model, ''))) as s_model, ")
+	fmt.Fprintf(&q, "word_similarity(@qp, lower(coalesce(v.plate_number, ''))) as s_plate ")
+	fmt.Fprintf(&q, "from vehicles v where v.deleted_at is null and %v ", visibleVehicles)
+	fmt.Fprintf(&q, "and (v.search_text like @pattern or @q <%% v.search_text ")
+	fmt.Fprintf(&q, "or lower(v.plate_number) like @plate) ")
+	if in.OrgId != "" {
+		fmt.Fprintf(&q, "and v.org_id = @org_id ")
+		args["org_id"] = in.OrgId
+	}
+
+	fmt.Fprintf(&q, ") c order by score desc, id limit @limit")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out SearchVehiclesResponse
+	for rows.Next() {
+		var v base.Vehicle
+		var hit SearchHit
+		var number, country, orgId *string
+		var region string
+		var sim [5]float64
+		err = rows.Scan(&v.Id, &v.ChassisNumber, &v.Vin, &v.Make, &v.Model, &v.Year,
+			&v.Kilometers, &number, &country, &region, &orgId, &hit.Archived, &hit.Score,
+			&sim[0], &sim[1], &sim[2], &sim[3], &sim[4])
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if orgId != nil {
+			hit.OrgId = *orgId
+		}
+
+		var plateNumber string
+		if number != nil && country != nil {
+			hit.Plate = &Plate{Number: *number, Country: *country, Region: region}
+			plateNumber = *number
+		}
+
+		fields := []struct {
+			name, value, query string
+			sim                float64
+		}{
+			{"vin", v.Vin, query, sim[0]},
+			{"chassisNumber", v.ChassisNumber, query, sim[1]},
+			{"make", v.Make, query, sim[2]},
+			{"model", v.Model, query, sim[3]},
+			{"plateNumber", plateNumber, platePart, sim[4]},
+		}
+
+		for _, f := range fields {
+			if h := highlight(f.value, f.query, f.sim); h != "" {
+				hit.Highlights = append(hit.Highlights, &Highlight{Field: f.name, Fragment: h})
+			}
+		}
+
+		hit.Vehicle = &v
+		out.Hits = append(out.Hits, &hit)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// highlight marks where query occurs in value. A fuzzy-only match (similarity
+// at or above the search threshold but no exact occurrence) marks the whole
+// value. Returns "" if the field didn't match.
+func highlight(value, query string, sim float64) string {
+	lower := strings.ToLower(value)
+	if i := strings.Index(lower, query); i >= 0 && len(lower) == len(value) {
+		j := i + len(query)
+		return value[:i] + hlStart + value[i:j] + hlEnd + value[j:]
+	}
+
+	if value != "" && sim >= fuzzyThreshold {
+		return hlStart + value + hlEnd
+	}
+
+	return ""
+}
+
+// plateQuery strips separators from query like plate.Normalize does.
+func plateQuery(query string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+
+		return -1
+	}, query)
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
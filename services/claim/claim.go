@@ -0,0 +1,569 @@
+package claim
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/notify"
+	"github.com/drival-ai/v10-api/services/media"
+	"github.com/drival-ai/v10-api/services/transfer"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	StatusOpen      = "open"
+	StatusDisputed  = "disputed"  // the owner contests the claim; support decides
+	StatusReleased  = "released"  // the owner handed the vehicle over
+	StatusApproved  = "approved"  // support gave the vehicle to the claimant
+	StatusRejected  = "rejected"  // support kept the vehicle with its owner
+	StatusWithdrawn = "withdrawn" // the claimant gave up
+
+	RoleClaimant = "claimant"
+	RoleOwner    = "owner"
+	RoleAdmin    = "admin"
+
+	maxReasonLen = 2000
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type Event struct {
+	Status    string    `json:"status,omitempty"`
+	ActorRole string    `json:"actorRole,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+type Claim struct {
+	Id            string    `json:"id,omitempty"`
+	VehicleId     string    `json:"vehicleId,omitempty"` // only shown to the owner and admins
+	Vin           string    `json:"vin,omitempty"`
+	ChassisNumber string    `json:"chassisNumber,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	Role          string    `json:"role,omitempty"` // the caller's role in this claim
+	CreatedAt     time.Time `json:"createdAt,omitempty"`
+	UpdatedAt     time.Time `json:"updatedAt,omitempty"`
+
+	// Only filled in by GetClaim.
+	Events []*Event             `json:"events,omitempty"`
+	Files  []*media.VehicleFile `json:"files,omitempty"`
+}
+
+type CreateClaimRequest struct {
+	Vin           string `json:"vin,omitempty"`
+	ChassisNumber string `json:"chassisNumber,omitempty"` // used if there's no VIN
+	Reason        string `json:"reason,omitempty"`
+}
+
+type ClaimRequest struct {
+	ClaimId string `json:"claimId,omitempty"`
+	Note    string `json:"note,omitempty"` // optional, recorded with the transition
+}
+
+type ListClaimsRequest struct {
+	All    bool   `json:"all,omitempty"`    // admins only: every claim, not just the caller's
+	Status string `json:"status,omitempty"` // optional filter
+}
+
+type ListClaimsResponse struct {
+	Claims []*Claim `json:"claims,omitempty"`
+}
+
+type ResolveClaimRequest struct {
+	ClaimId string `json:"claimId,omitempty"`
+	Approve bool   `json:"approve,omitempty"` // true gives the vehicle to the claimant
+	Note    string `json:"note,omitempty"`
+}
+
+// CreateClaim disputes the registration of a vehicle by someone else, i.e. after
+// RegisterVehicle failed with AlreadyExists. The current owner is notified and
+// can release the vehicle or dispute the claim; support resolves disputes.
+// Supporting documents are uploaded with media.UploadVehicleFile and the claim id.
+func (s *svc) CreateClaim(ctx context.Context, in *CreateClaimRequest) (*Claim, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateClaim input=%v", string(b))
+	in.Vin = strings.ToUpper(strings.TrimSpace(in.Vin)) // stored uppercase, see base.validateVehicle
+	in.ChassisNumber = strings.ToUpper(strings.TrimSpace(in.ChassisNumber))
+	in.Reason = strings.TrimSpace(in.Reason)
+	switch {
+	case in.Vin == "" && in.ChassisNumber == "":
+		return nil, status.Errorf(codes.InvalidArgument, "vin and chassis number are empty")
+	case in.Reason == "":
+		return nil, status.Errorf(codes.InvalidArgument, "reason is empty")
+	case len(in.Reason) > maxReasonLen:
+		return nil, status.Errorf(codes.InvalidArgument, "reason exceeds %v characters", maxReasonLen)
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+
+	// Same matching as the registration uniqueness check, deleted vehicles included.
+	var vehicleId, ownerId, name string
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, user_id, trim(coalesce(make, '') || ' ' || coalesce(model, '')) ")
+	if in.Vin != "" {
+		fmt.Fprintf(&q, "from vehicles where vin = $1")
+	} else {
+		fmt.Fprintf(&q, "from vehicles where chassis_number = $1")
+	}
+
+	err = tx.QueryRow(ctx, q.String(), in.Vin+in.ChassisNumber).Scan(&vehicleId, &ownerId, &name)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found, register it instead")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if ownerId == s.Config.UserInfo.Id {
+		return nil, status.Errorf(codes.FailedPrecondition, "you already own this vehicle")
+	}
+
+	c := Claim{
+		Id:            uuid.NewString(),
+		Vin:           in.Vin,
+		ChassisNumber: in.ChassisNumber,
+		Reason:        in.Reason,
+		Status:        StatusOpen,
+		Role:          RoleClaimant,
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into vehicle_claims (id, vehicle_id, claimant_id, owner_id, ")
+	fmt.Fprintf(&q, "vin, chassis_number, reason) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @claimant_id, @owner_id, ")
+	fmt.Fprintf(&q, "@vin, @chassis_number, @reason) ")
+	fmt.Fprintf(&q, "returning created_at, updated_at")
+	args := pgx.NamedArgs{
+		"id":             c.Id,
+		"vehicle_id":     vehicleId,
+		"claimant_id":    s.Config.UserInfo.Id,
+		"owner_id":       ownerId,
+		"vin":            c.Vin,
+		"chassis_number": c.ChassisNumber,
+		"reason":         c.Reason,
+	}
+
+	err = tx.QueryRow(ctx, q.String(), args).Scan(&c.CreatedAt, &c.UpdatedAt)
+	switch {
+	case internal.IsUniqueViolation(err):
+		return nil, status.Errorf(codes.AlreadyExists, "you already have an open claim for this vehicle")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	err = recordEvent(ctx, tx, c.Id, StatusOpen, s.Config.UserInfo.Id, RoleClaimant, "")
+	if err != nil {
+		glog.Errorf("recordEvent failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	notifyUser(ctx, ownerId, c.Id, StatusOpen, "Someone claimed your vehicle",
+		fmt.Sprintf("%v: another user says this vehicle is theirs. You can release it or dispute the claim.", name))
+
+	glog.Infof("CreateClaim success! claim=%v, vehicle=%v", c.Id, vehicleId)
+	return &c, nil
+}
+
+// WithdrawClaim closes a claim filed by the caller.
+func (s *svc) WithdrawClaim(ctx context.Context, in *ClaimRequest) (*Claim, error) {
+	return s.transition(ctx, "WithdrawClaim", in.ClaimId, RoleClaimant, StatusWithdrawn, in.Note)
+}
+
+// ReleaseVehicle lets the vehicle's owner accept a claim. The vehicle moves to
+// the claimant the same way a redeemed transfer does.
+func (s *svc) ReleaseVehicle(ctx context.Context, in *ClaimRequest) (*Claim, error) {
+	return s.transition(ctx, "ReleaseVehicle", in.ClaimId, RoleOwner, StatusReleased, in.Note)
+}
+
+// DisputeClaim lets the vehicle's owner contest a claim, leaving it to support.
+func (s *svc) DisputeClaim(ctx context.Context, in *ClaimRequest) (*Claim, error) {
+	return s.transition(ctx, "DisputeClaim", in.ClaimId, RoleOwner, StatusDisputed, in.Note)
+}
+
+// ResolveClaim lets an admin settle a claim either way. A note is required since
+// it is the only record of why.
+func (s *svc) ResolveClaim(ctx context.Context, in *ResolveClaimRequest) (*Claim, error) {
+	if strings.TrimSpace(in.Note) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "note is empty")
+	}
+
+	to := StatusRejected
+	if in.Approve {
+		to = StatusApproved
+	}
+
+	return s.transition(ctx, "ResolveClaim", in.ClaimId, RoleAdmin, to, in.Note)
+}
+
+func (s *svc) GetClaim(ctx context.Context, in *ClaimRequest) (*Claim, error) {
+	if in.ClaimId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "claim id is empty")
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicle_claims c ", claimColumns)
+	fmt.Fprintf(&q, "join vehicles v on v.id = c.vehicle_id ")
+	fmt.Fprintf(&q, "where c.id = $1")
+	c, ownerId, claimantId, err := scanClaim(global.PgxPool.QueryRow(ctx, q.String(), in.ClaimId))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "claim not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if !s.view(c, ownerId, claimantId) {
+		return nil, status.Errorf(codes.NotFound, "claim not found")
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "select status, actor_role, note, created_at ")
+	fmt.Fprintf(&q, "from vehicle_claim_events where claim_id = $1 order by id")
+	rows, err := global.PgxPool.Query(ctx, q.String(), c.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		if err = rows.Scan(&e.Status, &e.ActorRole, &e.Note, &e.CreatedAt); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		c.Events = append(c.Events, &e)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	// Evidence is for support and the claimant; owners don't get the documents.
+	if c.Role == RoleOwner {
+		return c, nil
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "select id, kind, filename, content_type, size_bytes, sha256, created_at ")
+	fmt.Fprintf(&q, "from vehicle_files where claim_id = $1 order by created_at")
+	rows, err = global.PgxPool.Query(ctx, q.String(), c.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := media.VehicleFile{VehicleId: c.VehicleId, ClaimId: c.Id}
+		err = rows.Scan(&f.Id, &f.Kind, &f.Filename, &f.ContentType, &f.Size, &f.Sha256, &f.CreatedAt)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		c.Files = append(c.Files, &f)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return c, nil
+}
+
+// ListClaims returns claims filed by the caller and claims on vehicles they own,
+// newest first. Admins can list all claims.
+func (s *svc) ListClaims(ctx context.Context, in *ListClaimsRequest) (*ListClaimsResponse, error) {
+	admin := internal.IsAdmin(s.Config.Config, s.Config.UserInfo)
+	if in.All && !admin {
+		return nil, status.Errorf(codes.PermissionDenied, "admin only")
+	}
+
+	args := pgx.NamedArgs{"user_id": s.Config.UserInfo.Id}
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicle_claims c ", claimColumns)
+	fmt.Fprintf(&q, "join vehicles v on v.id = c.vehicle_id where true ")
+	if !in.All {
+		fmt.Fprintf(&q, "and (c.claimant_id = @user_id or v.user_id = @user_id) ")
+	}
+
+	if in.Status != "" {
+		fmt.Fprintf(&q, "and c.status = @status ")
+		args["status"] = in.Status
+	}
+
+	fmt.Fprintf(&q, "order by c.created_at desc")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListClaimsResponse
+	for rows.Next() {
+		c, ownerId, claimantId, err := scanClaim(rows)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if s.view(c, ownerId, claimantId) {
+			out.Claims = append(out.Claims, c)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// transition moves a claim to status to on behalf of the caller acting as role.
+// Only open and disputed claims can change. Released and approved claims move
+// the vehicle to the claimant, restoring it if the owner had deleted it.
+func (s *svc) transition(ctx context.Context, method, claimId, role, to, note string) (*Claim, error) {
+	glog.Infof("%v: claim=%v, status=%v", method, claimId, to)
+	if claimId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "claim id is empty")
+	}
+
+	if role == RoleAdmin && !internal.IsAdmin(s.Config.Config, s.Config.UserInfo) {
+		return nil, status.Errorf(codes.PermissionDenied, "admin only")
+	}
+
+	note = strings.TrimSpace(note)
+	if len(note) > maxReasonLen {
+		return nil, status.Errorf(codes.InvalidArgument, "note exceeds %v characters", maxReasonLen)
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicle_claims c ", claimColumns)
+	fmt.Fprintf(&q, "join vehicles v on v.id = c.vehicle_id ")
+	fmt.Fprintf(&q, "where c.id = $1 for update of c, v")
+	c, ownerId, claimantId, err := scanClaim(tx.QueryRow(ctx, q.String(), claimId))
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "claim not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	actorId := s.Config.UserInfo.Id
+	switch {
+	case role == RoleClaimant && actorId != claimantId,
+		role == RoleOwner && actorId != ownerId:
+		return nil, status.Errorf(codes.NotFound, "claim not found")
+	case c.Status != StatusOpen && c.Status != StatusDisputed:
+		return nil, status.Errorf(codes.FailedPrecondition, "claim is already %v", c.Status)
+	case c.Status == to:
+		return nil, status.Errorf(codes.FailedPrecondition, "claim is already %v", c.Status)
+	case ownerId == claimantId && to != StatusWithdrawn:
+		return nil, status.Errorf(codes.FailedPrecondition, "claimant already owns the vehicle")
+	}
+
+	if to == StatusReleased || to == StatusApproved {
+		if err = handOver(ctx, tx, c.VehicleId, claimantId); err != nil {
+			return nil, err
+		}
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "update vehicle_claims set status = $2, updated_at = now()")
+	if to != StatusDisputed {
+		fmt.Fprintf(&q, ", resolved_at = now(), resolved_by = $3")
+	}
+
+	fmt.Fprintf(&q, " where id = $1 returning updated_at")
+	qargs := []any{claimId, to}
+	if to != StatusDisputed {
+		qargs = append(qargs, actorId)
+	}
+
+	if err = tx.QueryRow(ctx, q.String(), qargs...).Scan(&c.UpdatedAt); err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = recordEvent(ctx, tx, claimId, to, actorId, role, note); err != nil {
+		glog.Errorf("recordEvent failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	c.Status = to
+	s.notifyTransition(ctx, c, ownerId, claimantId, role)
+	s.view(c, ownerId, claimantId)
+	glog.Infof("%v success! claim=%v, status=%v", method, claimId, to)
+	return c, nil
+}
+
+// handOver moves the vehicle to the claimant within tx.
+func handOver(ctx context.Context, tx pgx.Tx, vehicleId, claimantId string) error {
+	var kms int32
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicles set deleted_at = null, purge_after = null, archived_at = null ")
+	fmt.Fprintf(&q, "where id = $1 returning kms")
+	err := tx.QueryRow(ctx, q.String(), vehicleId).Scan(&kms)
+	switch {
+	case internal.IsUniqueViolation(err):
+		return status.Errorf(codes.FailedPrecondition, "vehicle's plate is registered to another vehicle")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	}
+
+	_, err = tx.Exec(ctx, "update vehicle_transfers set status = $2 where vehicle_id = $1 and status = $3",
+		vehicleId, transfer.StatusCancelled, transfer.StatusPending)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return internal.InternalErr
+	}
+
+	if err = transfer.MoveOwnership(ctx, tx, vehicleId, claimantId, kms); err != nil {
+		glog.Errorf("MoveOwnership failed: %v", err)
+		return internal.InternalErr
+	}
+
+	return nil
+}
+
+func (s *svc) notifyTransition(ctx context.Context, c *Claim, ownerId, claimantId, actor string) {
+	var title, body string
+	switch c.Status {
+	case StatusDisputed:
+		title, body = "Your claim is disputed", "The owner disputes your claim. Our support team will review it."
+	case StatusReleased:
+		title, body = "Your claim was accepted", "The owner released the vehicle. It is now in your garage."
+	case StatusApproved:
+		title, body = "Your claim was approved", "Support approved your claim. The vehicle is now in your garage."
+	case StatusRejected:
+		title, body = "Your claim was rejected", "Support reviewed your claim and kept the vehicle with its owner."
+	}
+
+	if title != "" {
+		notifyUser(ctx, claimantId, c.Id, c.Status, title, body)
+	}
+
+	switch {
+	case c.Status == StatusWithdrawn:
+		notifyUser(ctx, ownerId, c.Id, c.Status, "A claim was withdrawn",
+			"A claim on your vehicle was withdrawn. No action is needed.")
+	case actor == RoleAdmin && c.Status == StatusApproved:
+		notifyUser(ctx, ownerId, c.Id, c.Status, "A claim on your vehicle was approved",
+			"Support approved a claim on your vehicle and moved it to the claimant.")
+	case actor == RoleAdmin && c.Status == StatusRejected:
+		notifyUser(ctx, ownerId, c.Id, c.Status, "A claim on your vehicle was rejected",
+			"Support rejected a claim on your vehicle. No action is needed.")
+	}
+}
+
+// view sets the caller's role in c and hides what they shouldn't see. Returns
+// false if they have no business seeing the claim at all.
+func (s *svc) view(c *Claim, ownerId, claimantId string) bool {
+	switch s.Config.UserInfo.Id {
+	case claimantId:
+		c.Role = RoleClaimant
+		c.VehicleId = ""
+		return true
+	case ownerId:
+		c.Role = RoleOwner
+		return true
+	}
+
+	if internal.IsAdmin(s.Config.Config, s.Config.UserInfo) {
+		c.Role = RoleAdmin
+		return true
+	}
+
+	return false
+}
+
+// claimColumns selects a claim along with the vehicle's current owner and the
+// claimant (see scanClaim).
+const claimColumns = "c.id, c.vehicle_id, c.vin, c.chassis_number, c.reason, c.status, " +
+	"c.created_at, c.updated_at, v.user_id, c.claimant_id"
+
+func scanClaim(row pgx.Row) (*Claim, string, string, error) {
+	var c Claim
+	var ownerId, claimantId string
+	err := row.Scan(&c.Id, &c.VehicleId, &c.Vin, &c.ChassisNumber, &c.Reason, &c.Status,
+		&c.CreatedAt, &c.UpdatedAt, &ownerId, &claimantId)
+	return &c, ownerId, claimantId, err
+}
+
+func recordEvent(ctx context.Context, tx pgx.Tx, claimId, status, actorId, role, note string) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_claim_events (claim_id, status, actor_id, actor_role, note) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5)")
+	_, err := tx.Exec(ctx, q.String(), claimId, status, actorId, role, note)
+	return err
+}
+
+func notifyUser(ctx context.Context, userId, claimId, claimStatus, title, body string) {
+	n := notify.Notification{
+		UserId: userId,
+		Kind:   "claim." + claimStatus,
+		Title:  title,
+		Body:   body,
+		Data:   map[string]string{"claimId": claimId},
+	}
+
+	if err := global.Notifier.Notify(ctx, &n); err != nil {
+		glog.Errorf("Notify failed: %v", err)
+	}
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,335 @@
+package compliance
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	KindRegistration = "registration"
+	KindInsurance    = "insurance"
+	KindInspection   = "inspection"
+
+	defaultLookAheadDays = 30
+	maxLookAheadDays     = 366
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type Record struct {
+	Id        string    `json:"id,omitempty"`
+	VehicleId string    `json:"vehicleId,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Reference string    `json:"reference,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"`
+	IssuedOn  time.Time `json:"issuedOn,omitempty"` // optional
+	ExpiresOn time.Time `json:"expiresOn,omitempty"`
+	CostMinor int64     `json:"costMinor,omitempty"` // optional, in minor units of Currency
+	Currency  string    `json:"currency,omitempty"`
+}
+
+type ListRecordsRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListRecordsResponse struct {
+	Records []*Record `json:"records,omitempty"`
+}
+
+type DeleteRecordRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+type ListExpiringRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"` // optional, all vehicles if empty
+	Days      int32  `json:"days,omitempty"`      // look-ahead window, default 30
+}
+
+type ExpiringRecord struct {
+	Record   *Record `json:"record,omitempty"`
+	DaysLeft int32   `json:"daysLeft,omitempty"` // negative once expired
+	Expired  bool    `json:"expired,omitempty"`
+}
+
+type ListExpiringResponse struct {
+	Records []*ExpiringRecord `json:"records,omitempty"`
+}
+
+func (s *svc) CreateRecord(ctx context.Context, in *Record) (*Record, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateRecord input=%v", string(b))
+	if err := validateRecord(in); err != nil {
+		return nil, err
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	in.Id = uuid.NewString()
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into compliance_records (id, vehicle_id, user_id, ")
+	fmt.Fprintf(&q, "kind, reference, issuer, issued_on, expires_on, cost_minor, currency) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @user_id, ")
+	fmt.Fprintf(&q, "@kind, @reference, @issuer, @issued_on, @expires_on, @cost_minor, @currency)")
+	_, err := global.PgxPool.Exec(ctx, q.String(), recordArgs(in, s.Config.UserInfo.Id))
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+func (s *svc) ListRecords(ctx context.Context, in *ListRecordsRequest) (*ListRecordsResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from compliance_records r ", recordColumns)
+	fmt.Fprintf(&q, "where r.vehicle_id = $1 and r.user_id = $2 ")
+	fmt.Fprintf(&q, "order by r.kind, r.expires_on")
+	rows, err := global.PgxPool.Query(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListRecordsResponse
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Records = append(out.Records, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+func (s *svc) UpdateRecord(ctx context.Context, in *Record) (*Record, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("UpdateRecord input=%v", string(b))
+	if in.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id is empty")
+	}
+
+	if err := validateRecord(in); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "update compliance_records r set kind = @kind, reference = @reference, ")
+	fmt.Fprintf(&q, "issuer = @issuer, issued_on = @issued_on, expires_on = @expires_on, ")
+	fmt.Fprintf(&q, "cost_minor = @cost_minor, currency = @currency, updated_at = now() ")
+	fmt.Fprintf(&q, "from vehicles v where r.id = @id and r.user_id = @user_id ")
+	fmt.Fprintf(&q, "and v.id = r.vehicle_id and v.user_id = @user_id and v.deleted_at is null ")
+	fmt.Fprintf(&q, "returning r.vehicle_id")
+	err := global.PgxPool.QueryRow(ctx, q.String(), recordArgs(in, s.Config.UserInfo.Id)).Scan(&in.VehicleId)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "record not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+func (s *svc) DeleteRecord(ctx context.Context, in *DeleteRecordRequest) (*emptypb.Empty, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "delete from compliance_records r using vehicles v ")
+	fmt.Fprintf(&q, "where r.id = $1 and r.user_id = $2 ")
+	fmt.Fprintf(&q, "and v.id = r.vehicle_id and v.user_id = $2 and v.deleted_at is null")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), in.Id, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "record not found")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListExpiring returns the caller's documents that expire within the look-ahead
+// window, including ones that already expired, soonest first.
+func (s *svc) ListExpiring(ctx context.Context, in *ListExpiringRequest) (*ListExpiringResponse, error) {
+	days := in.Days
+	switch {
+	case days == 0:
+		days = defaultLookAheadDays
+	case days < 0 || days > maxLookAheadDays:
+		return nil, status.Errorf(codes.InvalidArgument, "days must be between 1 and %v", maxLookAheadDays)
+	}
+
+	today := truncDay(time.Now().UTC())
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from compliance_records r ", recordColumns)
+	fmt.Fprintf(&q, "join vehicles v on v.id = r.vehicle_id and v.user_id = r.user_id ")
+	fmt.Fprintf(&q, "and v.deleted_at is null ")
+	fmt.Fprintf(&q, "where r.user_id = @user_id and r.expires_on <= @until ")
+	args := pgx.NamedArgs{
+		"user_id": s.Config.UserInfo.Id,
+		"until":   today.AddDate(0, 0, int(days)),
+	}
+
+	if in.VehicleId != "" {
+		fmt.Fprintf(&q, "and r.vehicle_id = @vehicle_id ")
+		args["vehicle_id"] = in.VehicleId
+	}
+
+	// Superseded documents (an older insurance policy after renewal) aren't expiring.
+	fmt.Fprintf(&q, "and not exists (select 1 from compliance_records n ")
+	fmt.Fprintf(&q, "where n.vehicle_id = r.vehicle_id and n.user_id = r.user_id ")
+	fmt.Fprintf(&q, "and n.kind = r.kind and n.expires_on > r.expires_on) ")
+	fmt.Fprintf(&q, "order by r.expires_on")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListExpiringResponse
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		left := daysLeft(r.ExpiresOn, today)
+		out.Records = append(out.Records, &ExpiringRecord{
+			Record:   r,
+			DaysLeft: left,
+			Expired:  left < 0,
+		})
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+const recordColumns = "r.id, r.vehicle_id, r.kind, r.reference, r.issuer, r.issued_on, r.expires_on, " +
+	"r.cost_minor, r.currency"
+
+func scanRecord(row pgx.Row) (*Record, error) {
+	var r Record
+	var issued *time.Time
+	err := row.Scan(&r.Id, &r.VehicleId, &r.Kind, &r.Reference, &r.Issuer, &issued, &r.ExpiresOn,
+		&r.CostMinor, &r.Currency)
+	if issued != nil {
+		r.IssuedOn = *issued
+	}
+
+	return &r, err
+}
+
+func validateRecord(in *Record) error {
+	switch in.Kind {
+	case KindRegistration, KindInsurance, KindInspection:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown kind %q", in.Kind)
+	}
+
+	if in.ExpiresOn.IsZero() {
+		return status.Errorf(codes.InvalidArgument, "expiry date is empty")
+	}
+
+	in.ExpiresOn = truncDay(in.ExpiresOn)
+	if !in.IssuedOn.IsZero() {
+		in.IssuedOn = truncDay(in.IssuedOn)
+		if !in.IssuedOn.Before(in.ExpiresOn) {
+			return status.Errorf(codes.InvalidArgument, "issue date must be before expiry date")
+		}
+	}
+
+	if in.CostMinor < 0 {
+		return status.Errorf(codes.InvalidArgument, "cost must not be negative")
+	}
+
+	if in.CostMinor > 0 || in.Currency != "" {
+		c, ok := money.NormalizeCurrency(in.Currency)
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+		}
+
+		in.Currency = c
+	}
+
+	in.Reference = strings.TrimSpace(in.Reference)
+	in.Issuer = strings.TrimSpace(in.Issuer)
+	return nil
+}
+
+func recordArgs(in *Record, userId string) pgx.NamedArgs {
+	args := pgx.NamedArgs{
+		"id":         in.Id,
+		"vehicle_id": in.VehicleId,
+		"user_id":    userId,
+		"kind":       in.Kind,
+		"reference":  in.Reference,
+		"issuer":     in.Issuer,
+		"issued_on":  nil,
+		"expires_on": in.ExpiresOn,
+		"cost_minor": in.CostMinor,
+		"currency":   in.Currency,
+	}
+
+	if !in.IssuedOn.IsZero() {
+		args["issued_on"] = in.IssuedOn
+	}
+
+	return args
+}
+
+func truncDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func daysLeft(expiresOn, today time.Time) int32 {
+	return int32(truncDay(expiresOn).Sub(today).Hours() / 24)
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,144 @@
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/notify"
+	"github.com/golang/glog"
+)
+
+var DefaultReminderOffsets = []int{30, 7, 1}
+
+// RunExpiryReminders sends a reminder when a document is within one of the given
+// offsets (in days) of its expiry, checking every interval until ctx is done.
+// Sent reminders are persisted before notifying, so restarts and other API
+// instances never repeat one. After downtime only the closest offset is sent.
+func RunExpiryReminders(ctx context.Context, every time.Duration, offsets []int) {
+	if len(offsets) == 0 {
+		offsets = DefaultReminderOffsets
+	}
+
+	offsets = append([]int(nil), offsets...)
+	sort.Ints(offsets)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := sendExpiryReminders(ctx, offsets, time.Now().UTC()); err != nil {
+			glog.Errorf("sendExpiryReminders failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendExpiryReminders expects offsets sorted ascending.
+func sendExpiryReminders(ctx context.Context, offsets []int, now time.Time) error {
+	today := truncDay(now)
+	maxOffset := offsets[len(offsets)-1]
+	type due struct {
+		record *Record
+		userId string
+		name   string
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v, r.user_id, v.make, v.model ", recordColumns)
+	fmt.Fprintf(&q, "from compliance_records r ")
+	fmt.Fprintf(&q, "join vehicles v on v.id = r.vehicle_id and v.user_id = r.user_id ")
+	fmt.Fprintf(&q, "and v.deleted_at is null ")
+	fmt.Fprintf(&q, "where r.expires_on >= $1 and r.expires_on <= $2 ")
+	fmt.Fprintf(&q, "and not exists (select 1 from compliance_records n ")
+	fmt.Fprintf(&q, "where n.vehicle_id = r.vehicle_id and n.user_id = r.user_id ")
+	fmt.Fprintf(&q, "and n.kind = r.kind and n.expires_on > r.expires_on)")
+	rows, err := global.PgxPool.Query(ctx, q.String(), today, today.AddDate(0, 0, maxOffset))
+	if err != nil {
+		return err
+	}
+
+	var list []due
+	for rows.Next() {
+		var d due
+		var r Record
+		var issued *time.Time
+		var mk, model string
+		err = rows.Scan(&r.Id, &r.VehicleId, &r.Kind, &r.Reference, &r.Issuer,
+			&issued, &r.ExpiresOn, &r.CostMinor, &r.Currency, &d.userId, &mk, &model)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		d.record = &r
+		d.name = strings.TrimSpace(mk + " " + model)
+		list = append(list, d)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range list {
+		left := int(daysLeft(d.record.ExpiresOn, today))
+		offset := -1
+		for _, o := range offsets {
+			if left <= o {
+				offset = o
+				break
+			}
+		}
+
+		if offset < 0 {
+			continue
+		}
+
+		var q strings.Builder
+		fmt.Fprintf(&q, "insert into compliance_reminders (record_id, expires_on, offset_days) ")
+		fmt.Fprintf(&q, "values ($1, $2, $3) on conflict do nothing")
+		tag, err := global.PgxPool.Exec(ctx, q.String(), d.record.Id, d.record.ExpiresOn, offset)
+		if err != nil {
+			glog.Errorf("Exec failed: %v", err)
+			continue
+		}
+
+		if tag.RowsAffected() == 0 {
+			continue // already sent
+		}
+
+		when := fmt.Sprintf("in %d days", left)
+		switch left {
+		case 0:
+			when = "today"
+		case 1:
+			when = "tomorrow"
+		}
+
+		n := notify.Notification{
+			UserId: d.userId,
+			Kind:   "compliance.expiring",
+			Title:  fmt.Sprintf("%v %v expires %v", d.name, d.record.Kind, when),
+			Body: fmt.Sprintf("Your %v for %v expires on %v.", d.record.Kind, d.name,
+				d.record.ExpiresOn.Format("Jan 2, 2006")),
+			Data: map[string]string{
+				"vehicleId": d.record.VehicleId,
+				"recordId":  d.record.Id,
+				"kind":      d.record.Kind,
+			},
+		}
+
+		if err = global.Notifier.Notify(ctx, &n); err != nil {
+			glog.Errorf("Notify failed: %v", err)
+		}
+	}
+
+	return nil
+}
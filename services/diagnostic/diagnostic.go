@@ -0,0 +1,559 @@
+package diagnostic
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/notify"
+	"github.com/drival-ai/v10-api/obd"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	StateActive  = "active"  // confirmed, mode 03; the check engine light is usually on
+	StatePending = "pending" // seen once, mode 07; not confirmed yet
+	StateCleared = "cleared"
+
+	maxReadings   = 1000
+	maxCodes      = 100
+	defaultFaults = 100
+	maxFaults     = 1000
+
+	// Dongle clocks come from the phone; same bounds as telemetry.
+	maxClockSkew   = time.Minute * 5
+	maxReadingsAge = time.Hour * 24 * 30
+)
+
+var states = []string{StateActive, StatePending, StateCleared}
+
+// Columns of obd_readings by pid, and the metric names used in ObdStatus.
+var (
+	pidColumns = map[int]string{
+		obd.PidRpm:         "rpm",
+		obd.PidCoolantTemp: "coolant_c",
+		obd.PidFuelLevel:   "fuel_pct",
+		obd.PidSpeed:       "speed_kmh",
+		obd.PidOdometer:    "odometer_km",
+	}
+
+	metrics = []struct{ name, column string }{
+		{"rpm", "rpm"},
+		{"coolantC", "coolant_c"},
+		{"fuelPct", "fuel_pct"},
+		{"speedKmh", "speed_kmh"},
+		{"odometerKm", "odometer_km"},
+	}
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// PidValue is a raw mode 01 response: the pid and its data bytes, as the dongle
+// returned them.
+type PidValue struct {
+	Pid  int32  `json:"pid,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+type ObdReading struct {
+	RecordedAt time.Time   `json:"recordedAt,omitempty"`
+	Pids       []*PidValue `json:"pids,omitempty"`
+}
+
+// DtcReport is the full list of trouble codes read from the vehicle at ReadAt.
+// Open faults missing from it are cleared, so it must not be partial.
+type DtcReport struct {
+	ReadAt  time.Time `json:"readAt,omitempty"`
+	Active  []string  `json:"active,omitempty"`  // mode 03, stored codes
+	Pending []string  `json:"pending,omitempty"` // mode 07
+}
+
+type UploadObdRequest struct {
+	VehicleId string        `json:"vehicleId,omitempty"`
+	Readings  []*ObdReading `json:"readings,omitempty"`
+	Dtcs      *DtcReport    `json:"dtcs,omitempty"` // optional
+}
+
+type UploadObdResponse struct {
+	Accepted  int32    `json:"accepted,omitempty"`  // readings stored
+	Skipped   int32    `json:"skipped,omitempty"`   // readings out of time bounds, repeated, or without supported pids
+	NewFaults []*Fault `json:"newFaults,omitempty"` // faults opened or confirmed by this report
+}
+
+type Fault struct {
+	Id          string    `json:"id,omitempty"`
+	VehicleId   string    `json:"vehicleId,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	State       string    `json:"state,omitempty"` // active, pending, cleared
+	Dtc         *obd.DTC  `json:"dtc,omitempty"`   // decoded code
+	FirstSeenAt time.Time `json:"firstSeenAt,omitempty"`
+	LastSeenAt  time.Time `json:"lastSeenAt,omitempty"`
+	ClearedAt   time.Time `json:"clearedAt,omitempty"`
+}
+
+type ListFaultsRequest struct {
+	VehicleId string   `json:"vehicleId,omitempty"`
+	States    []string `json:"states,omitempty"` // optional
+	Limit     int32    `json:"limit,omitempty"`  // default 100
+}
+
+type ListFaultsResponse struct {
+	Faults []*Fault `json:"faults,omitempty"` // newest first
+}
+
+type GetObdStatusRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+// Metric is the latest known value of rpm, coolantC, fuelPct, speedKmh or
+// odometerKm.
+type Metric struct {
+	Name       string    `json:"name,omitempty"`
+	Value      float64   `json:"value,omitempty"`
+	RecordedAt time.Time `json:"recordedAt,omitempty"`
+}
+
+type ObdStatus struct {
+	VehicleId  string    `json:"vehicleId,omitempty"`
+	Metrics    []*Metric `json:"metrics,omitempty"`    // those the vehicle ever reported
+	OpenFaults []*Fault  `json:"openFaults,omitempty"` // active and pending
+}
+
+// UploadObd stores dongle readings and, if given, the trouble codes read with
+// them. Owners and the reporter are notified of new and newly confirmed faults.
+func (s *svc) UploadObd(ctx context.Context, in *UploadObdRequest) (*UploadObdResponse, error) {
+	glog.Infof("UploadObd input: vehicle=%v, readings=%v, dtcs=%v", in.VehicleId, len(in.Readings), in.Dtcs != nil)
+	userId := s.Config.UserInfo.Id
+	if len(in.Readings) > maxReadings {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %v readings per request", maxReadings)
+	}
+
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, userId); err != nil {
+		return nil, err
+	}
+
+	r, err := normalizeReport(in.Dtcs)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var out UploadObdResponse
+	out.Accepted, err = s.writeReadings(ctx, tx, in.VehicleId, in.Readings)
+	if err != nil {
+		glog.Errorf("writeReadings failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	out.Skipped = int32(len(in.Readings)) - out.Accepted
+	if r != nil {
+		out.NewFaults, err = s.updateFaults(ctx, tx, in.VehicleId, r)
+		if err != nil {
+			glog.Errorf("updateFaults failed: %v", err)
+			return nil, internal.InternalErr
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if len(out.NewFaults) > 0 {
+		s.alert(ctx, in.VehicleId, out.NewFaults)
+	}
+
+	return &out, nil
+}
+
+// ListFaults returns the fault history of a vehicle the caller owns or drives
+// for an org, since its current owner took it over.
+func (s *svc) ListFaults(ctx context.Context, in *ListFaultsRequest) (*ListFaultsResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListFaults input=%v", string(b))
+	limit := in.Limit
+	switch {
+	case limit == 0:
+		limit = defaultFaults
+	case limit < 0 || limit > maxFaults:
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %v", maxFaults)
+	}
+
+	for _, st := range in.States {
+		if !contains(states, st) {
+			return nil, status.Errorf(codes.InvalidArgument, "state must be one of %v", strings.Join(states, ", "))
+		}
+	}
+
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	faults, err := listFaults(ctx, in.VehicleId, in.States, limit)
+	if err != nil {
+		glog.Errorf("listFaults failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &ListFaultsResponse{Faults: faults}, nil
+}
+
+// GetObdStatus returns a vehicle's latest dongle readings and open faults from
+// its current ownership period.
+func (s *svc) GetObdStatus(ctx context.Context, in *GetObdStatusRequest) (*ObdStatus, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("GetObdStatus input=%v", string(b))
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	out := ObdStatus{VehicleId: in.VehicleId}
+	for _, m := range metrics {
+		var q strings.Builder
+		fmt.Fprintf(&q, "select %v, recorded_at from obd_readings ", m.column)
+		fmt.Fprintf(&q, "where vehicle_id = @vehicle_id and recorded_at >= %v ", ownedSince)
+		fmt.Fprintf(&q, "and %v is not null order by recorded_at desc limit 1", m.column)
+		v := Metric{Name: m.name}
+		err := global.PgxPool.QueryRow(ctx, q.String(), pgx.NamedArgs{"vehicle_id": in.VehicleId}).
+			Scan(&v.Value, &v.RecordedAt)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			continue
+		case err != nil:
+			glog.Errorf("QueryRow failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Metrics = append(out.Metrics, &v)
+	}
+
+	var err error
+	out.OpenFaults, err = listFaults(ctx, in.VehicleId, []string{StateActive, StatePending}, maxFaults)
+	if err != nil {
+		glog.Errorf("listFaults failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// writeReadings decodes and stores readings, returning how many were stored.
+// Unsupported pids are ignored.
+func (s *svc) writeReadings(ctx context.Context, tx pgx.Tx, vehicleId string, readings []*ObdReading) (int32, error) {
+	var accepted int32
+	now := time.Now()
+	for _, r := range readings {
+		if r == nil || r.RecordedAt.After(now.Add(maxClockSkew)) || now.Sub(r.RecordedAt) > maxReadingsAge {
+			continue
+		}
+
+		args := pgx.NamedArgs{
+			"vehicle_id":  vehicleId,
+			"user_id":     s.Config.UserInfo.Id,
+			"recorded_at": r.RecordedAt,
+		}
+
+		for _, column := range pidColumns {
+			args[column] = nil
+		}
+
+		var n int
+		for _, p := range r.Pids {
+			if p == nil {
+				continue
+			}
+
+			v, err := obd.DecodePid(int(p.Pid), p.Data)
+			if err != nil {
+				continue
+			}
+
+			args[pidColumns[int(p.Pid)]] = v
+			n++
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		var q strings.Builder
+		fmt.Fprintf(&q, "insert into obd_readings (vehicle_id, user_id, recorded_at, rpm, coolant_c, ")
+		fmt.Fprintf(&q, "fuel_pct, speed_kmh, odometer_km) values (@vehicle_id, @user_id, @recorded_at, ")
+		fmt.Fprintf(&q, "@rpm, @coolant_c, @fuel_pct, @speed_kmh, @odometer_km) on conflict do nothing")
+		tag, err := tx.Exec(ctx, q.String(), args)
+		if err != nil {
+			return 0, err
+		}
+
+		accepted += int32(tag.RowsAffected())
+	}
+
+	return accepted, nil
+}
+
+// updateFaults applies a trouble code report to the vehicle's open faults and
+// returns the faults it opened or confirmed. Reports older than the latest one
+// change nothing.
+func (s *svc) updateFaults(ctx context.Context, tx pgx.Tx, vehicleId string, r *report) ([]*Fault, error) {
+	at, seen := r.at, r.codes
+	// Also serializes concurrent reports for the vehicle.
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_fault_reads (vehicle_id, read_at) values ($1, $2) ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id) do update set read_at = excluded.read_at ")
+	fmt.Fprintf(&q, "where vehicle_fault_reads.read_at < excluded.read_at")
+	tag, err := tx.Exec(ctx, q.String(), vehicleId, at)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, nil
+	}
+
+	open, err := openFaults(ctx, tx, vehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []*Fault
+	for _, f := range open {
+		state, ok := seen[f.Code]
+		delete(seen, f.Code)
+		switch {
+		case !ok:
+			_, err = tx.Exec(ctx, "update vehicle_faults set state = $2, cleared_at = $3 where id = $1",
+				f.Id, StateCleared, at)
+		default:
+			if state == StateActive && f.State == StatePending {
+				f.State = state
+				changed = append(changed, f)
+			}
+
+			_, err = tx.Exec(ctx, "update vehicle_faults set state = $2, last_seen_at = $3 where id = $1",
+				f.Id, state, at)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into vehicle_faults (id, vehicle_id, user_id, code, state, first_seen_at, ")
+	fmt.Fprintf(&q, "last_seen_at) values ($1, $2, $3, $4, $5, $6, $6)")
+	for _, code := range sortedKeys(seen) {
+		f := Fault{
+			Id:          uuid.NewString(),
+			VehicleId:   vehicleId,
+			Code:        code,
+			State:       seen[code],
+			FirstSeenAt: at,
+		}
+
+		f.Dtc, _ = obd.Decode(code)
+		_, err = tx.Exec(ctx, q.String(), f.Id, vehicleId, s.Config.UserInfo.Id, code, f.State, at)
+		if err != nil {
+			return nil, err
+		}
+
+		changed = append(changed, &f)
+	}
+
+	return changed, nil
+}
+
+// alert notifies the vehicle's owner and the reporter, if another org member,
+// of new or newly confirmed faults.
+func (s *svc) alert(ctx context.Context, vehicleId string, faults []*Fault) {
+	var ownerId, mk, model string
+	err := global.PgxPool.QueryRow(ctx, "select user_id, make, model from vehicles where id = $1",
+		vehicleId).Scan(&ownerId, &mk, &model)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return
+	}
+
+	name := strings.TrimSpace(mk + " " + model)
+	users := []string{ownerId}
+	if s.Config.UserInfo.Id != ownerId {
+		users = append(users, s.Config.UserInfo.Id)
+	}
+
+	for _, f := range faults {
+		desc := f.Dtc.Description
+		if desc == "" {
+			desc = fmt.Sprintf("A %v %v code", f.Dtc.Category, f.Dtc.System)
+		}
+
+		title := fmt.Sprintf("%v reported fault %v", name, f.Code)
+		if f.State == StatePending {
+			title = fmt.Sprintf("%v reported possible fault %v", name, f.Code)
+		}
+
+		for _, userId := range users {
+			n := notify.Notification{
+				UserId: userId,
+				Kind:   "diagnostic.fault",
+				Title:  title,
+				Body:   desc + ".",
+				Data: map[string]string{
+					"vehicleId": vehicleId,
+					"faultId":   f.Id,
+					"code":      f.Code,
+					"state":     f.State,
+				},
+			}
+
+			if err = global.Notifier.Notify(ctx, &n); err != nil {
+				glog.Errorf("Notify failed: %v", err)
+			}
+		}
+	}
+}
+
+// report is a checked DtcReport.
+type report struct {
+	at    time.Time
+	codes map[string]string // normalized code to state
+}
+
+// normalizeReport checks a trouble code report; nil without one. A code both
+// active and pending is active.
+func normalizeReport(in *DtcReport) (*report, error) {
+	if in == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	switch {
+	case in.ReadAt.IsZero():
+		return nil, status.Errorf(codes.InvalidArgument, "dtc read time is empty")
+	case in.ReadAt.After(now.Add(maxClockSkew)) || now.Sub(in.ReadAt) > maxReadingsAge:
+		return nil, status.Errorf(codes.InvalidArgument, "dtc read time is out of range")
+	case len(in.Active)+len(in.Pending) > maxCodes:
+		return nil, status.Errorf(codes.InvalidArgument, "at most %v trouble codes per report", maxCodes)
+	}
+
+	r := report{at: in.ReadAt, codes: map[string]string{}}
+	for _, list := range []struct {
+		codes []string
+		state string
+	}{{in.Pending, StatePending}, {in.Active, StateActive}} {
+		for _, c := range list.codes {
+			code, err := obd.Normalize(c)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid trouble code %q", c)
+			}
+
+			r.codes[code] = list.state
+		}
+	}
+
+	return &r, nil
+}
+
+func openFaults(ctx context.Context, tx pgx.Tx, vehicleId string) ([]*Fault, error) {
+	rows, err := tx.Query(ctx, fmt.Sprintf("select %v from vehicle_faults where vehicle_id = $1 "+
+		"and state <> $2 order by code for update", faultColumns), vehicleId, StateCleared)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanFaults(rows)
+}
+
+func listFaults(ctx context.Context, vehicleId string, states []string, limit int32) ([]*Fault, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from vehicle_faults where vehicle_id = @vehicle_id ", faultColumns)
+	fmt.Fprintf(&q, "and last_seen_at >= %v ", ownedSince)
+	args := pgx.NamedArgs{"vehicle_id": vehicleId, "limit": limit}
+	if len(states) > 0 {
+		fmt.Fprintf(&q, "and state = any(@states) ")
+		args["states"] = states
+	}
+
+	fmt.Fprintf(&q, "order by first_seen_at desc, code limit @limit")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanFaults(rows)
+}
+
+// ownedSince is the start of the current ownership period of @vehicle_id.
+// Readings and faults from before it belong to the previous owner and aren't
+// returned; faults still seen since then are.
+const ownedSince = "(select o.started_at from vehicle_ownerships o where o.vehicle_id = @vehicle_id " +
+	"and o.ended_at is null)"
+
+const faultColumns = "id, vehicle_id, code, state, first_seen_at, last_seen_at, cleared_at"
+
+func scanFaults(rows pgx.Rows) ([]*Fault, error) {
+	defer rows.Close()
+	var out []*Fault
+	for rows.Next() {
+		var f Fault
+		var clearedAt *time.Time
+		err := rows.Scan(&f.Id, &f.VehicleId, &f.Code, &f.State, &f.FirstSeenAt, &f.LastSeenAt, &clearedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if clearedAt != nil {
+			f.ClearedAt = *clearedAt
+		}
+
+		f.Dtc, _ = obd.Decode(f.Code)
+		out = append(out, &f)
+	}
+
+	return out, rows.Err()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
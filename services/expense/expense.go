@@ -0,0 +1,592 @@
+package expense
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	CategoryToll    = "toll"
+	CategoryParking = "parking"
+	CategoryFine    = "fine"
+	CategoryWash    = "wash"
+	CategoryOther   = "other"
+
+	maxNoteLen   = 500
+	maxTripIdLen = 64
+	maxExpenses  = 5000
+)
+
+var categories = []string{CategoryToll, CategoryParking, CategoryFine, CategoryWash, CategoryOther}
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type Expense struct {
+	Id            string    `json:"id,omitempty"`
+	VehicleId     string    `json:"vehicleId,omitempty"`
+	UserId        string    `json:"userId,omitempty"` // who recorded it; set by the server
+	TripId        string    `json:"tripId,omitempty"` // optional
+	Category      string    `json:"category,omitempty"`
+	SpentAt       time.Time `json:"spentAt,omitempty"`
+	AmountMinor   int64     `json:"amountMinor,omitempty"`
+	Currency      string    `json:"currency,omitempty"`
+	ReceiptFileId string    `json:"receiptFileId,omitempty"` // optional, a receipt uploaded as a vehicle file
+	Reimbursable  bool      `json:"reimbursable,omitempty"`
+	Note          string    `json:"note,omitempty"`
+}
+
+// ListExpensesRequest selects expenses: one vehicle, every vehicle of an org
+// (fleet), or all of the caller's vehicles if both are empty. The other fields
+// narrow that down.
+type ListExpensesRequest struct {
+	VehicleId    string    `json:"vehicleId,omitempty"`
+	OrgId        string    `json:"orgId,omitempty"`
+	TripId       string    `json:"tripId,omitempty"`
+	Category     string    `json:"category,omitempty"`
+	From         time.Time `json:"from,omitempty"`         // optional
+	To           time.Time `json:"to,omitempty"`           // optional, exclusive
+	Reimbursable bool      `json:"reimbursable,omitempty"` // only reimbursable expenses
+}
+
+type ListExpensesResponse struct {
+	Expenses []*Expense `json:"expenses,omitempty"` // newest first
+}
+
+type AggregateExpensesRequest struct {
+	Filter   *ListExpensesRequest `json:"filter,omitempty"`
+	Currency string               `json:"currency,omitempty"` // default the exchange-rate base
+}
+
+type Amount struct {
+	Key         string `json:"key,omitempty"` // category, month (2006-01), vehicle id or currency
+	AmountMinor int64  `json:"amountMinor,omitempty"`
+}
+
+type AggregateExpensesResponse struct {
+	Currency          string    `json:"currency,omitempty"`
+	Count             int32     `json:"count,omitempty"`
+	TotalMinor        int64     `json:"totalMinor,omitempty"`
+	ReimbursableMinor int64     `json:"reimbursableMinor,omitempty"`
+	Categories        []*Amount `json:"categories,omitempty"`
+	Months            []*Amount `json:"months,omitempty"`
+	Vehicles          []*Amount `json:"vehicles,omitempty"`
+
+	// Expenses left out because there's no exchange rate for their currency.
+	Unconverted []*Amount `json:"unconverted,omitempty"` // keyed by currency
+}
+
+type DeleteExpenseRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+// CreateExpense records an expense for a vehicle the caller owns or drives for
+// an org.
+func (s *svc) CreateExpense(ctx context.Context, in *Expense) (*Expense, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateExpense input=%v", string(b))
+	if err := validate(in); err != nil {
+		return nil, err
+	}
+
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkReceipt(ctx, in); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkTrip(ctx, in); err != nil {
+		return nil, err
+	}
+
+	in.Id = uuid.NewString()
+	in.UserId = s.Config.UserInfo.Id
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into expenses (id, vehicle_id, user_id, trip_id, category, spent_at, ")
+	fmt.Fprintf(&q, "amount_minor, currency, receipt_file_id, reimbursable, note) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @user_id, @trip_id, @category, @spent_at, ")
+	fmt.Fprintf(&q, "@amount_minor, @currency, @receipt_file_id, @reimbursable, @note)")
+	if _, err := global.PgxPool.Exec(ctx, q.String(), args(in)); err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+// UpdateExpense replaces an expense the caller recorded. The vehicle can't change.
+func (s *svc) UpdateExpense(ctx context.Context, in *Expense) (*Expense, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("UpdateExpense input=%v", string(b))
+	if in.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "expense id is empty")
+	}
+
+	var vehicleId string
+	err := global.PgxPool.QueryRow(ctx, "select vehicle_id from expenses where id = $1 and user_id = $2",
+		in.Id, s.Config.UserInfo.Id).Scan(&vehicleId)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "expense not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	case in.VehicleId != "" && in.VehicleId != vehicleId:
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle can't be changed")
+	}
+
+	in.VehicleId = vehicleId
+	if err = validate(in); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkReceipt(ctx, in); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkTrip(ctx, in); err != nil {
+		return nil, err
+	}
+
+	in.UserId = s.Config.UserInfo.Id
+	var q strings.Builder
+	fmt.Fprintf(&q, "update expenses set trip_id = @trip_id, category = @category, ")
+	fmt.Fprintf(&q, "spent_at = @spent_at, amount_minor = @amount_minor, currency = @currency, ")
+	fmt.Fprintf(&q, "receipt_file_id = @receipt_file_id, reimbursable = @reimbursable, note = @note ")
+	fmt.Fprintf(&q, "where id = @id and user_id = @user_id")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), args(in))
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "expense not found")
+	}
+
+	return in, nil
+}
+
+// DeleteExpense deletes an expense the caller recorded. The receipt, if any, is kept.
+func (s *svc) DeleteExpense(ctx context.Context, in *DeleteExpenseRequest) (*emptypb.Empty, error) {
+	tag, err := global.PgxPool.Exec(ctx, "delete from expenses where id = $1 and user_id = $2",
+		in.Id, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "expense not found")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListExpenses returns the expenses the caller may see: their own, and within
+// an org, every member's expenses for the org's vehicles. It fails rather than
+// return part of a selection larger than maxExpenses.
+func (s *svc) ListExpenses(ctx context.Context, in *ListExpensesRequest) (*ListExpensesResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListExpenses input=%v", string(b))
+	var out ListExpensesResponse
+	err := s.each(ctx, in, "desc", maxExpenses+1, func(e *Expense) error {
+		out.Expenses = append(out.Expenses, e)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Expenses) > maxExpenses {
+		return nil, status.Errorf(codes.ResourceExhausted, "more than %v expenses match, narrow the filter "+
+			"or use AggregateExpenses or ExportExpenses", maxExpenses)
+	}
+
+	return &out, nil
+}
+
+// AggregateExpenses totals the expenses ListExpenses would return by category,
+// month and vehicle, converting everything into one currency.
+func (s *svc) AggregateExpenses(ctx context.Context, in *AggregateExpensesRequest) (*AggregateExpensesResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("AggregateExpenses input=%v", string(b))
+	rates := &money.Rates{}
+	if s.Config.Config != nil {
+		rates = &s.Config.Config.ExchangeRates
+	}
+
+	out := AggregateExpensesResponse{Currency: rates.Base}
+	if in.Currency != "" {
+		var ok bool
+		if out.Currency, ok = money.NormalizeCurrency(in.Currency); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+		}
+	}
+
+	if out.Currency == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "currency is empty")
+	}
+
+	filter := in.Filter
+	if filter == nil {
+		filter = &ListExpensesRequest{}
+	}
+
+	// Summed per group in SQL, so there's no limit on the number of expenses;
+	// the groups are few. Sums are converted rather than single expenses, which
+	// can differ from converting each one by a minor unit per group.
+	var q strings.Builder
+	fmt.Fprintf(&q, "select e.category, to_char(e.spent_at at time zone 'UTC', 'YYYY-MM'), ")
+	fmt.Fprintf(&q, "e.vehicle_id, e.currency, e.reimbursable, count(*), sum(e.amount_minor)::bigint ")
+	args, err := s.from(ctx, &q, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&q, "group by 1, 2, 3, 4, 5")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	byCategory := map[string]int64{}
+	byMonth := map[string]int64{}
+	byVehicle := map[string]int64{}
+	unconverted := map[string]int64{}
+	for rows.Next() {
+		var category, month, vehicleId, currency string
+		var reimbursable bool
+		var count int32
+		var sum int64
+		err = rows.Scan(&category, &month, &vehicleId, &currency, &reimbursable, &count, &sum)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		amount, err := rates.Convert(sum, currency, out.Currency)
+		if errors.Is(err, money.ErrNoRate) {
+			unconverted[currency] += sum
+			continue
+		}
+
+		out.Count += count
+		out.TotalMinor += amount
+		if reimbursable {
+			out.ReimbursableMinor += amount
+		}
+
+		byCategory[category] += amount
+		byMonth[month] += amount
+		byVehicle[vehicleId] += amount
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	out.Categories = sorted(byCategory)
+	out.Months = sorted(byMonth)
+	out.Vehicles = sorted(byVehicle)
+	out.Unconverted = sorted(unconverted)
+	return &out, nil
+}
+
+// ExportExpenses is ListExpenses as CSV, one row per expense, oldest first.
+func (s *svc) ExportExpenses(ctx context.Context, in *ListExpensesRequest) (*internal.ExportResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ExportExpenses input=%v", string(b))
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"date", "vehicle_id", "user_id", "trip_id", "category", "amount",
+		"currency", "reimbursable", "receipt_file_id", "note"})
+	err := s.each(ctx, in, "asc", 0, func(e *Expense) error {
+		return w.Write([]string{e.SpentAt.UTC().Format(time.RFC3339), e.VehicleId, e.UserId, e.TripId,
+			e.Category, money.Format(e.AmountMinor, e.Currency), e.Currency,
+			fmt.Sprint(e.Reimbursable), e.ReceiptFileId, e.Note})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		glog.Errorf("Write failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &internal.ExportResponse{
+		Filename:    fmt.Sprintf("expenses-%v.csv", time.Now().UTC().Format(time.DateOnly)),
+		ContentType: "text/csv",
+		Data:        buf.Bytes(),
+	}, nil
+}
+
+func validate(in *Expense) error {
+	in.Note = strings.TrimSpace(in.Note)
+	in.TripId = strings.TrimSpace(in.TripId)
+	switch {
+	case in.VehicleId == "":
+		return status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	case !contains(categories, in.Category):
+		return status.Errorf(codes.InvalidArgument, "category must be one of %v", strings.Join(categories, ", "))
+	case in.SpentAt.IsZero():
+		return status.Errorf(codes.InvalidArgument, "expense time is empty")
+	case in.SpentAt.After(time.Now().Add(time.Hour)):
+		return status.Errorf(codes.InvalidArgument, "expense time is in the future")
+	case in.AmountMinor <= 0:
+		return status.Errorf(codes.InvalidArgument, "amount must be positive")
+	case utf8.RuneCountInString(in.Note) > maxNoteLen:
+		return status.Errorf(codes.InvalidArgument, "note must have at most %v characters", maxNoteLen)
+	case len(in.TripId) > maxTripIdLen:
+		return status.Errorf(codes.InvalidArgument, "trip id must have at most %v characters", maxTripIdLen)
+	}
+
+	currency, ok := money.NormalizeCurrency(in.Currency)
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+	}
+
+	in.Currency = currency
+	return nil
+}
+
+// checkReceipt checks that the receipt is a file the caller uploaded for the
+// expense's vehicle.
+func (s *svc) checkReceipt(ctx context.Context, in *Expense) error {
+	if in.ReceiptFileId == "" {
+		return nil
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select exists(select 1 from vehicle_files where id = $1 ")
+	fmt.Fprintf(&q, "and vehicle_id = $2 and user_id = $3 and claim_id is null)")
+	var ok bool
+	err := global.PgxPool.QueryRow(ctx, q.String(), in.ReceiptFileId, in.VehicleId,
+		s.Config.UserInfo.Id).Scan(&ok)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	}
+
+	if !ok {
+		return status.Errorf(codes.NotFound, "receipt file not found")
+	}
+
+	return nil
+}
+
+// checkTrip makes sure the expense's trip, if any, is one the caller drove in
+// the expense's vehicle.
+func (s *svc) checkTrip(ctx context.Context, in *Expense) error {
+	if in.TripId == "" {
+		return nil
+	}
+
+	var ok bool
+	err := global.PgxPool.QueryRow(ctx, "select exists(select 1 from trips where id = $1 "+
+		"and vehicle_id = $2 and user_id = $3)", in.TripId, in.VehicleId, s.Config.UserInfo.Id).Scan(&ok)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	}
+
+	if !ok {
+		return status.Errorf(codes.NotFound, "trip not found")
+	}
+
+	return nil
+}
+
+// each calls f with the expenses matching in, by spent_at in the given order
+// (asc or desc), up to limit if > 0. Errors from f are returned as they are.
+func (s *svc) each(ctx context.Context, in *ListExpensesRequest, order string, limit int,
+	f func(*Expense) error) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select e.id, e.vehicle_id, e.user_id, coalesce(e.trip_id, ''), e.category, ")
+	fmt.Fprintf(&q, "e.spent_at, e.amount_minor, e.currency, coalesce(e.receipt_file_id, ''), ")
+	fmt.Fprintf(&q, "e.reimbursable, e.note ")
+	args, err := s.from(ctx, &q, in)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&q, "order by e.spent_at %v, e.id", order)
+	if limit > 0 {
+		fmt.Fprintf(&q, " limit @limit")
+		args["limit"] = limit
+	}
+
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return internal.InternalErr
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var e Expense
+		err = rows.Scan(&e.Id, &e.VehicleId, &e.UserId, &e.TripId, &e.Category, &e.SpentAt,
+			&e.AmountMinor, &e.Currency, &e.ReceiptFileId, &e.Reimbursable, &e.Note)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return internal.InternalErr
+		}
+
+		if err = f(&e); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return internal.InternalErr
+	}
+
+	return nil
+}
+
+// from adds the from and where clauses selecting the expenses in the filter to
+// q, as expenses e joined with their vehicles v.
+func (s *svc) from(ctx context.Context, q *strings.Builder, in *ListExpensesRequest) (pgx.NamedArgs, error) {
+	userId := s.Config.UserInfo.Id
+	args := pgx.NamedArgs{"user_id": userId}
+	fmt.Fprintf(q, "from expenses e join vehicles v on v.id = e.vehicle_id ")
+	fmt.Fprintf(q, "where v.deleted_at is null ")
+
+	// Expenses are private to whoever recorded them, except within an org,
+	// where members see each other's expenses for the org's vehicles.
+	switch {
+	case in.OrgId != "":
+		var member bool
+		err := global.PgxPool.QueryRow(ctx, "select exists(select 1 from org_members "+
+			"where org_id = $1 and user_id = $2)", in.OrgId, userId).Scan(&member)
+		if err != nil {
+			glog.Errorf("QueryRow failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if !member {
+			return nil, status.Errorf(codes.NotFound, "org not found")
+		}
+
+		fmt.Fprintf(q, "and v.org_id = @org_id and e.user_id in ")
+		fmt.Fprintf(q, "(select m.user_id from org_members m where m.org_id = @org_id) ")
+		args["org_id"] = in.OrgId
+	default:
+		fmt.Fprintf(q, "and e.user_id = @user_id ")
+	}
+
+	if in.VehicleId != "" {
+		fmt.Fprintf(q, "and e.vehicle_id = @vehicle_id ")
+		args["vehicle_id"] = in.VehicleId
+	}
+
+	if in.TripId != "" {
+		fmt.Fprintf(q, "and e.trip_id = @trip_id ")
+		args["trip_id"] = in.TripId
+	}
+
+	if in.Category != "" {
+		fmt.Fprintf(q, "and e.category = @category ")
+		args["category"] = in.Category
+	}
+
+	if !in.From.IsZero() {
+		fmt.Fprintf(q, "and e.spent_at >= @from ")
+		args["from"] = in.From
+	}
+
+	if !in.To.IsZero() {
+		fmt.Fprintf(q, "and e.spent_at < @to ")
+		args["to"] = in.To
+	}
+
+	if in.Reimbursable {
+		fmt.Fprintf(q, "and e.reimbursable ")
+	}
+
+	return args, nil
+}
+
+func args(in *Expense) pgx.NamedArgs {
+	a := pgx.NamedArgs{
+		"id":              in.Id,
+		"vehicle_id":      in.VehicleId,
+		"user_id":         in.UserId,
+		"trip_id":         nil,
+		"category":        in.Category,
+		"spent_at":        in.SpentAt,
+		"amount_minor":    in.AmountMinor,
+		"currency":        in.Currency,
+		"receipt_file_id": nil,
+		"reimbursable":    in.Reimbursable,
+		"note":            in.Note,
+	}
+
+	if in.TripId != "" {
+		a["trip_id"] = in.TripId
+	}
+
+	if in.ReceiptFileId != "" {
+		a["receipt_file_id"] = in.ReceiptFileId
+	}
+
+	return a
+}
+
+func sorted(m map[string]int64) []*Amount {
+	var out []*Amount
+	for k, v := range m {
+		out = append(out, &Amount{Key: k, AmountMinor: v})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
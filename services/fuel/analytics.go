@@ -0,0 +1,275 @@
+package fuel
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	UnitLitresPer100Km = "l/100km"
+	UnitKmPerKwh       = "km/kwh"
+
+	// Segments further than this many (scaled) MADs from the median are outliers.
+	outlierMads = 3.5
+	// Need at least this many segments before the median/MAD test means anything.
+	minOutlierSamples = 4
+)
+
+// Plausible consumption ranges; anything outside is a bad entry no matter what.
+var bounds = map[string][2]float64{
+	KindFuel:   {1, 60},   // l/100km
+	KindCharge: {1.5, 15}, // km/kWh
+}
+
+type GetFuelAnalyticsRequest struct {
+	VehicleId string    `json:"vehicleId,omitempty"`
+	Kind      string    `json:"kind,omitempty"` // fuel (default) or charge
+	From      time.Time `json:"from,omitempty"` // optional
+	To        time.Time `json:"to,omitempty"`   // optional, exclusive
+}
+
+// Segment is the stretch between two full fills, the only points where we know
+// exactly how much was consumed.
+type Segment struct {
+	FromEntryId string    `json:"fromEntryId,omitempty"`
+	ToEntryId   string    `json:"toEntryId,omitempty"`
+	EndedAt     time.Time `json:"endedAt,omitempty"`
+	DistanceKm  float64   `json:"distanceKm,omitempty"`
+	Volume      float64   `json:"volume,omitempty"`
+	Consumption float64   `json:"consumption,omitempty"` // in FuelAnalytics.Unit
+	Excluded    bool      `json:"excluded,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+type CostPerKm struct {
+	Currency   string  `json:"currency,omitempty"`
+	MinorPerKm float64 `json:"minorPerKm,omitempty"`
+}
+
+type MonthlySpend struct {
+	Month     string  `json:"month,omitempty"` // YYYY-MM
+	Currency  string  `json:"currency,omitempty"`
+	CostMinor int64   `json:"costMinor,omitempty"`
+	Volume    float64 `json:"volume,omitempty"`
+}
+
+type FuelAnalytics struct {
+	Kind               string          `json:"kind,omitempty"`
+	Unit               string          `json:"unit,omitempty"`
+	AverageConsumption float64         `json:"averageConsumption,omitempty"`
+	DistanceKm         float64         `json:"distanceKm,omitempty"` // covered by included segments
+	Volume             float64         `json:"volume,omitempty"`     // consumed in included segments
+	CostPerKm          []*CostPerKm    `json:"costPerKm,omitempty"`
+	Monthly            []*MonthlySpend `json:"monthly,omitempty"`
+	Segments           []*Segment      `json:"segments,omitempty"`
+	ExcludedEntryIds   []string        `json:"excludedEntryIds,omitempty"` // odometer went backwards
+}
+
+// GetFuelAnalytics computes consumption, cost per km and monthly spend for one
+// kind of entry. Consumption is only measured between full fills; segments that
+// look like bad entries are reported but left out of the averages.
+func (s *svc) GetFuelAnalytics(ctx context.Context, in *GetFuelAnalyticsRequest) (*FuelAnalytics, error) {
+	if in.Kind == "" {
+		in.Kind = KindFuel
+	}
+
+	if in.Kind != KindFuel && in.Kind != KindCharge {
+		return nil, status.Errorf(codes.InvalidArgument, "kind must be %v or %v", KindFuel, KindCharge)
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	entries, err := listEntries(ctx, &ListFuelEntriesRequest{
+		VehicleId: in.VehicleId,
+		Kind:      in.Kind,
+		From:      in.From,
+		To:        in.To,
+	}, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("listEntries failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return analyze(in.Kind, entries), nil
+}
+
+// analyze expects entries of a single kind.
+func analyze(kind string, entries []*FuelEntry) *FuelAnalytics {
+	out := FuelAnalytics{Kind: kind, Unit: UnitLitresPer100Km}
+	if kind == KindCharge {
+		out.Unit = UnitKmPerKwh
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].FilledAt.Before(entries[j].FilledAt)
+	})
+
+	// Drop entries whose odometer goes backwards in time; those are typos.
+	var valid []*FuelEntry
+	var maxKms int32
+	for _, e := range entries {
+		if e.OdometerKms < maxKms {
+			out.ExcludedEntryIds = append(out.ExcludedEntryIds, e.Id)
+			continue
+		}
+
+		maxKms = e.OdometerKms
+		valid = append(valid, e)
+	}
+
+	// Volume filled after a full fill, up to and including the next full fill,
+	// is what was burned over that distance.
+	type segcost struct {
+		seg  *Segment
+		cost map[string]int64
+	}
+
+	var segs []*segcost
+	var prev *FuelEntry
+	var vol float64
+	cost := map[string]int64{}
+	for _, e := range valid {
+		if prev != nil {
+			vol += e.Volume
+			if e.CostMinor > 0 {
+				cost[e.Currency] += e.CostMinor
+			}
+		}
+
+		if !e.Full {
+			continue
+		}
+
+		if prev != nil && e.OdometerKms > prev.OdometerKms {
+			seg := Segment{
+				FromEntryId: prev.Id,
+				ToEntryId:   e.Id,
+				EndedAt:     e.FilledAt,
+				DistanceKm:  float64(e.OdometerKms - prev.OdometerKms),
+				Volume:      vol,
+			}
+
+			seg.Consumption = consumption(kind, seg.DistanceKm, seg.Volume)
+			segs = append(segs, &segcost{seg: &seg, cost: cost})
+		}
+
+		prev, vol, cost = e, 0, map[string]int64{}
+	}
+
+	var values []float64
+	for _, v := range segs {
+		b := bounds[kind]
+		if v.seg.Consumption < b[0] || v.seg.Consumption > b[1] {
+			v.seg.Excluded, v.seg.Reason = true, "implausible consumption"
+			continue
+		}
+
+		values = append(values, v.seg.Consumption)
+	}
+
+	// Robust outlier test: distance from the median in units of the (normal-scaled)
+	// median absolute deviation, which a single bad entry can't drag around.
+	if len(values) >= minOutlierSamples {
+		med := median(values)
+		var dev []float64
+		for _, v := range values {
+			dev = append(dev, math.Abs(v-med))
+		}
+
+		mad := median(dev) * 1.4826
+		if mad > 0 {
+			for _, v := range segs {
+				if !v.seg.Excluded && math.Abs(v.seg.Consumption-med)/mad > outlierMads {
+					v.seg.Excluded, v.seg.Reason = true, "outlier"
+				}
+			}
+		}
+	}
+
+	costs := map[string]int64{}
+	for _, v := range segs {
+		out.Segments = append(out.Segments, v.seg)
+		if v.seg.Excluded {
+			continue
+		}
+
+		out.DistanceKm += v.seg.DistanceKm
+		out.Volume += v.seg.Volume
+		for c, n := range v.cost {
+			costs[c] += n
+		}
+	}
+
+	if out.DistanceKm > 0 && out.Volume > 0 {
+		out.AverageConsumption = consumption(kind, out.DistanceKm, out.Volume)
+		for _, c := range sortedKeys(costs) {
+			out.CostPerKm = append(out.CostPerKm, &CostPerKm{
+				Currency:   c,
+				MinorPerKm: float64(costs[c]) / out.DistanceKm,
+			})
+		}
+	}
+
+	// Spend is what was paid, regardless of whether consumption could be measured.
+	monthly := map[[2]string]*MonthlySpend{}
+	for _, e := range entries {
+		k := [2]string{e.FilledAt.UTC().Format("2006-01"), e.Currency}
+		m, ok := monthly[k]
+		if !ok {
+			m = &MonthlySpend{Month: k[0], Currency: k[1]}
+			monthly[k] = m
+			out.Monthly = append(out.Monthly, m)
+		}
+
+		m.CostMinor += e.CostMinor
+		m.Volume += e.Volume
+	}
+
+	sort.SliceStable(out.Monthly, func(i, j int) bool {
+		if out.Monthly[i].Month != out.Monthly[j].Month {
+			return out.Monthly[i].Month < out.Monthly[j].Month
+		}
+
+		return out.Monthly[i].Currency < out.Monthly[j].Currency
+	})
+
+	return &out
+}
+
+func consumption(kind string, km, volume float64) float64 {
+	if kind == KindCharge {
+		return km / volume
+	}
+
+	return volume / km * 100
+}
+
+func median(v []float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+func sortedKeys(m map[string]int64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
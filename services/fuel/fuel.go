@@ -0,0 +1,219 @@
+package fuel
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	KindFuel   = "fuel"   // volume in litres
+	KindCharge = "charge" // volume in kWh
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type FuelEntry struct {
+	Id          string    `json:"id,omitempty"`
+	VehicleId   string    `json:"vehicleId,omitempty"`
+	Kind        string    `json:"kind,omitempty"`
+	FilledAt    time.Time `json:"filledAt,omitempty"`
+	Volume      float64   `json:"volume,omitempty"`
+	CostMinor   int64     `json:"costMinor,omitempty"`
+	Currency    string    `json:"currency,omitempty"`
+	OdometerKms int32     `json:"odometerKms,omitempty"`
+	Full        bool      `json:"full,omitempty"`
+}
+
+type ListFuelEntriesRequest struct {
+	VehicleId string    `json:"vehicleId,omitempty"`
+	Kind      string    `json:"kind,omitempty"` // optional
+	From      time.Time `json:"from,omitempty"` // optional
+	To        time.Time `json:"to,omitempty"`   // optional, exclusive
+}
+
+type ListFuelEntriesResponse struct {
+	Entries []*FuelEntry `json:"entries,omitempty"`
+}
+
+type DeleteFuelEntryRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+func (s *svc) CreateFuelEntry(ctx context.Context, in *FuelEntry) (*FuelEntry, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateFuelEntry input=%v", string(b))
+	switch {
+	case in.Kind != KindFuel && in.Kind != KindCharge:
+		return nil, status.Errorf(codes.InvalidArgument, "kind must be %v or %v", KindFuel, KindCharge)
+	case in.FilledAt.IsZero():
+		return nil, status.Errorf(codes.InvalidArgument, "fill time is empty")
+	case in.FilledAt.After(time.Now().Add(time.Hour)):
+		return nil, status.Errorf(codes.InvalidArgument, "fill time is in the future")
+	case in.Volume <= 0:
+		return nil, status.Errorf(codes.InvalidArgument, "volume must be positive")
+	case in.OdometerKms <= 0:
+		return nil, status.Errorf(codes.InvalidArgument, "odometer is empty")
+	case in.CostMinor < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "cost must not be negative")
+	}
+
+	if in.CostMinor > 0 || in.Currency != "" {
+		c, ok := money.NormalizeCurrency(in.Currency)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+		}
+
+		in.Currency = c
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	in.Id = uuid.NewString()
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into fuel_entries (id, vehicle_id, user_id, kind, filled_at, ")
+	fmt.Fprintf(&q, "volume, cost_minor, currency, odometer_kms, full) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @user_id, @kind, @filled_at, ")
+	fmt.Fprintf(&q, "@volume, @cost_minor, @currency, @odometer_kms, @full)")
+	args := pgx.NamedArgs{
+		"id":           in.Id,
+		"vehicle_id":   in.VehicleId,
+		"user_id":      s.Config.UserInfo.Id,
+		"kind":         in.Kind,
+		"filled_at":    in.FilledAt,
+		"volume":       in.Volume,
+		"cost_minor":   in.CostMinor,
+		"currency":     in.Currency,
+		"odometer_kms": in.OdometerKms,
+		"full":         in.Full,
+	}
+
+	_, err = tx.Exec(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	// Keep the vehicle's odometer current.
+	_, err = tx.Exec(ctx, "update vehicles set kms = $2, version = version + 1 where id = $1 and kms < $2", in.VehicleId, in.OdometerKms)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+func (s *svc) ListFuelEntries(ctx context.Context, in *ListFuelEntriesRequest) (*ListFuelEntriesResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	entries, err := listEntries(ctx, in, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("listEntries failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &ListFuelEntriesResponse{Entries: entries}, nil
+}
+
+func (s *svc) DeleteFuelEntry(ctx context.Context, in *DeleteFuelEntryRequest) (*emptypb.Empty, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "delete from fuel_entries e using vehicles v ")
+	fmt.Fprintf(&q, "where e.id = $1 and e.user_id = $2 ")
+	fmt.Fprintf(&q, "and v.id = e.vehicle_id and v.user_id = $2 and v.deleted_at is null")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), in.Id, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "fuel entry not found")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// listEntries returns the user's entries for a vehicle ordered by odometer.
+func listEntries(ctx context.Context, in *ListFuelEntriesRequest, userId string) ([]*FuelEntry, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, kind, filled_at, volume, ")
+	fmt.Fprintf(&q, "cost_minor, currency, odometer_kms, full ")
+	fmt.Fprintf(&q, "from fuel_entries ")
+	fmt.Fprintf(&q, "where vehicle_id = @vehicle_id and user_id = @user_id ")
+	args := pgx.NamedArgs{"vehicle_id": in.VehicleId, "user_id": userId}
+	if in.Kind != "" {
+		fmt.Fprintf(&q, "and kind = @kind ")
+		args["kind"] = in.Kind
+	}
+
+	if !in.From.IsZero() {
+		fmt.Fprintf(&q, "and filled_at >= @from ")
+		args["from"] = in.From
+	}
+
+	if !in.To.IsZero() {
+		fmt.Fprintf(&q, "and filled_at < @to ")
+		args["to"] = in.To
+	}
+
+	fmt.Fprintf(&q, "order by odometer_kms, filled_at")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var entries []*FuelEntry
+	for rows.Next() {
+		var e FuelEntry
+		err = rows.Scan(&e.Id, &e.VehicleId, &e.Kind, &e.FilledAt, &e.Volume,
+			&e.CostMinor, &e.Currency, &e.OdometerKms, &e.Full)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &e)
+	}
+
+	return entries, rows.Err()
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
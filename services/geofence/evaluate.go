@@ -0,0 +1,482 @@
+package geofence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/notify"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	StateUnknown = "unknown"
+	StateInside  = "inside"
+	StateOutside = "outside"
+
+	evalBatchSamples = 5000
+
+	// Samples of a transaction still open when the cursor moves past its
+	// received_at would be skipped; this is ample for an ingestion flush.
+	evalSettleDelay = time.Second * 10
+)
+
+type thresholds struct {
+	exitBuffer  float64
+	dwell       time.Duration
+	maxAccuracy float64
+}
+
+func thresholdsFrom(c global.GeofenceConfig) thresholds {
+	t := thresholds{exitBuffer: 30, dwell: time.Second * 30, maxAccuracy: 100}
+	if c.ExitBufferM > 0 {
+		t.exitBuffer = c.ExitBufferM
+	}
+
+	if c.DwellSeconds > 0 {
+		t.dwell = time.Second * time.Duration(c.DwellSeconds)
+	}
+
+	if c.MaxAccuracyM > 0 {
+		t.maxAccuracy = c.MaxAccuracyM
+	}
+
+	return t
+}
+
+// RunGeofences evaluates new telemetry of vehicles with geofences, storing and
+// notifying enter and exit events. To keep GPS jitter from producing events, a
+// vehicle enters once inside the fence and exits once further than the exit
+// buffer outside it, and either only counts after holding for the dwell time.
+// Where a vehicle first is relative to a fence sets its state without an event.
+func RunGeofences(ctx context.Context, every time.Duration, config global.GeofenceConfig) {
+	t := thresholdsFrom(config)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		pairs, err := pending(ctx)
+		if err != nil {
+			glog.Errorf("pending failed: %v", err)
+		}
+
+		for _, p := range pairs {
+			for {
+				n, err := evaluate(ctx, p[0], p[1], t)
+				if err != nil {
+					glog.Errorf("evaluate failed: %v", err)
+				}
+
+				if err != nil || n < evalBatchSamples {
+					break
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pending returns the vehicle and driver pairs with telemetry not evaluated yet.
+func pending(ctx context.Context) ([][2]string, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select distinct t.vehicle_id, t.user_id from geofence_vehicles gv ")
+	fmt.Fprintf(&q, "join telemetry_samples t on t.vehicle_id = gv.vehicle_id ")
+	fmt.Fprintf(&q, "and t.received_at > gv.created_at and t.received_at < $1 ")
+	fmt.Fprintf(&q, "left join geofence_cursors c on c.vehicle_id = t.vehicle_id and c.user_id = t.user_id ")
+	fmt.Fprintf(&q, "where c.vehicle_id is null or (t.received_at, t.seq) > (c.received_at, c.seq)")
+	rows, err := global.PgxPool.Query(ctx, q.String(), time.Now().Add(-evalSettleDelay))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var out [][2]string
+	for rows.Next() {
+		var p [2]string
+		if err = rows.Scan(&p[0], &p[1]); err != nil {
+			return nil, err
+		}
+
+		out = append(out, p)
+	}
+
+	return out, rows.Err()
+}
+
+// state is a geofence_states row.
+type state struct {
+	state          string
+	candidateSince time.Time
+	candidate      geo.Point
+	lastAt         time.Time
+}
+
+type event struct {
+	fence *Geofence
+	typ   string
+	at    time.Time
+	p     geo.Point
+}
+
+// step advances st by a sample d meters from the fence's boundary (negative
+// inside). Once a change has held for the dwell time, returns the event type
+// and the time and place of the change's first sample.
+func (st *state) step(at time.Time, p geo.Point, d float64, t thresholds) (string, time.Time, geo.Point) {
+	st.lastAt = at
+	var target string
+	switch {
+	case d < 0:
+		target = StateInside
+	case d > t.exitBuffer:
+		target = StateOutside
+	}
+
+	switch {
+	case target == "" || target == st.state:
+		st.candidateSince = time.Time{}
+		return "", time.Time{}, geo.Point{}
+	case st.state == StateUnknown:
+		st.state = target
+		return "", time.Time{}, geo.Point{}
+	case st.candidateSince.IsZero():
+		st.candidateSince, st.candidate = at, p
+	}
+
+	if at.Sub(st.candidateSince) < t.dwell {
+		return "", time.Time{}, geo.Point{}
+	}
+
+	since := st.candidateSince
+	st.state = target
+	st.candidateSince = time.Time{}
+	if target == StateInside {
+		return EventEnter, since, st.candidate
+	}
+
+	return EventExit, since, st.candidate
+}
+
+type evalSample struct {
+	seq        int64
+	receivedAt time.Time
+	at         time.Time
+	p          geo.Point
+	accuracy   float32
+}
+
+// evaluate runs the next batch of a driver's telemetry for a vehicle through
+// the geofences that apply: the driver's own, and those of the vehicle's org if
+// the driver is a member. Returns the number of samples read.
+func evaluate(ctx context.Context, vehicleId, userId string, t thresholds) (int, error) {
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "insert into geofence_cursors (vehicle_id, user_id, received_at, seq) "+
+		"values ($1, $2, 'epoch', 0) on conflict do nothing", vehicleId, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Another instance evaluating the pair holds the lock.
+	var cursorAt time.Time
+	var cursorSeq int64
+	err = tx.QueryRow(ctx, "select received_at, seq from geofence_cursors where vehicle_id = $1 "+
+		"and user_id = $2 for update skip locked", vehicleId, userId).Scan(&cursorAt, &cursorSeq)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select seq, received_at, recorded_at, lat, lon, accuracy_m from telemetry_samples ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 and (received_at, seq) > ($3, $4) ")
+	fmt.Fprintf(&q, "and received_at < $5 order by received_at, seq limit $6")
+	rows, err := tx.Query(ctx, q.String(), vehicleId, userId, cursorAt, cursorSeq,
+		time.Now().Add(-evalSettleDelay), evalBatchSamples)
+	if err != nil {
+		return 0, err
+	}
+
+	var samples []*evalSample
+	for rows.Next() {
+		var sm evalSample
+		err = rows.Scan(&sm.seq, &sm.receivedAt, &sm.at, &sm.p.Lat, &sm.p.Lon, &sm.accuracy)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		samples = append(samples, &sm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(samples) == 0 {
+		return 0, tx.Commit(ctx)
+	}
+
+	fences, err := applicable(ctx, tx, vehicleId, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []*event
+	if len(fences) > 0 {
+		events, err = run(ctx, tx, vehicleId, userId, fences, samples, t)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	last := samples[len(samples)-1]
+	_, err = tx.Exec(ctx, "update geofence_cursors set received_at = $3, seq = $4 where vehicle_id = $1 "+
+		"and user_id = $2", vehicleId, userId, last.receivedAt, last.seq)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	if len(events) > 0 {
+		alert(ctx, vehicleId, events)
+	}
+
+	return len(samples), nil
+}
+
+// assignedFence is a geofence with the time it was assigned to the vehicle.
+type assignedFence struct {
+	*Geofence
+	assignedAt time.Time
+}
+
+func applicable(ctx context.Context, tx pgx.Tx, vehicleId, userId string) ([]*assignedFence, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from geofences g join vehicles v on v.id = $1 ", geofenceColumns)
+	fmt.Fprintf(&q, "where g.id in (select geofence_id from geofence_vehicles where vehicle_id = $1) ")
+	fmt.Fprintf(&q, "and v.deleted_at is null and ((g.org_id is null and g.user_id = $2) or ")
+	fmt.Fprintf(&q, "(g.org_id = v.org_id and exists(select 1 from org_members m ")
+	fmt.Fprintf(&q, "where m.org_id = g.org_id and m.user_id = $2))) order by g.id")
+	rows, err := tx.Query(ctx, q.String(), vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := scanGeofences(rows)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, "select geofence_id, created_at from geofence_vehicles where vehicle_id = $1",
+		vehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	assigned := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var at time.Time
+		if err = rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+
+		assigned[id] = at
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]*assignedFence, len(list))
+	for i, g := range list {
+		out[i] = &assignedFence{Geofence: g, assignedAt: assigned[g.Id]}
+	}
+
+	return out, nil
+}
+
+// run steps each fence's state through the samples, in recorded order, and
+// stores the new states and any events.
+func run(ctx context.Context, tx pgx.Tx, vehicleId, userId string, fences []*assignedFence,
+	samples []*evalSample, t thresholds) ([]*event, error) {
+	var usable []*evalSample
+	for _, sm := range samples {
+		if float64(sm.accuracy) <= t.maxAccuracy {
+			usable = append(usable, sm)
+		}
+	}
+
+	sort.SliceStable(usable, func(i, j int) bool {
+		if !usable[i].at.Equal(usable[j].at) {
+			return usable[i].at.Before(usable[j].at)
+		}
+
+		return usable[i].seq < usable[j].seq
+	})
+
+	states := map[string]*state{}
+	var q strings.Builder
+	fmt.Fprintf(&q, "select geofence_id, state, candidate_since, candidate_lat, candidate_lon, last_at ")
+	fmt.Fprintf(&q, "from geofence_states where vehicle_id = $1 and user_id = $2")
+	rows, err := tx.Query(ctx, q.String(), vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id string
+		var st state
+		var since *time.Time
+		var lat, lon *float64
+		if err = rows.Scan(&id, &st.state, &since, &lat, &lon, &st.lastAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if since != nil && lat != nil && lon != nil {
+			st.candidateSince, st.candidate = *since, geo.Point{Lat: *lat, Lon: *lon}
+		}
+
+		states[id] = &st
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []*event
+	q.Reset()
+	fmt.Fprintf(&q, "insert into geofence_states (geofence_id, vehicle_id, user_id, state, ")
+	fmt.Fprintf(&q, "candidate_since, candidate_lat, candidate_lon, last_at) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6, $7, $8) on conflict (geofence_id, vehicle_id, user_id) ")
+	fmt.Fprintf(&q, "do update set state = excluded.state, candidate_since = excluded.candidate_since, ")
+	fmt.Fprintf(&q, "candidate_lat = excluded.candidate_lat, candidate_lon = excluded.candidate_lon, ")
+	fmt.Fprintf(&q, "last_at = excluded.last_at")
+	for _, g := range fences {
+		st := states[g.Id]
+		if st == nil {
+			st = &state{state: StateUnknown}
+		}
+
+		var stepped bool
+		for _, sm := range usable {
+			// Samples older than what was evaluated, e.g. from an offline
+			// upload, can't change the past.
+			if !sm.receivedAt.After(g.assignedAt) || !sm.at.After(st.lastAt) {
+				continue
+			}
+
+			stepped = true
+			if typ, at, p := st.step(sm.at, sm.p, distance(g.Geofence, sm.p), t); typ != "" {
+				events = append(events, &event{fence: g.Geofence, typ: typ, at: at, p: p})
+			}
+		}
+
+		if !stepped {
+			continue
+		}
+
+		var since *time.Time
+		var lat, lon *float64
+		if !st.candidateSince.IsZero() {
+			since, lat, lon = &st.candidateSince, &st.candidate.Lat, &st.candidate.Lon
+		}
+
+		_, err = tx.Exec(ctx, q.String(), g.Id, vehicleId, userId, st.state, since, lat, lon, st.lastAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into geofence_events (id, geofence_id, vehicle_id, user_id, type, at, lat, lon) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6, $7, $8)")
+	for _, e := range events {
+		_, err = tx.Exec(ctx, q.String(), uuid.NewString(), e.fence.Id, vehicleId, userId, e.typ, e.at,
+			e.p.Lat, e.p.Lon)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// alert notifies the creator of each fence and, for org fences, the org's
+// admins.
+func alert(ctx context.Context, vehicleId string, events []*event) {
+	var mk, model string
+	err := global.PgxPool.QueryRow(ctx, "select make, model from vehicles where id = $1",
+		vehicleId).Scan(&mk, &model)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return
+	}
+
+	name := strings.TrimSpace(mk + " " + model)
+	for _, e := range events {
+		users := []string{e.fence.UserId}
+		if e.fence.OrgId != "" {
+			rows, err := global.PgxPool.Query(ctx, "select user_id from org_members where org_id = $1 "+
+				"and role = 'admin' and user_id <> $2", e.fence.OrgId, e.fence.UserId)
+			if err != nil {
+				glog.Errorf("Query failed: %v", err)
+				continue
+			}
+
+			for rows.Next() {
+				var id string
+				if err = rows.Scan(&id); err == nil {
+					users = append(users, id)
+				}
+			}
+
+			rows.Close()
+		}
+
+		verb := "entered"
+		if e.typ == EventExit {
+			verb = "left"
+		}
+
+		for _, userId := range users {
+			n := notify.Notification{
+				UserId: userId,
+				Kind:   "geofence." + e.typ,
+				Title:  fmt.Sprintf("%v %v %v", name, verb, e.fence.Name),
+				Body:   fmt.Sprintf("%v %v %v at %v UTC.", name, verb, e.fence.Name, e.at.UTC().Format("Jan 2, 15:04")),
+				Data: map[string]string{
+					"vehicleId":  vehicleId,
+					"geofenceId": e.fence.Id,
+					"type":       e.typ,
+				},
+			}
+
+			if err = global.Notifier.Notify(ctx, &n); err != nil {
+				glog.Errorf("Notify failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package geofence
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	ShapeCircle  = "circle"
+	ShapePolygon = "polygon"
+
+	EventEnter = "enter"
+	EventExit  = "exit"
+
+	maxNameLen       = 100
+	minRadiusM       = 20 // GPS can't tell much smaller circles apart
+	maxRadiusM       = 50000
+	maxPolygonPoints = 200
+	maxPolygonSpanM  = 100000
+	maxVehicles      = 1000
+	defaultEvents    = 100
+	maxEvents        = 1000
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// Geofence is a circle (Center and RadiusM) or a polygon. Without OrgId it's the
+// creator's own and applies to their drives only; with OrgId it's managed by the
+// org's admins, visible to members, and applies to any member's drives.
+type Geofence struct {
+	Id         string       `json:"id,omitempty"`
+	OrgId      string       `json:"orgId,omitempty"`
+	UserId     string       `json:"userId,omitempty"` // creator; set by the server
+	Name       string       `json:"name,omitempty"`
+	Shape      string       `json:"shape,omitempty"` // circle, polygon
+	Center     *geo.Point   `json:"center,omitempty"`
+	RadiusM    float64      `json:"radiusM,omitempty"`
+	Polygon    []*geo.Point `json:"polygon,omitempty"`    // 3 to 200 points, not closed
+	VehicleIds []string     `json:"vehicleIds,omitempty"` // set on create or with SetGeofenceVehicles
+	CreatedAt  time.Time    `json:"createdAt,omitempty"`
+	UpdatedAt  time.Time    `json:"updatedAt,omitempty"`
+}
+
+type DeleteGeofenceRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+// ListGeofencesRequest lists an org's geofences, or the caller's own if OrgId is
+// empty.
+type ListGeofencesRequest struct {
+	OrgId string `json:"orgId,omitempty"`
+}
+
+type ListGeofencesResponse struct {
+	Geofences []*Geofence `json:"geofences,omitempty"` // by name
+}
+
+// SetGeofenceVehiclesRequest replaces the vehicles a geofence applies to. Org
+// geofences take the org's vehicles, personal ones the creator's.
+type SetGeofenceVehiclesRequest struct {
+	GeofenceId string   `json:"geofenceId,omitempty"`
+	VehicleIds []string `json:"vehicleIds,omitempty"`
+}
+
+type GeofenceEvent struct {
+	Id         string     `json:"id,omitempty"`
+	GeofenceId string     `json:"geofenceId,omitempty"`
+	VehicleId  string     `json:"vehicleId,omitempty"`
+	UserId     string     `json:"userId,omitempty"` // driver
+	Type       string     `json:"type,omitempty"`   // enter, exit
+	At         time.Time  `json:"at,omitempty"`     // first sample past the boundary
+	Location   *geo.Point `json:"location,omitempty"`
+}
+
+// ListGeofenceEventsRequest needs a geofence, a vehicle, or both.
+type ListGeofenceEventsRequest struct {
+	GeofenceId string    `json:"geofenceId,omitempty"`
+	VehicleId  string    `json:"vehicleId,omitempty"`
+	From       time.Time `json:"from,omitempty"`  // optional
+	To         time.Time `json:"to,omitempty"`    // optional, exclusive
+	Limit      int32     `json:"limit,omitempty"` // default 100
+}
+
+type ListGeofenceEventsResponse struct {
+	Events []*GeofenceEvent `json:"events,omitempty"` // newest first
+}
+
+// CreateGeofence creates a personal geofence, or an org geofence if the caller
+// is an admin of the org.
+func (s *svc) CreateGeofence(ctx context.Context, in *Geofence) (*Geofence, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateGeofence input=%v", string(b))
+	if err := validate(in); err != nil {
+		return nil, err
+	}
+
+	if in.OrgId != "" {
+		if err := s.checkOrg(ctx, in.OrgId, true); err != nil {
+			return nil, err
+		}
+	}
+
+	in.Id = uuid.NewString()
+	in.UserId = s.Config.UserInfo.Id
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into geofences (id, user_id, org_id, name, shape, center_lat, center_lon, ")
+	fmt.Fprintf(&q, "radius_m, polygon) values (@id, @user_id, @org_id, @name, @shape, @center_lat, ")
+	fmt.Fprintf(&q, "@center_lon, @radius_m, @polygon) returning created_at, updated_at")
+	err = tx.QueryRow(ctx, q.String(), args(in)).Scan(&in.CreatedAt, &in.UpdatedAt)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = s.setVehicles(ctx, tx, in, in.VehicleIds); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+// UpdateGeofence changes the name and shape of a geofence the caller manages.
+// The org and vehicles can't change here. A new shape starts evaluation over.
+func (s *svc) UpdateGeofence(ctx context.Context, in *Geofence) (*Geofence, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("UpdateGeofence input=%v", string(b))
+	old, err := s.get(ctx, in.Id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.OrgId != "" && in.OrgId != old.OrgId {
+		return nil, status.Errorf(codes.InvalidArgument, "org can't be changed")
+	}
+
+	in.OrgId, in.UserId, in.VehicleIds, in.CreatedAt = old.OrgId, old.UserId, old.VehicleIds, old.CreatedAt
+	if err = validate(in); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "update geofences set name = @name, shape = @shape, center_lat = @center_lat, ")
+	fmt.Fprintf(&q, "center_lon = @center_lon, radius_m = @radius_m, polygon = @polygon, ")
+	fmt.Fprintf(&q, "updated_at = now() where id = @id returning updated_at")
+	if err = tx.QueryRow(ctx, q.String(), args(in)).Scan(&in.UpdatedAt); err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if !sameShape(old, in) {
+		if _, err = tx.Exec(ctx, "delete from geofence_states where geofence_id = $1", in.Id); err != nil {
+			glog.Errorf("Exec failed: %v", err)
+			return nil, internal.InternalErr
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+// DeleteGeofence deletes a geofence the caller manages, with its events.
+func (s *svc) DeleteGeofence(ctx context.Context, in *DeleteGeofenceRequest) (*emptypb.Empty, error) {
+	if _, err := s.get(ctx, in.Id, true); err != nil {
+		return nil, err
+	}
+
+	if _, err := global.PgxPool.Exec(ctx, "delete from geofences where id = $1", in.Id); err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListGeofences returns an org's geofences, or the caller's personal ones.
+func (s *svc) ListGeofences(ctx context.Context, in *ListGeofencesRequest) (*ListGeofencesResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListGeofences input=%v", string(b))
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from geofences g ", geofenceColumns)
+	args := pgx.NamedArgs{"user_id": s.Config.UserInfo.Id}
+	if in.OrgId != "" {
+		if err := s.checkOrg(ctx, in.OrgId, false); err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&q, "where g.org_id = @org_id ")
+		args["org_id"] = in.OrgId
+	} else {
+		fmt.Fprintf(&q, "where g.org_id is null and g.user_id = @user_id ")
+	}
+
+	fmt.Fprintf(&q, "order by g.name, g.id")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	var out ListGeofencesResponse
+	out.Geofences, err = scanGeofences(rows)
+	if err != nil {
+		glog.Errorf("scanGeofences failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// SetGeofenceVehicles replaces the vehicles of a geofence the caller manages.
+func (s *svc) SetGeofenceVehicles(ctx context.Context, in *SetGeofenceVehiclesRequest) (*Geofence, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("SetGeofenceVehicles input=%v", string(b))
+	g, err := s.get(ctx, in.GeofenceId, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	if err = s.setVehicles(ctx, tx, g, in.VehicleIds); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return g, nil
+}
+
+// ListGeofenceEvents returns enter and exit events of the geofences the caller
+// can see. Locations inside the driver's privacy zones are moved to their edge.
+func (s *svc) ListGeofenceEvents(ctx context.Context, in *ListGeofenceEventsRequest) (*ListGeofenceEventsResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListGeofenceEvents input=%v", string(b))
+	limit := in.Limit
+	switch {
+	case in.GeofenceId == "" && in.VehicleId == "":
+		return nil, status.Errorf(codes.InvalidArgument, "geofence or vehicle id is required")
+	case limit == 0:
+		limit = defaultEvents
+	case limit < 0 || limit > maxEvents:
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %v", maxEvents)
+	}
+
+	userId := s.Config.UserInfo.Id
+	var q strings.Builder
+	fmt.Fprintf(&q, "select e.id, e.geofence_id, e.vehicle_id, e.user_id, e.type, e.at, e.lat, e.lon ")
+	fmt.Fprintf(&q, "from geofence_events e join geofences g on g.id = e.geofence_id ")
+	fmt.Fprintf(&q, "where %v ", visible)
+	args := pgx.NamedArgs{"user_id": userId, "limit": limit}
+	if in.GeofenceId != "" {
+		fmt.Fprintf(&q, "and e.geofence_id = @geofence_id ")
+		args["geofence_id"] = in.GeofenceId
+	}
+
+	if in.VehicleId != "" {
+		if err := internal.CheckVehicleAccess(ctx, in.VehicleId, userId); err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&q, "and e.vehicle_id = @vehicle_id ")
+		args["vehicle_id"] = in.VehicleId
+	}
+
+	if !in.From.IsZero() {
+		fmt.Fprintf(&q, "and e.at >= @from ")
+		args["from"] = in.From
+	}
+
+	if !in.To.IsZero() {
+		fmt.Fprintf(&q, "and e.at < @to ")
+		args["to"] = in.To
+	}
+
+	fmt.Fprintf(&q, "order by e.at desc, e.id limit @limit")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListGeofenceEventsResponse
+	for rows.Next() {
+		e := GeofenceEvent{Location: &geo.Point{}}
+		err = rows.Scan(&e.Id, &e.GeofenceId, &e.VehicleId, &e.UserId, &e.Type, &e.At,
+			&e.Location.Lat, &e.Location.Lon)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Events = append(out.Events, &e)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	zones := map[string][]geo.Circle{} // by driver
+	for _, e := range out.Events {
+		if _, ok := zones[e.UserId]; !ok {
+			if zones[e.UserId], err = privacy.Zones(ctx, e.UserId); err != nil {
+				glog.Errorf("Zones failed: %v", err)
+				return nil, internal.InternalErr
+			}
+		}
+
+		privacy.Mask(e.Location, zones[e.UserId])
+	}
+
+	return &out, nil
+}
+
+// visible is a condition on geofences g for those the caller (@user_id) can see:
+// their personal ones and those of their orgs.
+const visible = "((g.org_id is null and g.user_id = @user_id) or g.org_id in " +
+	"(select m.org_id from org_members m where m.user_id = @user_id))"
+
+// get returns a geofence the caller can see, or with manage, manage.
+func (s *svc) get(ctx context.Context, id string, manage bool) (*Geofence, error) {
+	if id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "geofence id is empty")
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from geofences g where g.id = @id and %v", geofenceColumns, visible)
+	rows, err := global.PgxPool.Query(ctx, q.String(), pgx.NamedArgs{"id": id, "user_id": s.Config.UserInfo.Id})
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	list, err := scanGeofences(rows)
+	switch {
+	case err != nil:
+		glog.Errorf("scanGeofences failed: %v", err)
+		return nil, internal.InternalErr
+	case len(list) == 0:
+		return nil, status.Errorf(codes.NotFound, "geofence not found")
+	}
+
+	g := list[0]
+	if manage && g.OrgId != "" {
+		if err = s.checkOrg(ctx, g.OrgId, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// checkOrg checks that the caller is a member of the org, or an admin.
+func (s *svc) checkOrg(ctx context.Context, orgId string, admin bool) error {
+	var role string
+	err := global.PgxPool.QueryRow(ctx, "select role from org_members where org_id = $1 and user_id = $2",
+		orgId, s.Config.UserInfo.Id).Scan(&role)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return status.Errorf(codes.NotFound, "org not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	case admin && role != "admin":
+		return status.Errorf(codes.PermissionDenied, "only org admins can manage org geofences")
+	}
+
+	return nil
+}
+
+// setVehicles replaces the vehicles of g. Vehicles keep their assignment time,
+// which bounds the telemetry evaluated for them.
+func (s *svc) setVehicles(ctx context.Context, tx pgx.Tx, g *Geofence, vehicleIds []string) error {
+	var ids []string
+	for _, id := range vehicleIds {
+		if !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) > maxVehicles {
+		return status.Errorf(codes.InvalidArgument, "at most %v vehicles per geofence", maxVehicles)
+	}
+
+	for _, id := range ids {
+		if g.OrgId == "" {
+			if err := internal.CheckVehicleAccess(ctx, id, g.UserId); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		var ok bool
+		err := tx.QueryRow(ctx, "select exists(select 1 from vehicles where id = $1 and org_id = $2 "+
+			"and deleted_at is null)", id, g.OrgId).Scan(&ok)
+		if err != nil {
+			glog.Errorf("QueryRow failed: %v", err)
+			return internal.InternalErr
+		}
+
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "vehicle %v is not one of the org's vehicles", id)
+		}
+	}
+
+	_, err := tx.Exec(ctx, "delete from geofence_vehicles where geofence_id = $1 and "+
+		"not (vehicle_id = any($2))", g.Id, ids)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return internal.InternalErr
+	}
+
+	for _, id := range ids {
+		_, err = tx.Exec(ctx, "insert into geofence_vehicles (geofence_id, vehicle_id) values ($1, $2) "+
+			"on conflict do nothing", g.Id, id)
+		if err != nil {
+			glog.Errorf("Exec failed: %v", err)
+			return internal.InternalErr
+		}
+	}
+
+	g.VehicleIds = ids
+	return nil
+}
+
+func validate(in *Geofence) error {
+	in.Name = strings.TrimSpace(in.Name)
+	switch {
+	case in.Name == "" || utf8.RuneCountInString(in.Name) > maxNameLen:
+		return status.Errorf(codes.InvalidArgument, "name must have 1 to %v characters", maxNameLen)
+	case in.Shape == ShapeCircle:
+		switch {
+		case in.Center == nil || !validPoint(in.Center):
+			return status.Errorf(codes.InvalidArgument, "circle needs a valid center")
+		case !(in.RadiusM >= minRadiusM && in.RadiusM <= maxRadiusM):
+			return status.Errorf(codes.InvalidArgument, "radius must be between %v and %v m", minRadiusM, maxRadiusM)
+		}
+
+		in.Polygon = nil
+	case in.Shape == ShapePolygon:
+		if len(in.Polygon) < 3 || len(in.Polygon) > maxPolygonPoints {
+			return status.Errorf(codes.InvalidArgument, "polygon must have 3 to %v points", maxPolygonPoints)
+		}
+
+		for _, p := range in.Polygon {
+			if p == nil || !validPoint(p) {
+				return status.Errorf(codes.InvalidArgument, "polygon has an invalid point")
+			}
+
+			if geo.Distance(*in.Polygon[0], *p) > maxPolygonSpanM {
+				return status.Errorf(codes.InvalidArgument, "polygon must span less than %v km", maxPolygonSpanM/1000)
+			}
+		}
+
+		in.Center, in.RadiusM = nil, 0
+	default:
+		return status.Errorf(codes.InvalidArgument, "shape must be %v or %v", ShapeCircle, ShapePolygon)
+	}
+
+	return nil
+}
+
+func validPoint(p *geo.Point) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180 && !(p.Lat == 0 && p.Lon == 0)
+}
+
+func sameShape(a, b *Geofence) bool {
+	if a.Shape != b.Shape || a.RadiusM != b.RadiusM || (a.Center == nil) != (b.Center == nil) ||
+		len(a.Polygon) != len(b.Polygon) {
+		return false
+	}
+
+	if a.Center != nil && *a.Center != *b.Center {
+		return false
+	}
+
+	for i := range a.Polygon {
+		if *a.Polygon[i] != *b.Polygon[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func args(in *Geofence) pgx.NamedArgs {
+	a := pgx.NamedArgs{
+		"id":         in.Id,
+		"user_id":    in.UserId,
+		"org_id":     nil,
+		"name":       in.Name,
+		"shape":      in.Shape,
+		"center_lat": nil,
+		"center_lon": nil,
+		"radius_m":   nil,
+		"polygon":    nil,
+	}
+
+	if in.OrgId != "" {
+		a["org_id"] = in.OrgId
+	}
+
+	if in.Center != nil {
+		a["center_lat"], a["center_lon"], a["radius_m"] = in.Center.Lat, in.Center.Lon, in.RadiusM
+	}
+
+	if in.Polygon != nil {
+		b, _ := json.Marshal(in.Polygon)
+		a["polygon"] = string(b)
+	}
+
+	return a
+}
+
+const geofenceColumns = "g.id, coalesce(g.org_id, ''), g.user_id, g.name, g.shape, g.center_lat, " +
+	"g.center_lon, g.radius_m, g.polygon, g.created_at, g.updated_at, array(select gv.vehicle_id " +
+	"from geofence_vehicles gv where gv.geofence_id = g.id order by gv.vehicle_id)"
+
+func scanGeofences(rows pgx.Rows) ([]*Geofence, error) {
+	defer rows.Close()
+	var out []*Geofence
+	for rows.Next() {
+		var g Geofence
+		var lat, lon, radius *float64
+		err := rows.Scan(&g.Id, &g.OrgId, &g.UserId, &g.Name, &g.Shape, &lat, &lon, &radius,
+			&g.Polygon, &g.CreatedAt, &g.UpdatedAt, &g.VehicleIds)
+		if err != nil {
+			return nil, err
+		}
+
+		if lat != nil && lon != nil && radius != nil {
+			g.Center, g.RadiusM = &geo.Point{Lat: *lat, Lon: *lon}, *radius
+		}
+
+		out = append(out, &g)
+	}
+
+	return out, rows.Err()
+}
+
+// distance is how far p is from the geofence's boundary in meters, negative
+// inside.
+func distance(g *Geofence, p geo.Point) float64 {
+	switch g.Shape {
+	case ShapeCircle:
+		return geo.Distance(*g.Center, p) - g.RadiusM
+	case ShapePolygon:
+		ring := make([]geo.Point, len(g.Polygon))
+		for i, v := range g.Polygon {
+			ring[i] = *v
+		}
+
+		return geo.PolygonDistance(p, ring)
+	}
+
+	return math.Inf(1)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,161 @@
+package location
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/golang/glog"
+)
+
+// Channel is the Postgres notification channel telemetry ingestion announces new
+// positions on, as VehicleLocation JSON.
+const Channel = "vehicle_locations"
+
+const reconnectDelay = time.Second * 5
+
+// hub fans positions announced by any API instance out to this instance's
+// watchers.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+var watchers = &hub{subs: map[*subscriber]struct{}{}}
+
+// subscriber buffers the latest position per vehicle until its stream takes
+// them; a slow stream skips the positions overwritten meanwhile.
+type subscriber struct {
+	mu      sync.Mutex
+	scope   *scope
+	pending map[string]*VehicleLocation
+	resync  bool          // notifications may have been missed; send a new snapshot
+	signal  chan struct{} // capacity 1: something is pending
+}
+
+func newSubscriber(sc *scope) *subscriber {
+	return &subscriber{
+		scope:   sc,
+		pending: map[string]*VehicleLocation{},
+		signal:  make(chan struct{}, 1),
+	}
+}
+
+func (s *subscriber) offer(loc *VehicleLocation) {
+	s.mu.Lock()
+	if !s.scope.visible(loc) {
+		s.mu.Unlock()
+		return
+	}
+
+	if old := s.pending[loc.VehicleId]; old == nil || old.RecordedAt.Before(loc.RecordedAt) {
+		s.pending[loc.VehicleId] = loc
+	}
+
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *subscriber) wake() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears what's pending.
+func (s *subscriber) take() (map[string]*VehicleLocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, resync := s.pending, s.resync
+	s.pending, s.resync = map[string]*VehicleLocation{}, false
+	return pending, resync
+}
+
+func (s *subscriber) setScope(sc *scope) {
+	s.mu.Lock()
+	s.scope = sc
+	s.mu.Unlock()
+}
+
+func (h *hub) add(s *subscriber) {
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *hub) remove(s *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+func (h *hub) each(f func(s *subscriber)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		f(s)
+	}
+}
+
+// RunHub listens for position notifications from all API instances and passes
+// them to this instance's watchers, until ctx is done. Notifications sent while
+// the connection was lost are gone, so after reconnecting, watchers are sent a
+// fresh snapshot.
+func RunHub(ctx context.Context) {
+	var reconnect bool
+	for {
+		err := listen(ctx, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+
+		glog.Errorf("listen failed: %v", err)
+		reconnect = true
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func listen(ctx context.Context, reconnect bool) error {
+	pc, err := global.PgxPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A listening connection can't go back to the pool.
+	conn := pc.Hijack()
+	defer conn.Close(context.WithoutCancel(ctx))
+	if _, err = conn.Exec(ctx, "listen "+Channel); err != nil {
+		return err
+	}
+
+	if reconnect {
+		watchers.each(func(s *subscriber) {
+			s.mu.Lock()
+			s.resync = true
+			s.mu.Unlock()
+			s.wake()
+		})
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var loc VehicleLocation
+		if err = json.Unmarshal([]byte(n.Payload), &loc); err != nil {
+			glog.Errorf("Unmarshal failed: %v", err)
+			continue
+		}
+
+		watchers.each(func(s *subscriber) { s.offer(&loc) })
+	}
+}
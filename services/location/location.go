@@ -0,0 +1,318 @@
+package location
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Also how often the caller's vehicles and orgs are looked up again.
+const heartbeatInterval = time.Second * 30
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type WatchVehicleLocationsRequest struct {
+	VehicleIds []string `json:"vehicleIds,omitempty"` // optional, default every vehicle the caller may see
+}
+
+type VehicleLocation struct {
+	VehicleId  string    `json:"vehicleId,omitempty"`
+	UserId     string    `json:"userId,omitempty"` // driver
+	RecordedAt time.Time `json:"recordedAt,omitempty"`
+	Lat        float64   `json:"lat,omitempty"`
+	Lon        float64   `json:"lon,omitempty"`
+	SpeedMps   float64   `json:"speedMps,omitempty"`
+	HeadingDeg float64   `json:"headingDeg,omitempty"`
+}
+
+// LocationUpdate is one message of the watch stream: a snapshot of every
+// vehicle's position, which replaces what the client has, newer positions of
+// some vehicles, or a heartbeat with nothing else.
+type LocationUpdate struct {
+	Snapshot  bool               `json:"snapshot,omitempty"`
+	Locations []*VehicleLocation `json:"locations,omitempty"` // by vehicle id
+	Heartbeat time.Time          `json:"heartbeat,omitempty"`
+}
+
+type WatchVehicleLocationsServer interface {
+	Context() context.Context
+	Send(*LocationUpdate) error
+}
+
+// WatchVehicleLocations streams the latest position of each vehicle the caller
+// may see: a snapshot first, then positions as telemetry arrives on any API
+// instance. Positions are private to the driver, except within an org, where
+// members see each other's positions in the org's vehicles. Positions inside the
+// driver's privacy zones are moved to their edge. A client that reads
+// slower than positions arrive only gets the latest per vehicle. Heartbeats are
+// sent every 30 seconds.
+func (s *svc) WatchVehicleLocations(in *WatchVehicleLocationsRequest, stream WatchVehicleLocationsServer) error {
+	ctx := stream.Context()
+	b, _ := json.Marshal(in)
+	glog.Infof("WatchVehicleLocations input=%v", string(b))
+	sc, err := s.scope(ctx, in.VehicleIds)
+	if err != nil {
+		return err
+	}
+
+	// Subscribe before the snapshot so nothing falls in between; positions
+	// already sent are skipped.
+	sub := newSubscriber(sc)
+	watchers.add(sub)
+	defer watchers.remove(sub)
+	sent := map[string]time.Time{}
+	zones := masker{}
+	if err = snapshot(ctx, stream, sc, zones, sent); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if sc, err = s.scope(ctx, in.VehicleIds); err != nil {
+				return err
+			}
+
+			sub.setScope(sc)
+			zones = masker{} // zones may have changed too
+			if err = stream.Send(&LocationUpdate{Heartbeat: now.UTC()}); err != nil {
+				return err
+			}
+		case <-sub.signal:
+			pending, resync := sub.take()
+			if resync {
+				if err = snapshot(ctx, stream, sc, zones, sent); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			var out LocationUpdate
+			for _, loc := range pending {
+				if loc.RecordedAt.After(sent[loc.VehicleId]) {
+					out.Locations = append(out.Locations, loc)
+					sent[loc.VehicleId] = loc.RecordedAt
+				}
+			}
+
+			if len(out.Locations) == 0 {
+				continue
+			}
+
+			if out.Locations, err = zones.mask(ctx, out.Locations); err != nil {
+				glog.Errorf("mask failed: %v", err)
+				return internal.InternalErr
+			}
+
+			sortLocations(out.Locations)
+			if err = stream.Send(&out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func snapshot(ctx context.Context, stream WatchVehicleLocationsServer, sc *scope, zones masker,
+	sent map[string]time.Time) error {
+	ids := make([]string, 0, len(sc.vehicles))
+	for id := range sc.vehicles {
+		ids = append(ids, id)
+	}
+
+	rows, err := global.PgxPool.Query(ctx, "select vehicle_id, user_id, recorded_at, lat, lon, speed_mps, "+
+		"heading_deg from vehicle_locations where vehicle_id = any($1)", ids)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return internal.InternalErr
+	}
+
+	defer rows.Close()
+	latest := map[string]*VehicleLocation{}
+	for rows.Next() {
+		var loc VehicleLocation
+		var speed, heading float32
+		err = rows.Scan(&loc.VehicleId, &loc.UserId, &loc.RecordedAt, &loc.Lat, &loc.Lon, &speed, &heading)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return internal.InternalErr
+		}
+
+		loc.SpeedMps, loc.HeadingDeg = float64(speed), float64(heading)
+		if old := latest[loc.VehicleId]; sc.visible(&loc) && (old == nil || old.RecordedAt.Before(loc.RecordedAt)) {
+			latest[loc.VehicleId] = &loc
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return internal.InternalErr
+	}
+
+	out := LocationUpdate{Snapshot: true}
+	for id, loc := range latest {
+		out.Locations = append(out.Locations, loc)
+		sent[id] = loc.RecordedAt
+	}
+
+	if out.Locations, err = zones.mask(ctx, out.Locations); err != nil {
+		glog.Errorf("mask failed: %v", err)
+		return internal.InternalErr
+	}
+
+	sortLocations(out.Locations)
+	return stream.Send(&out)
+}
+
+// masker caches drivers' privacy zones for one watcher.
+type masker map[string][]geo.Circle
+
+// mask returns copies of locs moved out of their driver's privacy zones. The
+// originals may be shared with other watchers.
+func (m masker) mask(ctx context.Context, locs []*VehicleLocation) ([]*VehicleLocation, error) {
+	out := make([]*VehicleLocation, 0, len(locs))
+	for _, loc := range locs {
+		zones, ok := m[loc.UserId]
+		if !ok {
+			var err error
+			if zones, err = privacy.Zones(ctx, loc.UserId); err != nil {
+				return nil, err
+			}
+
+			m[loc.UserId] = zones
+		}
+
+		c := *loc
+		p := geo.Point{Lat: c.Lat, Lon: c.Lon}
+		privacy.Mask(&p, zones)
+		c.Lat, c.Lon = p.Lat, p.Lon
+		out = append(out, &c)
+	}
+
+	return out, nil
+}
+
+// scope is what a watcher may see.
+type scope struct {
+	userId   string
+	vehicles map[string]string          // vehicle id to org id, empty if none
+	members  map[string]map[string]bool // org id to member ids
+}
+
+func (sc *scope) visible(loc *VehicleLocation) bool {
+	orgId, ok := sc.vehicles[loc.VehicleId]
+	switch {
+	case !ok:
+		return false
+	case loc.UserId == sc.userId:
+		return true
+	default:
+		return orgId != "" && sc.members[orgId][loc.UserId]
+	}
+}
+
+// scope looks up the vehicles the caller owns or can see through an org,
+// narrowed down to vehicleIds if given.
+func (s *svc) scope(ctx context.Context, vehicleIds []string) (*scope, error) {
+	userId := s.Config.UserInfo.Id
+	sc := scope{
+		userId:   userId,
+		vehicles: map[string]string{},
+		members:  map[string]map[string]bool{},
+	}
+
+	rows, err := global.PgxPool.Query(ctx, "select v.id, coalesce(v.org_id, '') from vehicles v "+
+		"where v.deleted_at is null and (v.user_id = $1 or v.org_id in "+
+		"(select m.org_id from org_members m where m.user_id = $1))", userId)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	all := map[string]string{}
+	for rows.Next() {
+		var id, orgId string
+		if err = rows.Scan(&id, &orgId); err != nil {
+			rows.Close()
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		all[id] = orgId
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	sc.vehicles = all
+	if len(vehicleIds) > 0 {
+		sc.vehicles = map[string]string{}
+		for _, id := range vehicleIds {
+			orgId, ok := all[id]
+			if !ok {
+				return nil, status.Errorf(codes.NotFound, "vehicle %v not found", id)
+			}
+
+			sc.vehicles[id] = orgId
+		}
+	}
+
+	rows, err = global.PgxPool.Query(ctx, "select org_id, user_id from org_members where org_id in "+
+		"(select m.org_id from org_members m where m.user_id = $1)", userId)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var orgId, memberId string
+		if err = rows.Scan(&orgId, &memberId); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if sc.members[orgId] == nil {
+			sc.members[orgId] = map[string]bool{}
+		}
+
+		sc.members[orgId][memberId] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &sc, nil
+}
+
+func sortLocations(list []*VehicleLocation) {
+	sort.Slice(list, func(i, j int) bool { return list[i].VehicleId < list[j].VehicleId })
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
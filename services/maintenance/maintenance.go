@@ -0,0 +1,410 @@
+package maintenance
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type ServiceRecord struct {
+	Id          string    `json:"id,omitempty"`
+	VehicleId   string    `json:"vehicleId,omitempty"`
+	ServiceType string    `json:"serviceType,omitempty"` // e.g. oil_change, tire_rotation
+	ServicedOn  time.Time `json:"servicedOn,omitempty"`
+	OdometerKms int32     `json:"odometerKms,omitempty"`
+	CostMinor   int64     `json:"costMinor,omitempty"` // in minor units of Currency
+	Currency    string    `json:"currency,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+}
+
+type Schedule struct {
+	Id           string `json:"id,omitempty"`
+	VehicleId    string `json:"vehicleId,omitempty"`
+	ServiceType  string `json:"serviceType,omitempty"`
+	IntervalDays int32  `json:"intervalDays,omitempty"` // 0 if distance-only
+	IntervalKms  int32  `json:"intervalKms,omitempty"`  // 0 if time-only
+}
+
+type ListServiceRecordsRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListServiceRecordsResponse struct {
+	Records []*ServiceRecord `json:"records,omitempty"`
+}
+
+type DeleteServiceRecordRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+type ListSchedulesRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListSchedulesResponse struct {
+	Schedules []*Schedule `json:"schedules,omitempty"`
+}
+
+type DeleteScheduleRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+func (s *svc) CreateServiceRecord(ctx context.Context, in *ServiceRecord) (*ServiceRecord, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateServiceRecord input=%v", string(b))
+	if err := normalizeRecord(in); err != nil {
+		return nil, err
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	in.Id = uuid.NewString()
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into service_records (id, vehicle_id, user_id, ")
+	fmt.Fprintf(&q, "service_type, serviced_on, odometer_kms, cost_minor, currency, notes) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @user_id, ")
+	fmt.Fprintf(&q, "@service_type, @serviced_on, @odometer_kms, @cost_minor, @currency, @notes)")
+	_, err = tx.Exec(ctx, q.String(), recordArgs(in, s.Config.UserInfo.Id))
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = bumpOdometer(ctx, tx, in.VehicleId, in.OdometerKms); err != nil {
+		glog.Errorf("bumpOdometer failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+func (s *svc) ListServiceRecords(ctx context.Context, in *ListServiceRecordsRequest) (*ListServiceRecordsResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	records, err := listRecords(ctx, in.VehicleId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("listRecords failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &ListServiceRecordsResponse{Records: records}, nil
+}
+
+func (s *svc) UpdateServiceRecord(ctx context.Context, in *ServiceRecord) (*ServiceRecord, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("UpdateServiceRecord input=%v", string(b))
+	if in.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id is empty")
+	}
+
+	if err := normalizeRecord(in); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var q strings.Builder
+	fmt.Fprintf(&q, "update service_records r set service_type = @service_type, ")
+	fmt.Fprintf(&q, "serviced_on = @serviced_on, odometer_kms = @odometer_kms, ")
+	fmt.Fprintf(&q, "cost_minor = @cost_minor, currency = @currency, notes = @notes, ")
+	fmt.Fprintf(&q, "updated_at = now() ")
+	fmt.Fprintf(&q, "from vehicles v where r.id = @id and r.user_id = @user_id ")
+	fmt.Fprintf(&q, "and v.id = r.vehicle_id and v.user_id = @user_id and v.deleted_at is null ")
+	fmt.Fprintf(&q, "returning r.vehicle_id")
+	err = tx.QueryRow(ctx, q.String(), recordArgs(in, s.Config.UserInfo.Id)).Scan(&in.VehicleId)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "service record not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = bumpOdometer(ctx, tx, in.VehicleId, in.OdometerKms); err != nil {
+		glog.Errorf("bumpOdometer failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return in, nil
+}
+
+func (s *svc) DeleteServiceRecord(ctx context.Context, in *DeleteServiceRecordRequest) (*emptypb.Empty, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "delete from service_records r using vehicles v ")
+	fmt.Fprintf(&q, "where r.id = $1 and r.user_id = $2 ")
+	fmt.Fprintf(&q, "and v.id = r.vehicle_id and v.user_id = $2 and v.deleted_at is null")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), in.Id, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "service record not found")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// CreateSchedule adds a recurring maintenance item. There is at most one
+// schedule per service type and vehicle.
+func (s *svc) CreateSchedule(ctx context.Context, in *Schedule) (*Schedule, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateSchedule input=%v", string(b))
+	in.ServiceType = normalizeType(in.ServiceType)
+	switch {
+	case in.ServiceType == "":
+		return nil, status.Errorf(codes.InvalidArgument, "service type is empty")
+	case in.IntervalDays < 0 || in.IntervalKms < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "intervals must be positive")
+	case in.IntervalDays == 0 && in.IntervalKms == 0:
+		return nil, status.Errorf(codes.InvalidArgument, "interval days or kms is required")
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	in.Id = uuid.NewString()
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into maintenance_schedules (id, vehicle_id, user_id, ")
+	fmt.Fprintf(&q, "service_type, interval_days, interval_kms, baseline_kms) ")
+	fmt.Fprintf(&q, "select @id, @vehicle_id, @user_id, ")
+	fmt.Fprintf(&q, "@service_type, @interval_days, @interval_kms, kms ")
+	fmt.Fprintf(&q, "from vehicles where id = @vehicle_id ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id, user_id, service_type) do nothing")
+	args := pgx.NamedArgs{
+		"id":            in.Id,
+		"vehicle_id":    in.VehicleId,
+		"user_id":       s.Config.UserInfo.Id,
+		"service_type":  in.ServiceType,
+		"interval_days": nullIfZero(in.IntervalDays),
+		"interval_kms":  nullIfZero(in.IntervalKms),
+	}
+
+	tag, err := global.PgxPool.Exec(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.AlreadyExists, "schedule for %v already exists", in.ServiceType)
+	}
+
+	return in, nil
+}
+
+func (s *svc) ListSchedules(ctx context.Context, in *ListSchedulesRequest) (*ListSchedulesResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	schedules, err := listSchedules(ctx, in.VehicleId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("listSchedules failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	var out ListSchedulesResponse
+	for _, v := range schedules {
+		out.Schedules = append(out.Schedules, &v.Schedule)
+	}
+
+	return &out, nil
+}
+
+func (s *svc) DeleteSchedule(ctx context.Context, in *DeleteScheduleRequest) (*emptypb.Empty, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "delete from maintenance_schedules ")
+	fmt.Fprintf(&q, "where id = $1 and user_id = $2")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), in.Id, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "schedule not found")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// listRecords returns the user's service records for a vehicle, oldest first.
+func listRecords(ctx context.Context, vehicleId, userId string) ([]*ServiceRecord, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, service_type, serviced_on, ")
+	fmt.Fprintf(&q, "odometer_kms, cost_minor, currency, notes ")
+	fmt.Fprintf(&q, "from service_records ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 ")
+	fmt.Fprintf(&q, "order by serviced_on, odometer_kms")
+	rows, err := global.PgxPool.Query(ctx, q.String(), vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var records []*ServiceRecord
+	for rows.Next() {
+		var r ServiceRecord
+		err = rows.Scan(&r.Id, &r.VehicleId, &r.ServiceType, &r.ServicedOn,
+			&r.OdometerKms, &r.CostMinor, &r.Currency, &r.Notes)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, &r)
+	}
+
+	return records, rows.Err()
+}
+
+type schedule struct {
+	Schedule
+	baselineKms int32
+	createdAt   time.Time
+}
+
+func listSchedules(ctx context.Context, vehicleId, userId string) ([]*schedule, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, service_type, coalesce(interval_days, 0), ")
+	fmt.Fprintf(&q, "coalesce(interval_kms, 0), baseline_kms, created_at ")
+	fmt.Fprintf(&q, "from maintenance_schedules ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 ")
+	fmt.Fprintf(&q, "order by service_type")
+	rows, err := global.PgxPool.Query(ctx, q.String(), vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var schedules []*schedule
+	for rows.Next() {
+		var v schedule
+		err = rows.Scan(&v.Id, &v.VehicleId, &v.ServiceType, &v.IntervalDays,
+			&v.IntervalKms, &v.baselineKms, &v.createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, &v)
+	}
+
+	return schedules, rows.Err()
+}
+
+// bumpOdometer moves the vehicle's odometer forward if kms is a newer reading.
+func bumpOdometer(ctx context.Context, tx pgx.Tx, vehicleId string, kms int32) error {
+	_, err := tx.Exec(ctx, "update vehicles set kms = $2, version = version + 1 where id = $1 and kms < $2", vehicleId, kms)
+	return err
+}
+
+func normalizeRecord(in *ServiceRecord) error {
+	in.ServiceType = normalizeType(in.ServiceType)
+	switch {
+	case in.ServiceType == "":
+		return status.Errorf(codes.InvalidArgument, "service type is empty")
+	case in.ServicedOn.IsZero():
+		return status.Errorf(codes.InvalidArgument, "service date is empty")
+	case in.ServicedOn.After(time.Now().Add(time.Hour * 24)):
+		return status.Errorf(codes.InvalidArgument, "service date is in the future")
+	case in.OdometerKms < 0 || in.CostMinor < 0:
+		return status.Errorf(codes.InvalidArgument, "odometer and cost must not be negative")
+	}
+
+	if in.CostMinor > 0 || in.Currency != "" {
+		c, ok := money.NormalizeCurrency(in.Currency)
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+		}
+
+		in.Currency = c
+	}
+
+	y, m, d := in.ServicedOn.Date()
+	in.ServicedOn = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// normalizeType maps e.g. "Oil Change" to "oil_change".
+func normalizeType(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	return strings.Join(strings.FieldsFunc(v, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), "_")
+}
+
+func recordArgs(in *ServiceRecord, userId string) pgx.NamedArgs {
+	return pgx.NamedArgs{
+		"id":           in.Id,
+		"vehicle_id":   in.VehicleId,
+		"user_id":      userId,
+		"service_type": in.ServiceType,
+		"serviced_on":  in.ServicedOn,
+		"odometer_kms": in.OdometerKms,
+		"cost_minor":   in.CostMinor,
+		"currency":     in.Currency,
+		"notes":        in.Notes,
+	}
+}
+
+func nullIfZero(v int32) any {
+	if v == 0 {
+		return nil
+	}
+
+	return v
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
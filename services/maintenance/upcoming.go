@@ -0,0 +1,323 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/notify"
+	"github.com/golang/glog"
+)
+
+const (
+	StatusOk      = "ok"
+	StatusDueSoon = "due_soon"
+	StatusOverdue = "overdue"
+
+	dueSoonDays = 14
+	dueSoonKms  = 1000
+
+	// Minimum span of odometer history before we trust the daily distance rate.
+	minRateDays = 14
+)
+
+type UpcomingItem struct {
+	ScheduleId      string    `json:"scheduleId,omitempty"`
+	ServiceType     string    `json:"serviceType,omitempty"`
+	LastServicedOn  time.Time `json:"lastServicedOn,omitempty"` // zero if never serviced
+	LastOdometerKms int32     `json:"lastOdometerKms,omitempty"`
+	DueOn           time.Time `json:"dueOn,omitempty"`  // zero for distance-only schedules
+	DueKms          int32     `json:"dueKms,omitempty"` // zero for time-only schedules
+	EstimatedDueOn  time.Time `json:"estimatedDueOn,omitempty"`
+	Status          string    `json:"status,omitempty"`
+}
+
+type ListUpcomingMaintenanceRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListUpcomingMaintenanceResponse struct {
+	CurrentKms int32           `json:"currentKms,omitempty"`
+	KmsPerDay  float64         `json:"kmsPerDay,omitempty"` // zero if not enough history
+	Items      []*UpcomingItem `json:"items,omitempty"`
+}
+
+// ListUpcomingMaintenance returns the vehicle's schedules with their next due
+// date and distance, soonest first.
+func (s *svc) ListUpcomingMaintenance(ctx context.Context, in *ListUpcomingMaintenanceRequest) (*ListUpcomingMaintenanceResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	out, err := loadUpcoming(ctx, in.VehicleId, s.Config.UserInfo.Id, time.Now().UTC())
+	if err != nil {
+		glog.Errorf("loadUpcoming failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// RunReminders notifies owners about maintenance that is due soon or overdue,
+// checking every interval until ctx is done. It is safe to run on every API
+// instance: each due date of a schedule is only notified once.
+func RunReminders(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := sendReminders(ctx); err != nil {
+			glog.Errorf("sendReminders failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendReminders(ctx context.Context) error {
+	type vehicle struct{ id, userId, name string }
+	var q strings.Builder
+	fmt.Fprintf(&q, "select distinct v.id, v.user_id, v.make, v.model ")
+	fmt.Fprintf(&q, "from maintenance_schedules s ")
+	fmt.Fprintf(&q, "join vehicles v on v.id = s.vehicle_id and v.user_id = s.user_id ")
+	fmt.Fprintf(&q, "where v.deleted_at is null")
+	rows, err := global.PgxPool.Query(ctx, q.String())
+	if err != nil {
+		return err
+	}
+
+	var vehicles []vehicle
+	for rows.Next() {
+		var v vehicle
+		var mk, model string
+		if err = rows.Scan(&v.id, &v.userId, &mk, &model); err != nil {
+			rows.Close()
+			return err
+		}
+
+		v.name = strings.TrimSpace(mk + " " + model)
+		vehicles = append(vehicles, v)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, v := range vehicles {
+		out, err := loadUpcoming(ctx, v.id, v.userId, now)
+		if err != nil {
+			glog.Errorf("loadUpcoming failed (vehicle=%v): %v", v.id, err)
+			continue
+		}
+
+		for _, item := range out.Items {
+			if item.Status == StatusOk {
+				continue
+			}
+
+			key := fmt.Sprintf("%v:%v:%v", item.Status, item.DueOn.Format(time.DateOnly), item.DueKms)
+			tag, err := global.PgxPool.Exec(ctx, "insert into maintenance_notifications "+
+				"(schedule_id, due_key) values ($1, $2) on conflict do nothing", item.ScheduleId, key)
+			if err != nil {
+				glog.Errorf("Exec failed: %v", err)
+				continue
+			}
+
+			if tag.RowsAffected() == 0 {
+				continue // already sent
+			}
+
+			err = global.Notifier.Notify(ctx, reminder(v.userId, v.id, v.name, item))
+			if err != nil {
+				glog.Errorf("Notify failed: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func reminder(userId, vehicleId, name string, item *UpcomingItem) *notify.Notification {
+	what := strings.ReplaceAll(item.ServiceType, "_", " ")
+	if what != "" {
+		what = strings.ToUpper(what[:1]) + what[1:]
+	}
+
+	n := notify.Notification{
+		UserId: userId,
+		Kind:   "maintenance." + item.Status,
+		Data: map[string]string{
+			"vehicleId":   vehicleId,
+			"scheduleId":  item.ScheduleId,
+			"serviceType": item.ServiceType,
+		},
+	}
+
+	var due []string
+	if !item.DueOn.IsZero() {
+		due = append(due, item.DueOn.Format("Jan 2, 2006"))
+	}
+
+	if item.DueKms > 0 {
+		due = append(due, fmt.Sprintf("%d km", item.DueKms))
+	}
+
+	switch item.Status {
+	case StatusOverdue:
+		n.Title = fmt.Sprintf("%v is overdue", what)
+	default:
+		n.Title = fmt.Sprintf("%v is due soon", what)
+	}
+
+	n.Body = fmt.Sprintf("%v: due at %v.", name, strings.Join(due, " or "))
+	return &n
+}
+
+func loadUpcoming(ctx context.Context, vehicleId, userId string, now time.Time) (*ListUpcomingMaintenanceResponse, error) {
+	schedules, err := listSchedules(ctx, vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := listRecords(ctx, vehicleId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var kms int32
+	var since time.Time
+	var startKms int32
+	var q strings.Builder
+	fmt.Fprintf(&q, "select v.kms, o.started_at, o.start_kms ")
+	fmt.Fprintf(&q, "from vehicles v join vehicle_ownerships o ")
+	fmt.Fprintf(&q, "on o.vehicle_id = v.id and o.ended_at is null ")
+	fmt.Fprintf(&q, "where v.id = $1")
+	err = global.PgxPool.QueryRow(ctx, q.String(), vehicleId).Scan(&kms, &since, &startKms)
+	if err != nil {
+		return nil, err
+	}
+
+	readings := []reading{{at: since, kms: startKms}, {at: now, kms: kms}}
+	for _, r := range records {
+		if r.OdometerKms > 0 {
+			readings = append(readings, reading{at: r.ServicedOn, kms: r.OdometerKms})
+		}
+	}
+
+	out := ListUpcomingMaintenanceResponse{
+		CurrentKms: kms,
+		KmsPerDay:  kmsPerDay(readings),
+	}
+
+	out.Items = computeUpcoming(schedules, records, kms, out.KmsPerDay, now)
+	return &out, nil
+}
+
+type reading struct {
+	at  time.Time
+	kms int32
+}
+
+// kmsPerDay estimates the average daily distance from odometer readings.
+func kmsPerDay(readings []reading) float64 {
+	if len(readings) < 2 {
+		return 0
+	}
+
+	first, last := readings[0], readings[0]
+	for _, r := range readings[1:] {
+		if r.at.Before(first.at) {
+			first = r
+		}
+
+		if r.at.After(last.at) {
+			last = r
+		}
+	}
+
+	days := last.at.Sub(first.at).Hours() / 24
+	if days < minRateDays || last.kms <= first.kms {
+		return 0
+	}
+
+	return float64(last.kms-first.kms) / days
+}
+
+// computeUpcoming works out when each schedule is next due. A schedule is due
+// interval days/kms after its most recent matching service record, or after its
+// creation if it has never been serviced.
+func computeUpcoming(schedules []*schedule, records []*ServiceRecord, kms int32, rate float64, now time.Time) []*UpcomingItem {
+	last := map[string]*ServiceRecord{}
+	for _, r := range records { // oldest first, so the latest wins
+		last[r.ServiceType] = r
+	}
+
+	var items []*UpcomingItem
+	for _, sc := range schedules {
+		item := UpcomingItem{ScheduleId: sc.Id, ServiceType: sc.ServiceType}
+		baseOn, baseKms := sc.createdAt, sc.baselineKms
+		if r, ok := last[sc.ServiceType]; ok {
+			item.LastServicedOn, item.LastOdometerKms = r.ServicedOn, r.OdometerKms
+			baseOn = r.ServicedOn
+			if r.OdometerKms > 0 {
+				baseKms = r.OdometerKms
+			}
+		}
+
+		if sc.IntervalDays > 0 {
+			item.DueOn = baseOn.AddDate(0, 0, int(sc.IntervalDays))
+			item.EstimatedDueOn = item.DueOn
+		}
+
+		if sc.IntervalKms > 0 {
+			item.DueKms = baseKms + sc.IntervalKms
+			if rate > 0 {
+				left := max(float64(item.DueKms-kms), 0)
+				at := now.Add(time.Duration(left / rate * float64(time.Hour*24)))
+				if item.EstimatedDueOn.IsZero() || at.Before(item.EstimatedDueOn) {
+					item.EstimatedDueOn = at
+				}
+			}
+		}
+
+		soon := now.AddDate(0, 0, dueSoonDays)
+		switch {
+		case !item.DueOn.IsZero() && !now.Before(item.DueOn):
+			item.Status = StatusOverdue
+		case item.DueKms > 0 && kms >= item.DueKms:
+			item.Status = StatusOverdue
+		case !item.EstimatedDueOn.IsZero() && item.EstimatedDueOn.Before(soon):
+			item.Status = StatusDueSoon
+		case item.DueKms > 0 && item.DueKms-kms <= dueSoonKms:
+			item.Status = StatusDueSoon
+		default:
+			item.Status = StatusOk
+		}
+
+		items = append(items, &item)
+	}
+
+	// Soonest first; schedules we can't estimate go last.
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i].EstimatedDueOn, items[j].EstimatedDueOn
+		switch {
+		case a.IsZero():
+			return false
+		case b.IsZero():
+			return true
+		}
+
+		return a.Before(b)
+	})
+
+	return items
+}
@@ -0,0 +1,169 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func TestKmsPerDay(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		readings []reading
+		want     float64
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "one",
+			readings: []reading{{date("2026-01-01"), 1000}},
+		},
+		{
+			name:     "steady",
+			readings: []reading{{date("2026-01-01"), 10000}, {date("2026-01-31"), 11500}},
+			want:     50,
+		},
+		{
+			name: "first and last by date",
+			readings: []reading{{date("2026-01-11"), 10000}, {date("2026-01-01"), 9000},
+				{date("2026-02-10"), 15000}, {date("2026-01-20"), 20000}},
+			want: 150,
+		},
+		{
+			name:     "too short",
+			readings: []reading{{date("2026-01-01"), 10000}, {date("2026-01-10"), 11000}},
+		},
+		{
+			name:     "odometer went back",
+			readings: []reading{{date("2026-01-01"), 10000}, {date("2026-03-01"), 500}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := kmsPerDay(tc.readings); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestComputeUpcoming(t *testing.T) {
+	now := date("2026-06-01")
+	sched := func(id, typ string, days, kms, baselineKms int32, created string) *schedule {
+		return &schedule{
+			Schedule:    Schedule{Id: id, ServiceType: typ, IntervalDays: days, IntervalKms: kms},
+			baselineKms: baselineKms,
+			createdAt:   date(created),
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		schedules []*schedule
+		records   []*ServiceRecord
+		kms       int32
+		rate      float64
+		want      []UpcomingItem
+	}{
+		{
+			name:      "by time, never serviced",
+			schedules: []*schedule{sched("a", "inspection", 365, 0, 0, "2026-01-01")},
+			kms:       12000,
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "inspection", DueOn: date("2027-01-01"),
+				EstimatedDueOn: date("2027-01-01"), Status: StatusOk}},
+		},
+		{
+			name:      "by time, due soon",
+			schedules: []*schedule{sched("a", "inspection", 180, 0, 0, "2025-12-08")},
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "inspection", DueOn: date("2026-06-06"),
+				EstimatedDueOn: date("2026-06-06"), Status: StatusDueSoon}},
+		},
+		{
+			name:      "by time, due today",
+			schedules: []*schedule{sched("a", "inspection", 365, 0, 0, "2025-06-01")},
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "inspection", DueOn: date("2026-06-01"),
+				EstimatedDueOn: date("2026-06-01"), Status: StatusOverdue}},
+		},
+		{
+			name:      "by distance, estimated",
+			schedules: []*schedule{sched("a", "oil_change", 0, 15000, 10000, "2026-01-01")},
+			kms:       20000,
+			rate:      50,
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "oil_change", DueKms: 25000,
+				EstimatedDueOn: date("2026-09-09"), Status: StatusOk}},
+		},
+		{
+			name:      "by distance, no rate, due soon",
+			schedules: []*schedule{sched("a", "oil_change", 0, 15000, 10000, "2026-01-01")},
+			kms:       24500,
+			want:      []UpcomingItem{{ScheduleId: "a", ServiceType: "oil_change", DueKms: 25000, Status: StatusDueSoon}},
+		},
+		{
+			name:      "by distance, overdue",
+			schedules: []*schedule{sched("a", "oil_change", 0, 15000, 10000, "2026-01-01")},
+			kms:       25000,
+			rate:      50,
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "oil_change", DueKms: 25000,
+				EstimatedDueOn: now, Status: StatusOverdue}},
+		},
+		{
+			name:      "whichever comes first",
+			schedules: []*schedule{sched("a", "oil_change", 365, 15000, 10000, "2026-01-01")},
+			records: []*ServiceRecord{
+				{ServiceType: "oil_change", ServicedOn: date("2025-09-01"), OdometerKms: 25000},
+				{ServiceType: "oil_change", ServicedOn: date("2026-03-01"), OdometerKms: 30000},
+				{ServiceType: "tire_rotation", ServicedOn: date("2026-04-01"), OdometerKms: 31000},
+			},
+			kms:  32000,
+			rate: 50,
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "oil_change", LastServicedOn: date("2026-03-01"),
+				LastOdometerKms: 30000, DueOn: date("2027-03-01"), DueKms: 45000,
+				EstimatedDueOn: date("2027-02-16"), Status: StatusOk}},
+		},
+		{
+			name:      "service without odometer reading",
+			schedules: []*schedule{sched("a", "oil_change", 365, 15000, 10000, "2026-01-01")},
+			records:   []*ServiceRecord{{ServiceType: "oil_change", ServicedOn: date("2026-03-01")}},
+			kms:       12000,
+			want: []UpcomingItem{{ScheduleId: "a", ServiceType: "oil_change", LastServicedOn: date("2026-03-01"),
+				DueOn: date("2027-03-01"), DueKms: 25000, EstimatedDueOn: date("2027-03-01"), Status: StatusOk}},
+		},
+		{
+			name: "soonest first",
+			schedules: []*schedule{
+				sched("a", "brake_fluid", 0, 50000, 0, "2026-01-01"),
+				sched("b", "inspection", 365, 0, 0, "2026-01-01"),
+				sched("c", "oil_change", 180, 0, 0, "2026-01-01"),
+			},
+			kms: 20000,
+			want: []UpcomingItem{
+				{ScheduleId: "c", ServiceType: "oil_change", DueOn: date("2026-06-30"),
+					EstimatedDueOn: date("2026-06-30"), Status: StatusOk},
+				{ScheduleId: "b", ServiceType: "inspection", DueOn: date("2027-01-01"),
+					EstimatedDueOn: date("2027-01-01"), Status: StatusOk},
+				{ScheduleId: "a", ServiceType: "brake_fluid", DueKms: 50000, Status: StatusOk},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := computeUpcoming(tc.schedules, tc.records, tc.kms, tc.rate, now)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v items, want %v", len(got), len(tc.want))
+			}
+
+			for i, w := range tc.want {
+				if *got[i] != w {
+					t.Errorf("item %v:\n got %+v\nwant %+v", i, *got[i], w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/blob"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	KindPhoto        = "photo"
+	KindRegistration = "registration"
+	KindInsurance    = "insurance"
+	KindReceipt      = "receipt"
+	KindOther        = "other"
+
+	defaultMaxUploadMb = 20
+	downloadChunkSize  = 64 << 10
+	sniffLen           = 512 // what http.DetectContentType looks at
+)
+
+var (
+	imageTypes    = []string{"image/jpeg", "image/png", "image/webp"}
+	documentTypes = []string{"image/jpeg", "image/png", "image/webp", "application/pdf"}
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type VehicleFile struct {
+	Id          string    `json:"id,omitempty"`
+	VehicleId   string    `json:"vehicleId,omitempty"`
+	Kind        string    `json:"kind,omitempty"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Sha256      string    `json:"sha256,omitempty"`
+	ClaimId     string    `json:"claimId,omitempty"` // set for claim evidence
+	CreatedAt   time.Time `json:"createdAt,omitempty"`
+}
+
+// UploadMetadata describes the file being uploaded. Size and Sha256 (hex) are
+// what the client computed locally and are verified against the received bytes.
+// Claimants set ClaimId instead of VehicleId to attach evidence to their claim.
+type UploadMetadata struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+	ClaimId   string `json:"claimId,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Sha256    string `json:"sha256,omitempty"`
+}
+
+// UploadVehicleFileRequest is one message of the upload stream. The first message
+// carries Metadata, all messages may carry a Chunk.
+type UploadVehicleFileRequest struct {
+	Metadata *UploadMetadata `json:"metadata,omitempty"`
+	Chunk    []byte          `json:"chunk,omitempty"`
+}
+
+type UploadVehicleFileServer interface {
+	Context() context.Context
+	Recv() (*UploadVehicleFileRequest, error)
+	SendAndClose(*VehicleFile) error
+}
+
+type DownloadVehicleFileRequest struct {
+	FileId string `json:"fileId,omitempty"`
+}
+
+// DownloadVehicleFileResponse is one message of the download stream. The first
+// message carries File, the rest carry the contents in order.
+type DownloadVehicleFileResponse struct {
+	File  *VehicleFile `json:"file,omitempty"`
+	Chunk []byte       `json:"chunk,omitempty"`
+}
+
+type DownloadVehicleFileServer interface {
+	Context() context.Context
+	Send(*DownloadVehicleFileResponse) error
+}
+
+type ListVehicleFilesRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListVehicleFilesResponse struct {
+	Files []*VehicleFile `json:"files,omitempty"`
+}
+
+type DeleteVehicleFileRequest struct {
+	FileId string `json:"fileId,omitempty"`
+}
+
+// UploadVehicleFile stores a photo or document for a vehicle owned by the caller,
+// or supporting documents for a claim the caller filed (see claim.CreateClaim).
+func (s *svc) UploadVehicleFile(stream UploadVehicleFileServer) error {
+	ctx := stream.Context()
+	in, err := stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return status.Errorf(codes.InvalidArgument, "no data")
+		}
+
+		glog.Errorf("Recv failed: %v", err)
+		return err
+	}
+
+	md := in.Metadata
+	if md == nil {
+		return status.Errorf(codes.InvalidArgument, "first message must carry metadata")
+	}
+
+	b, _ := json.Marshal(md)
+	glog.Infof("UploadVehicleFile input=%v", string(b))
+	allowed, ok := allowedTypes(md.Kind)
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown kind %q", md.Kind)
+	}
+
+	limit := s.maxUploadBytes()
+	switch {
+	case md.Size <= 0:
+		return status.Errorf(codes.InvalidArgument, "size is empty")
+	case md.Size > limit:
+		return status.Errorf(codes.ResourceExhausted, "file exceeds %v bytes", limit)
+	case len(md.Sha256) != sha256.Size*2:
+		return status.Errorf(codes.InvalidArgument, "invalid sha256")
+	}
+
+	if global.BlobStore == nil {
+		glog.Errorf("failed: blob store not configured")
+		return status.Errorf(codes.Unavailable, "uploads are unavailable")
+	}
+
+	if md.ClaimId != "" {
+		md.VehicleId, err = s.claimVehicle(ctx, md.ClaimId)
+	} else {
+		err = internal.CheckVehicleOwner(ctx, md.VehicleId, s.Config.UserInfo.Id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Buffer enough of the head to sniff the content type before anything is stored.
+	var head bytes.Buffer
+	head.Write(in.Chunk)
+	var eof bool
+	for head.Len() < sniffLen && !eof {
+		in, err = stream.Recv()
+		switch {
+		case err == io.EOF:
+			eof = true
+		case err != nil:
+			glog.Errorf("Recv failed: %v", err)
+			return err
+		default:
+			head.Write(in.Chunk)
+		}
+	}
+
+	contentType := http.DetectContentType(head.Bytes())
+	contentType, _, _ = strings.Cut(contentType, ";")
+	if !contains(allowed, contentType) {
+		return status.Errorf(codes.InvalidArgument, "content type %v not allowed for %v", contentType, md.Kind)
+	}
+
+	f := VehicleFile{
+		Id:          uuid.NewString(),
+		VehicleId:   md.VehicleId,
+		Kind:        md.Kind,
+		Filename:    md.Filename,
+		ContentType: contentType,
+		ClaimId:     md.ClaimId,
+	}
+
+	key := blobKey(f.VehicleId, f.Id)
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		_, err := global.BlobStore.Put(ctx, key, pr)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	// Feed the blob store and hash in one pass; the size cap is enforced as we go.
+	write := func(p []byte) error {
+		f.Size += int64(len(p))
+		if f.Size > md.Size {
+			return status.Errorf(codes.InvalidArgument, "received more than the declared %v bytes", md.Size)
+		}
+
+		hash.Write(p)
+		if _, err := pw.Write(p); err != nil {
+			glog.Errorf("Write failed: %v", err)
+			return internal.InternalErr
+		}
+
+		return nil
+	}
+
+	err = write(head.Bytes())
+	for err == nil && !eof {
+		in, err = stream.Recv()
+		switch {
+		case err == io.EOF:
+			eof, err = true, nil
+		case err != nil:
+			glog.Errorf("Recv failed: %v", err)
+		default:
+			err = write(in.Chunk)
+		}
+	}
+
+	if err == nil && f.Size != md.Size {
+		err = status.Errorf(codes.InvalidArgument, "received %v of the declared %v bytes", f.Size, md.Size)
+	}
+
+	f.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	if err == nil && !strings.EqualFold(f.Sha256, md.Sha256) {
+		err = status.Errorf(codes.InvalidArgument, "checksum mismatch")
+	}
+
+	if err != nil {
+		pw.CloseWithError(err)
+		<-done
+		global.BlobStore.Delete(context.Background(), key)
+		return err
+	}
+
+	pw.Close()
+	if err = <-done; err != nil {
+		glog.Errorf("Put failed: %v", err)
+		global.BlobStore.Delete(context.Background(), key)
+		return internal.InternalErr
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_files (id, vehicle_id, user_id, kind, ")
+	fmt.Fprintf(&q, "filename, content_type, size_bytes, sha256, blob_key, claim_id) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @user_id, @kind, ")
+	fmt.Fprintf(&q, "@filename, @content_type, @size, @sha256, @blob_key, @claim_id) ")
+	fmt.Fprintf(&q, "returning created_at")
+	args := pgx.NamedArgs{
+		"id":           f.Id,
+		"vehicle_id":   f.VehicleId,
+		"user_id":      s.Config.UserInfo.Id,
+		"kind":         f.Kind,
+		"filename":     f.Filename,
+		"content_type": f.ContentType,
+		"size":         f.Size,
+		"sha256":       f.Sha256,
+		"blob_key":     key,
+		"claim_id":     nil,
+	}
+
+	if f.ClaimId != "" {
+		args["claim_id"] = f.ClaimId
+	}
+
+	err = global.PgxPool.QueryRow(ctx, q.String(), args).Scan(&f.CreatedAt)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		global.BlobStore.Delete(context.Background(), key)
+		return internal.InternalErr
+	}
+
+	glog.Infof("UploadVehicleFile success! file=%v, size=%v", f.Id, f.Size)
+	return stream.SendAndClose(&f)
+}
+
+// DownloadVehicleFile streams back a file uploaded by the caller for a vehicle
+// they still own, or for one of their claims. Admins can download any claim evidence.
+func (s *svc) DownloadVehicleFile(in *DownloadVehicleFileRequest, stream DownloadVehicleFileServer) error {
+	ctx := stream.Context()
+	if global.BlobStore == nil {
+		glog.Errorf("failed: blob store not configured")
+		return status.Errorf(codes.Unavailable, "downloads are unavailable")
+	}
+
+	f, key, err := s.getFile(ctx, in.FileId, internal.IsAdmin(s.Config.Config, s.Config.UserInfo))
+	if err != nil {
+		return err
+	}
+
+	r, err := global.BlobStore.Get(ctx, key)
+	if err != nil {
+		glog.Errorf("Get failed: %v", err)
+		if errors.Is(err, blob.ErrNotFound) {
+			return status.Errorf(codes.NotFound, "file contents not found")
+		}
+
+		return internal.InternalErr
+	}
+
+	defer r.Close()
+	if err = stream.Send(&DownloadVehicleFileResponse{File: f}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if err := stream.Send(&DownloadVehicleFileResponse{Chunk: chunk}); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil
+		case err != nil:
+			glog.Errorf("Read failed: %v", err)
+			return internal.InternalErr
+		}
+	}
+}
+
+func (s *svc) ListVehicleFiles(ctx context.Context, in *ListVehicleFilesRequest) (*ListVehicleFilesResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, kind, filename, content_type, ")
+	fmt.Fprintf(&q, "size_bytes, sha256, coalesce(claim_id, ''), created_at ")
+	fmt.Fprintf(&q, "from vehicle_files ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 ")
+	fmt.Fprintf(&q, "order by created_at")
+	rows, err := global.PgxPool.Query(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListVehicleFilesResponse
+	for rows.Next() {
+		var f VehicleFile
+		err = rows.Scan(&f.Id, &f.VehicleId, &f.Kind, &f.Filename, &f.ContentType,
+			&f.Size, &f.Sha256, &f.ClaimId, &f.CreatedAt)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Files = append(out.Files, &f)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+func (s *svc) DeleteVehicleFile(ctx context.Context, in *DeleteVehicleFileRequest) (*emptypb.Empty, error) {
+	if global.BlobStore == nil {
+		// Deleting the metadata alone would orphan the blob.
+		glog.Errorf("failed: blob store not configured")
+		return nil, status.Errorf(codes.Unavailable, "deletes are unavailable")
+	}
+
+	_, key, err := s.getFile(ctx, in.FileId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = global.PgxPool.Exec(ctx, "delete from vehicle_files where id = $1", in.FileId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = global.BlobStore.Delete(ctx, key); err != nil {
+		glog.Errorf("Delete failed: %v", err) // orphaned blob, metadata is gone
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// getFile loads file metadata after checking that the caller uploaded it and
+// still owns the vehicle, or uploaded it for a claim. With admin set, any claim
+// evidence is accessible. Returns the blob key as well.
+func (s *svc) getFile(ctx context.Context, fileId string, admin bool) (*VehicleFile, string, error) {
+	if fileId == "" {
+		return nil, "", status.Errorf(codes.InvalidArgument, "file id is empty")
+	}
+
+	var f VehicleFile
+	var key string
+	var q strings.Builder
+	fmt.Fprintf(&q, "select f.id, f.vehicle_id, f.kind, f.filename, f.content_type, ")
+	fmt.Fprintf(&q, "f.size_bytes, f.sha256, coalesce(f.claim_id, ''), f.created_at, f.blob_key ")
+	fmt.Fprintf(&q, "from vehicle_files f join vehicles v on v.id = f.vehicle_id ")
+	fmt.Fprintf(&q, "where f.id = $1 and (")
+	fmt.Fprintf(&q, "(f.user_id = $2 and v.user_id = $2 and v.deleted_at is null) ")
+	fmt.Fprintf(&q, "or (f.claim_id is not null and (f.user_id = $2 or $3)))")
+	err := global.PgxPool.QueryRow(ctx, q.String(), fileId, s.Config.UserInfo.Id, admin).Scan(&f.Id,
+		&f.VehicleId, &f.Kind, &f.Filename, &f.ContentType, &f.Size, &f.Sha256, &f.ClaimId, &f.CreatedAt, &key)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, "", status.Errorf(codes.NotFound, "file not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, "", internal.InternalErr
+	}
+
+	return &f, key, nil
+}
+
+// claimVehicle returns the vehicle of an active claim filed by the caller.
+func (s *svc) claimVehicle(ctx context.Context, claimId string) (string, error) {
+	var vehicleId string
+	var q strings.Builder
+	fmt.Fprintf(&q, "select vehicle_id from vehicle_claims ")
+	fmt.Fprintf(&q, "where id = $1 and claimant_id = $2 and status in ('open', 'disputed')")
+	err := global.PgxPool.QueryRow(ctx, q.String(), claimId, s.Config.UserInfo.Id).Scan(&vehicleId)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return "", status.Errorf(codes.NotFound, "claim not found or already closed")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return "", internal.InternalErr
+	}
+
+	return vehicleId, nil
+}
+
+func (s *svc) maxUploadBytes() int64 {
+	mb := defaultMaxUploadMb
+	if s.Config.Config != nil && s.Config.Config.MaxUploadMb > 0 {
+		mb = s.Config.Config.MaxUploadMb
+	}
+
+	return int64(mb) << 20
+}
+
+func allowedTypes(kind string) ([]string, bool) {
+	switch kind {
+	case KindPhoto:
+		return imageTypes, true
+	case KindRegistration, KindInsurance, KindReceipt, KindOther:
+		return documentTypes, true
+	}
+
+	return nil, false
+}
+
+func blobKey(vehicleId, fileId string) string {
+	return "vehicles/" + vehicleId + "/" + fileId
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
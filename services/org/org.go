@@ -0,0 +1,427 @@
+package org
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	RoleMember = "member"
+	RoleAdmin  = "admin" // manages members, org geofences and alerts
+
+	maxNameLen = 100
+	maxOrgs    = 20 // per user
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// Org is an organization (fleet). Its members see and use the vehicles assigned
+// to it; see SetVehicleOrg.
+type Org struct {
+	Id        string    `json:"id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Role      string    `json:"role,omitempty"` // the caller's; set by the server
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+type OrgMember struct {
+	OrgId     string    `json:"orgId,omitempty"`
+	UserId    string    `json:"userId,omitempty"`
+	Role      string    `json:"role,omitempty"` // member (default), admin
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+type DeleteOrgRequest struct {
+	OrgId string `json:"orgId,omitempty"`
+}
+
+type ListOrgsRequest struct{}
+
+type ListOrgsResponse struct {
+	Orgs []*Org `json:"orgs,omitempty"` // by name
+}
+
+type RemoveOrgMemberRequest struct {
+	OrgId  string `json:"orgId,omitempty"`
+	UserId string `json:"userId,omitempty"` // empty to leave the org
+}
+
+type ListOrgMembersRequest struct {
+	OrgId string `json:"orgId,omitempty"`
+}
+
+type ListOrgMembersResponse struct {
+	Members []*OrgMember `json:"members,omitempty"` // oldest first
+}
+
+type SetVehicleOrgRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+	OrgId     string `json:"orgId,omitempty"` // empty to take the vehicle out of its org
+}
+
+// CreateOrg creates an org with the caller as its admin.
+func (s *svc) CreateOrg(ctx context.Context, in *Org) (*Org, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreateOrg input=%v", string(b))
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || utf8.RuneCountInString(in.Name) > maxNameLen {
+		return nil, status.Errorf(codes.InvalidArgument, "name must have 1 to %v characters", maxNameLen)
+	}
+
+	userId := s.Config.UserInfo.Id
+	var n int
+	q := "select count(*) from org_members where user_id = $1"
+	if err := global.PgxPool.QueryRow(ctx, q, userId).Scan(&n); err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if n >= maxOrgs {
+		return nil, status.Errorf(codes.FailedPrecondition, "at most %v orgs are allowed", maxOrgs)
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	out := Org{Id: uuid.NewString(), Name: in.Name, Role: RoleAdmin}
+	err = tx.QueryRow(ctx, "insert into orgs (id, name) values ($1, $2) returning created_at",
+		out.Id, out.Name).Scan(&out.CreatedAt)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	_, err = tx.Exec(ctx, "insert into org_members (org_id, user_id, role) values ($1, $2, $3)",
+		out.Id, userId, RoleAdmin)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// DeleteOrg deletes an org the caller is an admin of. Its vehicles go back to
+// being visible to their owners only; its geofences are deleted.
+func (s *svc) DeleteOrg(ctx context.Context, in *DeleteOrgRequest) (*emptypb.Empty, error) {
+	if err := s.checkOrg(ctx, in.OrgId, true); err != nil {
+		return nil, err
+	}
+
+	if _, err := global.PgxPool.Exec(ctx, "delete from orgs where id = $1", in.OrgId); err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListOrgs returns the orgs the caller is a member of, with their role in each.
+func (s *svc) ListOrgs(ctx context.Context, in *ListOrgsRequest) (*ListOrgsResponse, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select o.id, o.name, m.role, o.created_at from orgs o ")
+	fmt.Fprintf(&q, "join org_members m on m.org_id = o.id ")
+	fmt.Fprintf(&q, "where m.user_id = $1 order by o.name, o.id")
+	rows, err := global.PgxPool.Query(ctx, q.String(), s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListOrgsResponse
+	for rows.Next() {
+		var o Org
+		if err = rows.Scan(&o.Id, &o.Name, &o.Role, &o.CreatedAt); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Orgs = append(out.Orgs, &o)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// AddOrgMember adds a user to an org the caller is an admin of, or changes the
+// role of an existing member.
+func (s *svc) AddOrgMember(ctx context.Context, in *OrgMember) (*OrgMember, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("AddOrgMember input=%v", string(b))
+	if in.Role == "" {
+		in.Role = RoleMember
+	}
+
+	switch {
+	case in.UserId == "":
+		return nil, status.Errorf(codes.InvalidArgument, "user id is empty")
+	case in.Role != RoleMember && in.Role != RoleAdmin:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role %q", in.Role)
+	}
+
+	if err := s.checkOrg(ctx, in.OrgId, true); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var exist bool
+	err = tx.QueryRow(ctx, "select exists(select 1 from users where id = $1)", in.UserId).Scan(&exist)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if !exist {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+
+	if in.Role != RoleAdmin {
+		if err = lastAdmin(ctx, tx, in.OrgId, in.UserId); err != nil {
+			return nil, err
+		}
+	}
+
+	out := OrgMember{OrgId: in.OrgId, UserId: in.UserId, Role: in.Role}
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into org_members (org_id, user_id, role) values ($1, $2, $3) ")
+	fmt.Fprintf(&q, "on conflict (org_id, user_id) do update set role = excluded.role ")
+	fmt.Fprintf(&q, "returning created_at")
+	err = tx.QueryRow(ctx, q.String(), out.OrgId, out.UserId, out.Role).Scan(&out.CreatedAt)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// RemoveOrgMember removes a member from an org the caller is an admin of, or
+// the caller themselves. The member's vehicles leave the org with them.
+func (s *svc) RemoveOrgMember(ctx context.Context, in *RemoveOrgMemberRequest) (*emptypb.Empty, error) {
+	userId := s.Config.UserInfo.Id
+	if in.UserId == "" {
+		in.UserId = userId
+	}
+
+	if err := s.checkOrg(ctx, in.OrgId, in.UserId != userId); err != nil {
+		return nil, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	if err = lastAdmin(ctx, tx, in.OrgId, in.UserId); err != nil {
+		return nil, err
+	}
+
+	tag, err := tx.Exec(ctx, "delete from org_members where org_id = $1 and user_id = $2", in.OrgId, in.UserId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.NotFound, "member not found")
+	}
+
+	_, err = tx.Exec(ctx, "update vehicles set org_id = null, version = version + 1 "+
+		"where org_id = $1 and user_id = $2", in.OrgId, in.UserId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListOrgMembers returns the members of an org the caller is a member of.
+func (s *svc) ListOrgMembers(ctx context.Context, in *ListOrgMembersRequest) (*ListOrgMembersResponse, error) {
+	if err := s.checkOrg(ctx, in.OrgId, false); err != nil {
+		return nil, err
+	}
+
+	rows, err := global.PgxPool.Query(ctx, "select org_id, user_id, role, created_at from org_members "+
+		"where org_id = $1 order by created_at, user_id", in.OrgId)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListOrgMembersResponse
+	for rows.Next() {
+		var m OrgMember
+		if err = rows.Scan(&m.OrgId, &m.UserId, &m.Role, &m.CreatedAt); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Members = append(out.Members, &m)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// SetVehicleOrg assigns one of the caller's vehicles to an org they're a member
+// of, or takes it out of its org. Org admins can also take any vehicle out of
+// their org. A vehicle leaves its org when its ownership moves.
+func (s *svc) SetVehicleOrg(ctx context.Context, in *SetVehicleOrgRequest) (*emptypb.Empty, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("SetVehicleOrg input=%v", string(b))
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	userId := s.Config.UserInfo.Id
+	var ownerId, orgId string
+	err := global.PgxPool.QueryRow(ctx, "select user_id, coalesce(org_id, '') from vehicles "+
+		"where id = $1 and deleted_at is null", in.VehicleId).Scan(&ownerId, &orgId)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	switch {
+	case ownerId != userId && (orgId == "" || in.OrgId != ""):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case ownerId != userId:
+		// An org admin taking someone else's vehicle out of the org.
+		if err = s.checkOrg(ctx, orgId, true); err != nil {
+			return nil, err
+		}
+	case in.OrgId != "":
+		if err = s.checkOrg(ctx, in.OrgId, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var target any
+	if in.OrgId != "" {
+		target = in.OrgId
+	}
+
+	_, err = global.PgxPool.Exec(ctx, "update vehicles set org_id = $2, version = version + 1 "+
+		"where id = $1 and user_id = $3", in.VehicleId, target, ownerId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// checkOrg checks that the caller is a member of the org, or an admin.
+func (s *svc) checkOrg(ctx context.Context, orgId string, admin bool) error {
+	if orgId == "" {
+		return status.Errorf(codes.InvalidArgument, "org id is empty")
+	}
+
+	var role string
+	err := global.PgxPool.QueryRow(ctx, "select role from org_members where org_id = $1 and user_id = $2",
+		orgId, s.Config.UserInfo.Id).Scan(&role)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return status.Errorf(codes.NotFound, "org not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	case admin && role != RoleAdmin:
+		return status.Errorf(codes.PermissionDenied, "only org admins can do this")
+	}
+
+	return nil
+}
+
+// lastAdmin fails if userId is the org's only admin, so that every org keeps
+// one. It locks the org row until tx ends, which serializes role changes.
+func lastAdmin(ctx context.Context, tx pgx.Tx, orgId, userId string) error {
+	_, err := tx.Exec(ctx, "select 1 from orgs where id = $1 for update", orgId)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return internal.InternalErr
+	}
+
+	var others int
+	var admin bool
+	var q strings.Builder
+	fmt.Fprintf(&q, "select count(*) filter (where user_id <> $3), coalesce(bool_or(user_id = $3), false) ")
+	fmt.Fprintf(&q, "from org_members where org_id = $1 and role = $2")
+	err = tx.QueryRow(ctx, q.String(), orgId, RoleAdmin, userId).Scan(&others, &admin)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return internal.InternalErr
+	}
+
+	if admin && others == 0 {
+		return status.Errorf(codes.FailedPrecondition, "an org needs an admin, delete the org instead")
+	}
+
+	return nil
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
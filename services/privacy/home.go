@@ -0,0 +1,188 @@
+package privacy
+
+import (
+	"context"
+	"time"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/golang/glog"
+)
+
+const (
+	homeName           = "Home"
+	homeWindow         = time.Hour * 24 * 90
+	homeMaxTrips       = 500 // most recent, per user
+	homeMinStops       = 8
+	homeMinDays        = 4
+	defaultHomeRadiusM = 300
+)
+
+type stop struct {
+	p   geo.Point
+	day string
+}
+
+// RunHomeDetection looks for the place each recently active user stops at most
+// often, and puts a home privacy zone around it if they've stopped there on
+// enough days. A detected zone moves when the place does, and isn't recreated
+// where the user dismissed one.
+func RunHomeDetection(ctx context.Context, every time.Duration, config global.PrivacyConfig) {
+	radius := float64(defaultHomeRadiusM)
+	if config.HomeRadiusM > 0 {
+		radius = config.HomeRadiusM
+	}
+
+	since := time.Now().Add(-time.Hour * 24)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		users, err := activeUsers(ctx, since)
+		if err != nil {
+			glog.Errorf("activeUsers failed: %v", err)
+		} else {
+			since = now
+		}
+
+		for _, userId := range users {
+			if err = detectHome(ctx, userId, radius); err != nil {
+				glog.Errorf("detectHome failed for %v: %v", userId, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeUsers returns the users whose trips changed since the given time. That
+// includes trips uploaded long after they ended.
+func activeUsers(ctx context.Context, since time.Time) ([]string, error) {
+	rows, err := global.PgxPool.Query(ctx, "select distinct user_id from trips where updated_at >= $1", since)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		out = append(out, id)
+	}
+
+	return out, rows.Err()
+}
+
+func detectHome(ctx context.Context, userId string, radius float64) error {
+	rows, err := global.PgxPool.Query(ctx, "select start_lat, start_lon, started_at, end_lat, end_lon, "+
+		"ended_at from trips where user_id = $1 and ended_at >= $2 order by ended_at desc limit $3",
+		userId, time.Now().Add(-homeWindow), homeMaxTrips)
+	if err != nil {
+		return err
+	}
+
+	var stops []stop
+	for rows.Next() {
+		var start, end stop
+		var startedAt, endedAt time.Time
+		err = rows.Scan(&start.p.Lat, &start.p.Lon, &startedAt, &end.p.Lat, &end.p.Lon, &endedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		start.day, end.day = startedAt.Format(time.DateOnly), endedAt.Format(time.DateOnly)
+		stops = append(stops, start, end)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	home, ok := cluster(stops, radius/2)
+	if !ok {
+		return nil
+	}
+
+	rows, err = global.PgxPool.Query(ctx, "select id, center_lat, center_lon, radius_m, dismissed_at "+
+		"is not null from privacy_zones where user_id = $1 and source = $2", userId, SourceHome)
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for rows.Next() {
+		var id string
+		var c geo.Circle
+		var dismissed bool
+		if err = rows.Scan(&id, &c.Center.Lat, &c.Center.Lon, &c.RadiusM, &dismissed); err != nil {
+			rows.Close()
+			return err
+		}
+
+		switch {
+		case c.Contains(home):
+			rows.Close()
+			return nil // already covered, or dismissed there
+		case !dismissed:
+			stale = append(stale, id)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// The user moved: replace the old zone.
+	if len(stale) > 0 {
+		_, err = global.PgxPool.Exec(ctx, "delete from privacy_zones where id = any($1)", stale)
+		if err != nil {
+			return err
+		}
+	}
+
+	glog.Infof("detected home zone for %v", userId)
+	_, err = create(ctx, userId, homeName, SourceHome, geo.Circle{Center: home, RadiusM: radius})
+	return err
+}
+
+// cluster returns the middle of the stops with the most others within
+// withinM, if there are enough of them on enough days.
+func cluster(stops []stop, withinM float64) (geo.Point, bool) {
+	var best []stop
+	for _, a := range stops {
+		var near []stop
+		for _, b := range stops {
+			if geo.Distance(a.p, b.p) <= withinM {
+				near = append(near, b)
+			}
+		}
+
+		if len(near) > len(best) {
+			best = near
+		}
+	}
+
+	days := map[string]bool{}
+	var sum geo.Point
+	for _, s := range best {
+		days[s.day] = true
+		sum.Lat += s.p.Lat
+		sum.Lon += s.p.Lon
+	}
+
+	if len(best) < homeMinStops || len(days) < homeMinDays {
+		return geo.Point{}, false
+	}
+
+	n := float64(len(best))
+	return geo.Point{Lat: sum.Lat / n, Lon: sum.Lon / n}, true
+}
@@ -0,0 +1,257 @@
+package privacy
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	SourceUser = "user"
+	SourceHome = "home" // detected from frequent stops
+
+	maxNameLen = 100
+	minRadiusM = 50 // smaller than GPS error
+	maxRadiusM = 5000
+	maxZones   = 20
+
+	defaultSharedDigits = 3
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// PrivacyZone is a circle inside which the caller's trip endpoints are moved to
+// the edge and route points are left out. The stored center is a random offset
+// from the one asked for, and the radius grown by as much, so that the edge
+// gives nothing away.
+type PrivacyZone struct {
+	Id        string     `json:"id,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	Center    *geo.Point `json:"center,omitempty"`
+	RadiusM   float64    `json:"radiusM,omitempty"` // 50 to 5000
+	Source    string     `json:"source,omitempty"`  // user, home; set by the server
+	CreatedAt time.Time  `json:"createdAt,omitempty"`
+}
+
+type DeletePrivacyZoneRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+type ListPrivacyZonesRequest struct{}
+
+type ListPrivacyZonesResponse struct {
+	Zones []*PrivacyZone `json:"zones,omitempty"` // oldest first
+}
+
+// CreatePrivacyZone adds a privacy zone for the caller. It applies to all their
+// trips, including past ones.
+func (s *svc) CreatePrivacyZone(ctx context.Context, in *PrivacyZone) (*PrivacyZone, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("CreatePrivacyZone input=%v", string(b))
+	in.Name = strings.TrimSpace(in.Name)
+	switch {
+	case in.Name == "" || utf8.RuneCountInString(in.Name) > maxNameLen:
+		return nil, status.Errorf(codes.InvalidArgument, "name must have 1 to %v characters", maxNameLen)
+	case in.Center == nil || !validPoint(in.Center):
+		return nil, status.Errorf(codes.InvalidArgument, "center is invalid")
+	case !(in.RadiusM >= minRadiusM && in.RadiusM <= maxRadiusM):
+		return nil, status.Errorf(codes.InvalidArgument, "radius must be between %v and %v m", minRadiusM, maxRadiusM)
+	}
+
+	userId := s.Config.UserInfo.Id
+	var n int
+	q := "select count(*) from privacy_zones where user_id = $1 and dismissed_at is null"
+	if err := global.PgxPool.QueryRow(ctx, q, userId).Scan(&n); err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if n >= maxZones {
+		return nil, status.Errorf(codes.FailedPrecondition, "at most %v privacy zones are allowed", maxZones)
+	}
+
+	out, err := create(ctx, userId, in.Name, SourceUser, geo.Circle{Center: *in.Center, RadiusM: in.RadiusM})
+	if err != nil {
+		glog.Errorf("create failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// DeletePrivacyZone removes one of the caller's privacy zones. A detected home
+// zone isn't detected there again.
+func (s *svc) DeletePrivacyZone(ctx context.Context, in *DeletePrivacyZoneRequest) (*emptypb.Empty, error) {
+	userId := s.Config.UserInfo.Id
+	var source string
+	q := "select source from privacy_zones where id = $1 and user_id = $2 and dismissed_at is null"
+	err := global.PgxPool.QueryRow(ctx, q, in.Id, userId).Scan(&source)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "privacy zone not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	q = "delete from privacy_zones where id = $1"
+	if source == SourceHome {
+		q = "update privacy_zones set dismissed_at = now() where id = $1"
+	}
+
+	if _, err = global.PgxPool.Exec(ctx, q, in.Id); err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = invalidate(ctx, userId); err != nil {
+		glog.Errorf("invalidate failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListPrivacyZones returns the caller's privacy zones, including detected ones.
+func (s *svc) ListPrivacyZones(ctx context.Context, in *ListPrivacyZonesRequest) (*ListPrivacyZonesResponse, error) {
+	q := "select id, name, center_lat, center_lon, radius_m, source, created_at from privacy_zones " +
+		"where user_id = $1 and dismissed_at is null order by created_at, id"
+	rows, err := global.PgxPool.Query(ctx, q, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListPrivacyZonesResponse
+	for rows.Next() {
+		z := PrivacyZone{Center: &geo.Point{}}
+		err = rows.Scan(&z.Id, &z.Name, &z.Center.Lat, &z.Center.Lon, &z.RadiusM, &z.Source, &z.CreatedAt)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		out.Zones = append(out.Zones, &z)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// Zones returns a user's privacy zones, for services that return their
+// locations.
+func Zones(ctx context.Context, userId string) ([]geo.Circle, error) {
+	q := "select center_lat, center_lon, radius_m from privacy_zones where user_id = $1 and dismissed_at is null"
+	rows, err := global.PgxPool.Query(ctx, q, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var out []geo.Circle
+	for rows.Next() {
+		var c geo.Circle
+		if err = rows.Scan(&c.Center.Lat, &c.Center.Lon, &c.RadiusM); err != nil {
+			return nil, err
+		}
+
+		out = append(out, c)
+	}
+
+	return out, rows.Err()
+}
+
+// Mask moves p to the edge of the zones it's in.
+func Mask(p *geo.Point, zones []geo.Circle) {
+	if p != nil {
+		*p, _ = geo.SnapOutside(*p, zones)
+	}
+}
+
+// SharedDigits is the number of decimal places coordinates shared outside the
+// app are rounded to.
+func SharedDigits(config *global.Config) int {
+	if config != nil && config.Privacy.SharedDigits > 0 {
+		return config.Privacy.SharedDigits
+	}
+
+	return defaultSharedDigits
+}
+
+func create(ctx context.Context, userId, name, source string, c geo.Circle) (*PrivacyZone, error) {
+	c = fuzz(c)
+	out := PrivacyZone{
+		Id:      uuid.NewString(),
+		Name:    name,
+		Center:  &c.Center,
+		RadiusM: c.RadiusM,
+		Source:  source,
+	}
+
+	q := "insert into privacy_zones (id, user_id, name, center_lat, center_lon, radius_m, source) " +
+		"values ($1, $2, $3, $4, $5, $6, $7) returning created_at"
+	err := global.PgxPool.QueryRow(ctx, q, out.Id, userId, name, c.Center.Lat, c.Center.Lon,
+		c.RadiusM, source).Scan(&out.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = invalidate(ctx, userId); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// fuzz moves the center of c up to half its radius in a random direction, and
+// grows the radius by as much, so that c still covers the original circle.
+func fuzz(c geo.Circle) geo.Circle {
+	d := rand.Float64() * c.RadiusM / 2
+	return geo.Circle{
+		Center:  geo.Offset(c.Center, rand.Float64()*360, d),
+		RadiusM: math.Ceil(c.RadiusM + d + 1), // 1 m for the flat-earth offset
+	}
+}
+
+// invalidate drops the cached routes of a user's trips after their zones
+// change.
+func invalidate(ctx context.Context, userId string) error {
+	_, err := global.PgxPool.Exec(ctx, "delete from trip_routes where trip_id in "+
+		"(select id from trips where user_id = $1)", userId)
+	return err
+}
+
+func validPoint(p *geo.Point) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180 && !(p.Lat == 0 && p.Lon == 0)
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,176 @@
+package recall
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drival-ai/v10-go/base/v1"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Dataset is a versioned set of recall campaigns, loaded from a YAML file:
+//
+//	version: "2026-10-01"
+//	campaigns:
+//	  - id: 26V-123
+//	    make: Toyota
+//	    model: Corolla      # optional, all models if empty
+//	    yearFrom: 2019      # optional
+//	    yearTo: 2021        # optional
+//	    vinFrom: JT2...     # optional, with vinTo
+//	    vinTo: JT2...
+//	    description: Fuel pump may fail.
+//	    remedy: Dealer will replace the fuel pump.
+type Dataset struct {
+	Version   string      `yaml:"version"`
+	Campaigns []*Campaign `yaml:"campaigns"`
+}
+
+type Campaign struct {
+	Id          string `yaml:"id"`
+	Make        string `yaml:"make"`
+	Model       string `yaml:"model"`
+	YearFrom    int32  `yaml:"yearFrom"`
+	YearTo      int32  `yaml:"yearTo"`
+	VinFrom     string `yaml:"vinFrom"`
+	VinTo       string `yaml:"vinTo"`
+	Description string `yaml:"description"`
+	Remedy      string `yaml:"remedy"`
+}
+
+var current atomic.Pointer[Dataset]
+
+// Current returns the loaded dataset, or nil if none was loaded.
+func Current() *Dataset { return current.Load() }
+
+// Load reads and validates a dataset file.
+func Load(path string) (*Dataset, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var d Dataset
+	if err = yaml.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+
+	if d.Version == "" {
+		return nil, fmt.Errorf("missing version")
+	}
+
+	ids := map[string]bool{}
+	for i, c := range d.Campaigns {
+		c.VinFrom = strings.ToUpper(strings.TrimSpace(c.VinFrom))
+		c.VinTo = strings.ToUpper(strings.TrimSpace(c.VinTo))
+		switch {
+		case c.Id == "":
+			return nil, fmt.Errorf("campaign %d: missing id", i)
+		case ids[c.Id]:
+			return nil, fmt.Errorf("campaign %v: duplicate id", c.Id)
+		case c.Make == "":
+			return nil, fmt.Errorf("campaign %v: missing make", c.Id)
+		case c.YearFrom > 0 && c.YearTo > 0 && c.YearFrom > c.YearTo:
+			return nil, fmt.Errorf("campaign %v: invalid year range", c.Id)
+		case (c.VinFrom == "") != (c.VinTo == ""):
+			return nil, fmt.Errorf("campaign %v: vin range needs both ends", c.Id)
+		case len(c.VinFrom) != len(c.VinTo) || c.VinFrom > c.VinTo:
+			return nil, fmt.Errorf("campaign %v: invalid vin range", c.Id)
+		}
+
+		ids[c.Id] = true
+	}
+
+	return &d, nil
+}
+
+// Match returns the campaigns that apply to the vehicle.
+func (d *Dataset) Match(v *base.Vehicle) []*Campaign {
+	if d == nil || v == nil {
+		return nil
+	}
+
+	var out []*Campaign
+	for _, c := range d.Campaigns {
+		if c.matches(v) {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+func (c *Campaign) matches(v *base.Vehicle) bool {
+	if !strings.EqualFold(strings.TrimSpace(v.Make), c.Make) {
+		return false
+	}
+
+	if c.Model != "" && !strings.EqualFold(strings.TrimSpace(v.Model), c.Model) {
+		return false
+	}
+
+	if c.YearFrom > 0 || c.YearTo > 0 {
+		if v.Year == 0 {
+			return false // can't tell, don't guess
+		}
+
+		if (c.YearFrom > 0 && v.Year < c.YearFrom) || (c.YearTo > 0 && v.Year > c.YearTo) {
+			return false
+		}
+	}
+
+	if c.VinFrom != "" {
+		// Same-length VINs order by serial within a range; see Load.
+		vin := strings.ToUpper(v.Vin)
+		if len(vin) != len(c.VinFrom) || vin < c.VinFrom || vin > c.VinTo {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Watch loads the dataset at path and reloads it whenever the file changes,
+// re-matching all vehicles after each load. A file that fails to load keeps the
+// previous dataset in place. Runs until ctx is done.
+func Watch(ctx context.Context, path string, every time.Duration) {
+	var modTime time.Time
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			glog.Errorf("Stat failed: %v", err)
+		case !fi.ModTime().Equal(modTime):
+			d, err := Load(path)
+			if err != nil {
+				glog.Errorf("recall dataset %v not loaded: %v", path, err)
+				modTime = fi.ModTime() // don't retry until it changes again
+				break
+			}
+
+			modTime = fi.ModTime()
+			prev := current.Swap(d)
+			if prev == nil || prev.Version != d.Version {
+				glog.Infof("recall dataset %v loaded: %v campaigns", d.Version, len(d.Campaigns))
+			}
+
+			if err = MatchAll(ctx, d); err != nil {
+				glog.Errorf("MatchAll failed: %v", err)
+				modTime = time.Time{} // retry on the next tick
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package recall
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-go/base/v1"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const matchPageSize = 500
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type VehicleRecall struct {
+	CampaignId     string    `json:"campaignId,omitempty"`
+	Description    string    `json:"description,omitempty"`
+	Remedy         string    `json:"remedy,omitempty"`
+	DatasetVersion string    `json:"datasetVersion,omitempty"`
+	MatchedAt      time.Time `json:"matchedAt,omitempty"`
+	AcknowledgedAt time.Time `json:"acknowledgedAt,omitempty"` // zero if open
+}
+
+type ListRecallsRequest struct {
+	VehicleId           string `json:"vehicleId,omitempty"`
+	IncludeAcknowledged bool   `json:"includeAcknowledged,omitempty"`
+}
+
+type ListRecallsResponse struct {
+	Recalls []*VehicleRecall `json:"recalls,omitempty"`
+}
+
+type AcknowledgeRecallRequest struct {
+	VehicleId  string `json:"vehicleId,omitempty"`
+	CampaignId string `json:"campaignId,omitempty"`
+}
+
+// ListRecalls returns the recalls matched to a vehicle owned by the caller.
+// Acknowledged recalls are left out unless asked for.
+func (s *svc) ListRecalls(ctx context.Context, in *ListRecallsRequest) (*ListRecallsResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select r.campaign_id, r.description, r.remedy, r.dataset_version, ")
+	fmt.Fprintf(&q, "r.matched_at, a.acknowledged_at ")
+	fmt.Fprintf(&q, "from vehicle_recalls r left join recall_acknowledgements a ")
+	fmt.Fprintf(&q, "on a.vehicle_id = r.vehicle_id and a.campaign_id = r.campaign_id ")
+	fmt.Fprintf(&q, "and a.user_id = $2 ")
+	fmt.Fprintf(&q, "where r.vehicle_id = $1 and r.withdrawn_at is null ")
+	if !in.IncludeAcknowledged {
+		fmt.Fprintf(&q, "and a.acknowledged_at is null ")
+	}
+
+	fmt.Fprintf(&q, "order by r.matched_at desc")
+	rows, err := global.PgxPool.Query(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListRecallsResponse
+	for rows.Next() {
+		var r VehicleRecall
+		var ack *time.Time
+		err = rows.Scan(&r.CampaignId, &r.Description, &r.Remedy, &r.DatasetVersion, &r.MatchedAt, &ack)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if ack != nil {
+			r.AcknowledgedAt = *ack
+		}
+
+		out.Recalls = append(out.Recalls, &r)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// AcknowledgeRecall marks a recall as seen by the caller. Acknowledging twice is fine.
+func (s *svc) AcknowledgeRecall(ctx context.Context, in *AcknowledgeRecallRequest) (*emptypb.Empty, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into recall_acknowledgements (vehicle_id, campaign_id, user_id) ")
+	fmt.Fprintf(&q, "select vehicle_id, campaign_id, $3 from vehicle_recalls ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and campaign_id = $2 ")
+	fmt.Fprintf(&q, "on conflict do nothing")
+	tag, err := global.PgxPool.Exec(ctx, q.String(), in.VehicleId, in.CampaignId, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if tag.RowsAffected() == 0 {
+		var exist bool
+		err = global.PgxPool.QueryRow(ctx, "select exists(select 1 from vehicle_recalls "+
+			"where vehicle_id = $1 and campaign_id = $2)", in.VehicleId, in.CampaignId).Scan(&exist)
+		if err != nil {
+			glog.Errorf("QueryRow failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if !exist {
+			return nil, status.Errorf(codes.NotFound, "recall not found")
+		}
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// MatchVehicle records the current dataset's campaigns for one vehicle. Called
+// when a vehicle is registered; v.Id must be set.
+func MatchVehicle(ctx context.Context, v *base.Vehicle) error {
+	d := Current()
+	if d == nil {
+		return nil
+	}
+
+	var b pgx.Batch
+	queueMatches(&b, d, v)
+	if b.Len() == 0 {
+		return nil
+	}
+
+	return global.PgxPool.SendBatch(ctx, &b).Close()
+}
+
+// MatchAll re-matches every vehicle against d, then withdraws recorded recalls
+// that d no longer has: campaigns dropped from the dataset, or narrowed so that
+// they don't cover the vehicle anymore.
+func MatchAll(ctx context.Context, d *Dataset) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, chassis_number, vin, make, model, year, kms ")
+	fmt.Fprintf(&q, "from vehicles where id > $1 order by id limit $2")
+	var last string
+	var matched int
+	for {
+		rows, err := global.PgxPool.Query(ctx, q.String(), last, matchPageSize)
+		if err != nil {
+			return err
+		}
+
+		var b pgx.Batch
+		var n int
+		for rows.Next() {
+			var v base.Vehicle
+			err = rows.Scan(&v.Id, &v.ChassisNumber, &v.Vin, &v.Make, &v.Model, &v.Year, &v.Kilometers)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			last = v.Id
+			n++
+			queueMatches(&b, d, &v)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		if b.Len() > 0 {
+			matched += b.Len()
+			if err = global.PgxPool.SendBatch(ctx, &b).Close(); err != nil {
+				return err
+			}
+		}
+
+		if n < matchPageSize {
+			break
+		}
+	}
+
+	// Every match still valid was just stamped with this version; the rest are
+	// for campaigns that were dropped or no longer cover the vehicle.
+	q.Reset()
+	fmt.Fprintf(&q, "update vehicle_recalls set withdrawn_at = now() ")
+	fmt.Fprintf(&q, "where withdrawn_at is null and dataset_version <> $1")
+	_, err := global.PgxPool.Exec(ctx, q.String(), d.Version)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("MatchAll done: dataset=%v, matches=%v", d.Version, matched)
+	return nil
+}
+
+// queueMatches adds an upsert per matching campaign. Existing matches keep their
+// matched_at but pick up the latest wording, and are reinstated if withdrawn.
+func queueMatches(b *pgx.Batch, d *Dataset, v *base.Vehicle) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_recalls (vehicle_id, campaign_id, ")
+	fmt.Fprintf(&q, "description, remedy, dataset_version) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5) ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id, campaign_id) do update set ")
+	fmt.Fprintf(&q, "description = excluded.description, remedy = excluded.remedy, ")
+	fmt.Fprintf(&q, "dataset_version = excluded.dataset_version, withdrawn_at = null")
+	for _, c := range d.Match(v) {
+		b.Queue(q.String(), v.Id, c.Id, c.Description, c.Remedy, d.Version)
+	}
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,344 @@
+package score
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/scoring"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	BucketDay  = "day"
+	BucketWeek = "week"
+
+	defaultHistoryDays = 90
+	maxHistoryDays     = 366
+)
+
+// Rolling windows returned by GetScore, in days.
+var windows = []int{7, 30, 90}
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// GetScoreRequest asks for one trip's score, a vehicle's rolling scores, or if
+// both are empty, the caller's rolling scores as a driver across vehicles.
+type GetScoreRequest struct {
+	TripId       string `json:"tripId,omitempty"`
+	VehicleId    string `json:"vehicleId,omitempty"`
+	ModelVersion string `json:"modelVersion,omitempty"` // default the current model
+}
+
+type TripScore struct {
+	TripId    string             `json:"tripId,omitempty"`
+	Score     float64            `json:"score,omitempty"` // 0 to 100
+	SubScores map[string]float64 `json:"subScores,omitempty"`
+	DistanceM float64            `json:"distanceM,omitempty"`
+	ScoredAt  time.Time          `json:"scoredAt,omitempty"`
+}
+
+// WindowScore is the distance-weighted average of the trip scores in the last
+// Days days. Score is zero if there were no trips.
+type WindowScore struct {
+	Days      int32              `json:"days,omitempty"`
+	Score     float64            `json:"score,omitempty"`
+	SubScores map[string]float64 `json:"subScores,omitempty"`
+	DistanceM float64            `json:"distanceM,omitempty"`
+	Trips     int32              `json:"trips,omitempty"`
+}
+
+type GetScoreResponse struct {
+	ModelVersion string         `json:"modelVersion,omitempty"`
+	Trip         *TripScore     `json:"trip,omitempty"`    // when asked for a trip
+	Windows      []*WindowScore `json:"windows,omitempty"` // 7, 30 and 90 days otherwise
+}
+
+type ScoreHistoryRequest struct {
+	VehicleId    string `json:"vehicleId,omitempty"`    // optional, as in GetScoreRequest
+	Days         int32  `json:"days,omitempty"`         // default 90
+	Bucket       string `json:"bucket,omitempty"`       // day or week (default)
+	ModelVersion string `json:"modelVersion,omitempty"` // default the current model
+}
+
+type ScorePoint struct {
+	Start     time.Time `json:"start,omitempty"` // start of the day or week, UTC
+	Score     float64   `json:"score,omitempty"`
+	DistanceM float64   `json:"distanceM,omitempty"`
+	Trips     int32     `json:"trips,omitempty"`
+}
+
+type ScoreHistoryResponse struct {
+	ModelVersion string        `json:"modelVersion,omitempty"`
+	Points       []*ScorePoint `json:"points,omitempty"` // oldest first, buckets without trips left out
+}
+
+// GetScore returns a trip's score, or rolling 7, 30 and 90-day scores for a
+// driver or vehicle. Scores of recent trips may lag a few minutes behind.
+func (s *svc) GetScore(ctx context.Context, in *GetScoreRequest) (*GetScoreResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("GetScore input=%v", string(b))
+	version, err := modelVersion(in.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	out := GetScoreResponse{ModelVersion: version}
+	if in.TripId != "" {
+		out.Trip, err = s.tripScore(ctx, in.TripId, version)
+		if err != nil {
+			return nil, err
+		}
+
+		return &out, nil
+	}
+
+	sc, err := s.scope(ctx, in.VehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	longest := windows[len(windows)-1]
+	sc.args["version"] = version
+	sc.args["since"] = time.Now().UTC().AddDate(0, 0, -longest)
+	var q strings.Builder
+	fmt.Fprintf(&q, "select s.started_at, s.distance_m, s.score, s.sub_scores ")
+	fmt.Fprintf(&q, "from trip_scores s join vehicles v on v.id = s.vehicle_id ")
+	fmt.Fprintf(&q, "where v.deleted_at is null and s.model_version = @version ")
+	fmt.Fprintf(&q, "and s.started_at >= @since and %v", sc.cond)
+	rows, err := global.PgxPool.Query(ctx, q.String(), sc.args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	now := time.Now()
+	sums := make([]weighted, len(windows))
+	for rows.Next() {
+		var startedAt time.Time
+		var distance float64
+		var score float32
+		var subs map[string]float64
+		if err = rows.Scan(&startedAt, &distance, &score, &subs); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		for i, days := range windows {
+			if now.Sub(startedAt) <= time.Hour*24*time.Duration(days) {
+				sums[i].add(distance, float64(score), subs)
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	for i, days := range windows {
+		w := sums[i].result()
+		w.Days = int32(days)
+		out.Windows = append(out.Windows, w)
+	}
+
+	return &out, nil
+}
+
+// ScoreHistory returns distance-weighted scores per day or week, for charts.
+func (s *svc) ScoreHistory(ctx context.Context, in *ScoreHistoryRequest) (*ScoreHistoryResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ScoreHistory input=%v", string(b))
+	version, err := modelVersion(in.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	days := in.Days
+	switch {
+	case days == 0:
+		days = defaultHistoryDays
+	case days < 0 || days > maxHistoryDays:
+		return nil, status.Errorf(codes.InvalidArgument, "days must be between 1 and %v", maxHistoryDays)
+	}
+
+	bucket := in.Bucket
+	switch bucket {
+	case "":
+		bucket = BucketWeek
+	case BucketDay, BucketWeek:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "bucket must be %v or %v", BucketDay, BucketWeek)
+	}
+
+	sc, err := s.scope(ctx, in.VehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.args["version"] = version
+	sc.args["since"] = time.Now().UTC().AddDate(0, 0, -int(days))
+	sc.args["bucket"] = bucket
+	var q strings.Builder
+	fmt.Fprintf(&q, "select date_trunc(@bucket, s.started_at at time zone 'UTC') as start, ")
+	fmt.Fprintf(&q, "sum(s.score * s.distance_m) / nullif(sum(s.distance_m), 0), ")
+	fmt.Fprintf(&q, "sum(s.distance_m), count(*) ")
+	fmt.Fprintf(&q, "from trip_scores s join vehicles v on v.id = s.vehicle_id ")
+	fmt.Fprintf(&q, "where v.deleted_at is null and s.model_version = @version ")
+	fmt.Fprintf(&q, "and s.started_at >= @since and %v ", sc.cond)
+	fmt.Fprintf(&q, "group by start order by start")
+	rows, err := global.PgxPool.Query(ctx, q.String(), sc.args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	out := ScoreHistoryResponse{ModelVersion: version}
+	for rows.Next() {
+		var p ScorePoint
+		var score *float64
+		if err = rows.Scan(&p.Start, &score, &p.DistanceM, &p.Trips); err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if score != nil {
+			p.Score = round(*score)
+		}
+
+		p.Start = p.Start.UTC()
+		out.Points = append(out.Points, &p)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+func (s *svc) tripScore(ctx context.Context, tripId, version string) (*TripScore, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select s.trip_id, s.score, s.sub_scores, s.distance_m, s.scored_at ")
+	fmt.Fprintf(&q, "from trips t left join trip_scores s on s.trip_id = t.id and s.model_version = $3 ")
+	fmt.Fprintf(&q, "where t.id = $1 and t.user_id = $2 and exists(select 1 from vehicles v ")
+	fmt.Fprintf(&q, "where v.id = t.vehicle_id and v.deleted_at is null)")
+	var id *string
+	var score *float32
+	var out TripScore
+	var distance *float64
+	var scoredAt *time.Time
+	err := global.PgxPool.QueryRow(ctx, q.String(), tripId, s.Config.UserInfo.Id, version).Scan(&id,
+		&score, &out.SubScores, &distance, &scoredAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "trip not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	case id == nil:
+		return nil, status.Errorf(codes.Unavailable, "trip is not scored yet")
+	}
+
+	out.TripId, out.Score, out.DistanceM, out.ScoredAt = *id, float64(*score), *distance, *scoredAt
+	return &out, nil
+}
+
+// scope is a condition on trip_scores s (and vehicles v) for the trips the
+// caller may see. Trips are private to whoever drove them, except within an org,
+// where members see each other's trips in the org's vehicles.
+type scope struct {
+	cond string
+	args pgx.NamedArgs
+}
+
+func (s *svc) scope(ctx context.Context, vehicleId string) (*scope, error) {
+	userId := s.Config.UserInfo.Id
+	sc := scope{cond: "s.user_id = @user_id", args: pgx.NamedArgs{"user_id": userId}}
+	if vehicleId == "" {
+		return &sc, nil
+	}
+
+	if err := internal.CheckVehicleAccess(ctx, vehicleId, userId); err != nil {
+		return nil, err
+	}
+
+	sc.args["vehicle_id"] = vehicleId
+	sc.cond = "s.vehicle_id = @vehicle_id and (s.user_id = @user_id or (v.org_id in " +
+		"(select m.org_id from org_members m where m.user_id = @user_id) and s.user_id in " +
+		"(select m.user_id from org_members m where m.org_id = v.org_id)))"
+	return &sc, nil
+}
+
+func modelVersion(version string) (string, error) {
+	if version == "" {
+		return scoring.Current, nil
+	}
+
+	if _, ok := scoring.Get(version); !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown model version %q", version)
+	}
+
+	return version, nil
+}
+
+// weighted accumulates distance-weighted scores.
+type weighted struct {
+	distance float64
+	trips    int32
+	score    float64
+	subs     map[string]float64
+}
+
+func (w *weighted) add(distance, score float64, subs map[string]float64) {
+	if w.subs == nil {
+		w.subs = map[string]float64{}
+	}
+
+	w.distance += distance
+	w.trips++
+	w.score += score * distance
+	for k, v := range subs {
+		w.subs[k] += v * distance
+	}
+}
+
+func (w *weighted) result() *WindowScore {
+	out := WindowScore{DistanceM: math.Round(w.distance), Trips: w.trips}
+	if w.distance == 0 {
+		return &out
+	}
+
+	out.Score = round(w.score / w.distance)
+	out.SubScores = map[string]float64{}
+	for k, v := range w.subs {
+		out.SubScores[k] = round(v / w.distance)
+	}
+
+	return &out
+}
+
+func round(f float64) float64 { return math.Round(f*10) / 10 }
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,137 @@
+package score
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/scoring"
+	"github.com/golang/glog"
+)
+
+const scoreBatchSize = 200
+
+// RunScorer scores trips that have no score from the current model yet: new and
+// re-segmented trips, and after a model change, all of history, newest first.
+func RunScorer(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := scoreBatch(ctx, scoring.Current)
+			if err != nil {
+				glog.Errorf("scoreBatch failed: %v", err)
+			}
+
+			if err != nil || n < scoreBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type unscored struct {
+	id, vehicleId, userId string
+	startedAt, updatedAt  time.Time
+	in                    scoring.Inputs
+}
+
+func scoreBatch(ctx context.Context, version string) (int, error) {
+	model, ok := scoring.Get(version)
+	if !ok {
+		return 0, fmt.Errorf("unknown model %v", version)
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select t.id, t.vehicle_id, t.user_id, t.started_at, t.updated_at, ")
+	fmt.Fprintf(&q, "t.distance_m, t.night_share, t.speed_cv from trips t ")
+	fmt.Fprintf(&q, "where not exists(select 1 from trip_scores s ")
+	fmt.Fprintf(&q, "where s.trip_id = t.id and s.model_version = $1) ")
+	fmt.Fprintf(&q, "order by t.started_at desc limit $2")
+	rows, err := global.PgxPool.Query(ctx, q.String(), version, scoreBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var trips []*unscored
+	byId := map[string]*unscored{}
+	for rows.Next() {
+		var t unscored
+		var night, cv float32
+		err = rows.Scan(&t.id, &t.vehicleId, &t.userId, &t.startedAt, &t.updatedAt,
+			&t.in.DistanceM, &night, &cv)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		t.in.NightShare, t.in.SpeedCV = float64(night), float64(cv)
+		trips = append(trips, &t)
+		byId[t.id] = &t
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(trips) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(trips))
+	for i, t := range trips {
+		ids[i] = t.id
+	}
+
+	rows, err = global.PgxPool.Query(ctx, "select trip_id, type, severity from trip_events "+
+		"where trip_id = any($1)", ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var tripId string
+		var ev scoring.Event
+		if err = rows.Scan(&tripId, &ev.Type, &ev.Severity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		byId[tripId].in.Events = append(byId[tripId].in.Events, &ev)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// A trip re-segmented meanwhile is skipped; it's picked up again next round.
+	q.Reset()
+	fmt.Fprintf(&q, "insert into trip_scores (trip_id, model_version, vehicle_id, user_id, ")
+	fmt.Fprintf(&q, "started_at, distance_m, score, sub_scores) ")
+	fmt.Fprintf(&q, "select $1, $2, $3, $4, $5, $6, $7, $8 ")
+	fmt.Fprintf(&q, "where exists(select 1 from trips where id = $1 and updated_at = $9) ")
+	fmt.Fprintf(&q, "on conflict (trip_id, model_version) do update set ")
+	fmt.Fprintf(&q, "started_at = excluded.started_at, distance_m = excluded.distance_m, ")
+	fmt.Fprintf(&q, "score = excluded.score, sub_scores = excluded.sub_scores, scored_at = now()")
+	for _, t := range trips {
+		r := model(&t.in)
+		subs, _ := json.Marshal(r.SubScores)
+		_, err = global.PgxPool.Exec(ctx, q.String(), t.id, version, t.vehicleId, t.userId,
+			t.startedAt, t.in.DistanceM, r.Score, string(subs), t.updatedAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	glog.Infof("scored %v trips with model %v", len(trips), version)
+	return len(trips), nil
+}
@@ -0,0 +1,417 @@
+package tco
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	CategoryPurchase     = "purchase"
+	CategoryFuel         = "fuel"
+	CategoryMaintenance  = "maintenance"
+	CategoryInsurance    = "insurance"
+	CategoryRegistration = "registration" // registration and inspection fees
+
+	maxRangeYears = 10
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type SetPurchaseRequest struct {
+	VehicleId   string    `json:"vehicleId,omitempty"`
+	PurchasedOn time.Time `json:"purchasedOn,omitempty"`
+	PriceMinor  int64     `json:"priceMinor,omitempty"`
+	Currency    string    `json:"currency,omitempty"`
+}
+
+// ReportRequest selects the costs to report on: one vehicle, every vehicle of an
+// org (fleet), or all of the caller's vehicles if both are empty.
+type ReportRequest struct {
+	VehicleId string    `json:"vehicleId,omitempty"`
+	OrgId     string    `json:"orgId,omitempty"`
+	From      time.Time `json:"from,omitempty"`     // inclusive, default a year before To
+	To        time.Time `json:"to,omitempty"`       // exclusive, default tomorrow
+	Currency  string    `json:"currency,omitempty"` // default the exchange-rate base
+}
+
+type Amount struct {
+	Key         string `json:"key,omitempty"` // category or month (2006-01)
+	AmountMinor int64  `json:"amountMinor,omitempty"`
+}
+
+type MonthCosts struct {
+	Month       string    `json:"month,omitempty"` // 2006-01
+	AmountMinor int64     `json:"amountMinor,omitempty"`
+	Categories  []*Amount `json:"categories,omitempty"`
+}
+
+type Report struct {
+	From       time.Time `json:"from,omitempty"`
+	To         time.Time `json:"to,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+	Vehicles   int32     `json:"vehicles,omitempty"`
+	TotalMinor int64     `json:"totalMinor,omitempty"`
+	Kms        int64     `json:"kms,omitempty"`        // distance driven in the range, from odometer readings
+	PerKmMinor float64   `json:"perKmMinor,omitempty"` // zero if Kms is zero
+
+	Categories []*Amount     `json:"categories,omitempty"`
+	Months     []*MonthCosts `json:"months,omitempty"`
+
+	// Costs left out because there's no exchange rate for their currency.
+	Unconverted []*Amount `json:"unconverted,omitempty"` // keyed by currency
+}
+
+// SetPurchase records what the caller paid for a vehicle they own.
+func (s *svc) SetPurchase(ctx context.Context, in *SetPurchaseRequest) (*emptypb.Empty, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("SetPurchase input=%v", string(b))
+	switch {
+	case in.PriceMinor < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "price must not be negative")
+	case in.PurchasedOn.IsZero():
+		return nil, status.Errorf(codes.InvalidArgument, "purchase date is empty")
+	case in.PurchasedOn.After(time.Now().Add(time.Hour * 24)):
+		return nil, status.Errorf(codes.InvalidArgument, "purchase date is in the future")
+	}
+
+	currency, ok := money.NormalizeCurrency(in.Currency)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+	}
+
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicle_ownerships set purchased_on = $3, ")
+	fmt.Fprintf(&q, "purchase_price_minor = $4, purchase_currency = $5 ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 and ended_at is null")
+	_, err := global.PgxPool.Exec(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id,
+		truncDay(in.PurchasedOn), in.PriceMinor, currency)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// GetReport breaks down the total cost of ownership in a date range by category
+// and month, converting everything into one currency.
+func (s *svc) GetReport(ctx context.Context, in *ReportRequest) (*Report, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("GetReport input=%v", string(b))
+	return s.report(ctx, in)
+}
+
+// ExportReport is GetReport as CSV: one row per month and category, then the
+// totals per category, the grand total and the cost per km.
+func (s *svc) ExportReport(ctx context.Context, in *ReportRequest) (*internal.ExportResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ExportReport input=%v", string(b))
+	r, err := s.report(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"month", "category", "amount", "currency"})
+	for _, m := range r.Months {
+		for _, c := range m.Categories {
+			w.Write([]string{m.Month, c.Key, money.Format(c.AmountMinor, r.Currency), r.Currency})
+		}
+	}
+
+	for _, c := range r.Categories {
+		w.Write([]string{"total", c.Key, money.Format(c.AmountMinor, r.Currency), r.Currency})
+	}
+
+	w.Write([]string{"total", "all", money.Format(r.TotalMinor, r.Currency), r.Currency})
+	if r.Kms > 0 {
+		perKm := r.PerKmMinor / math.Pow10(money.MinorDigits(r.Currency))
+		w.Write([]string{"total", "per km", fmt.Sprintf("%.4f", perKm), r.Currency})
+	}
+
+	for _, u := range r.Unconverted {
+		w.Write([]string{"unconverted", "all", money.Format(u.AmountMinor, u.Key), u.Key})
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		glog.Errorf("Write failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &internal.ExportResponse{
+		Filename: fmt.Sprintf("tco-%v-%v.csv", r.From.Format(time.DateOnly),
+			r.To.AddDate(0, 0, -1).Format(time.DateOnly)),
+		ContentType: "text/csv",
+		Data:        buf.Bytes(),
+	}, nil
+}
+
+// item is one cost in its original currency.
+type item struct {
+	vehicleId   string
+	category    string
+	on          time.Time
+	amountMinor int64
+	currency    string
+}
+
+func (s *svc) report(ctx context.Context, in *ReportRequest) (*Report, error) {
+	rates := &money.Rates{}
+	if s.Config.Config != nil {
+		rates = &s.Config.Config.ExchangeRates
+	}
+
+	out := Report{From: truncDay(in.From), To: truncDay(in.To), Currency: rates.Base}
+	if in.Currency != "" {
+		var ok bool
+		if out.Currency, ok = money.NormalizeCurrency(in.Currency); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid currency %q", in.Currency)
+		}
+	}
+
+	if out.To.IsZero() {
+		out.To = truncDay(time.Now().UTC()).AddDate(0, 0, 1)
+	}
+
+	if out.From.IsZero() {
+		out.From = out.To.AddDate(-1, 0, 0)
+	}
+
+	switch {
+	case out.Currency == "":
+		return nil, status.Errorf(codes.InvalidArgument, "currency is empty")
+	case !out.From.Before(out.To):
+		return nil, status.Errorf(codes.InvalidArgument, "from must be before to")
+	case out.To.Sub(out.From) > time.Hour*24*366*maxRangeYears:
+		return nil, status.Errorf(codes.InvalidArgument, "range exceeds %v years", maxRangeYears)
+	}
+
+	sc, err := s.scope(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.args["from"], sc.args["to"] = out.From, out.To
+	items, err := loadItems(ctx, sc)
+	if err != nil {
+		glog.Errorf("loadItems failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	var vehicles int32
+	out.Kms, vehicles, err = distance(ctx, sc)
+	if err != nil {
+		glog.Errorf("distance failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	out.Vehicles = vehicles
+	aggregate(&out, items, rates)
+	if out.Kms > 0 {
+		out.PerKmMinor = math.Round(float64(out.TotalMinor)/float64(out.Kms)*100) / 100
+	}
+
+	return &out, nil
+}
+
+// scope limits a report to what the caller may see: vehicles is a condition on
+// vehicles v, authors one on cost rows i. Costs are private to whoever recorded
+// them, except within an org, where members see each other's costs for the
+// org's vehicles.
+type scope struct {
+	vehicles string
+	authors  string
+	args     pgx.NamedArgs
+}
+
+func (s *svc) scope(ctx context.Context, in *ReportRequest) (*scope, error) {
+	userId := s.Config.UserInfo.Id
+	sc := scope{
+		vehicles: "v.user_id = @user_id",
+		authors:  "i.user_id = @user_id",
+		args:     pgx.NamedArgs{"user_id": userId},
+	}
+
+	switch {
+	case in.OrgId != "":
+		var member bool
+		err := global.PgxPool.QueryRow(ctx, "select exists(select 1 from org_members "+
+			"where org_id = $1 and user_id = $2)", in.OrgId, userId).Scan(&member)
+		if err != nil {
+			glog.Errorf("QueryRow failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if !member {
+			return nil, status.Errorf(codes.NotFound, "org not found")
+		}
+
+		sc.args["org_id"] = in.OrgId
+		sc.vehicles = "v.org_id = @org_id"
+		sc.authors = "i.user_id in (select m.user_id from org_members m where m.org_id = @org_id)"
+		if in.VehicleId != "" {
+			sc.vehicles += " and v.id = @vehicle_id"
+			sc.args["vehicle_id"] = in.VehicleId
+		}
+	case in.VehicleId != "":
+		if err := internal.CheckVehicleOwner(ctx, in.VehicleId, userId); err != nil {
+			return nil, err
+		}
+
+		sc.vehicles = "v.id = @vehicle_id"
+		sc.args["vehicle_id"] = in.VehicleId
+	}
+
+	return &sc, nil
+}
+
+// costItems lists every cost with its vehicle, author and date. New cost sources
+// are added here. Expenses keep their own category (toll, parking, fine, ...).
+const costItems = `
+select vehicle_id, user_id, 'fuel' as category, (filled_at at time zone 'UTC')::date as on_date,
+	cost_minor, currency from fuel_entries
+union all
+select vehicle_id, user_id, 'maintenance', serviced_on, cost_minor, currency from service_records
+union all
+select vehicle_id, user_id, case kind when 'insurance' then 'insurance' else 'registration' end,
+	coalesce(issued_on, (created_at at time zone 'UTC')::date), cost_minor, currency from compliance_records
+union all
+select vehicle_id, user_id, 'purchase', purchased_on, purchase_price_minor, purchase_currency
+	from vehicle_ownerships where purchased_on is not null
+union all
+select vehicle_id, user_id, category, (spent_at at time zone 'UTC')::date, amount_minor, currency
+	from expenses`
+
+func loadItems(ctx context.Context, sc *scope) ([]*item, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select i.vehicle_id, i.category, i.on_date, i.cost_minor, i.currency ")
+	fmt.Fprintf(&q, "from (%v) i join vehicles v on v.id = i.vehicle_id ", costItems)
+	fmt.Fprintf(&q, "where v.deleted_at is null and %v and %v ", sc.vehicles, sc.authors)
+	fmt.Fprintf(&q, "and i.cost_minor > 0 and i.on_date >= @from and i.on_date < @to")
+	rows, err := global.PgxPool.Query(ctx, q.String(), sc.args)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var items []*item
+	for rows.Next() {
+		var it item
+		if err = rows.Scan(&it.vehicleId, &it.category, &it.on, &it.amountMinor, &it.currency); err != nil {
+			return nil, err
+		}
+
+		items = append(items, &it)
+	}
+
+	return items, rows.Err()
+}
+
+// distance sums, over the vehicles in scope, the distance between the first and
+// last odometer readings in the range. Also returns the number of vehicles.
+func distance(ctx context.Context, sc *scope) (int64, int32, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select coalesce(sum(kms), 0), count(*) from (")
+	fmt.Fprintf(&q, "select v.id, coalesce(max(i.odometer_kms) - min(i.odometer_kms), 0) as kms ")
+	fmt.Fprintf(&q, "from vehicles v left join (")
+	fmt.Fprintf(&q, "select vehicle_id, user_id, odometer_kms, (filled_at at time zone 'UTC')::date as on_date ")
+	fmt.Fprintf(&q, "from fuel_entries union all ")
+	fmt.Fprintf(&q, "select vehicle_id, user_id, odometer_kms, serviced_on from service_records ")
+	fmt.Fprintf(&q, "where odometer_kms > 0 union all ")
+	fmt.Fprintf(&q, "select vehicle_id, user_id, odometer_km::bigint, (recorded_at at time zone 'UTC')::date ")
+	fmt.Fprintf(&q, "from obd_readings where odometer_km > 0) i on i.vehicle_id = v.id ")
+	fmt.Fprintf(&q, "and i.on_date >= @from and i.on_date < @to and %v ", sc.authors)
+	fmt.Fprintf(&q, "where v.deleted_at is null and %v group by v.id) d", sc.vehicles)
+	var kms int64
+	var n int32
+	err := global.PgxPool.QueryRow(ctx, q.String(), sc.args).Scan(&kms, &n)
+	return kms, n, err
+}
+
+func aggregate(out *Report, items []*item, rates *money.Rates) {
+	categories := map[string]int64{}
+	months := map[string]map[string]int64{}
+	unconverted := map[string]int64{}
+	for _, it := range items {
+		amount, err := rates.Convert(it.amountMinor, it.currency, out.Currency)
+		if errors.Is(err, money.ErrNoRate) {
+			unconverted[it.currency] += it.amountMinor
+			continue
+		}
+
+		month := it.on.Format("2006-01")
+		if months[month] == nil {
+			months[month] = map[string]int64{}
+		}
+
+		months[month][it.category] += amount
+		categories[it.category] += amount
+		out.TotalMinor += amount
+	}
+
+	out.Categories = sorted(categories)
+	out.Unconverted = sorted(unconverted)
+	for m, byCategory := range months {
+		mc := MonthCosts{Month: m, Categories: sorted(byCategory)}
+		for _, c := range mc.Categories {
+			mc.AmountMinor += c.AmountMinor
+		}
+
+		out.Months = append(out.Months, &mc)
+	}
+
+	sort.Slice(out.Months, func(i, j int) bool { return out.Months[i].Month < out.Months[j].Month })
+}
+
+func sorted(m map[string]int64) []*Amount {
+	var out []*Amount
+	for k, v := range m {
+		out = append(out, &Amount{Key: k, AmountMinor: v})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func truncDay(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,353 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/location"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxBatchSamples = 1000 // per stream message
+	flushSamples    = 2000 // written to Postgres in one COPY
+
+	maxSpeedMps = 150 // ~540 km/h, anything above is a GPS glitch
+	maxAccel    = 160 // m/s², ~16 g
+
+	// How far from the server's clock sample timestamps may be.
+	maxClockSkew = time.Minute * 5
+	maxSampleAge = time.Hour * 24 * 30
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// Sample is one GPS/IMU reading. Seq is assigned by the app, increases
+// monotonically per vehicle, and is what duplicates are detected by.
+type Sample struct {
+	Seq        int64     `json:"seq,omitempty"`
+	Timestamp  time.Time `json:"timestamp,omitempty"`
+	Lat        float64   `json:"lat,omitempty"`
+	Lon        float64   `json:"lon,omitempty"`
+	SpeedMps   float32   `json:"speedMps,omitempty"`
+	HeadingDeg float32   `json:"headingDeg,omitempty"` // 0 to 360, clockwise from north
+	AccuracyM  float32   `json:"accuracyM,omitempty"`  // horizontal, 68% confidence
+	AccelX     float32   `json:"accelX,omitempty"`     // m/s², device frame
+	AccelY     float32   `json:"accelY,omitempty"`
+	AccelZ     float32   `json:"accelZ,omitempty"`
+}
+
+// UploadTelemetryRequest is one message of the upload stream. The first message
+// must carry VehicleId; later ones may leave it empty but can't change it.
+type UploadTelemetryRequest struct {
+	VehicleId string    `json:"vehicleId,omitempty"`
+	Samples   []*Sample `json:"samples,omitempty"`
+}
+
+// UploadTelemetryResponse acknowledges an upload. LastSequence is the highest
+// seq stored for the vehicle, so the app can drop everything up to it and resume
+// from there, even if this stream failed partway.
+type UploadTelemetryResponse struct {
+	LastSequence int64 `json:"lastSequence,omitempty"`
+	Accepted     int32 `json:"accepted,omitempty"`
+	Duplicates   int32 `json:"duplicates,omitempty"`
+	Rejected     int32 `json:"rejected,omitempty"` // failed validation
+}
+
+type UploadTelemetryServer interface {
+	Context() context.Context
+	Recv() (*UploadTelemetryRequest, error)
+	SendAndClose(*UploadTelemetryResponse) error
+}
+
+type LastSequenceRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type LastSequenceResponse struct {
+	LastSequence int64 `json:"lastSequence,omitempty"` // zero if nothing was stored yet
+}
+
+// UploadTelemetry receives samples for a vehicle the caller owns or drives for
+// an org. Invalid samples are counted and skipped rather than failing the stream;
+// samples already stored, or repeated within the stream, are dropped.
+func (s *svc) UploadTelemetry(stream UploadTelemetryServer) error {
+	ctx := stream.Context()
+	in, err := stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return status.Errorf(codes.InvalidArgument, "no data")
+		}
+
+		glog.Errorf("Recv failed: %v", err)
+		return err
+	}
+
+	vehicleId := in.VehicleId
+	glog.Infof("UploadTelemetry input=vehicle:%v", vehicleId)
+	if err = internal.CheckVehicleAccess(ctx, vehicleId, s.Config.UserInfo.Id); err != nil {
+		return err
+	}
+
+	var out UploadTelemetryResponse
+	seen := map[int64]bool{}
+	var buf []*Sample
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+
+		// Samples already received are stored even if the client goes away.
+		n, err := s.write(context.WithoutCancel(ctx), vehicleId, buf)
+		if err != nil {
+			glog.Errorf("write failed: %v", err)
+			return internal.InternalErr
+		}
+
+		out.Accepted += int32(n)
+		out.Duplicates += int32(len(buf) - n)
+		buf = buf[:0]
+		return nil
+	}
+
+	now := time.Now()
+	for {
+		switch {
+		case in.VehicleId != "" && in.VehicleId != vehicleId:
+			return status.Errorf(codes.InvalidArgument, "vehicle id can't change within a stream")
+		case len(in.Samples) > maxBatchSamples:
+			return status.Errorf(codes.InvalidArgument, "message exceeds %v samples", maxBatchSamples)
+		}
+
+		for _, sm := range in.Samples {
+			switch {
+			case !valid(sm, now):
+				out.Rejected++
+			case seen[sm.Seq]:
+				out.Duplicates++
+			default:
+				seen[sm.Seq] = true
+				buf = append(buf, sm)
+			}
+		}
+
+		if len(buf) >= flushSamples {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+
+		in, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			glog.Errorf("Recv failed: %v", err)
+			flush() // keep what we have, the app resumes from LastSequence
+			return err
+		}
+	}
+
+	if err = flush(); err != nil {
+		return err
+	}
+
+	out.LastSequence, err = s.lastSequence(ctx, vehicleId)
+	if err != nil {
+		glog.Errorf("lastSequence failed: %v", err)
+		return internal.InternalErr
+	}
+
+	b, _ := json.Marshal(&out)
+	glog.Infof("UploadTelemetry success! vehicle=%v, out=%v", vehicleId, string(b))
+	return stream.SendAndClose(&out)
+}
+
+// LastSequence returns the highest seq stored for the vehicle by the caller.
+func (s *svc) LastSequence(ctx context.Context, in *LastSequenceRequest) (*LastSequenceResponse, error) {
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	seq, err := s.lastSequence(ctx, in.VehicleId)
+	if err != nil {
+		glog.Errorf("lastSequence failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &LastSequenceResponse{LastSequence: seq}, nil
+}
+
+func (s *svc) lastSequence(ctx context.Context, vehicleId string) (int64, error) {
+	var seq int64
+	err := global.PgxPool.QueryRow(ctx, "select coalesce(max(seq), 0) from telemetry_samples "+
+		"where vehicle_id = $1 and user_id = $2", vehicleId, s.Config.UserInfo.Id).Scan(&seq)
+	return seq, err
+}
+
+var copyColumns = []string{"vehicle_id", "user_id", "seq", "recorded_at", "lat", "lon",
+	"speed_mps", "heading_deg", "accuracy_m", "accel_x", "accel_y", "accel_z"}
+
+// write bulk-loads samples with COPY into a temporary table, then moves them
+// over skipping the ones already stored. Returns how many were new.
+func (s *svc) write(ctx context.Context, vehicleId string, samples []*Sample) (int, error) {
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+	userId := s.Config.UserInfo.Id
+	if err = copyIn(ctx, tx, vehicleId, userId, samples); err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, "insert into telemetry_samples select * from telemetry_in "+
+		"on conflict (vehicle_id, user_id, seq) do nothing")
+	if err != nil {
+		return 0, err
+	}
+
+	if tag.RowsAffected() > 0 {
+		from, to := samples[0].Timestamp, samples[0].Timestamp
+		for _, sm := range samples {
+			from, to = minTime(from, sm.Timestamp), maxTime(to, sm.Timestamp)
+		}
+
+		if err = markDirty(ctx, tx, vehicleId, userId, from, to); err != nil {
+			return 0, err
+		}
+
+		if err = updateLocation(ctx, tx); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+// copyIn loads samples into telemetry_in, a temporary table shaped like
+// telemetry_samples that is dropped on commit. COPY can't skip conflicts, so
+// rows are moved on from there.
+func copyIn(ctx context.Context, tx pgx.Tx, vehicleId, userId string, samples []*Sample) error {
+	_, err := tx.Exec(ctx, "create temp table telemetry_in "+
+		"(like telemetry_samples including defaults) on commit drop")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"telemetry_in"}, copyColumns,
+		pgx.CopyFromSlice(len(samples), func(i int) ([]any, error) {
+			sm := samples[i]
+			return []any{vehicleId, userId, sm.Seq, sm.Timestamp, sm.Lat, sm.Lon, sm.SpeedMps,
+				sm.HeadingDeg, sm.AccuracyM, sm.AccelX, sm.AccelY, sm.AccelZ}, nil
+		}))
+	return err
+}
+
+// markDirty has the trip segmenter look at a time range with new samples.
+func markDirty(ctx context.Context, tx pgx.Tx, vehicleId, userId string, from, to time.Time) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into trip_dirty_windows (vehicle_id, user_id, from_at, to_at) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4) ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id, user_id) do update set ")
+	fmt.Fprintf(&q, "from_at = least(trip_dirty_windows.from_at, excluded.from_at), ")
+	fmt.Fprintf(&q, "to_at = greatest(trip_dirty_windows.to_at, excluded.to_at), marked_at = now()")
+	_, err := tx.Exec(ctx, q.String(), vehicleId, userId, from, to)
+	return err
+}
+
+// updateLocation moves the vehicle's live position to the newest sample in
+// telemetry_in, if newer, and announces it to watchers on commit.
+func updateLocation(ctx context.Context, tx pgx.Tx) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "with latest as (select vehicle_id, user_id, seq, recorded_at, lat, lon, speed_mps, ")
+	fmt.Fprintf(&q, "heading_deg from telemetry_in order by recorded_at desc, seq desc limit 1), ")
+	fmt.Fprintf(&q, "moved as (insert into vehicle_locations select * from latest ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id, user_id) do update set seq = excluded.seq, ")
+	fmt.Fprintf(&q, "recorded_at = excluded.recorded_at, lat = excluded.lat, lon = excluded.lon, ")
+	fmt.Fprintf(&q, "speed_mps = excluded.speed_mps, heading_deg = excluded.heading_deg ")
+	fmt.Fprintf(&q, "where vehicle_locations.recorded_at < excluded.recorded_at returning *) ")
+	fmt.Fprintf(&q, "select pg_notify($1, json_build_object('vehicleId', vehicle_id, 'userId', user_id, ")
+	fmt.Fprintf(&q, "'recordedAt', recorded_at, 'lat', lat, 'lon', lon, 'speedMps', speed_mps, ")
+	fmt.Fprintf(&q, "'headingDeg', heading_deg)::text) from moved")
+	_, err := tx.Exec(ctx, q.String(), location.Channel)
+	return err
+}
+
+func valid(sm *Sample, now time.Time) bool {
+	switch {
+	case sm == nil, sm.Seq <= 0:
+		return false
+	case sm.Timestamp.IsZero(), sm.Timestamp.After(now.Add(maxClockSkew)),
+		sm.Timestamp.Before(now.Add(-maxSampleAge)):
+		return false
+	case !finite(sm.Lat, sm.Lon) || sm.Lat < -90 || sm.Lat > 90 || sm.Lon < -180 || sm.Lon > 180:
+		return false
+	case sm.Lat == 0 && sm.Lon == 0: // no fix
+		return false
+	case !finite(float64(sm.SpeedMps), float64(sm.HeadingDeg), float64(sm.AccuracyM)):
+		return false
+	case sm.SpeedMps < 0 || sm.SpeedMps > maxSpeedMps:
+		return false
+	case sm.HeadingDeg < 0 || sm.HeadingDeg >= 360 || sm.AccuracyM < 0:
+		return false
+	case !finite(float64(sm.AccelX), float64(sm.AccelY), float64(sm.AccelZ)):
+		return false
+	}
+
+	return math.Abs(float64(sm.AccelX)) <= maxAccel && math.Abs(float64(sm.AccelY)) <= maxAccel &&
+		math.Abs(float64(sm.AccelZ)) <= maxAccel
+}
+
+func finite(fs ...float64) bool {
+	for _, f := range fs {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
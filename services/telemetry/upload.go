@@ -0,0 +1,459 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	UploadReceiving = "receiving"
+	UploadComplete  = "complete"
+	UploadRejected  = "rejected"
+
+	maxTripSamples = 200000 // a day at ~2 Hz
+	maxKeyLen      = 128
+	maxTripIdLen   = 64
+)
+
+// TripMetadata describes a trip recorded offline. IdempotencyKey identifies the
+// upload: streams with the same key add to the same upload, and once it's done
+// return its result without storing anything again. The trip's samples have the
+// seqs FirstSeq to FirstSeq + TotalSamples - 1; others are refused.
+type TripMetadata struct {
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	VehicleId      string `json:"vehicleId,omitempty"`
+	ClientTripId   string `json:"clientTripId,omitempty"`
+	TotalSamples   int32  `json:"totalSamples,omitempty"` // in the whole trip
+	FirstSeq       int64  `json:"firstSeq,omitempty"`
+}
+
+// UploadTripRequest is one message of the upload stream. The first message
+// carries Metadata, all messages may carry samples.
+type UploadTripRequest struct {
+	Metadata *TripMetadata `json:"metadata,omitempty"`
+	Samples  []*Sample     `json:"samples,omitempty"`
+}
+
+// UploadTripResponse is the state of an upload. While receiving, the app resumes
+// by sending the samples after LastSeq (or everything again; repeats are
+// dropped). Once all TotalSamples have arrived, the trip is merged into the
+// vehicle's telemetry and the upload is complete, or rejected with Error if its
+// samples contradict ones already stored: same seq, different time.
+type UploadTripResponse struct {
+	UploadId        string    `json:"uploadId,omitempty"`
+	Status          string    `json:"status,omitempty"` // receiving, complete, rejected
+	ClientTripId    string    `json:"clientTripId,omitempty"`
+	TotalSamples    int32     `json:"totalSamples,omitempty"`
+	ReceivedSamples int32     `json:"receivedSamples,omitempty"`
+	LastSeq         int64     `json:"lastSeq,omitempty"`
+	Accepted        int32     `json:"accepted,omitempty"` // new samples
+	Merged          int32     `json:"merged,omitempty"`   // already stored, e.g. streamed live
+	Invalid         int32     `json:"invalid,omitempty"`  // failed validation, skipped
+	StartedAt       time.Time `json:"startedAt,omitempty"`
+	EndedAt         time.Time `json:"endedAt,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type UploadTripServer interface {
+	Context() context.Context
+	Recv() (*UploadTripRequest, error)
+	SendAndClose(*UploadTripResponse) error
+}
+
+type GetTripUploadRequest struct {
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// upload is a trip_uploads row.
+type upload struct {
+	id           string
+	vehicleId    string
+	clientTripId string
+	total        int32
+	firstSeq     int64
+	status       string
+	result       *UploadTripResponse
+}
+
+// UploadTrip receives a complete trip recorded offline, for a vehicle the caller
+// owns or drives for an org. See UploadTripResponse for resuming and the outcome.
+func (s *svc) UploadTrip(stream UploadTripServer) error {
+	ctx := stream.Context()
+	in, err := stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return status.Errorf(codes.InvalidArgument, "no data")
+		}
+
+		glog.Errorf("Recv failed: %v", err)
+		return err
+	}
+
+	md := in.Metadata
+	if md == nil {
+		return status.Errorf(codes.InvalidArgument, "first message must carry metadata")
+	}
+
+	b, _ := json.Marshal(md)
+	glog.Infof("UploadTrip input=%v", string(b))
+	switch {
+	case md.IdempotencyKey == "" || utf8.RuneCountInString(md.IdempotencyKey) > maxKeyLen:
+		return status.Errorf(codes.InvalidArgument, "idempotency key must have 1 to %v characters", maxKeyLen)
+	case md.ClientTripId == "" || len(md.ClientTripId) > maxTripIdLen:
+		return status.Errorf(codes.InvalidArgument, "client trip id must have 1 to %v characters", maxTripIdLen)
+	case md.TotalSamples <= 0 || md.TotalSamples > maxTripSamples:
+		return status.Errorf(codes.InvalidArgument, "total samples must be between 1 and %v", maxTripSamples)
+	case md.FirstSeq <= 0:
+		return status.Errorf(codes.InvalidArgument, "first seq must be positive")
+	}
+
+	if err = internal.CheckVehicleAccess(ctx, md.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return err
+	}
+
+	u, err := s.openUpload(ctx, md)
+	if err != nil {
+		return err
+	}
+
+	if u.result != nil {
+		return stream.SendAndClose(u.result) // done before, nothing left to receive
+	}
+
+	var buf []*Sample
+	for {
+		if len(in.Samples) > maxBatchSamples {
+			return status.Errorf(codes.InvalidArgument, "message exceeds %v samples", maxBatchSamples)
+		}
+
+		// Only seqs in the trip's range count towards its total.
+		for _, sm := range in.Samples {
+			if sm != nil && (sm.Seq < u.firstSeq || sm.Seq >= u.firstSeq+int64(u.total)) {
+				return status.Errorf(codes.InvalidArgument, "seq %v is outside the trip", sm.Seq)
+			}
+		}
+
+		buf = append(buf, in.Samples...)
+		if len(buf) >= flushSamples {
+			if err = s.stage(ctx, u, buf); err != nil {
+				glog.Errorf("stage failed: %v", err)
+				return internal.InternalErr
+			}
+
+			buf = buf[:0]
+		}
+
+		in, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			glog.Errorf("Recv failed: %v", err)
+			// Keep what we have; the app resumes with the same key.
+			if err := s.stage(context.WithoutCancel(ctx), u, buf); err != nil {
+				glog.Errorf("stage failed: %v", err)
+			}
+
+			return err
+		}
+	}
+
+	if err = s.stage(ctx, u, buf); err != nil {
+		glog.Errorf("stage failed: %v", err)
+		return internal.InternalErr
+	}
+
+	out, err := s.finish(ctx, u)
+	if err != nil {
+		glog.Errorf("finish failed: %v", err)
+		return internal.InternalErr
+	}
+
+	b, _ = json.Marshal(out)
+	glog.Infof("UploadTrip done, out=%v", string(b))
+	return stream.SendAndClose(out)
+}
+
+// GetTripUpload returns the state of one of the caller's uploads, e.g. to find
+// where to resume after an interrupted stream.
+func (s *svc) GetTripUpload(ctx context.Context, in *GetTripUploadRequest) (*UploadTripResponse, error) {
+	u, err := s.getUpload(ctx, in.IdempotencyKey)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "upload not found")
+	case err != nil:
+		glog.Errorf("getUpload failed: %v", err)
+		return nil, internal.InternalErr
+	case u.result != nil:
+		return u.result, nil
+	}
+
+	out, err := progress(ctx, u)
+	if err != nil {
+		glog.Errorf("progress failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return out, nil
+}
+
+// openUpload finds the upload for the key, or starts one. An upload that is
+// done carries its result. Re-sending a trip that was completed under another
+// key stores the new key as done too, with that upload's result.
+func (s *svc) openUpload(ctx context.Context, md *TripMetadata) (*upload, error) {
+	userId := s.Config.UserInfo.Id
+	u, err := s.getUpload(ctx, md.IdempotencyKey)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		glog.Errorf("getUpload failed: %v", err)
+		return nil, internal.InternalErr
+	case u.vehicleId != md.VehicleId || u.clientTripId != md.ClientTripId || u.total != md.TotalSamples ||
+		u.firstSeq != md.FirstSeq:
+		return nil, status.Errorf(codes.InvalidArgument, "idempotency key was used for a different trip")
+	default:
+		return u, nil
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select result from trip_uploads where user_id = $1 and vehicle_id = $2 ")
+	fmt.Fprintf(&q, "and client_trip_id = $3 and status = $4 order by completed_at limit 1")
+	var result *string
+	err = global.PgxPool.QueryRow(ctx, q.String(), userId, md.VehicleId, md.ClientTripId,
+		UploadComplete).Scan(&result)
+	st, completedAt := UploadReceiving, (*time.Time)(nil)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	default:
+		now := time.Now()
+		st, completedAt = UploadComplete, &now
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into trip_uploads (id, user_id, idempotency_key, vehicle_id, client_trip_id, ")
+	fmt.Fprintf(&q, "total_samples, first_seq, status, result, completed_at) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ")
+	fmt.Fprintf(&q, "on conflict (user_id, idempotency_key) do nothing")
+	_, err = global.PgxPool.Exec(ctx, q.String(), uuid.NewString(), userId, md.IdempotencyKey,
+		md.VehicleId, md.ClientTripId, md.TotalSamples, md.FirstSeq, st, result, completedAt)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	// Another stream may have won the insert; either way there's one row now.
+	u, err = s.getUpload(ctx, md.IdempotencyKey)
+	if err != nil {
+		glog.Errorf("getUpload failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return u, nil
+}
+
+// getUpload returns the caller's upload with the key.
+func (s *svc) getUpload(ctx context.Context, key string) (*upload, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, client_trip_id, total_samples, first_seq, status, result ")
+	fmt.Fprintf(&q, "from trip_uploads where user_id = $1 and idempotency_key = $2")
+	var u upload
+	err := global.PgxPool.QueryRow(ctx, q.String(), s.Config.UserInfo.Id, key).Scan(&u.id,
+		&u.vehicleId, &u.clientTripId, &u.total, &u.firstSeq, &u.status, &u.result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// stage stores received samples for an upload. Samples failing validation are
+// kept, flagged, so they count towards the total.
+func (s *svc) stage(ctx context.Context, u *upload, samples []*Sample) error {
+	var good, bad []*Sample
+	now := time.Now()
+	for _, sm := range samples {
+		switch {
+		case sm == nil:
+		case valid(sm, now):
+			good = append(good, sm)
+		default:
+			bad = append(bad, sm)
+		}
+	}
+
+	if len(good) == 0 && len(bad) == 0 {
+		return nil
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+	if len(good) > 0 {
+		if err = copyIn(ctx, tx, u.vehicleId, s.Config.UserInfo.Id, good); err != nil {
+			return err
+		}
+
+		var q strings.Builder
+		fmt.Fprintf(&q, "insert into trip_upload_samples (upload_id, seq, valid, recorded_at, lat, lon, ")
+		fmt.Fprintf(&q, "speed_mps, heading_deg, accuracy_m, accel_x, accel_y, accel_z) ")
+		fmt.Fprintf(&q, "select $1, seq, true, recorded_at, lat, lon, speed_mps, heading_deg, ")
+		fmt.Fprintf(&q, "accuracy_m, accel_x, accel_y, accel_z from telemetry_in ")
+		fmt.Fprintf(&q, "on conflict (upload_id, seq) do nothing")
+		if _, err = tx.Exec(ctx, q.String(), u.id); err != nil {
+			return err
+		}
+	}
+
+	// Only the seq of an invalid sample matters.
+	for _, sm := range bad {
+		_, err = tx.Exec(ctx, "insert into trip_upload_samples (upload_id, seq, valid, recorded_at, lat, lon) "+
+			"values ($1, $2, false, 'epoch', 0, 0) on conflict (upload_id, seq) do nothing", u.id, sm.Seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// finish completes the upload if all samples have arrived: the valid ones are
+// merged into the vehicle's telemetry, unless any contradicts a stored sample,
+// which rejects the whole trip. Returns the upload's state.
+func (s *svc) finish(ctx context.Context, u *upload) (*UploadTripResponse, error) {
+	out, err := progress(ctx, u)
+	if err != nil || out.ReceivedSamples < u.total {
+		return out, err
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+	userId := s.Config.UserInfo.Id
+
+	// Another stream for the same key may have finished first.
+	var result *UploadTripResponse
+	err = tx.QueryRow(ctx, "select result from trip_uploads where id = $1 for update", u.id).Scan(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result != nil {
+		return result, nil
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select count(*), count(*) filter (where valid), ")
+	fmt.Fprintf(&q, "min(recorded_at) filter (where valid), max(recorded_at) filter (where valid) ")
+	fmt.Fprintf(&q, "from trip_upload_samples where upload_id = $1")
+	var total, valid int32
+	var from, to *time.Time
+	if err = tx.QueryRow(ctx, q.String(), u.id).Scan(&total, &valid, &from, &to); err != nil {
+		return nil, err
+	}
+
+	out.Invalid = total - valid
+	if from != nil {
+		out.StartedAt, out.EndedAt = from.UTC(), to.UTC()
+	}
+
+	// A stored sample with the same seq but another time means the app reused
+	// sequence numbers; merging would mix two trips, so the upload is refused.
+	q.Reset()
+	fmt.Fprintf(&q, "select count(*) from trip_upload_samples u join telemetry_samples t ")
+	fmt.Fprintf(&q, "on t.vehicle_id = $2 and t.user_id = $3 and t.seq = u.seq ")
+	fmt.Fprintf(&q, "where u.upload_id = $1 and u.valid and t.recorded_at <> u.recorded_at")
+	var conflicts int32
+	if err = tx.QueryRow(ctx, q.String(), u.id, u.vehicleId, userId).Scan(&conflicts); err != nil {
+		return nil, err
+	}
+
+	out.Status = UploadComplete
+	if conflicts > 0 {
+		out.Status = UploadRejected
+		out.Error = fmt.Sprintf("%v samples conflict with stored samples of the same sequence", conflicts)
+	} else {
+		q.Reset()
+		fmt.Fprintf(&q, "insert into telemetry_samples (vehicle_id, user_id, seq, recorded_at, lat, lon, ")
+		fmt.Fprintf(&q, "speed_mps, heading_deg, accuracy_m, accel_x, accel_y, accel_z) ")
+		fmt.Fprintf(&q, "select $2, $3, seq, recorded_at, lat, lon, speed_mps, heading_deg, accuracy_m, ")
+		fmt.Fprintf(&q, "accel_x, accel_y, accel_z from trip_upload_samples where upload_id = $1 and valid ")
+		fmt.Fprintf(&q, "on conflict do nothing")
+		tag, err := tx.Exec(ctx, q.String(), u.id, u.vehicleId, userId)
+		if err != nil {
+			return nil, err
+		}
+
+		out.Accepted = int32(tag.RowsAffected())
+		out.Merged = valid - out.Accepted
+		if out.Accepted > 0 {
+			if err = markDirty(ctx, tx, u.vehicleId, userId, *from, *to); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b, _ := json.Marshal(out)
+	_, err = tx.Exec(ctx, "update trip_uploads set status = $2, result = $3, completed_at = now() "+
+		"where id = $1", u.id, out.Status, string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	// The result is all that's needed from now on.
+	if _, err = tx.Exec(ctx, "delete from trip_upload_samples where upload_id = $1", u.id); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// progress reports on an upload still receiving samples.
+func progress(ctx context.Context, u *upload) (*UploadTripResponse, error) {
+	out := UploadTripResponse{
+		UploadId:     u.id,
+		Status:       UploadReceiving,
+		ClientTripId: u.clientTripId,
+		TotalSamples: u.total,
+	}
+
+	var lastSeq *int64
+	err := global.PgxPool.QueryRow(ctx, "select count(*), max(seq) from trip_upload_samples "+
+		"where upload_id = $1", u.id).Scan(&out.ReceivedSamples, &lastSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastSeq != nil {
+		out.LastSeq = *lastSeq
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,476 @@
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-go/base/v1"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	StatusPending    = "pending"
+	StatusCompleted  = "completed"
+	StatusCancelled  = "cancelled"
+	StatusOverridden = "overridden"
+	StatusExpired    = "expired" // set on redeem or by RunExpiry once past expires_at
+
+	defaultTtlHours = 72
+
+	// Unambiguous characters only (no 0/O, 1/I) since codes are read out and typed in.
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 10
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type StartTransferRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type StartTransferResponse struct {
+	TransferId string    `json:"transferId,omitempty"`
+	Code       string    `json:"code,omitempty"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+}
+
+type CancelTransferRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type RedeemTransferRequest struct {
+	Code       string `json:"code,omitempty"`
+	Kilometers int32  `json:"kilometers,omitempty"` // optional odometer reading at handover
+}
+
+type RedeemTransferResponse struct {
+	Vehicle *base.Vehicle `json:"vehicle,omitempty"`
+}
+
+type OverrideTransferRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+	ToUserId  string `json:"toUserId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// StartTransfer creates a one-time code that the new owner can redeem to take over
+// the vehicle. Any previous pending transfer for the same vehicle is cancelled.
+func (s *svc) StartTransfer(ctx context.Context, in *StartTransferRequest) (*StartTransferResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("StartTransfer input=%v", string(b))
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	code, err := newCode()
+	if err != nil {
+		glog.Errorf("newCode failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	if _, err = lockOwnedVehicle(ctx, tx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	err = cancelPending(ctx, tx, in.VehicleId)
+	if err != nil {
+		glog.Errorf("cancelPending failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	ttl := defaultTtlHours
+	if s.Config.Config != nil && s.Config.Config.TransferTtlHours > 0 {
+		ttl = s.Config.Config.TransferTtlHours
+	}
+
+	out := StartTransferResponse{
+		TransferId: uuid.NewString(),
+		Code:       formatCode(code),
+		ExpiresAt:  time.Now().UTC().Add(time.Hour * time.Duration(ttl)),
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_transfers (id, vehicle_id, from_user_id, ")
+	fmt.Fprintf(&q, "code_hash, status, expires_at) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @from_user_id, ")
+	fmt.Fprintf(&q, "@code_hash, @status, @expires_at)")
+	args := pgx.NamedArgs{
+		"id":           out.TransferId,
+		"vehicle_id":   in.VehicleId,
+		"from_user_id": s.Config.UserInfo.Id,
+		"code_hash":    hashCode(code),
+		"status":       StatusPending,
+		"expires_at":   out.ExpiresAt,
+	}
+
+	_, err = tx.Exec(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	glog.Infof("StartTransfer success! transfer=%v", out.TransferId)
+	return &out, nil
+}
+
+// CancelTransfer cancels the pending transfer, if any, of a vehicle owned by the caller.
+func (s *svc) CancelTransfer(ctx context.Context, in *CancelTransferRequest) (*emptypb.Empty, error) {
+	if in.VehicleId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	if _, err = lockOwnedVehicle(ctx, tx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	err = cancelPending(ctx, tx, in.VehicleId)
+	if err != nil {
+		glog.Errorf("cancelPending failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// RedeemTransfer moves the vehicle behind a valid transfer code to the caller. The
+// odometer carries over; a handover reading, if given, may not go backwards.
+func (s *svc) RedeemTransfer(ctx context.Context, in *RedeemTransferRequest) (*RedeemTransferResponse, error) {
+	code := normalizeCode(in.Code)
+	if len(code) != codeLength {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid transfer code")
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var transferId, vehicleId, fromUserId string
+	var expiresAt time.Time
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, vehicle_id, from_user_id, expires_at ")
+	fmt.Fprintf(&q, "from vehicle_transfers ")
+	fmt.Fprintf(&q, "where code_hash = $1 and status = $2 for update")
+	err = tx.QueryRow(ctx, q.String(), hashCode(code), StatusPending).
+		Scan(&transferId, &vehicleId, &fromUserId, &expiresAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "transfer code not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if time.Now().After(expiresAt) {
+		_, err = tx.Exec(ctx, "update vehicle_transfers set status = $2 where id = $1", transferId, StatusExpired)
+		if err != nil {
+			glog.Errorf("Exec failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			glog.Errorf("Commit failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		return nil, status.Errorf(codes.FailedPrecondition, "transfer code expired")
+	}
+
+	if fromUserId == s.Config.UserInfo.Id {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot transfer a vehicle to its owner")
+	}
+
+	// The seller may no longer own the vehicle (e.g. admin override in the meantime).
+	v, err := lockOwnedVehicle(ctx, tx, vehicleId, fromUserId)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "transfer is no longer valid")
+	}
+
+	if in.Kilometers > 0 {
+		if in.Kilometers < v.Kilometers {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"odometer reading %v is lower than the last recorded %v", in.Kilometers, v.Kilometers)
+		}
+
+		v.Kilometers = in.Kilometers
+	}
+
+	err = MoveOwnership(ctx, tx, vehicleId, s.Config.UserInfo.Id, v.Kilometers)
+	if err != nil {
+		glog.Errorf("MoveOwnership failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "update vehicle_transfers set status = @status, ")
+	fmt.Fprintf(&q, "to_user_id = @to_user_id, completed_at = now() ")
+	fmt.Fprintf(&q, "where id = @id")
+	args := pgx.NamedArgs{
+		"id":         transferId,
+		"status":     StatusCompleted,
+		"to_user_id": s.Config.UserInfo.Id,
+	}
+
+	_, err = tx.Exec(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	glog.Infof("RedeemTransfer success! transfer=%v, vehicle=%v", transferId, vehicleId)
+	return &RedeemTransferResponse{Vehicle: v}, nil
+}
+
+// OverrideTransfer lets an admin assign a vehicle to another user, e.g. to settle a
+// disputed sale. Pending transfers for the vehicle are cancelled.
+func (s *svc) OverrideTransfer(ctx context.Context, in *OverrideTransferRequest) (*emptypb.Empty, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("OverrideTransfer input=%v", string(b))
+	if !internal.IsAdmin(s.Config.Config, s.Config.UserInfo) {
+		return nil, status.Errorf(codes.PermissionDenied, "admin only")
+	}
+
+	switch {
+	case in.VehicleId == "":
+		return nil, status.Errorf(codes.InvalidArgument, "vehicle id is empty")
+	case in.ToUserId == "":
+		return nil, status.Errorf(codes.InvalidArgument, "target user id is empty")
+	case strings.TrimSpace(in.Reason) == "":
+		return nil, status.Errorf(codes.InvalidArgument, "reason is empty")
+	}
+
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		glog.Errorf("Begin failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer tx.Rollback(ctx)
+	var exist bool
+	err = tx.QueryRow(ctx, "select exists(select 1 from users where id = $1)", in.ToUserId).Scan(&exist)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if !exist {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+
+	var fromUserId string
+	var kms int32
+	err = tx.QueryRow(ctx, "select user_id, kms from vehicles where id = $1 for update", in.VehicleId).
+		Scan(&fromUserId, &kms)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if fromUserId == in.ToUserId {
+		return nil, status.Errorf(codes.FailedPrecondition, "user already owns the vehicle")
+	}
+
+	err = cancelPending(ctx, tx, in.VehicleId)
+	if err != nil {
+		glog.Errorf("cancelPending failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	err = MoveOwnership(ctx, tx, in.VehicleId, in.ToUserId, kms)
+	if err != nil {
+		glog.Errorf("MoveOwnership failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into vehicle_transfers (id, vehicle_id, from_user_id, ")
+	fmt.Fprintf(&q, "to_user_id, status, completed_at, admin_id, reason) ")
+	fmt.Fprintf(&q, "values (@id, @vehicle_id, @from_user_id, ")
+	fmt.Fprintf(&q, "@to_user_id, @status, now(), @admin_id, @reason)")
+	args := pgx.NamedArgs{
+		"id":           uuid.NewString(),
+		"vehicle_id":   in.VehicleId,
+		"from_user_id": fromUserId,
+		"to_user_id":   in.ToUserId,
+		"status":       StatusOverridden,
+		"admin_id":     s.Config.UserInfo.Id,
+		"reason":       in.Reason,
+	}
+
+	_, err = tx.Exec(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		glog.Errorf("Commit failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	glog.Infof("OverrideTransfer success! vehicle=%v, from=%v, to=%v", in.VehicleId, fromUserId, in.ToUserId)
+	return &emptypb.Empty{}, nil
+}
+
+// RunExpiry marks pending transfers past their expiry as expired, checking every
+// interval until ctx is done. Redeeming an expired code marks it right away;
+// this covers the codes nobody redeems.
+func RunExpiry(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		_, err := global.PgxPool.Exec(ctx, "update vehicle_transfers set status = $1 "+
+			"where status = $2 and expires_at < now()", StatusExpired, StatusPending)
+		if err != nil {
+			glog.Errorf("Exec failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MoveOwnership assigns the vehicle to toUserId within tx. The current ownership
+// period is closed and a new one opened at kms, which also becomes the vehicle's
+// odometer reading. Callers are expected to hold a row lock on the vehicle.
+func MoveOwnership(ctx context.Context, tx pgx.Tx, vehicleId, toUserId string, kms int32) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicle_ownerships set ended_at = now(), end_kms = $2 ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and ended_at is null")
+	_, err := tx.Exec(ctx, q.String(), vehicleId, kms)
+	if err != nil {
+		return err
+	}
+
+	q.Reset()
+	fmt.Fprintf(&q, "insert into vehicle_ownerships (vehicle_id, user_id, start_kms) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3)")
+	_, err = tx.Exec(ctx, q.String(), vehicleId, toUserId, kms)
+	if err != nil {
+		return err
+	}
+
+	// The vehicle leaves the previous owner's org; the new owner can assign it
+	// to one of theirs (see org.SetVehicleOrg).
+	_, err = tx.Exec(ctx, "update vehicles set user_id = $2, kms = $3, org_id = null, "+
+		"version = version + 1 where id = $1", vehicleId, toUserId, kms)
+	return err
+}
+
+// lockOwnedVehicle loads and row-locks a vehicle owned by userId.
+func lockOwnedVehicle(ctx context.Context, tx pgx.Tx, vehicleId, userId string) (*base.Vehicle, error) {
+	var v base.Vehicle
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, chassis_number, vin, make, model, year, kms ")
+	fmt.Fprintf(&q, "from vehicles where id = $1 and user_id = $2 ")
+	fmt.Fprintf(&q, "and deleted_at is null for update")
+	err := tx.QueryRow(ctx, q.String(), vehicleId, userId).Scan(&v.Id,
+		&v.ChassisNumber, &v.Vin, &v.Make, &v.Model, &v.Year, &v.Kilometers)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "vehicle not found")
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &v, nil
+}
+
+func cancelPending(ctx context.Context, tx pgx.Tx, vehicleId string) error {
+	var q strings.Builder
+	fmt.Fprintf(&q, "update vehicle_transfers set status = $2 ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and status = $3")
+	_, err := tx.Exec(ctx, q.String(), vehicleId, StatusCancelled, StatusPending)
+	return err
+}
+
+func newCode() (string, error) {
+	b := make([]byte, codeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+
+	return string(b), nil
+}
+
+// formatCode splits the code in two halves for readability, i.e. ABCDE-FGHJK.
+func formatCode(code string) string {
+	return code[:codeLength/2] + "-" + code[codeLength/2:]
+}
+
+func normalizeCode(code string) string {
+	r := strings.NewReplacer("-", "", " ", "")
+	return strings.ToUpper(r.Replace(code))
+}
+
+func hashCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,154 @@
+package trip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/detect"
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type TripEvent struct {
+	Id        string     `json:"id,omitempty"`
+	TripId    string     `json:"tripId,omitempty"`
+	Type      string     `json:"type,omitempty"`     // harshBraking, harshAcceleration, sharpCornering, speeding, phoneDistraction
+	Severity  string     `json:"severity,omitempty"` // low, medium, high
+	StartedAt time.Time  `json:"startedAt,omitempty"`
+	EndedAt   time.Time  `json:"endedAt,omitempty"`
+	Location  *geo.Point `json:"location,omitempty"` // where the peak was
+	Peak      float64    `json:"peak,omitempty"`     // m/s², km/h for speeding
+	Threshold float64    `json:"threshold,omitempty"`
+}
+
+type ListTripEventsRequest struct {
+	TripId string   `json:"tripId,omitempty"`
+	Types  []string `json:"types,omitempty"` // optional
+}
+
+type ListTripEventsResponse struct {
+	Events []*TripEvent `json:"events,omitempty"` // in the order they happened
+}
+
+// ListTripEvents returns the driving events detected in one of the caller's trips.
+// Events inside the caller's privacy zones are placed on the zone's edge.
+func (s *svc) ListTripEvents(ctx context.Context, in *ListTripEventsRequest) (*ListTripEventsResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListTripEvents input=%v", string(b))
+	_, zones, err := s.getMasked(ctx, in.TripId)
+	if err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select id, trip_id, type, severity, started_at, ended_at, lat, lon, peak, threshold ")
+	fmt.Fprintf(&q, "from trip_events where trip_id = @trip_id ")
+	args := pgx.NamedArgs{"trip_id": in.TripId}
+	if len(in.Types) > 0 {
+		fmt.Fprintf(&q, "and type = any(@types) ")
+		args["types"] = in.Types
+	}
+
+	fmt.Fprintf(&q, "order by started_at, id")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListTripEventsResponse
+	for rows.Next() {
+		e := TripEvent{Location: &geo.Point{}}
+		err = rows.Scan(&e.Id, &e.TripId, &e.Type, &e.Severity, &e.StartedAt, &e.EndedAt,
+			&e.Location.Lat, &e.Location.Lon, &e.Peak, &e.Threshold)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		privacy.Mask(e.Location, zones)
+		out.Events = append(out.Events, &e)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// writeEvents replaces the events of freshly segmented trips, using the
+// thresholds for the vehicle's class.
+func writeEvents(ctx context.Context, tx pgx.Tx, vehicleId, userId string, trips []*segmented,
+	t thresholds) error {
+	if len(trips) == 0 {
+		return nil
+	}
+
+	var class string
+	err := tx.QueryRow(ctx, "select vehicle_class from vehicles where id = $1", vehicleId).Scan(&class)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, len(trips))
+	for i, tr := range trips {
+		ids[i] = tr.Id
+	}
+
+	if _, err = tx.Exec(ctx, "delete from trip_events where trip_id = any($1)", ids); err != nil {
+		return err
+	}
+
+	th := detect.For(class, t.events)
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into trip_events (id, trip_id, vehicle_id, user_id, type, severity, ")
+	fmt.Fprintf(&q, "started_at, ended_at, lat, lon, peak, threshold) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)")
+	for _, tr := range trips {
+		for _, ev := range detect.Detect(tr.raw, th) {
+			_, err = tx.Exec(ctx, q.String(), uuid.NewString(), tr.Id, vehicleId, userId, ev.Type,
+				ev.Severity, ev.StartedAt, ev.EndedAt, ev.Lat, ev.Lon, ev.Peak, ev.Threshold)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// tripSamples returns the usable samples within a trip, for event detection and
+// the scoring profile.
+func tripSamples(tr *segmented, samples []*sample, t thresholds) []*detect.Sample {
+	var out []*detect.Sample
+	for _, sm := range samples {
+		if sm.at.Before(tr.StartedAt) || sm.at.After(tr.EndedAt) || sm.accuracy > t.maxAccuracy {
+			continue
+		}
+
+		out = append(out, &detect.Sample{
+			Seq:        sm.seq,
+			At:         sm.at,
+			Lat:        sm.p.Lat,
+			Lon:        sm.p.Lon,
+			SpeedMps:   sm.speed,
+			HeadingDeg: sm.heading,
+			AccelX:     sm.accel[0],
+			AccelY:     sm.accel[1],
+			AccelZ:     sm.accel[2],
+		})
+	}
+
+	return out
+}
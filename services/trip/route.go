@@ -0,0 +1,204 @@
+package trip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRouteZoom = 14
+	maxRouteZoom     = 20
+
+	// Points closer than this many pixels to the simplified line at the
+	// requested zoom can't be told apart on screen.
+	tolerancePixels = 1
+
+	minToleranceM = 0.5
+)
+
+// Speed bucket upper bounds in km/h; the last bucket is everything faster.
+var speedBucketLimits = []float64{30, 60, 90, 120}
+
+type GetTripRouteRequest struct {
+	TripId string `json:"tripId,omitempty"`
+	Zoom   int32  `json:"zoom,omitempty"`   // web map zoom level the route is drawn at, default 14
+	Speeds bool   `json:"speeds,omitempty"` // include speed buckets
+}
+
+type TripRoute struct {
+	TripId     string  `json:"tripId,omitempty"`
+	Polyline   string  `json:"polyline,omitempty"` // Google encoded polyline, precision 5
+	Points     int32   `json:"points,omitempty"`
+	ToleranceM float64 `json:"toleranceM,omitempty"`
+
+	// With Speeds, the average speed bucket of each segment between consecutive
+	// points: 0 is below the first limit, len(limits) above the last.
+	SpeedBuckets    []int32   `json:"speedBuckets,omitempty"`
+	BucketLimitsKmh []float64 `json:"bucketLimitsKmh,omitempty"`
+}
+
+// GetTripRoute returns the route of one of the caller's trips, simplified for
+// drawing at the given zoom level.
+func (s *svc) GetTripRoute(ctx context.Context, in *GetTripRouteRequest) (*TripRoute, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("GetTripRoute input=%v", string(b))
+	zoom := in.Zoom
+	switch {
+	case zoom == 0:
+		zoom = defaultRouteZoom
+	case zoom < 0 || zoom > maxRouteZoom:
+		return nil, status.Errorf(codes.InvalidArgument, "zoom must be between 1 and %v", maxRouteZoom)
+	}
+
+	tr, zones, err := s.getMasked(ctx, in.TripId)
+	if err != nil {
+		return nil, err
+	}
+
+	tolerance := routeTolerance(int(zoom), (tr.Start.Lat+tr.End.Lat)/2)
+	out := TripRoute{TripId: tr.Id, ToleranceM: float64(tolerance)}
+	var buckets []int16
+	q := "select polyline, points, speed_buckets from trip_routes where trip_id = $1 and tolerance_m = $2"
+	err = global.PgxPool.QueryRow(ctx, q, tr.Id, tolerance).Scan(&out.Polyline, &out.Points, &buckets)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		buckets, err = s.buildRoute(ctx, tr, zones, tolerance, &out)
+		if err != nil {
+			glog.Errorf("buildRoute failed: %v", err)
+			return nil, internal.InternalErr
+		}
+	case err != nil:
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if in.Speeds {
+		out.BucketLimitsKmh = speedBucketLimits
+		out.SpeedBuckets = make([]int32, len(buckets))
+		for i, b := range buckets {
+			out.SpeedBuckets[i] = int32(b)
+		}
+	}
+
+	return &out, nil
+}
+
+// buildRoute simplifies the trip's samples outside the privacy zones and caches
+// the result. Changing zones clears the cache.
+func (s *svc) buildRoute(ctx context.Context, tr *Trip, zones []geo.Circle, tolerance float32,
+	out *TripRoute) ([]int16, error) {
+	var config global.TripConfig
+	if s.Config.Config != nil {
+		config = s.Config.Config.Trips
+	}
+
+	t := thresholdsFrom(config)
+	var q strings.Builder
+	fmt.Fprintf(&q, "select recorded_at, lat, lon, speed_mps from telemetry_samples ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 and recorded_at >= $3 and recorded_at <= $4 ")
+	fmt.Fprintf(&q, "and accuracy_m <= $5 order by recorded_at, seq")
+	rows, err := global.PgxPool.Query(ctx, q.String(), tr.VehicleId, s.Config.UserInfo.Id,
+		tr.StartedAt, tr.EndedAt, t.maxAccuracy)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var samples []*sample
+	var rejects int
+	for rows.Next() {
+		var sm sample
+		var speed float32
+		if err = rows.Scan(&sm.at, &sm.p.Lat, &sm.p.Lon, &speed); err != nil {
+			return nil, err
+		}
+
+		sm.speed = float64(speed)
+		if n := len(samples); n > 0 {
+			prev := samples[n-1]
+			dt := sm.at.Sub(prev.at).Seconds()
+			if dt <= 0 {
+				continue
+			}
+
+			// Same rule as the segmenter: skip GPS jumps.
+			if geo.Distance(prev.p, sm.p)/dt > t.maxJumpSpeed && rejects < maxJumpRejects {
+				rejects++
+				continue
+			}
+		}
+
+		rejects = 0
+		samples = append(samples, &sm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	samples = slices.DeleteFunc(samples, func(sm *sample) bool {
+		return slices.ContainsFunc(zones, func(c geo.Circle) bool { return c.Contains(sm.p) })
+	})
+
+	path := make([]geo.Point, len(samples))
+	for i, sm := range samples {
+		path[i] = sm.p
+	}
+
+	kept := geo.Simplify(path, float64(tolerance))
+	simplified := make([]geo.Point, len(kept))
+	for i, k := range kept {
+		simplified[i] = path[k]
+	}
+
+	buckets := make([]int16, 0, max(len(kept)-1, 0))
+	for i := 1; i < len(kept); i++ {
+		var sum float64
+		for _, sm := range samples[kept[i-1]+1 : kept[i]+1] {
+			sum += sm.speed
+		}
+
+		buckets = append(buckets, speedBucket(sum/float64(kept[i]-kept[i-1])*3.6))
+	}
+
+	out.Polyline = geo.EncodePolyline(simplified)
+	out.Points = int32(len(simplified))
+	_, err = global.PgxPool.Exec(ctx, "insert into trip_routes (trip_id, tolerance_m, polyline, points, "+
+		"speed_buckets) values ($1, $2, $3, $4, $5) on conflict do nothing", tr.Id, tolerance,
+		out.Polyline, out.Points, buckets)
+	if err != nil {
+		glog.Errorf("Exec failed: %v", err) // still return the route
+	}
+
+	return buckets, nil
+}
+
+// routeTolerance is the simplification tolerance for a zoom level, rounded to a
+// power of two so that nearby latitudes share cache entries.
+func routeTolerance(zoom int, lat float64) float32 {
+	m := geo.MetersPerPixel(zoom, lat) * tolerancePixels
+	return float32(math.Max(math.Pow(2, math.Round(math.Log2(m))), minToleranceM))
+}
+
+func speedBucket(kmh float64) int16 {
+	for i, limit := range speedBucketLimits {
+		if kmh < limit {
+			return int16(i)
+		}
+	}
+
+	return int16(len(speedBucketLimits))
+}
@@ -0,0 +1,430 @@
+package trip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/detect"
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/scoring"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	minMovingSpeedMps = 2 // ~7 km/h, slower is walking pace or GPS drift
+	minTripDuration   = time.Minute
+
+	// A fix that jumps away is only trusted once this many in a row agree.
+	maxJumpRejects = 3
+
+	// Dirty windows are left alone this long, so a stream still uploading is
+	// segmented once rather than after every batch.
+	settleDelay = time.Minute
+)
+
+// thresholds is global.TripConfig with defaults applied.
+type thresholds struct {
+	idle         time.Duration
+	maxGap       time.Duration
+	minDistance  float64
+	maxAccuracy  float64
+	maxJumpSpeed float64
+	events       map[string]detect.Thresholds // by vehicle class
+}
+
+func thresholdsFrom(c global.TripConfig) thresholds {
+	t := thresholds{
+		idle:         time.Minute * 5,
+		maxGap:       time.Minute * 30,
+		minDistance:  500,
+		maxAccuracy:  100,
+		maxJumpSpeed: 90,
+		events:       c.Events,
+	}
+
+	if c.IdleMinutes > 0 {
+		t.idle = time.Minute * time.Duration(c.IdleMinutes)
+	}
+
+	if c.MaxGapMinutes > 0 {
+		t.maxGap = time.Minute * time.Duration(c.MaxGapMinutes)
+	}
+
+	if c.MinDistanceM > 0 {
+		t.minDistance = c.MinDistanceM
+	}
+
+	if c.MaxAccuracyM > 0 {
+		t.maxAccuracy = c.MaxAccuracyM
+	}
+
+	if c.MaxJumpSpeedMps > 0 {
+		t.maxJumpSpeed = c.MaxJumpSpeedMps
+	}
+
+	t.maxGap = max(t.maxGap, t.idle)
+	return t
+}
+
+// RunSegmenter turns new telemetry into trips. Ingestion marks the time range
+// of new samples per vehicle and user as dirty; each dirty window is widened to
+// the trips it touches, and everything in it is segmented again, so samples that
+// arrive late merge into, split or extend the trips around them.
+func RunSegmenter(ctx context.Context, every time.Duration, config global.TripConfig) {
+	t := thresholdsFrom(config)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		for {
+			done, err := segmentNext(ctx, t)
+			if err != nil {
+				glog.Errorf("segmentNext failed: %v", err)
+			}
+
+			if err != nil || !done {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// segmentNext segments one dirty window. Returns false if there was none.
+func segmentNext(ctx context.Context, t thresholds) (bool, error) {
+	tx, err := global.PgxPool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback(ctx)
+	var vehicleId, userId string
+	var from, to time.Time
+	var q strings.Builder
+	fmt.Fprintf(&q, "select vehicle_id, user_id, from_at, to_at from trip_dirty_windows ")
+	fmt.Fprintf(&q, "where marked_at < $1 order by marked_at limit 1 for update skip locked")
+	err = tx.QueryRow(ctx, q.String(), time.Now().Add(-settleDelay)).Scan(&vehicleId, &userId, &from, &to)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	// Anything within a bridgeable gap of the new samples may join them, and
+	// the trips touching that range are redone whole.
+	from, to = from.Add(-t.maxGap), to.Add(t.maxGap)
+	args := pgx.NamedArgs{"vehicle_id": vehicleId, "user_id": userId, "from": from, "to": to}
+	q.Reset()
+	fmt.Fprintf(&q, "select id, started_at, ended_at from trips ")
+	fmt.Fprintf(&q, "where vehicle_id = @vehicle_id and user_id = @user_id ")
+	fmt.Fprintf(&q, "and ended_at >= @from and started_at <= @to for update")
+	rows, err := tx.Query(ctx, q.String(), args)
+	if err != nil {
+		return false, err
+	}
+
+	var old []*Trip
+	for rows.Next() {
+		var tr Trip
+		if err = rows.Scan(&tr.Id, &tr.StartedAt, &tr.EndedAt); err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		old = append(old, &tr)
+		from = minTime(from, tr.StartedAt)
+		to = maxTime(to, tr.EndedAt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	args["from"], args["to"] = from, to
+	samples, err := loadSamples(ctx, tx, args)
+	if err != nil {
+		return false, err
+	}
+
+	trips := segment(samples, t)
+	for _, tr := range trips {
+		tr.raw = tripSamples(tr, samples, t)
+		tr.nightShare, tr.speedCV = scoring.Profile(tr.raw)
+	}
+
+	kept := reuseIds(trips, old)
+	var gone []string
+	for _, tr := range old {
+		if !kept[tr.Id] {
+			gone = append(gone, tr.Id)
+		}
+	}
+
+	if len(gone) > 0 {
+		if _, err = tx.Exec(ctx, "delete from trips where id = any($1)", gone); err != nil {
+			return false, err
+		}
+	}
+
+	// Trips keeping their id are updated in place, so rows referencing them stay.
+	q.Reset()
+	fmt.Fprintf(&q, "insert into trips (id, vehicle_id, user_id, started_at, ended_at, distance_m, ")
+	fmt.Fprintf(&q, "start_lat, start_lon, end_lat, end_lon, max_speed_mps, samples, start_seq, end_seq, ")
+	fmt.Fprintf(&q, "night_share, speed_cv) ")
+	fmt.Fprintf(&q, "values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) ")
+	fmt.Fprintf(&q, "on conflict (id) do update set started_at = excluded.started_at, ")
+	fmt.Fprintf(&q, "ended_at = excluded.ended_at, distance_m = excluded.distance_m, ")
+	fmt.Fprintf(&q, "start_lat = excluded.start_lat, start_lon = excluded.start_lon, ")
+	fmt.Fprintf(&q, "end_lat = excluded.end_lat, end_lon = excluded.end_lon, ")
+	fmt.Fprintf(&q, "max_speed_mps = excluded.max_speed_mps, samples = excluded.samples, ")
+	fmt.Fprintf(&q, "start_seq = excluded.start_seq, end_seq = excluded.end_seq, ")
+	fmt.Fprintf(&q, "night_share = excluded.night_share, speed_cv = excluded.speed_cv, updated_at = now()")
+	for _, tr := range trips {
+		_, err = tx.Exec(ctx, q.String(), tr.Id, vehicleId, userId, tr.StartedAt, tr.EndedAt,
+			tr.DistanceM, tr.Start.Lat, tr.Start.Lon, tr.End.Lat, tr.End.Lon, tr.MaxSpeedMps,
+			tr.Samples, tr.startSeq, tr.endSeq, tr.nightShare, tr.speedCV)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err = writeEvents(ctx, tx, vehicleId, userId, trips, t); err != nil {
+		return false, err
+	}
+
+	// Scores and cached routes of changed trips are stale; the scorer
+	// recomputes scores, routes are rebuilt when next asked for.
+	if len(kept) > 0 {
+		for _, table := range []string{"trip_scores", "trip_routes"} {
+			_, err = tx.Exec(ctx, "delete from "+table+" where trip_id = any($1)", keys(kept))
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx, "delete from trip_dirty_windows where vehicle_id = $1 and user_id = $2",
+		vehicleId, userId)
+	if err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	glog.Infof("segmented vehicle=%v, user=%v, %v to %v: %v trips, %v removed",
+		vehicleId, userId, from.Format(time.RFC3339), to.Format(time.RFC3339), len(trips), len(gone))
+	return true, nil
+}
+
+// sample is a telemetry sample as the segmenter needs it.
+type sample struct {
+	seq      int64
+	at       time.Time
+	p        geo.Point
+	speed    float64
+	accuracy float64
+	heading  float64
+	accel    [3]float64
+}
+
+func loadSamples(ctx context.Context, tx pgx.Tx, args pgx.NamedArgs) ([]*sample, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select seq, recorded_at, lat, lon, speed_mps, accuracy_m, heading_deg, ")
+	fmt.Fprintf(&q, "accel_x, accel_y, accel_z from telemetry_samples ")
+	fmt.Fprintf(&q, "where vehicle_id = @vehicle_id and user_id = @user_id ")
+	fmt.Fprintf(&q, "and recorded_at >= @from and recorded_at <= @to order by recorded_at, seq")
+	rows, err := tx.Query(ctx, q.String(), args)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var out []*sample
+	for rows.Next() {
+		var sm sample
+		var speed, accuracy, heading float32
+		var accel [3]float32
+		err = rows.Scan(&sm.seq, &sm.at, &sm.p.Lat, &sm.p.Lon, &speed, &accuracy, &heading,
+			&accel[0], &accel[1], &accel[2])
+		if err != nil {
+			return nil, err
+		}
+
+		sm.speed, sm.accuracy, sm.heading = float64(speed), float64(accuracy), float64(heading)
+		for i, a := range accel {
+			sm.accel[i] = float64(a)
+		}
+
+		out = append(out, &sm)
+	}
+
+	return out, rows.Err()
+}
+
+// segmented is a trip being built.
+type segmented struct {
+	Trip
+	startSeq, endSeq int64
+
+	lastMoving *sample
+	distance   float64 // up to the latest sample; DistanceM stops at lastMoving
+	samples    int32
+
+	raw                 []*detect.Sample // usable samples within the trip
+	nightShare, speedCV float64
+}
+
+// segment splits samples, ordered by time, into trips. A trip starts at the
+// first moving sample and ends at the last one before the vehicle stood still
+// for the idle time, or before a gap in the data that can't be bridged: longer
+// than the max gap, or too little distance covered across it to have been
+// driving. Inaccurate fixes and GPS jumps are skipped.
+func segment(samples []*sample, t thresholds) []*segmented {
+	var trips []*segmented
+	var cur *segmented
+	var prev *sample
+	var rejects int
+	finish := func() {
+		if cur.DistanceM >= t.minDistance && cur.EndedAt.Sub(cur.StartedAt) >= minTripDuration {
+			trips = append(trips, cur)
+		}
+
+		cur = nil
+	}
+
+	for _, sm := range samples {
+		if sm.accuracy > t.maxAccuracy {
+			continue
+		}
+
+		var d, dt float64
+		if prev != nil {
+			d, dt = geo.Distance(prev.p, sm.p), sm.at.Sub(prev.at).Seconds()
+			if dt <= 0 {
+				continue
+			}
+
+			// A fix that moved impossibly fast is a jump, unless it keeps
+			// happening: then it was prev that was off.
+			if d/dt > t.maxJumpSpeed && rejects < maxJumpRejects {
+				rejects++
+				continue
+			}
+		}
+
+		rejects = 0
+		moving := sm.speed >= minMovingSpeedMps
+		if !moving && prev != nil && dt > 0 && d > 2*max(sm.accuracy, prev.accuracy) {
+			moving = d/dt >= minMovingSpeedMps // no speed from the device
+		}
+
+		if cur != nil {
+			gap := sm.at.Sub(prev.at)
+			switch {
+			case gap > t.idle && (gap > t.maxGap || d/dt < minMovingSpeedMps):
+				finish()
+			default:
+				cur.distance += d
+				cur.samples++
+				if moving {
+					cur.moved(sm)
+				} else if sm.at.Sub(cur.lastMoving.at) > t.idle {
+					finish()
+				}
+			}
+		}
+
+		if cur == nil && moving {
+			cur = &segmented{Trip: Trip{Start: &sm.p, StartedAt: sm.at}, startSeq: sm.seq}
+			cur.moved(sm)
+		}
+
+		prev = sm
+	}
+
+	if cur != nil {
+		finish()
+	}
+
+	return trips
+}
+
+// moved extends the trip to sm, a moving sample.
+func (s *segmented) moved(sm *sample) {
+	if s.lastMoving == nil {
+		s.samples = 1
+	}
+
+	s.lastMoving = sm
+	s.EndedAt = sm.at
+	s.End = &sm.p
+	s.DistanceM = s.distance
+	s.Samples = s.samples
+	s.MaxSpeedMps = max(s.MaxSpeedMps, float32(sm.speed))
+	s.endSeq = sm.seq
+}
+
+// reuseIds gives each new trip the id of the old trip it overlaps most, so
+// references to a trip survive it being recomputed. The rest get new ids.
+// Returns the old ids that were reused.
+func reuseIds(trips []*segmented, old []*Trip) map[string]bool {
+	used := map[string]bool{}
+	for _, tr := range trips {
+		var id string
+		var best time.Duration
+		for _, o := range old {
+			overlap := minTime(tr.EndedAt, o.EndedAt).Sub(maxTime(tr.StartedAt, o.StartedAt))
+			if !used[o.Id] && overlap >= 0 && (id == "" || overlap > best) {
+				id, best = o.Id, overlap
+			}
+		}
+
+		if id == "" {
+			tr.Id = uuid.NewString()
+			continue
+		}
+
+		tr.Id = id
+		used[id] = true
+	}
+
+	return used
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func keys(m map[string]bool) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+
+	return out
+}
@@ -0,0 +1,252 @@
+package trip
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+)
+
+// track builds telemetry one sample every 5 seconds, driving north.
+type track struct {
+	at      time.Time
+	p       geo.Point
+	samples []*sample
+}
+
+func newTrack() *track {
+	return &track{
+		at: time.Date(2026, 3, 14, 8, 0, 0, 0, time.UTC),
+		p:  geo.Point{Lat: 52.52, Lon: 13.405},
+	}
+}
+
+func (tr *track) add(p geo.Point, speed, accuracy float64) {
+	tr.at = tr.at.Add(time.Second * 5)
+	tr.samples = append(tr.samples, &sample{
+		seq:      int64(len(tr.samples)),
+		at:       tr.at,
+		p:        p,
+		speed:    speed,
+		accuracy: accuracy,
+	})
+}
+
+// drive moves at speed m/s for d.
+func (tr *track) drive(d time.Duration, speed float64) *track {
+	for i := 0; i < int(d/(time.Second*5)); i++ {
+		tr.p = geo.Offset(tr.p, 0, speed*5)
+		tr.add(tr.p, speed, 5)
+	}
+
+	return tr
+}
+
+// stop stands still for d.
+func (tr *track) stop(d time.Duration) *track {
+	for i := 0; i < int(d/(time.Second*5)); i++ {
+		tr.add(tr.p, 0, 5)
+	}
+
+	return tr
+}
+
+// gap leaves out the samples for d, during which the vehicle moved distM.
+func (tr *track) gap(d time.Duration, distM float64) *track {
+	tr.at = tr.at.Add(d)
+	tr.p = geo.Offset(tr.p, 0, distM)
+	return tr
+}
+
+// jump adds a fix that is off by distM.
+func (tr *track) jump(distM float64) *track {
+	tr.add(geo.Offset(tr.p, 90, distM), 15, 5)
+	return tr
+}
+
+// fuzzy adds an inaccurate fix that is off by distM.
+func (tr *track) fuzzy(distM float64) *track {
+	tr.add(geo.Offset(tr.p, 90, distM), 15, 500)
+	return tr
+}
+
+func TestSegment(t *testing.T) {
+	type want struct {
+		durationS int64
+		distanceM float64
+	}
+
+	for _, tc := range []struct {
+		name  string
+		track *track
+		want  []want
+	}{
+		{
+			name:  "one drive",
+			track: newTrack().stop(time.Minute).drive(time.Minute*10, 15).stop(time.Minute * 10),
+			want:  []want{{595, 8925}},
+		},
+		{
+			name:  "short stop",
+			track: newTrack().drive(time.Minute*5, 15).stop(time.Minute*3).drive(time.Minute*5, 15),
+			want:  []want{{775, 8925}},
+		},
+		{
+			name:  "long stop",
+			track: newTrack().drive(time.Minute*5, 15).stop(time.Minute*10).drive(time.Minute*5, 15),
+			want:  []want{{295, 4425}, {295, 4425}},
+		},
+		{
+			name:  "bridged gap",
+			track: newTrack().drive(time.Minute*5, 15).gap(time.Minute*10, 8000).drive(time.Minute*5, 15),
+			want:  []want{{1195, 16925}},
+		},
+		{
+			name:  "gap without moving",
+			track: newTrack().drive(time.Minute*5, 15).gap(time.Minute*10, 100).drive(time.Minute*5, 15),
+			want:  []want{{295, 4425}, {295, 4425}},
+		},
+		{
+			name:  "gap too long",
+			track: newTrack().drive(time.Minute*5, 15).gap(time.Minute*40, 30000).drive(time.Minute*5, 15),
+			want:  []want{{295, 4425}, {295, 4425}},
+		},
+		{
+			name:  "gps jump",
+			track: newTrack().drive(time.Minute*5, 15).jump(2000).drive(time.Minute*5, 15),
+			want:  []want{{600, 8925}},
+		},
+		{
+			name:  "inaccurate fix",
+			track: newTrack().drive(time.Minute*5, 15).fuzzy(300).drive(time.Minute*5, 15),
+			want:  []want{{600, 8925}},
+		},
+		{
+			name:  "too short",
+			track: newTrack().drive(time.Second*50, 15).stop(time.Minute * 10),
+		},
+		{
+			name:  "too little distance",
+			track: newTrack().drive(time.Minute*2, 3).stop(time.Minute * 10),
+		},
+		{
+			name:  "walking pace",
+			track: newTrack().drive(time.Minute*20, 1.5),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := segment(tc.track.samples, thresholdsFrom(global.TripConfig{}))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v trips, want %v", len(got), len(tc.want))
+			}
+
+			for i, w := range tc.want {
+				tr := got[i]
+				if d := int64(tr.EndedAt.Sub(tr.StartedAt).Seconds()); d != w.durationS {
+					t.Errorf("trip %v: duration %vs, want %vs", i, d, w.durationS)
+				}
+
+				if math.Abs(tr.DistanceM-w.distanceM) > 1 {
+					t.Errorf("trip %v: distance %.1fm, want %vm", i, tr.DistanceM, w.distanceM)
+				}
+			}
+		})
+	}
+}
+
+func TestReuseIds(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2026, 3, 14, 8, min, 0, 0, time.UTC) }
+	trip := func(id string, from, to int) *Trip { return &Trip{Id: id, StartedAt: at(from), EndedAt: at(to)} }
+	for _, tc := range []struct {
+		name   string
+		trips  [][2]int // new trips, from and to minute
+		old    []*Trip
+		want   []string // ids, "" for a new one
+		reused []string
+	}{
+		{
+			name:  "no old trips",
+			trips: [][2]int{{0, 10}},
+			want:  []string{""},
+		},
+		{
+			name:   "extended",
+			trips:  [][2]int{{0, 20}},
+			old:    []*Trip{trip("a", 0, 10)},
+			want:   []string{"a"},
+			reused: []string{"a"},
+		},
+		{
+			name:   "merged, keeps the larger overlap",
+			trips:  [][2]int{{0, 30}},
+			old:    []*Trip{trip("a", 0, 5), trip("b", 10, 30)},
+			want:   []string{"b"},
+			reused: []string{"b"},
+		},
+		{
+			name:   "split",
+			trips:  [][2]int{{0, 10}, {15, 30}},
+			old:    []*Trip{trip("a", 0, 30)},
+			want:   []string{"a", ""},
+			reused: []string{"a"},
+		},
+		{
+			name:   "each keeps its own",
+			trips:  [][2]int{{0, 10}, {20, 30}},
+			old:    []*Trip{trip("b", 20, 30), trip("a", 0, 10)},
+			want:   []string{"a", "b"},
+			reused: []string{"a", "b"},
+		},
+		{
+			name:  "no overlap",
+			trips: [][2]int{{20, 30}},
+			old:   []*Trip{trip("a", 0, 10)},
+			want:  []string{""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var trips []*segmented
+			for _, tr := range tc.trips {
+				trips = append(trips, &segmented{Trip: Trip{StartedAt: at(tr[0]), EndedAt: at(tr[1])}})
+			}
+
+			reused := reuseIds(trips, tc.old)
+			seen := map[string]bool{}
+			for i, w := range tc.want {
+				id := trips[i].Id
+				switch {
+				case id == "" || seen[id]:
+					t.Errorf("trip %v: id %q is empty or taken", i, id)
+				case w != "" && id != w:
+					t.Errorf("trip %v: id %v, want %v", i, id, w)
+				case w == "" && containsTrip(tc.old, id):
+					t.Errorf("trip %v: id %v is an old trip's", i, id)
+				}
+
+				seen[id] = true
+			}
+
+			if len(reused) != len(tc.reused) {
+				t.Errorf("reused %v, want %v", reused, tc.reused)
+			}
+
+			for _, id := range tc.reused {
+				if !reused[id] {
+					t.Errorf("reused %v, want %v", reused, tc.reused)
+				}
+			}
+		})
+	}
+}
+
+func containsTrip(trips []*Trip, id string) bool {
+	for _, tr := range trips {
+		if tr.Id == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,247 @@
+package trip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/geo"
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/drival-ai/v10-api/services/privacy"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+type Trip struct {
+	Id          string     `json:"id,omitempty"`
+	VehicleId   string     `json:"vehicleId,omitempty"`
+	StartedAt   time.Time  `json:"startedAt,omitempty"`
+	EndedAt     time.Time  `json:"endedAt,omitempty"`
+	DistanceM   float64    `json:"distanceM,omitempty"`
+	DurationS   int64      `json:"durationS,omitempty"`
+	Start       *geo.Point `json:"start,omitempty"`
+	End         *geo.Point `json:"end,omitempty"`
+	MaxSpeedMps float32    `json:"maxSpeedMps,omitempty"`
+	Samples     int32      `json:"samples,omitempty"`
+}
+
+type ListTripsRequest struct {
+	VehicleId string    `json:"vehicleId,omitempty"`
+	From      time.Time `json:"from,omitempty"`  // optional, trips starting at or after
+	To        time.Time `json:"to,omitempty"`    // optional, trips starting before
+	Limit     int32     `json:"limit,omitempty"` // default 50
+}
+
+type ListTripsResponse struct {
+	Trips []*Trip `json:"trips,omitempty"` // newest first
+}
+
+type GetTripRequest struct {
+	TripId string `json:"tripId,omitempty"`
+}
+
+// ListTrips returns the trips the caller drove in a vehicle. Trips are
+// segmented from telemetry in the background, so the latest samples may take a
+// minute to show up, and recent trips may still change. Endpoints inside the
+// caller's privacy zones are moved to the zone's edge.
+func (s *svc) ListTrips(ctx context.Context, in *ListTripsRequest) (*ListTripsResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ListTrips input=%v", string(b))
+	trips, _, err := s.list(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListTripsResponse{Trips: trips}, nil
+}
+
+// ExportTrips is ListTrips as CSV, oldest first, for sharing outside the app.
+// Besides privacy zones, coordinates are rounded to the configured precision,
+// but never back into a zone.
+func (s *svc) ExportTrips(ctx context.Context, in *ListTripsRequest) (*internal.ExportResponse, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("ExportTrips input=%v", string(b))
+	trips, zones, err := s.list(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	digits := privacy.SharedDigits(s.Config.Config)
+	coord := func(v float64) string { return strconv.FormatFloat(v, 'f', digits, 64) }
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"started_at", "ended_at", "vehicle_id", "trip_id", "distance_m", "duration_s",
+		"start_lat", "start_lon", "end_lat", "end_lon", "max_speed_mps"})
+	for i := len(trips) - 1; i >= 0; i-- {
+		t := trips[i]
+		start, end := geo.RoundOutside(*t.Start, digits, zones), geo.RoundOutside(*t.End, digits, zones)
+		w.Write([]string{t.StartedAt.UTC().Format(time.RFC3339), t.EndedAt.UTC().Format(time.RFC3339),
+			t.VehicleId, t.Id, fmt.Sprintf("%.0f", t.DistanceM), fmt.Sprint(t.DurationS),
+			coord(start.Lat), coord(start.Lon), coord(end.Lat), coord(end.Lon),
+			fmt.Sprintf("%.1f", t.MaxSpeedMps)})
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		glog.Errorf("Write failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &internal.ExportResponse{
+		Filename:    fmt.Sprintf("trips-%v.csv", time.Now().UTC().Format(time.DateOnly)),
+		ContentType: "text/csv",
+		Data:        buf.Bytes(),
+	}, nil
+}
+
+// list returns the caller's trips with their endpoints moved out of their
+// privacy zones, and the zones.
+func (s *svc) list(ctx context.Context, in *ListTripsRequest) ([]*Trip, []geo.Circle, error) {
+	limit := in.Limit
+	switch {
+	case limit == 0:
+		limit = defaultListLimit
+	case limit < 0 || limit > maxListLimit:
+		return nil, nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %v", maxListLimit)
+	}
+
+	if err := internal.CheckVehicleAccess(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from trips ", tripColumns)
+	fmt.Fprintf(&q, "where vehicle_id = @vehicle_id and user_id = @user_id ")
+	args := pgx.NamedArgs{
+		"vehicle_id": in.VehicleId,
+		"user_id":    s.Config.UserInfo.Id,
+		"limit":      limit,
+	}
+
+	if !in.From.IsZero() {
+		fmt.Fprintf(&q, "and started_at >= @from ")
+		args["from"] = in.From
+	}
+
+	if !in.To.IsZero() {
+		fmt.Fprintf(&q, "and started_at < @to ")
+		args["to"] = in.To
+	}
+
+	fmt.Fprintf(&q, "order by started_at desc limit @limit")
+	rows, err := global.PgxPool.Query(ctx, q.String(), args)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out []*Trip
+	for rows.Next() {
+		t, err := scanTrip(rows)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, nil, internal.InternalErr
+		}
+
+		out = append(out, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, nil, internal.InternalErr
+	}
+
+	zones, err := privacy.Zones(ctx, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Zones failed: %v", err)
+		return nil, nil, internal.InternalErr
+	}
+
+	for _, t := range out {
+		privacy.Mask(t.Start, zones)
+		privacy.Mask(t.End, zones)
+	}
+
+	return out, zones, nil
+}
+
+// GetTrip returns one of the caller's trips, with endpoints moved out of their
+// privacy zones as in ListTrips.
+func (s *svc) GetTrip(ctx context.Context, in *GetTripRequest) (*Trip, error) {
+	t, _, err := s.getMasked(ctx, in.TripId)
+	return t, err
+}
+
+// getMasked returns one of the caller's trips with its endpoints moved out of
+// their privacy zones, and the zones.
+func (s *svc) getMasked(ctx context.Context, tripId string) (*Trip, []geo.Circle, error) {
+	t, err := getTrip(ctx, tripId, s.Config.UserInfo.Id)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, nil, status.Errorf(codes.NotFound, "trip not found")
+	case err != nil:
+		glog.Errorf("getTrip failed: %v", err)
+		return nil, nil, internal.InternalErr
+	}
+
+	zones, err := privacy.Zones(ctx, s.Config.UserInfo.Id)
+	if err != nil {
+		glog.Errorf("Zones failed: %v", err)
+		return nil, nil, internal.InternalErr
+	}
+
+	privacy.Mask(t.Start, zones)
+	privacy.Mask(t.End, zones)
+	return t, zones, nil
+}
+
+const tripColumns = "id, vehicle_id, started_at, ended_at, distance_m, " +
+	"start_lat, start_lon, end_lat, end_lon, max_speed_mps, samples"
+
+func getTrip(ctx context.Context, tripId, userId string) (*Trip, error) {
+	var q strings.Builder
+	fmt.Fprintf(&q, "select %v from trips t ", tripColumns)
+	fmt.Fprintf(&q, "where t.id = $1 and t.user_id = $2 and exists(select 1 from vehicles v ")
+	fmt.Fprintf(&q, "where v.id = t.vehicle_id and v.deleted_at is null)")
+	return scanTrip(global.PgxPool.QueryRow(ctx, q.String(), tripId, userId))
+}
+
+func scanTrip(row pgx.Row) (*Trip, error) {
+	t := Trip{Start: &geo.Point{}, End: &geo.Point{}}
+	err := row.Scan(&t.Id, &t.VehicleId, &t.StartedAt, &t.EndedAt, &t.DistanceM,
+		&t.Start.Lat, &t.Start.Lon, &t.End.Lat, &t.End.Lon, &t.MaxSpeedMps, &t.Samples)
+	if err != nil {
+		return nil, err
+	}
+
+	t.DurationS = int64(t.EndedAt.Sub(t.StartedAt) / time.Second)
+	return &t, nil
+}
+
+func New(config *Config) *svc { return &svc{Config: config} }
@@ -0,0 +1,245 @@
+package valuation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drival-ai/v10-api/money"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Curves is a versioned set of depreciation curves, loaded from a YAML file:
+//
+//	version: "2026-10"
+//	currency: USD
+//	spread: 0.10                 # +/- around the estimate, default 0.10
+//	defaultSegment: midsize      # for vehicles no model entry matches
+//	serviceHistory:
+//	  full: 0.03                 # effect of a complete service history
+//	  none: -0.05                # effect of no service history
+//	segments:
+//	  - id: midsize
+//	    basePriceMinor: 3000000  # typical price new, in minor units
+//	    retained: [1.0, 0.80, 0.70, 0.62, 0.55, 0.49]  # value kept at age 0, 1, 2... years
+//	    annualDecay: 0.08        # yearly loss after the end of retained
+//	    minRetained: 0.08        # floor, e.g. scrap value
+//	    kmsPerYear: 15000        # expected mileage
+//	    kmsAdjustPer1000: 0.004  # effect per 1000 km over or under the expected mileage
+//	    maxKmsAdjust: 0.25
+//	models:
+//	  - make: Toyota
+//	    model: Corolla           # optional, all models of the make if empty
+//	    segment: midsize
+//	    basePriceMinor: 2800000  # optional, overrides the segment's
+type Curves struct {
+	Version        string  `yaml:"version"`
+	Currency       string  `yaml:"currency"`
+	Spread         float64 `yaml:"spread"`
+	DefaultSegment string  `yaml:"defaultSegment"`
+	ServiceHistory struct {
+		Full float64 `yaml:"full"`
+		None float64 `yaml:"none"`
+	} `yaml:"serviceHistory"`
+	Segments []*Segment `yaml:"segments"`
+	Models   []*Model   `yaml:"models"`
+
+	segments map[string]*Segment
+}
+
+type Segment struct {
+	Id               string    `yaml:"id"`
+	BasePriceMinor   int64     `yaml:"basePriceMinor"`
+	Retained         []float64 `yaml:"retained"`
+	AnnualDecay      float64   `yaml:"annualDecay"`
+	MinRetained      float64   `yaml:"minRetained"`
+	KmsPerYear       float64   `yaml:"kmsPerYear"`
+	KmsAdjustPer1000 float64   `yaml:"kmsAdjustPer1000"`
+	MaxKmsAdjust     float64   `yaml:"maxKmsAdjust"`
+}
+
+type Model struct {
+	Make           string `yaml:"make"`
+	Model          string `yaml:"model"`
+	Segment        string `yaml:"segment"`
+	BasePriceMinor int64  `yaml:"basePriceMinor"`
+}
+
+const defaultSpread = 0.10
+
+var current atomic.Pointer[Curves]
+
+// Current returns the loaded curves, or nil if none were loaded.
+func Current() *Curves { return current.Load() }
+
+// Load reads and validates a curves file.
+func Load(path string) (*Curves, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Curves
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	if c.Currency, ok = money.NormalizeCurrency(c.Currency); !ok {
+		return nil, fmt.Errorf("invalid currency %q", c.Currency)
+	}
+
+	switch {
+	case c.Version == "":
+		return nil, fmt.Errorf("missing version")
+	case c.Spread == 0:
+		c.Spread = defaultSpread
+	case c.Spread < 0 || c.Spread >= 1:
+		return nil, fmt.Errorf("spread must be between 0 and 1")
+	}
+
+	c.segments = map[string]*Segment{}
+	for i, s := range c.Segments {
+		switch {
+		case s.Id == "":
+			return nil, fmt.Errorf("segment %d: missing id", i)
+		case c.segments[s.Id] != nil:
+			return nil, fmt.Errorf("segment %v: duplicate id", s.Id)
+		case s.BasePriceMinor <= 0:
+			return nil, fmt.Errorf("segment %v: missing base price", s.Id)
+		case len(s.Retained) == 0:
+			return nil, fmt.Errorf("segment %v: missing retained curve", s.Id)
+		case s.AnnualDecay < 0 || s.AnnualDecay >= 1:
+			return nil, fmt.Errorf("segment %v: annual decay must be between 0 and 1", s.Id)
+		}
+
+		for j, r := range s.Retained {
+			if r <= 0 || r > 1 || (j > 0 && r > s.Retained[j-1]) {
+				return nil, fmt.Errorf("segment %v: retained must decrease within (0, 1]", s.Id)
+			}
+		}
+
+		c.segments[s.Id] = s
+	}
+
+	if c.DefaultSegment != "" && c.segments[c.DefaultSegment] == nil {
+		return nil, fmt.Errorf("unknown default segment %v", c.DefaultSegment)
+	}
+
+	for i, m := range c.Models {
+		switch {
+		case m.Make == "":
+			return nil, fmt.Errorf("model %d: missing make", i)
+		case c.segments[m.Segment] == nil:
+			return nil, fmt.Errorf("model %v %v: unknown segment %q", m.Make, m.Model, m.Segment)
+		}
+	}
+
+	return &c, nil
+}
+
+// lookup returns the segment and price new for a make and model. Exact model
+// entries win over make-wide ones. exact is false if the default segment was used.
+func (c *Curves) lookup(mk, model string) (seg *Segment, price int64, exact bool) {
+	mk, model = strings.TrimSpace(mk), strings.TrimSpace(model)
+	var best *Model
+	for _, m := range c.Models {
+		if !strings.EqualFold(m.Make, mk) {
+			continue
+		}
+
+		switch {
+		case m.Model != "" && strings.EqualFold(m.Model, model):
+			best = m
+		case m.Model == "" && best == nil:
+			best = m
+		}
+	}
+
+	if best == nil {
+		seg = c.segments[c.DefaultSegment]
+		if seg == nil {
+			return nil, 0, false
+		}
+
+		return seg, seg.BasePriceMinor, false
+	}
+
+	seg, price = c.segments[best.Segment], best.BasePriceMinor
+	if price == 0 {
+		price = seg.BasePriceMinor
+	}
+
+	return seg, price, true
+}
+
+// retained returns the fraction of the price new kept at age years, interpolating
+// between the yearly points of the curve.
+func (s *Segment) retained(age float64) float64 {
+	age = max(age, 0)
+	n := len(s.Retained)
+	i := int(age)
+	var r float64
+	switch {
+	case i+1 < n:
+		f := age - float64(i)
+		r = s.Retained[i]*(1-f) + s.Retained[i+1]*f
+	default:
+		r = s.Retained[n-1] * math.Pow(1-s.AnnualDecay, age-float64(n-1))
+	}
+
+	return max(r, s.MinRetained)
+}
+
+// kmsAdjust returns the effect of the odometer reading relative to the mileage
+// expected at age years.
+func (s *Segment) kmsAdjust(age float64, kms int32) float64 {
+	if s.KmsPerYear <= 0 || s.KmsAdjustPer1000 == 0 {
+		return 0
+	}
+
+	diff := float64(kms) - age*s.KmsPerYear
+	adj := -diff / 1000 * s.KmsAdjustPer1000
+	if s.MaxKmsAdjust > 0 {
+		adj = min(max(adj, -s.MaxKmsAdjust), s.MaxKmsAdjust)
+	}
+
+	return adj
+}
+
+// Watch loads the curves at path and reloads them whenever the file changes. A
+// file that fails to load keeps the previous curves in place. Runs until ctx is
+// done.
+func Watch(ctx context.Context, path string, every time.Duration) {
+	var modTime time.Time
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			glog.Errorf("Stat failed: %v", err)
+		case !fi.ModTime().Equal(modTime):
+			modTime = fi.ModTime() // don't retry a bad file until it changes again
+			c, err := Load(path)
+			if err != nil {
+				glog.Errorf("valuation curves %v not loaded: %v", path, err)
+				break
+			}
+
+			current.Store(c)
+			glog.Infof("valuation curves %v loaded: %v segments, %v models", c.Version, len(c.Segments), len(c.Models))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package valuation
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/drival-ai/v10-api/global"
+	"github.com/drival-ai/v10-api/internal"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Extra uncertainty when we only know the vehicle's segment by default.
+	unknownModelSpread = 0.05
+
+	// Service history needs this much ownership before it says anything.
+	minHistoryYears = 0.5
+
+	maxHistory = 100
+)
+
+type Config struct {
+	UserInfo   internal.UserInfo
+	Config     *global.Config
+	PrivateKey *rsa.PrivateKey
+}
+
+type svc struct {
+	Config *Config
+}
+
+// Factor is one input to an estimate. Effect is the relative change it made,
+// e.g. -0.38 for an age that lost 38% of the price new.
+type Factor struct {
+	Name   string  `json:"name,omitempty"` // segment, age, mileage, serviceHistory
+	Effect float64 `json:"effect,omitempty"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+type Valuation struct {
+	VehicleId     string    `json:"vehicleId,omitempty"`
+	ValuedOn      time.Time `json:"valuedOn,omitempty"`
+	LowMinor      int64     `json:"lowMinor,omitempty"`
+	MidMinor      int64     `json:"midMinor,omitempty"`
+	HighMinor     int64     `json:"highMinor,omitempty"`
+	Currency      string    `json:"currency,omitempty"`
+	Kilometers    int32     `json:"kilometers,omitempty"`
+	CurvesVersion string    `json:"curvesVersion,omitempty"`
+	Factors       []*Factor `json:"factors,omitempty"`
+}
+
+type EstimateValueRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListValuationsRequest struct {
+	VehicleId string `json:"vehicleId,omitempty"`
+}
+
+type ListValuationsResponse struct {
+	Valuations []*Valuation `json:"valuations,omitempty"` // oldest first
+}
+
+// EstimateValue estimates what the vehicle is worth today from its segment, age,
+// mileage and how complete its service history is. The estimate is recorded in
+// the vehicle's valuation history, once per day.
+func (s *svc) EstimateValue(ctx context.Context, in *EstimateValueRequest) (*Valuation, error) {
+	b, _ := json.Marshal(in)
+	glog.Infof("EstimateValue input=%v", string(b))
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	c := Current()
+	if c == nil {
+		return nil, status.Errorf(codes.Unavailable, "valuations are unavailable")
+	}
+
+	var data inputs
+	var ownedSince time.Time
+	var q strings.Builder
+	fmt.Fprintf(&q, "select v.make, v.model, v.year, v.kms, o.started_at ")
+	fmt.Fprintf(&q, "from vehicles v join vehicle_ownerships o ")
+	fmt.Fprintf(&q, "on o.vehicle_id = v.id and o.ended_at is null ")
+	fmt.Fprintf(&q, "where v.id = $1")
+	err := global.PgxPool.QueryRow(ctx, q.String(), in.VehicleId).Scan(&data.make, &data.model,
+		&data.year, &data.kms, &ownedSince)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	if data.year <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "vehicle year is unknown")
+	}
+
+	now := time.Now().UTC()
+	data.ownedYears = years(now.Sub(ownedSince))
+	q.Reset()
+	fmt.Fprintf(&q, "select count(distinct date_trunc('month', serviced_on)) from service_records ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 and serviced_on >= $3")
+	err = global.PgxPool.QueryRow(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id,
+		ownedSince).Scan(&data.services)
+	if err != nil {
+		glog.Errorf("QueryRow failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	v, err := c.estimate(&data, now)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
+	v.VehicleId = in.VehicleId
+	factors, _ := json.Marshal(v.Factors)
+	q.Reset()
+	fmt.Fprintf(&q, "insert into vehicle_valuations (vehicle_id, user_id, valued_on, ")
+	fmt.Fprintf(&q, "low_minor, mid_minor, high_minor, currency, kms, curves_version, factors) ")
+	fmt.Fprintf(&q, "values (@vehicle_id, @user_id, @valued_on, ")
+	fmt.Fprintf(&q, "@low, @mid, @high, @currency, @kms, @version, @factors) ")
+	fmt.Fprintf(&q, "on conflict (vehicle_id, user_id, valued_on) do update set ")
+	fmt.Fprintf(&q, "low_minor = excluded.low_minor, mid_minor = excluded.mid_minor, ")
+	fmt.Fprintf(&q, "high_minor = excluded.high_minor, currency = excluded.currency, ")
+	fmt.Fprintf(&q, "kms = excluded.kms, curves_version = excluded.curves_version, ")
+	fmt.Fprintf(&q, "factors = excluded.factors, created_at = now()")
+	args := pgx.NamedArgs{
+		"vehicle_id": in.VehicleId,
+		"user_id":    s.Config.UserInfo.Id,
+		"valued_on":  v.ValuedOn,
+		"low":        v.LowMinor,
+		"mid":        v.MidMinor,
+		"high":       v.HighMinor,
+		"currency":   v.Currency,
+		"kms":        v.Kilometers,
+		"version":    v.CurvesVersion,
+		"factors":    string(factors),
+	}
+
+	if _, err = global.PgxPool.Exec(ctx, q.String(), args); err != nil {
+		glog.Errorf("Exec failed: %v", err) // still return the estimate
+	}
+
+	return v, nil
+}
+
+// ListValuations returns the caller's past estimates for a vehicle.
+func (s *svc) ListValuations(ctx context.Context, in *ListValuationsRequest) (*ListValuationsResponse, error) {
+	if err := internal.CheckVehicleOwner(ctx, in.VehicleId, s.Config.UserInfo.Id); err != nil {
+		return nil, err
+	}
+
+	var q strings.Builder
+	fmt.Fprintf(&q, "select valued_on, low_minor, mid_minor, high_minor, currency, kms, ")
+	fmt.Fprintf(&q, "curves_version, factors from (select * from vehicle_valuations ")
+	fmt.Fprintf(&q, "where vehicle_id = $1 and user_id = $2 ")
+	fmt.Fprintf(&q, "order by valued_on desc limit $3) h order by valued_on")
+	rows, err := global.PgxPool.Query(ctx, q.String(), in.VehicleId, s.Config.UserInfo.Id, maxHistory)
+	if err != nil {
+		glog.Errorf("Query failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	defer rows.Close()
+	var out ListValuationsResponse
+	for rows.Next() {
+		v := Valuation{VehicleId: in.VehicleId}
+		var factors []byte
+		err = rows.Scan(&v.ValuedOn, &v.LowMinor, &v.MidMinor, &v.HighMinor, &v.Currency,
+			&v.Kilometers, &v.CurvesVersion, &factors)
+		if err != nil {
+			glog.Errorf("Scan failed: %v", err)
+			return nil, internal.InternalErr
+		}
+
+		if err = json.Unmarshal(factors, &v.Factors); err != nil {
+			glog.Errorf("Unmarshal failed: %v", err)
+		}
+
+		out.Valuations = append(out.Valuations, &v)
+	}
+
+	if err = rows.Err(); err != nil {
+		glog.Errorf("rows.Err failed: %v", err)
+		return nil, internal.InternalErr
+	}
+
+	return &out, nil
+}
+
+// inputs is what an estimate is based on.
+type inputs struct {
+	make, model string
+	year        int32
+	kms         int32
+	ownedYears  float64 // current ownership period
+	services    int     // months with at least one service record in that period
+}
+
+func (c *Curves) estimate(in *inputs, now time.Time) (*Valuation, error) {
+	seg, price, exact := c.lookup(in.make, in.model)
+	if seg == nil {
+		return nil, errors.New("no depreciation curve for this vehicle")
+	}
+
+	// Model years are sold from around mid-year.
+	age := max(years(now.Sub(time.Date(int(in.year)-1, time.July, 1, 0, 0, 0, 0, time.UTC))), 0)
+	retained := seg.retained(age)
+	kmsAdj := seg.kmsAdjust(age, in.kms)
+	svcAdj, svcDetail := c.serviceAdjust(in)
+
+	segDetail := seg.Id
+	if !exact {
+		segDetail += " (default, model not listed)"
+	}
+
+	v := Valuation{
+		ValuedOn:      time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+		Currency:      c.Currency,
+		Kilometers:    in.kms,
+		CurvesVersion: c.Version,
+		Factors: []*Factor{
+			{Name: "segment", Detail: segDetail},
+			{Name: "age", Effect: round(retained - 1), Detail: fmt.Sprintf("%.1f years", age)},
+			{Name: "mileage", Effect: round(kmsAdj), Detail: fmt.Sprintf("%d km, %.0f km expected", in.kms, age*seg.KmsPerYear)},
+			{Name: "serviceHistory", Effect: round(svcAdj), Detail: svcDetail},
+		},
+	}
+
+	spread := c.Spread
+	if !exact {
+		spread += unknownModelSpread
+	}
+
+	mid := float64(price) * retained * (1 + kmsAdj) * (1 + svcAdj)
+	v.MidMinor = int64(math.Round(mid))
+	v.LowMinor = int64(math.Round(mid * (1 - spread)))
+	v.HighMinor = int64(math.Round(mid * (1 + spread)))
+	return &v, nil
+}
+
+// serviceAdjust rates the service history as the share of ownership years with
+// a service on record, interpolating between the configured none and full effects.
+func (c *Curves) serviceAdjust(in *inputs) (float64, string) {
+	if in.ownedYears < minHistoryYears {
+		return 0, "not enough ownership history"
+	}
+
+	expected := math.Ceil(in.ownedYears)
+	complete := min(float64(in.services)/expected, 1)
+	adj := c.ServiceHistory.None + complete*(c.ServiceHistory.Full-c.ServiceHistory.None)
+	return adj, fmt.Sprintf("%.0f%% complete (%d of %.0f yearly services)", complete*100, in.services, expected)
+}
+
+func years(d time.Duration) float64 { return d.Hours() / 24 / 365.25 }
+
+func round(f float64) float64 { return math.Round(f*1000) / 1000 }
+
+func New(config *Config) *svc { return &svc{Config: config} }